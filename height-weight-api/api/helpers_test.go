@@ -0,0 +1,70 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"image"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/lucasfepe/height-weight-api/config"
+	"github.com/lucasfepe/height-weight-api/jobs"
+	"github.com/lucasfepe/height-weight-api/utils"
+)
+
+// newTestRouter sets up the router for cfg with DEV_MODE mock predictions
+func newTestRouter(t *testing.T, cfg *config.Config) http.Handler {
+	t.Helper()
+	t.Setenv("DEV_MODE", "true")
+	queue := jobs.NewQueue(jobs.NewJobStore(cfg.JobTTL), 1, 1)
+	t.Cleanup(func() { queue.Shutdown(context.Background()) })
+	return SetupRouter(cfg, queue, utils.NewMLClientsFromConfig(cfg), nil)
+}
+
+// newEstimateRequest builds a weight estimation POST to target of a person of
+// 175 cm, with distinct front and side images
+func newEstimateRequest(t *testing.T, target string) *http.Request {
+	t.Helper()
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	writer.WriteField("height", "175")
+	for i, field := range []string{"front_image", "side_image"} {
+		img := image.NewGray(image.Rect(0, 0, 64, 96))
+		for p := range img.Pix {
+			img.Pix[p] = uint8(40*(i+1) + p%7)
+		}
+		part, err := writer.CreateFormFile(field, field+".png")
+		if err != nil {
+			t.Fatalf("create form file: %v", err)
+		}
+		if err := png.Encode(part, img); err != nil {
+			t.Fatalf("encode PNG: %v", err)
+		}
+	}
+	writer.Close()
+
+	r := httptest.NewRequest(http.MethodPost, target, &body)
+	r.Header.Set("Content-Type", writer.FormDataContentType())
+	return r
+}
+
+// signTestJWT signs claims as an HS256 token with secret
+func signTestJWT(t *testing.T, secret string, claims utils.Claims) string {
+	t.Helper()
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatalf("marshal claims: %v", err)
+	}
+	unsigned := header + "." + base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(unsigned))
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,376 @@
+package api
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"path"
+	"regexp"
+	"runtime/debug"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lucasfepe/height-weight-api/config"
+	"github.com/lucasfepe/height-weight-api/utils"
+)
+
+// recoverMiddleware turns handler panics into 500 JSON responses instead of
+// dropped connections. The request ID is read from the response header set by
+// requestIDMiddleware, since the request context isn't visible from out here.
+func recoverMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if rec := recover(); rec != nil {
+				if rec == http.ErrAbortHandler {
+					panic(rec)
+				}
+				log.Printf("Panic serving %s %s (request %s): %v\n%s",
+					r.Method, r.URL.Path, w.Header().Get(utils.RequestIDHeader), rec, debug.Stack())
+				utils.RespondWithError(w, r, http.StatusInternalServerError, utils.ErrCodeInternal, "Internal server error")
+			}
+		}()
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requestIDPattern is the form of client request IDs that are reused, which
+// keeps log lines and response headers free of injected content
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9-]{1,64}$`)
+
+// requestIDMiddleware tags each request with an ID, reusing the client's
+// X-Request-ID when it matches requestIDPattern, and echoes it in the response
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(utils.RequestIDHeader)
+		if !requestIDPattern.MatchString(id) {
+			id = uuid.New().String()
+		}
+
+		w.Header().Set(utils.RequestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(utils.WithRequestID(r.Context(), id)))
+	})
+}
+
+// securityHeadersMiddleware adds the hardening headers enabled in cfg to every
+// response. Strict-Transport-Security is only sent while serving HTTPS.
+func securityHeadersMiddleware(cfg *config.Config) func(http.Handler) http.Handler {
+	headers := map[string]string{}
+	if cfg.ContentTypeNosniff {
+		headers["X-Content-Type-Options"] = "nosniff"
+	}
+	if cfg.FrameOptions != "" {
+		headers["X-Frame-Options"] = cfg.FrameOptions
+	}
+	if cfg.ReferrerPolicy != "" {
+		headers["Referrer-Policy"] = cfg.ReferrerPolicy
+	}
+	if cfg.TLSEnabled() && cfg.HSTSMaxAge > 0 {
+		headers["Strict-Transport-Security"] = fmt.Sprintf("max-age=%d; includeSubDomains", int64(cfg.HSTSMaxAge.Seconds()))
+	}
+	if cfg.ContentSecurityPolicy != "" {
+		headers["Content-Security-Policy"] = cfg.ContentSecurityPolicy
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for name, value := range headers {
+				w.Header().Set(name, value)
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// authMiddleware requires a valid "Authorization: Bearer <JWT>" header signed
+// with secret and stores the token's user ID in the request context
+func authMiddleware(secret string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || token == "" {
+				utils.RespondWithError(w, r, http.StatusUnauthorized, utils.ErrCodeUnauthorized, "Missing bearer token")
+				return
+			}
+
+			claims, err := utils.VerifyJWT(token, secret)
+			if err != nil {
+				utils.RespondWithError(w, r, http.StatusUnauthorized, utils.ErrCodeUnauthorized, "Invalid token: "+err.Error())
+				return
+			}
+
+			ctx := utils.WithUserID(r.Context(), claims.UserID)
+			next.ServeHTTP(w, r.WithContext(utils.WithRole(ctx, claims.Role)))
+		})
+	}
+}
+
+// adminOnly rejects requests whose token lacks the admin role. Without
+// authentication configured there is no role, so admin routes stay closed.
+func adminOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if utils.Role(r.Context()) != utils.RoleAdmin {
+			utils.RespondWithError(w, r, http.StatusForbidden, utils.ErrCodeForbidden, "Admin role required")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Request body media types accepted by routes
+const (
+	mediaTypeMultipart = "multipart/form-data"
+	mediaTypeJSON      = "application/json"
+	mediaTypeZIP       = "application/zip"
+	mediaTypeBinary    = "application/octet-stream"
+)
+
+// requireContentType answers 415 to requests whose Content-Type is none of
+// mediaTypes, listing the accepted ones, so a body in the wrong format gets a
+// clear error instead of a confusing parse failure
+func requireContentType(mediaTypes ...string) func(http.Handler) http.Handler {
+	accepted := strings.Join(mediaTypes, ", ")
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+			if err != nil || !slices.Contains(mediaTypes, mediaType) {
+				w.Header().Set("Accept", accepted)
+				utils.RespondWithError(w, r, http.StatusUnsupportedMediaType, utils.ErrCodeUnsupportedMedia, fmt.Sprintf("Unsupported Content-Type %q, expected %s", r.Header.Get("Content-Type"), accepted))
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// bodyLimitMiddleware caps the request body size, at the limit of routeLimits
+// for the paths listed there. A declared Content-Length over the limit is
+// answered with 413 before anything is read. Bodies without a length, such
+// as chunked ones, fail with *http.MaxBytesError once read past the limit,
+// which handlers turn into 413 responses.
+func bodyLimitMiddleware(limit int64, routeLimits map[string]int64) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			max := limit
+			if routeLimit, ok := routeLimits[r.URL.Path]; ok {
+				max = routeLimit
+			}
+			if r.ContentLength > max {
+				// Closing keeps the server from draining the unread body
+				w.Header().Set("Connection", "close")
+				utils.RespondWithError(w, r, http.StatusRequestEntityTooLarge, utils.ErrCodeRequestTooLarge, fmt.Sprintf("Request body too large: %d bytes declared, at most %d allowed", r.ContentLength, max))
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, max)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// timeoutMiddleware answers with a 503 JSON error once a request runs past
+// timeout. The handler's context is cancelled at the deadline, so ML calls
+// stop early, and its writes after the deadline are discarded. Requests to
+// paths matching a streamingPaths pattern, in the syntax of path.Match, are
+// passed through untimed, since the timeout buffers the whole response.
+func timeoutMiddleware(timeout time.Duration, streamingPaths ...string) func(http.Handler) http.Handler {
+	body, _ := json.Marshal(utils.Response{
+		Success:    false,
+		APIVersion: utils.APIVersion,
+		Message:    "Request timed out",
+		ErrorCode:  utils.ErrCodeTimeout,
+	})
+
+	return func(next http.Handler) http.Handler {
+		timeoutHandler := http.TimeoutHandler(next, timeout, string(body))
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for _, pattern := range streamingPaths {
+				if ok, _ := path.Match(pattern, r.URL.Path); ok {
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+			timeoutHandler.ServeHTTP(&timeoutResponseWriter{ResponseWriter: w}, r)
+		})
+	}
+}
+
+// timeoutResponseWriter labels the timeout body as JSON, since
+// http.TimeoutHandler doesn't set a Content-Type for it
+type timeoutResponseWriter struct {
+	http.ResponseWriter
+}
+
+// WriteHeader sets the JSON Content-Type on 503s that lack one
+func (t *timeoutResponseWriter) WriteHeader(code int) {
+	if code == http.StatusServiceUnavailable && t.Header().Get("Content-Type") == "" {
+		t.Header().Set("Content-Type", "application/json")
+	}
+	t.ResponseWriter.WriteHeader(code)
+}
+
+// gzipMinSize is the response size in bytes below which compression isn't worth it
+const gzipMinSize = 1024
+
+// gzipMiddleware compresses responses for clients that accept gzip encoding
+func gzipMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+
+		if !acceptsGzip(r.Header.Values("Accept-Encoding")) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		gzw := &gzipResponseWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(gzw, r)
+
+		// Not deferred: on panic nothing buffered is sent, so the recover
+		// middleware can still write a clean error response
+		gzw.Close()
+	})
+}
+
+// acceptsGzip reports whether Accept-Encoding header values accept gzip,
+// named or through a wildcard, with a nonzero quality. An explicit gzip
+// coding takes precedence over the wildcard.
+func acceptsGzip(values []string) bool {
+	gzipQ, wildcardQ := -1.0, -1.0
+	for _, value := range values {
+		for _, coding := range strings.Split(value, ",") {
+			name, params, _ := strings.Cut(strings.TrimSpace(coding), ";")
+			q := 1.0
+			for _, param := range strings.Split(params, ";") {
+				if value, ok := strings.CutPrefix(strings.TrimSpace(param), "q="); ok {
+					if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+						q = parsed
+					}
+				}
+			}
+
+			switch strings.ToLower(strings.TrimSpace(name)) {
+			case "gzip", "x-gzip":
+				gzipQ = max(gzipQ, q)
+			case "*":
+				wildcardQ = max(wildcardQ, q)
+			}
+		}
+	}
+	if gzipQ >= 0 {
+		return gzipQ > 0
+	}
+	return wildcardQ > 0
+}
+
+// gzipResponseWriter buffers the start of a response until it knows whether
+// the payload is large enough and of a type worth compressing
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	gz      *gzip.Writer
+	buf     []byte
+	status  int
+	decided bool
+}
+
+// WriteHeader records the status code until the encoding is decided
+func (g *gzipResponseWriter) WriteHeader(code int) {
+	if g.decided {
+		return
+	}
+	g.status = code
+}
+
+// Write buffers data until the compression threshold is reached
+func (g *gzipResponseWriter) Write(p []byte) (int, error) {
+	if g.decided {
+		if g.gz != nil {
+			return g.gz.Write(p)
+		}
+		return g.ResponseWriter.Write(p)
+	}
+
+	g.buf = append(g.buf, p...)
+	if len(g.buf) >= gzipMinSize {
+		if err := g.decide(true); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// Flush decides on the encoding and pushes buffered data to the client
+func (g *gzipResponseWriter) Flush() {
+	if !g.decided {
+		g.decide(len(g.buf) > 0)
+	}
+	if g.gz != nil {
+		g.gz.Flush()
+	}
+	if f, ok := g.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Close writes out any buffered data and finishes the gzip stream
+func (g *gzipResponseWriter) Close() error {
+	if !g.decided {
+		if err := g.decide(false); err != nil {
+			return err
+		}
+	}
+	if g.gz != nil {
+		return g.gz.Close()
+	}
+	return nil
+}
+
+// decide writes the headers and buffered data, compressing when requested
+// and the content type allows it
+func (g *gzipResponseWriter) decide(compress bool) error {
+	g.decided = true
+
+	header := g.Header()
+	if header.Get("Content-Type") == "" && len(g.buf) > 0 {
+		// Sniff from the raw bytes, not the compressed stream
+		header.Set("Content-Type", http.DetectContentType(g.buf))
+	}
+	if compress && compressible(header) {
+		header.Set("Content-Encoding", "gzip")
+		header.Del("Content-Length")
+		g.gz = gzip.NewWriter(g.ResponseWriter)
+	}
+
+	g.ResponseWriter.WriteHeader(g.status)
+	if len(g.buf) == 0 {
+		return nil
+	}
+
+	var err error
+	if g.gz != nil {
+		_, err = g.gz.Write(g.buf)
+	} else {
+		_, err = g.ResponseWriter.Write(g.buf)
+	}
+	g.buf = nil
+	return err
+}
+
+// compressible reports whether a response with these headers should be gzipped
+func compressible(header http.Header) bool {
+	if header.Get("Content-Encoding") != "" {
+		return false
+	}
+
+	contentType := header.Get("Content-Type")
+	for _, prefix := range []string{"image/", "video/", "audio/", "application/zip", "application/gzip"} {
+		if strings.HasPrefix(contentType, prefix) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,371 @@
+package api
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lucasfepe/height-weight-api/internal/testutil"
+	"github.com/lucasfepe/height-weight-api/utils"
+)
+
+func TestGzipMiddleware(t *testing.T) {
+	records := make([]map[string]interface{}, 200)
+	for i := range records {
+		records[i] = map[string]interface{}{"id": i, "weight": 70.5, "note": strings.Repeat("x", 20)}
+	}
+	handler := gzipMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		utils.RespondWithData(w, r, http.StatusOK, records)
+	}))
+
+	t.Run("large response is compressed", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Accept-Encoding", "gzip, deflate")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		if encoding := w.Header().Get("Content-Encoding"); encoding != "gzip" {
+			t.Fatalf("Content-Encoding = %q, want gzip", encoding)
+		}
+		reader, err := gzip.NewReader(w.Body)
+		if err != nil {
+			t.Fatalf("gzip reader: %v", err)
+		}
+		var response struct {
+			Data []map[string]interface{} `json:"data"`
+		}
+		if err := json.NewDecoder(reader).Decode(&response); err != nil {
+			t.Fatalf("decode decompressed body: %v", err)
+		}
+		if len(response.Data) != len(records) {
+			t.Errorf("decoded %d records, want %d", len(response.Data), len(records))
+		}
+	})
+
+	t.Run("client without gzip gets plain JSON", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		if encoding := w.Header().Get("Content-Encoding"); encoding != "" {
+			t.Fatalf("Content-Encoding = %q, want none", encoding)
+		}
+		if !json.Valid(w.Body.Bytes()) {
+			t.Errorf("body is not JSON: %.80s", w.Body.String())
+		}
+	})
+
+	t.Run("gzip refused with q=0 gets plain JSON", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Accept-Encoding", "gzip;q=0")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if encoding := w.Header().Get("Content-Encoding"); encoding != "" || !json.Valid(w.Body.Bytes()) {
+			t.Errorf("Content-Encoding = %q, body %.80q, want plain JSON", encoding, w.Body.String())
+		}
+	})
+
+	t.Run("small response is left uncompressed", func(t *testing.T) {
+		small := gzipMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			utils.RespondWithData(w, r, http.StatusOK, map[string]int{"id": 1})
+		}))
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Accept-Encoding", "gzip")
+		w := httptest.NewRecorder()
+		small.ServeHTTP(w, r)
+		body, _ := io.ReadAll(w.Body)
+		if encoding := w.Header().Get("Content-Encoding"); encoding != "" || !json.Valid(body) {
+			t.Errorf("Content-Encoding = %q, body %q, want plain JSON", encoding, body)
+		}
+	})
+}
+
+func TestAcceptsGzip(t *testing.T) {
+	tests := []struct {
+		values []string
+		want   bool
+	}{
+		{nil, false},
+		{[]string{"gzip"}, true},
+		{[]string{"gzip, deflate, br"}, true},
+		{[]string{"GZIP;q=0.5"}, true},
+		{[]string{"x-gzip"}, true},
+		{[]string{"gzip;q=0"}, false},
+		{[]string{"gzip; q=0.000, deflate"}, false},
+		{[]string{"x-gzip-unsupported"}, false},
+		{[]string{"deflate", "gzip"}, true},
+		{[]string{"*"}, true},
+		{[]string{"*;q=0"}, false},
+		{[]string{"gzip;q=0, *"}, false},
+		{[]string{"identity"}, false},
+	}
+	for _, tt := range tests {
+		if got := acceptsGzip(tt.values); got != tt.want {
+			t.Errorf("acceptsGzip(%q) = %v, want %v", tt.values, got, tt.want)
+		}
+	}
+}
+
+func TestBodyLimitMiddleware(t *testing.T) {
+	var read int
+	var readErr error
+	handler := bodyLimitMiddleware(100, map[string]int64{"/import": 1000})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var data []byte
+		data, readErr = io.ReadAll(r.Body)
+		read = len(data)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	tests := []struct {
+		name     string
+		path     string
+		size     int
+		chunked  bool
+		wantCode int
+		wantErr  bool
+	}{
+		{"within the limit", "/estimate", 100, false, http.StatusNoContent, false},
+		{"declared length over the limit", "/estimate", 101, false, http.StatusRequestEntityTooLarge, false},
+		{"chunked body over the limit", "/estimate", 101, true, http.StatusNoContent, true},
+		{"within a route limit", "/import", 1000, false, http.StatusNoContent, false},
+		{"over a route limit", "/import", 1001, false, http.StatusRequestEntityTooLarge, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			read, readErr = 0, nil
+			r := httptest.NewRequest(http.MethodPost, tt.path, strings.NewReader(strings.Repeat("x", tt.size)))
+			if tt.chunked {
+				r.ContentLength = -1
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if w.Code != tt.wantCode {
+				t.Fatalf("got %d, want %d", w.Code, tt.wantCode)
+			}
+			if tt.wantCode == http.StatusRequestEntityTooLarge {
+				var response utils.Response
+				if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil || response.ErrorCode != utils.ErrCodeRequestTooLarge {
+					t.Errorf("body = %s, want a %s error", w.Body.String(), utils.ErrCodeRequestTooLarge)
+				}
+				return
+			}
+			var maxBytesErr *http.MaxBytesError
+			if gotErr := errors.As(readErr, &maxBytesErr); gotErr != tt.wantErr {
+				t.Errorf("read error = %v, want MaxBytesError %v", readErr, tt.wantErr)
+			}
+			if !tt.wantErr && read != tt.size {
+				t.Errorf("handler read %d bytes, want %d", read, tt.size)
+			}
+		})
+	}
+}
+
+func TestRecoverMiddleware(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/panic", func(w http.ResponseWriter, r *http.Request) {
+		var estimation map[string]float64
+		estimation["weight"] = 70 // Assignment to a nil map
+	})
+	mux.HandleFunc("/ok", func(w http.ResponseWriter, r *http.Request) {
+		utils.RespondWithData(w, r, http.StatusOK, "fine")
+	})
+	server := httptest.NewServer(requestIDMiddleware(recoverMiddleware(mux)))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/panic")
+	if err != nil {
+		t.Fatalf("request to the panicking handler: %v", err)
+	}
+	var response utils.Response
+	json.NewDecoder(resp.Body).Decode(&response)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusInternalServerError || response.ErrorCode != utils.ErrCodeInternal {
+		t.Errorf("panicking handler got %d %q, want 500 %s", resp.StatusCode, response.ErrorCode, utils.ErrCodeInternal)
+	}
+	if resp.Header.Get(utils.RequestIDHeader) == "" {
+		t.Error("panic response lacks the request ID header")
+	}
+
+	// The server survives to serve the next request
+	resp, err = http.Get(server.URL + "/ok")
+	if err != nil {
+		t.Fatalf("request after the panic: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("request after the panic got %d, want 200", resp.StatusCode)
+	}
+}
+
+func TestTimeoutMiddleware(t *testing.T) {
+	cancelled := make(chan struct{})
+	slow := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+			close(cancelled)
+		case <-time.After(5 * time.Second):
+		}
+		utils.RespondWithData(w, r, http.StatusOK, "too late")
+	})
+	fast := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		utils.RespondWithData(w, r, http.StatusOK, "in time")
+	})
+	handler := timeoutMiddleware(50*time.Millisecond, "/stream/*")
+
+	w := httptest.NewRecorder()
+	handler(slow).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/estimate-weight", nil))
+	var response utils.Response
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("decode timeout response %q: %v", w.Body.String(), err)
+	}
+	if w.Code != http.StatusServiceUnavailable || response.ErrorCode != utils.ErrCodeTimeout {
+		t.Errorf("slow handler got %d %q, want 503 %s", w.Code, response.ErrorCode, utils.ErrCodeTimeout)
+	}
+	if got := w.Header().Get("Content-Type"); got != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", got)
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Error("slow handler's context not cancelled at the deadline")
+	}
+
+	w = httptest.NewRecorder()
+	handler(fast).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/estimate-weight", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("fast handler got %d, want 200", w.Code)
+	}
+
+	// Streaming paths aren't timed
+	timedOut := make(chan struct{})
+	streaming := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+		if r.Context().Err() != nil {
+			close(timedOut)
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+	w = httptest.NewRecorder()
+	handler(streaming).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/stream/estimates", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("streaming path got %d, want 200", w.Code)
+	}
+	select {
+	case <-timedOut:
+		t.Error("streaming path was timed out")
+	default:
+	}
+}
+
+func TestSecurityHeadersMiddleware(t *testing.T) {
+	defaults := map[string]string{
+		"X-Content-Type-Options":  "nosniff",
+		"X-Frame-Options":         "DENY",
+		"Referrer-Policy":         "no-referrer",
+		"Content-Security-Policy": "default-src 'none'; frame-ancestors 'none'",
+	}
+
+	tests := []struct {
+		name string
+		env  map[string]string
+		want map[string]string // Headers absent from want must not be sent
+	}{
+		{"defaults over HTTP", nil, defaults},
+		{"HSTS over HTTPS", map[string]string{"TLS_CERT_FILE": "cert.pem", "TLS_KEY_FILE": "key.pem", "HSTS_MAX_AGE_SEC": "3600"},
+			map[string]string{
+				"X-Content-Type-Options":    "nosniff",
+				"X-Frame-Options":           "DENY",
+				"Referrer-Policy":           "no-referrer",
+				"Content-Security-Policy":   "default-src 'none'; frame-ancestors 'none'",
+				"Strict-Transport-Security": "max-age=3600; includeSubDomains",
+			}},
+		{"all switched off", map[string]string{"CONTENT_TYPE_NOSNIFF": "false", "X_FRAME_OPTIONS": "", "REFERRER_POLICY": "", "CONTENT_SECURITY_POLICY": "", "TLS_CERT_FILE": "cert.pem", "TLS_KEY_FILE": "key.pem", "HSTS_MAX_AGE_SEC": "0"},
+			map[string]string{}},
+		{"custom values", map[string]string{"X_FRAME_OPTIONS": "SAMEORIGIN", "CONTENT_SECURITY_POLICY": "default-src 'self'"},
+			map[string]string{
+				"X-Content-Type-Options":  "nosniff",
+				"X-Frame-Options":         "SAMEORIGIN",
+				"Referrer-Policy":         "no-referrer",
+				"Content-Security-Policy": "default-src 'self'",
+			}},
+	}
+	names := []string{"X-Content-Type-Options", "X-Frame-Options", "Referrer-Policy", "Content-Security-Policy", "Strict-Transport-Security"}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := securityHeadersMiddleware(testutil.Config(t, tt.env))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("ok"))
+			}))
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+
+			for _, name := range names {
+				if got := w.Header().Get(name); got != tt.want[name] {
+					t.Errorf("%s = %q, want %q", name, got, tt.want[name])
+				}
+			}
+		})
+	}
+
+	// The router sends them on its responses, errors included
+	router := newTestRouter(t, testutil.Config(t, nil))
+	for _, path := range []string{"/api/health", "/api/unknown"} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		for name, value := range defaults {
+			if got := w.Header().Get(name); got != value {
+				t.Errorf("%s: %s = %q, want %q", path, name, got, value)
+			}
+		}
+	}
+}
+
+func TestRequireContentType(t *testing.T) {
+	handler := requireContentType(mediaTypeMultipart, mediaTypeJSON)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		utils.RespondWithData(w, r, http.StatusOK, "accepted")
+	}))
+
+	tests := []struct {
+		contentType string
+		want        int
+	}{
+		{"application/json", http.StatusOK},
+		{"application/json; charset=utf-8", http.StatusOK},
+		{"multipart/form-data; boundary=xyz", http.StatusOK},
+		{"text/plain", http.StatusUnsupportedMediaType},
+		{"application/zip", http.StatusUnsupportedMediaType},
+		{"", http.StatusUnsupportedMediaType},
+		{"not a media type;", http.StatusUnsupportedMediaType},
+	}
+	for _, tt := range tests {
+		t.Run(tt.contentType, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/estimate-weight", strings.NewReader("{}"))
+			if tt.contentType != "" {
+				r.Header.Set("Content-Type", tt.contentType)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != tt.want {
+				t.Fatalf("got %d, want %d", w.Code, tt.want)
+			}
+			if tt.want == http.StatusOK {
+				return
+			}
+
+			var response utils.Response
+			if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+				t.Fatalf("decode response %q: %v", w.Body.String(), err)
+			}
+			if response.ErrorCode != utils.ErrCodeUnsupportedMedia {
+				t.Errorf("error code = %q, want %s", response.ErrorCode, utils.ErrCodeUnsupportedMedia)
+			}
+			if got, want := w.Header().Get("Accept"), "multipart/form-data, application/json"; got != want {
+				t.Errorf("Accept = %q, want %q", got, want)
+			}
+		})
+	}
+}
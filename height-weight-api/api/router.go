@@ -1,45 +1,185 @@
 package api
 
 import (
+	"net"
 	"net/http"
+	"path/filepath"
+	"strings"
 
 	"github.com/gorilla/mux"
 	"github.com/lucasfepe/height-weight-api/config"
 	"github.com/lucasfepe/height-weight-api/handlers"
+	"github.com/lucasfepe/height-weight-api/jobs"
+	"github.com/lucasfepe/height-weight-api/utils"
 	"github.com/rs/cors"
 )
 
 // SetupRouter initializes the router with all the routes
-func SetupRouter(cfg *config.Config) http.Handler {
+func SetupRouter(cfg *config.Config, jobQueue *jobs.Queue, mlClients *utils.MLClients, objectStore *utils.S3Client) http.Handler {
 	router := mux.NewRouter()
 
+	// Unmatched requests get the standard error body instead of mux's plain text
+	router.NotFoundHandler = notFoundHandler(router)
+	router.MethodNotAllowedHandler = methodNotAllowedHandler(router)
+
+	// Every route lives under the configured prefix, which links to stored images must include
+	prefix := cfg.RoutePrefix
+	handlers.RoutePrefix = prefix
+
+	// Heights and weights are rounded in responses only, the records keep full precision
+	handlers.ResponsePrecision = cfg.ResponsePrecision
+
 	// Health check endpoint
-	router.HandleFunc("/api/health", handlers.HealthCheckHandler).Methods(http.MethodGet)
+	router.HandleFunc(prefix+"/health", handlers.NewHealthCheckHandler(mlClients)).Methods(http.MethodGet)
+	router.HandleFunc(prefix+"/health/ready", handlers.NewReadinessHandler(cfg)).Methods(http.MethodGet)
 
 	// API routes
-	apiRouter := router.PathPrefix("/api").Subrouter()
+	apiRouter := router.NewRoute().Subrouter()
+	if prefix != "" {
+		apiRouter = router.PathPrefix(prefix).Subrouter()
+	}
+	apiRouter.MethodNotAllowedHandler = router.MethodNotAllowedHandler
+
+	// Scope API routes to the token's user when authentication is configured
+	if cfg.JWTSecret != "" {
+		apiRouter.Use(authMiddleware(cfg.JWTSecret))
+	}
+
+	// Direct uploads to S3 and resumable chunked uploads, referenced by key in estimate-weight
+	chunkedUploads := utils.NewChunkedUploadStore(filepath.Join(cfg.UploadDir, "chunks"), cfg.MaxFileSize, cfg.ChunkedUploadTTL)
+	apiRouter.HandleFunc("/uploads/presign", handlers.NewPresignUploadHandler(cfg, objectStore)).Methods(http.MethodPost)
+	apiRouter.HandleFunc("/uploads/init", handlers.NewInitUploadHandler(chunkedUploads)).Methods(http.MethodPost)
+	apiRouter.HandleFunc("/uploads/{id}", handlers.NewAppendUploadHandler(chunkedUploads)).Methods(http.MethodPatch)
+	apiRouter.HandleFunc("/uploads/{id}/complete", handlers.NewCompleteUploadHandler(chunkedUploads)).Methods(http.MethodPost)
+
+	// Body formats are checked up front, so a wrong one gets a clear 415
+	multipartOnly := requireContentType(mediaTypeMultipart)
 
 	// New weight estimation endpoint using front image, side image, and height
-	apiRouter.HandleFunc("/estimate-weight", handlers.EstimateWeight).Methods(http.MethodPost)
+	apiRouter.Handle("/estimate-weight", requireContentType(mediaTypeMultipart, mediaTypeJSON)(handlers.NewEstimateWeightHandler(cfg, jobQueue, mlClients, utils.NewIdempotencyStore(cfg.IdempotencyTTL), objectStore, chunkedUploads))).Methods(http.MethodPost)
+	apiRouter.HandleFunc("/estimate-weight", handlers.ListWeightEstimations).Methods(http.MethodGet)
+	apiRouter.HandleFunc("/estimate-weight/history", handlers.GetWeightEstimationHistory).Methods(http.MethodGet)
+	apiRouter.Handle("/estimate-weight/labeled", multipartOnly(handlers.NewLabeledEstimateHandler(cfg, mlClients, objectStore, chunkedUploads))).Methods(http.MethodPost)
+	apiRouter.HandleFunc("/estimate-weight/{id}", handlers.GetWeightEstimation).Methods(http.MethodGet)
+	apiRouter.HandleFunc("/estimate-weight/{id}/reprocess", handlers.NewReprocessEstimationHandler(cfg, mlClients)).Methods(http.MethodPost)
+	apiRouter.HandleFunc("/estimate-weight/{id}/revalidate", handlers.NewRevalidateEstimationHandler(cfg)).Methods(http.MethodPost)
+	apiRouter.HandleFunc("/estimate-weight/{id}/bundle", handlers.GetEstimationBundle).Methods(http.MethodGet)
+	apiRouter.Handle("/estimate-weight", adminOnly(http.HandlerFunc(handlers.DeleteWeightEstimationsBefore))).Methods(http.MethodDelete)
+
+	// Audit log of deletes and updates
+	apiRouter.Handle("/audit", adminOnly(http.HandlerFunc(handlers.ListAuditEntries))).Methods(http.MethodGet)
+
+	// Maintenance of stored data
+	apiRouter.Handle("/maintenance/recompute-bmi", adminOnly(http.HandlerFunc(handlers.RecomputeBMI))).Methods(http.MethodPost)
+
+	// Estimation and training record of a labeled submission
+	apiRouter.HandleFunc("/submissions/{id}", handlers.GetSubmission).Methods(http.MethodGet)
+
+	// Async estimation jobs
+	apiRouter.HandleFunc("/jobs/{job_id}", handlers.NewGetJobHandler(jobQueue.Store())).Methods(http.MethodGet)
+
+	// Stored images of estimations
+	apiRouter.HandleFunc("/images/{id}", handlers.ServeImage).Methods(http.MethodGet)
+	apiRouter.Handle("/images/validate", multipartOnly(handlers.NewValidateImageHandler(cfg))).Methods(http.MethodPost)
 
 	// Training data endpoints
-	apiRouter.HandleFunc("/save-training-data", handlers.SaveTrainingData).Methods(http.MethodPost)
+	apiRouter.HandleFunc("/model/accuracy", handlers.GetModelAccuracy).Methods(http.MethodGet)
+	apiRouter.Handle("/save-training-data", multipartOnly(handlers.NewSaveTrainingDataHandler(cfg, mlClients))).Methods(http.MethodPost)
 	apiRouter.HandleFunc("/training-data", handlers.GetTrainingData).Methods(http.MethodGet)
+	apiRouter.HandleFunc("/training-data/stats", handlers.NewTrainingDataStatsHandler(cfg)).Methods(http.MethodGet)
+	apiRouter.HandleFunc("/training-data/distribution", handlers.GetTrainingDistribution).Methods(http.MethodGet)
+	apiRouter.Handle("/training-data/import", requireContentType(mediaTypeZIP, mediaTypeBinary)(handlers.NewImportTrainingDataHandler(cfg, mlClients))).Methods(http.MethodPost)
 	apiRouter.HandleFunc("/export-training-data", handlers.ExportTrainingData).Methods(http.MethodGet)
+	apiRouter.HandleFunc("/training-data/export", handlers.ExportTrainingData).Methods(http.MethodGet)
 
 	// Legacy endpoints
-	apiRouter.HandleFunc("/upload", handlers.NewImageUploadHandler(cfg)).Methods(http.MethodPost)
+	apiRouter.Handle("/upload", multipartOnly(handlers.NewImageUploadHandler(cfg, mlClients))).Methods(http.MethodPost)
+	apiRouter.HandleFunc("/estimates", handlers.ListEstimationsHandler).Methods(http.MethodGet)
+	apiRouter.Handle("/estimate/batch", requireContentType(mediaTypeJSON)(http.HandlerFunc(handlers.GetEstimationsBatchHandler))).Methods(http.MethodPost)
 	apiRouter.HandleFunc("/estimate/{imageID}", handlers.GetEstimationHandler).Methods(http.MethodGet)
+	apiRouter.Handle("/estimate/{imageID}", adminOnly(http.HandlerFunc(handlers.DeleteEstimationHandler))).Methods(http.MethodDelete)
+	apiRouter.Handle("/estimate/{imageID}/restore", adminOnly(http.HandlerFunc(handlers.RestoreEstimationHandler))).Methods(http.MethodPost)
+	apiRouter.HandleFunc("/estimate/{imageID}/overlay", handlers.ServeEstimationOverlay).Methods(http.MethodGet)
 
 	// Configure CORS
 	corsMiddleware := cors.New(cors.Options{
 		AllowedOrigins:   []string{"*"},
-		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token"},
-		ExposedHeaders:   []string{"Link"},
-		AllowCredentials: true,
-		MaxAge:           300,
+		AllowedMethods:   []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
+		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Range", "Content-Type", "X-CSRF-Token"},
+		ExposedHeaders:   []string{"Link", "X-Latest-Timestamp", "X-Skipped-Records", "X-Prediction-Mode"},
+		AllowCredentials: cfg.CORSAllowCredentials,
+		MaxAge:           cfg.CORSMaxAge,
 	})
 
-	return corsMiddleware.Handler(router)
+	var handler http.Handler = router
+	if cfg.RequestTimeout > 0 {
+		// Streamed exports and bundles run as long as they take to send
+		handler = timeoutMiddleware(cfg.RequestTimeout, prefix+"/training-data/export", prefix+"/export-training-data", prefix+"/estimate-weight/*/bundle")(handler)
+	}
+	// Training data archives are far larger than regular requests
+	handler = bodyLimitMiddleware(cfg.MaxRequestSize, map[string]int64{prefix + "/training-data/import": cfg.MaxImportSize})(handler)
+	handler = corsMiddleware.Handler(gzipMiddleware(handler))
+	handler = securityHeadersMiddleware(cfg)(handler)
+
+	// Recovery is outermost so it also catches panics in other middleware
+	return recoverMiddleware(requestIDMiddleware(handler))
+}
+
+// HTTPSRedirectHandler redirects plain HTTP requests to the same URL over
+// HTTPS on httpsPort
+func HTTPSRedirectHandler(httpsPort string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host // No port in the Host header
+		}
+		if httpsPort != "443" {
+			host = net.JoinHostPort(host, httpsPort)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
+
+// routeMethods are the methods probed when a request matches no route
+var routeMethods = []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete}
+
+// notFoundHandler answers requests matching no route. mux reports a wrong
+// method as not found when the route sits behind the /api prefix, so the
+// other methods are probed first to answer 405 where one would match.
+func notFoundHandler(router *mux.Router) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if len(allowedMethods(router, r)) > 0 {
+			methodNotAllowedHandler(router)(w, r)
+			return
+		}
+		utils.RespondWithError(w, r, http.StatusNotFound, utils.ErrCodeNotFound, "No route for "+r.URL.Path)
+	}
+}
+
+// methodNotAllowedHandler answers requests whose path matches a route that
+// doesn't accept their method, listing the accepted ones in the Allow header
+func methodNotAllowedHandler(router *mux.Router) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if allowed := allowedMethods(router, r); len(allowed) > 0 {
+			w.Header().Set("Allow", strings.Join(allowed, ", "))
+		}
+		utils.RespondWithError(w, r, http.StatusMethodNotAllowed, utils.ErrCodeMethodNotAllowed, "Method "+r.Method+" not allowed for "+r.URL.Path)
+	}
+}
+
+// allowedMethods returns the methods a route of router accepts for the path of r
+func allowedMethods(router *mux.Router, r *http.Request) []string {
+	var allowed []string
+	for _, method := range routeMethods {
+		if method == r.Method {
+			continue
+		}
+		probe := r.Clone(r.Context())
+		probe.Method = method
+		var match mux.RouteMatch
+		if router.Match(probe, &match) && match.MatchErr == nil {
+			allowed = append(allowed, method)
+		}
+	}
+	return allowed
 }
@@ -0,0 +1,304 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lucasfepe/height-weight-api/handlers"
+	"github.com/lucasfepe/height-weight-api/internal/testutil"
+	"github.com/lucasfepe/height-weight-api/jobs"
+	"github.com/lucasfepe/height-weight-api/utils"
+)
+
+func TestDeleteAndRestoreRequireAdmin(t *testing.T) {
+	const secret = "test-secret"
+	cfg := testutil.Config(t, map[string]string{"JWT_SECRET": secret})
+	router := newTestRouter(t, cfg)
+	userToken := signTestJWT(t, secret, utils.Claims{UserID: "alice"})
+
+	for _, route := range []struct{ method, path string }{
+		{http.MethodDelete, "/api/estimate/some-id"},
+		{http.MethodPost, "/api/estimate/some-id/restore"},
+	} {
+		r := httptest.NewRequest(route.method, route.path, nil)
+		r.Header.Set("Authorization", "Bearer "+userToken)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		if w.Code != http.StatusForbidden {
+			t.Errorf("%s %s as a regular user: got %d, want 403", route.method, route.path, w.Code)
+		}
+	}
+}
+
+func TestOversizedUploadRejected(t *testing.T) {
+	cfg := testutil.Config(t, map[string]string{"MAX_REQUEST_SIZE_MB": "1"})
+	router := newTestRouter(t, cfg)
+
+	for _, chunked := range []bool{false, true} {
+		var body bytes.Buffer
+		writer := multipart.NewWriter(&body)
+		writer.WriteField("height", "175")
+		part, _ := writer.CreateFormFile("front_image", "front.png")
+		part.Write(bytes.Repeat([]byte{0}, 2<<20))
+		writer.Close()
+
+		r := httptest.NewRequest(http.MethodPost, "/api/estimate-weight", &body)
+		r.Header.Set("Content-Type", writer.FormDataContentType())
+		if chunked {
+			r.ContentLength = -1
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+
+		var response utils.Response
+		json.Unmarshal(w.Body.Bytes(), &response)
+		if w.Code != http.StatusRequestEntityTooLarge || response.ErrorCode != utils.ErrCodeRequestTooLarge {
+			t.Errorf("chunked %v: got %d %s (%s), want 413 %s", chunked, w.Code, response.ErrorCode, response.Message, utils.ErrCodeRequestTooLarge)
+		}
+	}
+}
+
+func TestJobsScopedToTokenUser(t *testing.T) {
+	const secret = "test-secret"
+	cfg := testutil.Config(t, map[string]string{"JWT_SECRET": secret})
+	router := newTestRouter(t, cfg)
+	alice := signTestJWT(t, secret, utils.Claims{UserID: "alice"})
+	bob := signTestJWT(t, secret, utils.Claims{UserID: "bob"})
+	expired := signTestJWT(t, secret, utils.Claims{UserID: "alice", ExpiresAt: time.Now().Add(-time.Minute).Unix()})
+
+	send := func(r *http.Request, token string) (int, utils.Response) {
+		t.Helper()
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		var response utils.Response
+		json.Unmarshal(w.Body.Bytes(), &response)
+		return w.Code, response
+	}
+
+	code, response := send(newEstimateRequest(t, "/api/estimate-weight?async=true"), alice)
+	if code != http.StatusAccepted {
+		t.Fatalf("submit got %d %s (%s), want 202", code, response.ErrorCode, response.Message)
+	}
+	data, _ := response.Data.(map[string]interface{})
+	jobID, _ := data["job_id"].(string)
+	if jobID == "" {
+		t.Fatalf("submit data = %v, want a job ID", response.Data)
+	}
+
+	tests := []struct {
+		name     string
+		token    string
+		wantCode int
+		wantErr  string
+	}{
+		{"owner", alice, http.StatusOK, ""},
+		{"other user", bob, http.StatusNotFound, utils.ErrCodeNotFound},
+		{"expired token", expired, http.StatusUnauthorized, utils.ErrCodeUnauthorized},
+		{"bad signature", signTestJWT(t, "other-secret", utils.Claims{UserID: "alice"}), http.StatusUnauthorized, utils.ErrCodeUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, response := send(httptest.NewRequest(http.MethodGet, "/api/jobs/"+jobID, nil), tt.token)
+			if code != tt.wantCode || response.ErrorCode != tt.wantErr {
+				t.Errorf("got %d %q (%s), want %d %q", code, response.ErrorCode, response.Message, tt.wantCode, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestUnmatchedRoutesRespondJSON(t *testing.T) {
+	router := newTestRouter(t, testutil.Config(t, nil))
+
+	tests := []struct {
+		name      string
+		method    string
+		path      string
+		wantCode  int
+		wantErr   string
+		wantAllow string
+	}{
+		{"unknown API path", http.MethodGet, "/api/unknown", http.StatusNotFound, utils.ErrCodeNotFound, ""},
+		{"unknown path outside the API", http.MethodGet, "/unknown", http.StatusNotFound, utils.ErrCodeNotFound, ""},
+		{"wrong method on an API route", http.MethodPut, "/api/estimate-weight", http.StatusMethodNotAllowed, utils.ErrCodeMethodNotAllowed, "GET, POST, DELETE"},
+		{"wrong method on health", http.MethodPost, "/api/health", http.StatusMethodNotAllowed, utils.ErrCodeMethodNotAllowed, "GET"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, nil))
+
+			var response utils.Response
+			if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+				t.Fatalf("body %q is not JSON: %v", w.Body.String(), err)
+			}
+			if w.Code != tt.wantCode || response.Success || response.ErrorCode != tt.wantErr {
+				t.Errorf("got %d %s (%s), want %d %s", w.Code, response.ErrorCode, response.Message, tt.wantCode, tt.wantErr)
+			}
+			if contentType := w.Header().Get("Content-Type"); !strings.HasPrefix(contentType, "application/json") {
+				t.Errorf("Content-Type = %q, want application/json", contentType)
+			}
+			if allow := w.Header().Get("Allow"); allow != tt.wantAllow {
+				t.Errorf("Allow = %q, want %q", allow, tt.wantAllow)
+			}
+		})
+	}
+}
+
+func TestOversizedContentLengthRejectedImmediately(t *testing.T) {
+	cfg := testutil.Config(t, map[string]string{"MAX_REQUEST_SIZE_MB": "1", "MAX_IMPORT_SIZE_MB": "2"})
+	server := httptest.NewServer(newTestRouter(t, cfg))
+	defer server.Close()
+
+	for _, path := range []string{"/api/estimate-weight", "/api/training-data/import"} {
+		t.Run(strings.TrimPrefix(path, "/api/"), func(t *testing.T) {
+			conn, err := net.Dial("tcp", server.Listener.Addr().String())
+			if err != nil {
+				t.Fatalf("dial: %v", err)
+			}
+			defer conn.Close()
+
+			// Announce 10 GB and send none of it: only an answer that doesn't wait for the body arrives in time
+			fmt.Fprintf(conn, "POST %s HTTP/1.1\r\nHost: api.test\r\nContent-Type: multipart/form-data; boundary=x\r\nContent-Length: %d\r\n\r\n", path, int64(10)<<30)
+			conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+			resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			if err != nil {
+				t.Fatalf("no response before the body was sent: %v", err)
+			}
+			defer resp.Body.Close()
+
+			var response utils.Response
+			if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+				t.Fatalf("decode response: %v", err)
+			}
+			if resp.StatusCode != http.StatusRequestEntityTooLarge || response.ErrorCode != utils.ErrCodeRequestTooLarge {
+				t.Errorf("got %d %s (%s), want 413 %s", resp.StatusCode, response.ErrorCode, response.Message, utils.ErrCodeRequestTooLarge)
+			}
+			if !resp.Close {
+				t.Error("connection kept open, want it closed instead of draining the body")
+			}
+		})
+	}
+}
+
+func TestCORSPreflight(t *testing.T) {
+	const origin = "https://app.example"
+	tests := []struct {
+		name            string
+		env             map[string]string
+		wantMaxAge      string
+		wantCredentials string
+	}{
+		{"defaults", nil, "300", "true"},
+		{"configured", map[string]string{"CORS_MAX_AGE": "600", "CORS_ALLOW_CREDENTIALS": "false"}, "600", ""},
+		{"no caching", map[string]string{"CORS_MAX_AGE": "0"}, "", "true"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router := newTestRouter(t, testutil.Config(t, tt.env))
+			r := httptest.NewRequest(http.MethodOptions, "/api/estimate-weight", nil)
+			r.Header.Set("Origin", origin)
+			r.Header.Set("Access-Control-Request-Method", http.MethodPost)
+			// Browsers send the requested headers lowercased
+			r.Header.Set("Access-Control-Request-Headers", "content-type")
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, r)
+
+			if w.Code != http.StatusNoContent {
+				t.Errorf("status = %d, want %d", w.Code, http.StatusNoContent)
+			}
+			headers := []struct {
+				name string
+				want string
+			}{
+				{"Access-Control-Max-Age", tt.wantMaxAge},
+				{"Access-Control-Allow-Credentials", tt.wantCredentials},
+				{"Access-Control-Allow-Origin", "*"},
+				{"Access-Control-Allow-Methods", http.MethodPost},
+			}
+			for _, header := range headers {
+				if got := w.Header().Get(header.name); got != header.want {
+					t.Errorf("%s = %q, want %q", header.name, got, header.want)
+				}
+			}
+		})
+	}
+}
+
+func TestRoutePrefix(t *testing.T) {
+	tests := []struct {
+		name     string
+		prefix   string
+		wantOK   string
+		want404s []string
+	}{
+		{"custom", "/weight/v2", "/weight/v2/health", []string{"/api/health", "/health"}},
+		{"none", "", "/health", []string{"/api/health"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router := newTestRouter(t, testutil.Config(t, map[string]string{"ROUTE_PREFIX": tt.prefix}))
+			t.Cleanup(func() { handlers.RoutePrefix = "/api" })
+
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.wantOK, nil))
+			if w.Code != http.StatusOK {
+				t.Errorf("GET %s: got %d %s, want 200", tt.wantOK, w.Code, w.Body.String())
+			}
+			for _, path := range tt.want404s {
+				w := httptest.NewRecorder()
+				router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+				if w.Code != http.StatusNotFound {
+					t.Errorf("GET %s: got %d, want 404", path, w.Code)
+				}
+			}
+		})
+	}
+}
+
+func TestPredictionModeHeader(t *testing.T) {
+	ml := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(utils.ModelResponse{Weight: 70})
+	}))
+	defer ml.Close()
+
+	tests := []struct {
+		devMode string
+		want    string
+	}{
+		{"true", utils.PredictionModeMock},
+		{"false", utils.PredictionModeModel},
+	}
+	for _, tt := range tests {
+		t.Run("DEV_MODE="+tt.devMode, func(t *testing.T) {
+			cfg := testutil.Config(t, map[string]string{"ML_SERVICE_URL": ml.URL, "DEV_MODE": tt.devMode})
+			queue := jobs.NewQueue(jobs.NewJobStore(cfg.JobTTL), 1, 1)
+			defer queue.Shutdown(context.Background())
+			router := SetupRouter(cfg, queue, utils.NewMLClientsFromConfig(cfg), nil)
+
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, newEstimateRequest(t, "/api/estimate-weight"))
+			var response utils.Response
+			json.Unmarshal(w.Body.Bytes(), &response)
+			if w.Code != http.StatusOK {
+				t.Fatalf("got %d %s (%s), want 200", w.Code, response.ErrorCode, response.Message)
+			}
+			if mode := w.Header().Get("X-Prediction-Mode"); mode != tt.want {
+				t.Errorf("X-Prediction-Mode = %q, want %q", mode, tt.want)
+			}
+			if data, _ := response.Data.(map[string]interface{}); data["mode"] != tt.want {
+				t.Errorf("data mode = %v, want %q", data["mode"], tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,152 @@
+package config
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestLoadConfigMongoURI(t *testing.T) {
+	tests := []struct {
+		name         string
+		uri          string
+		allowDefault string
+		wantURI      string
+		wantErr      error
+	}{
+		{name: "missing URI", wantErr: ErrMissingMongoURI},
+		{name: "missing URI with the default refused", allowDefault: "false", wantErr: ErrMissingMongoURI},
+		{name: "missing URI with the local default allowed", allowDefault: "true", wantURI: localMongoURI},
+		{name: "URI set", uri: "mongodb://db.example:27017", wantURI: "mongodb://db.example:27017"},
+		{name: "URI set wins over the default", uri: "mongodb://db.example:27017", allowDefault: "true", wantURI: "mongodb://db.example:27017"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("MONGO_URI", tt.uri)
+			t.Setenv("MONGO_ALLOW_LOCAL_DEFAULT", tt.allowDefault)
+
+			cfg, err := LoadConfig()
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("LoadConfig error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("LoadConfig: %v", err)
+			}
+			if cfg.MongoURI != tt.wantURI {
+				t.Errorf("MongoURI = %q, want %q", cfg.MongoURI, tt.wantURI)
+			}
+		})
+	}
+}
+
+func TestLoadConfigCollections(t *testing.T) {
+	t.Setenv("MONGO_URI", "mongodb://db.example:27017")
+
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	if cfg.WeightEstimationCollection != "weight_estimations" || cfg.TrainingCollection != "training_data" {
+		t.Errorf("default collections = %q, %q, want weight_estimations, training_data", cfg.WeightEstimationCollection, cfg.TrainingCollection)
+	}
+
+	t.Setenv("WEIGHT_ESTIMATION_COLLECTION", "staging_estimations")
+	t.Setenv("TRAINING_COLLECTION", "staging_training")
+	if cfg, err = LoadConfig(); err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	if cfg.WeightEstimationCollection != "staging_estimations" || cfg.TrainingCollection != "staging_training" {
+		t.Errorf("configured collections = %q, %q, want staging_estimations, staging_training", cfg.WeightEstimationCollection, cfg.TrainingCollection)
+	}
+}
+
+func TestLoadConfigInvalidMockWeight(t *testing.T) {
+	t.Setenv("MONGO_URI", "mongodb://db.example:27017")
+	for _, weight := range []string{"heavy", "0", "-5"} {
+		t.Setenv("MOCK_WEIGHT", weight)
+		if _, err := LoadConfig(); err == nil {
+			t.Errorf("MOCK_WEIGHT=%q loaded, want an error", weight)
+		}
+	}
+}
+
+func TestLoadConfigMongoConsistency(t *testing.T) {
+	t.Setenv("MONGO_URI", "mongodb://db.example:27017")
+	t.Setenv("MONGO_WRITE_CONCERN", "majority")
+	t.Setenv("MONGO_READ_PREFERENCE", "secondaryPreferred")
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	if cfg.MongoWriteConcern != "majority" || cfg.MongoReadPreference != "secondaryPreferred" {
+		t.Errorf("write concern %q, read preference %q, want majority, secondaryPreferred", cfg.MongoWriteConcern, cfg.MongoReadPreference)
+	}
+
+	tests := []struct {
+		key   string
+		value string
+	}{
+		{"MONGO_WRITE_CONCERN", "0"},
+		{"MONGO_WRITE_CONCERN", "all"},
+		{"MONGO_READ_PREFERENCE", "fastest"},
+	}
+	for _, tt := range tests {
+		t.Setenv("MONGO_WRITE_CONCERN", "")
+		t.Setenv("MONGO_READ_PREFERENCE", "")
+		t.Setenv(tt.key, tt.value)
+		if _, err := LoadConfig(); err == nil {
+			t.Errorf("%s=%q loaded, want an error", tt.key, tt.value)
+		}
+	}
+}
+
+func TestLoadConfigInvalidCORSMaxAge(t *testing.T) {
+	t.Setenv("MONGO_URI", "mongodb://db.example:27017")
+	for _, maxAge := range []string{"5m", "-1"} {
+		t.Setenv("CORS_MAX_AGE", maxAge)
+		if _, err := LoadConfig(); err == nil {
+			t.Errorf("CORS_MAX_AGE=%q loaded, want an error", maxAge)
+		}
+	}
+}
+
+func TestLoadConfigRoutePrefix(t *testing.T) {
+	t.Setenv("MONGO_URI", "mongodb://db.example:27017")
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	if cfg.RoutePrefix != "/api" {
+		t.Errorf("default RoutePrefix = %q, want /api", cfg.RoutePrefix)
+	}
+
+	tests := []struct {
+		prefix string
+		want   string
+	}{
+		{"/weight/v2", "/weight/v2"},
+		{"weight/v2/", "/weight/v2"},
+		{" /v1 ", "/v1"},
+		{"", ""},
+		{"/", ""},
+	}
+	for _, tt := range tests {
+		t.Setenv("ROUTE_PREFIX", tt.prefix)
+		cfg, err := LoadConfig()
+		if err != nil {
+			t.Fatalf("ROUTE_PREFIX=%q: %v", tt.prefix, err)
+		}
+		if cfg.RoutePrefix != tt.want {
+			t.Errorf("ROUTE_PREFIX=%q: RoutePrefix = %q, want %q", tt.prefix, cfg.RoutePrefix, tt.want)
+		}
+	}
+
+	for _, prefix := range []string{"/api/{version}", "/api?x=1", "/my api"} {
+		t.Setenv("ROUTE_PREFIX", prefix)
+		if _, err := LoadConfig(); err == nil {
+			t.Errorf("ROUTE_PREFIX=%q loaded, want an error", prefix)
+		}
+	}
+}
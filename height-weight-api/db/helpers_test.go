@@ -0,0 +1,27 @@
+package db
+
+import (
+	"context"
+	"testing"
+
+	"github.com/lucasfepe/height-weight-api/config"
+	"github.com/lucasfepe/height-weight-api/internal/testutil"
+	"github.com/lucasfepe/height-weight-api/models"
+)
+
+// testDatabase connects to a database of the test's own on the MongoDB at
+// MONGO_TEST_URI, dropped when the test ends, and returns the configuration
+// it connected with. Tests needing a database are skipped without one.
+func testDatabase(t *testing.T, env map[string]string) *config.Config {
+	t.Helper()
+	cfg := testutil.DatabaseConfig(t, env)
+	if err := InitMongoDB(cfg); err != nil {
+		t.Fatalf("InitMongoDB: %v", err)
+	}
+	t.Cleanup(func() {
+		models.DB.Drop(context.Background())
+		CloseMongoDB()
+		models.DB = nil
+	})
+	return cfg
+}
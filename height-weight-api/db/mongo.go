@@ -2,26 +2,73 @@ package db
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/lucasfepe/height-weight-api/config"
 	"github.com/lucasfepe/height-weight-api/models"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
 )
 
 var client *mongo.Client
 var collection *mongo.Collection
 
-// InitMongoDB initializes the MongoDB connection
+// softDelete marks estimations as deleted instead of removing them
+var softDelete bool
+
+// transactions is set when the server is a replica set member or mongos,
+// the deployments that support multi-document transactions
+var transactions bool
+
+// mongoClientOptions builds the client options for cfg. The configured write
+// concern and read preference override any given in the URI.
+func mongoClientOptions(cfg *config.Config) (*options.ClientOptions, error) {
+	clientOptions := options.Client().ApplyURI(cfg.MongoURI)
+
+	switch cfg.MongoWriteConcern {
+	case "":
+	case "majority":
+		clientOptions.SetWriteConcern(writeconcern.Majority())
+	default:
+		w, err := strconv.Atoi(cfg.MongoWriteConcern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid write concern %q: %w", cfg.MongoWriteConcern, err)
+		}
+		clientOptions.SetWriteConcern(&writeconcern.WriteConcern{W: w})
+	}
+
+	if cfg.MongoReadPreference != "" {
+		mode, err := readpref.ModeFromString(cfg.MongoReadPreference)
+		if err != nil {
+			return nil, err
+		}
+		readPreference, err := readpref.New(mode)
+		if err != nil {
+			return nil, err
+		}
+		clientOptions.SetReadPreference(readPreference)
+	}
+
+	return clientOptions, nil
+}
+
 // InitMongoDB initializes the MongoDB connection
 func InitMongoDB(cfg *config.Config) error {
 	ctx, cancel := context.WithTimeout(context.Background(), cfg.MongoTimeout)
 	defer cancel()
 
-	var err error
-	clientOptions := options.Client().ApplyURI(cfg.MongoURI)
+	clientOptions, err := mongoClientOptions(cfg)
+	if err != nil {
+		return err
+	}
 	client, err = mongo.Connect(ctx, clientOptions)
 	if err != nil {
 		return err
@@ -38,15 +85,121 @@ func InitMongoDB(cfg *config.Config) error {
 
 	// Initialize the models.DB variable for use in weight_estimation.go
 	models.DB = client.Database(cfg.MongoDB)
+	models.WeightEstimationCollection = cfg.WeightEstimationCollection
+	models.TrainingCollection = cfg.TrainingCollection
+	models.AuditCollection = cfg.AuditCollection
+
+	softDelete = cfg.SoftDelete
+	models.OpTimeout = cfg.MongoOpTimeout
+	models.OpRetries = cfg.MongoOpRetries
+
+	// A standalone server has no transactions, so WithTransaction falls back to plain writes
+	if transactions, err = supportsTransactions(ctx); err != nil {
+		return err
+	}
+	if !transactions {
+		log.Printf("MongoDB is a standalone server; related writes won't run in transactions")
+	}
 
 	// Create indexes for faster lookups
 	indexModel := mongo.IndexModel{
-		Keys:    bson.D{{"id", 1}},
+		Keys:    bson.D{{Key: "id", Value: 1}},
 		Options: options.Index().SetUnique(true),
 	}
 
-	_, err = collection.Indexes().CreateOne(ctx, indexModel)
-	return err
+	if _, err = collection.Indexes().CreateOne(ctx, indexModel); err != nil {
+		return err
+	}
+
+	// The newer collections are listed newest first
+	createdAtIndex := mongo.IndexModel{
+		Keys: bson.D{{Key: "created_at", Value: -1}},
+	}
+	for _, name := range []string{models.WeightEstimationCollection, models.TrainingCollection, models.AuditCollection} {
+		if err := ensureIndex(ctx, models.DB.Collection(name), createdAtIndex); err != nil {
+			return err
+		}
+	}
+
+	// Listing a user's estimations filters by owner and sorts by date
+	userIndex := mongo.IndexModel{
+		Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "created_at", Value: -1}},
+	}
+	if err := ensureIndex(ctx, models.DB.Collection(models.WeightEstimationCollection), userIndex); err != nil {
+		return err
+	}
+
+	// Old estimations expire on their own when a retention period is set
+	if cfg.EstimationTTL > 0 {
+		for _, coll := range []*mongo.Collection{collection, models.DB.Collection(models.WeightEstimationCollection)} {
+			if err := ensureTTLIndex(ctx, coll, cfg.EstimationTTL); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Submissions are looked up across both collections by their shared ID
+	submissionIndex := mongo.IndexModel{
+		Keys:    bson.D{{Key: "submission_id", Value: 1}},
+		Options: options.Index().SetSparse(true),
+	}
+	for _, name := range []string{models.WeightEstimationCollection, models.TrainingCollection} {
+		if err := ensureIndex(ctx, models.DB.Collection(name), submissionIndex); err != nil {
+			return err
+		}
+	}
+
+	// Duplicate detection looks up recent estimations of the same images
+	imageHashIndex := mongo.IndexModel{
+		Keys: bson.D{{Key: "image_hash", Value: 1}, {Key: "created_at", Value: -1}},
+	}
+	if err := ensureIndex(ctx, models.DB.Collection(models.WeightEstimationCollection), imageHashIndex); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// ensureIndex creates an index if it doesn't exist yet. Creating an index
+// that already exists with the same keys and options is a no-op in MongoDB.
+func ensureIndex(ctx context.Context, coll *mongo.Collection, index mongo.IndexModel) error {
+	name, err := coll.Indexes().CreateOne(ctx, index)
+	if err != nil {
+		return fmt.Errorf("failed to create index on %s: %w", coll.Name(), err)
+	}
+	log.Printf("Ensured index %s on %s", name, coll.Name())
+	return nil
+}
+
+// ttlIndexName names the index expiring estimations by their created_at
+const ttlIndexName = "created_at_ttl"
+
+// indexOptionsConflict is the MongoDB error code for creating an index that
+// exists with other options
+const indexOptionsConflict = 85
+
+// ensureTTLIndex makes MongoDB expire documents of coll once their created_at
+// is older than ttl, updating the expiry of an existing TTL index
+func ensureTTLIndex(ctx context.Context, coll *mongo.Collection, ttl time.Duration) error {
+	seconds := int32(ttl.Seconds())
+	index := mongo.IndexModel{
+		Keys:    bson.D{{Key: "created_at", Value: 1}},
+		Options: options.Index().SetName(ttlIndexName).SetExpireAfterSeconds(seconds),
+	}
+	_, err := coll.Indexes().CreateOne(ctx, index)
+	var cmdErr mongo.CommandError
+	if errors.As(err, &cmdErr) && cmdErr.Code == indexOptionsConflict {
+		// The retention period changed since the index was created
+		err = coll.Database().RunCommand(ctx, bson.D{
+			{Key: "collMod", Value: coll.Name()},
+			{Key: "index", Value: bson.D{{Key: "name", Value: ttlIndexName}, {Key: "expireAfterSeconds", Value: seconds}}},
+		}).Err()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create TTL index on %s: %w", coll.Name(), err)
+	}
+	log.Printf("Ensured TTL index on %s expiring after %d seconds", coll.Name(), seconds)
+	return nil
 }
 
 // CloseMongoDB closes the MongoDB connection
@@ -57,24 +210,101 @@ func CloseMongoDB() error {
 	return client.Disconnect(context.Background())
 }
 
-// SaveEstimation saves an estimation to MongoDB
+// Ping checks that the MongoDB connection is alive
+func Ping(ctx context.Context) error {
+	if client == nil {
+		return fmt.Errorf("MongoDB not initialized")
+	}
+	return client.Ping(ctx, nil)
+}
+
+// supportsTransactions asks the server whether it is a replica set member or
+// a mongos router
+func supportsTransactions(ctx context.Context) (bool, error) {
+	var hello struct {
+		SetName string `bson:"setName"`
+		Msg     string `bson:"msg"`
+	}
+	if err := client.Database("admin").RunCommand(ctx, bson.D{{Key: "hello", Value: 1}}).Decode(&hello); err != nil {
+		return false, fmt.Errorf("failed to query MongoDB topology: %w", err)
+	}
+	return hello.SetName != "" || hello.Msg == "isdbgrid", nil
+}
+
+// WithTransaction runs fn in a transaction, committing if it returns nil and
+// aborting otherwise. fn may be retried on transient errors, so it must only
+// write through sessCtx. On a standalone server, which has no transactions,
+// fn runs once without one and its writes are not rolled back on failure.
+func WithTransaction(ctx context.Context, fn func(sessCtx mongo.SessionContext) error) error {
+	if client == nil {
+		return fmt.Errorf("MongoDB not initialized")
+	}
+	return client.UseSession(ctx, func(sessCtx mongo.SessionContext) error {
+		if !transactions {
+			return fn(sessCtx)
+		}
+		_, err := sessCtx.WithTransaction(sessCtx, func(sessCtx mongo.SessionContext) (interface{}, error) {
+			return nil, fn(sessCtx)
+		})
+		return err
+	})
+}
+
+// maxSaveAttempts is how many IDs SaveEstimation tries before giving up on
+// duplicate key errors
+const maxSaveAttempts = 3
+
+// SaveEstimation saves an estimation to MongoDB. When its ID is already taken
+// the estimation gets a fresh UUID and the insert is retried; a duplicate key
+// error is only returned once every attempt collided. The image path is kept.
 func SaveEstimation(estimation *models.Estimation) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), models.OpTimeout)
 	defer cancel()
 
-	_, err := collection.InsertOne(ctx, estimation)
+	var err error
+	for attempt := 1; attempt <= maxSaveAttempts; attempt++ {
+		if _, err = collection.InsertOne(ctx, estimation); !IsDuplicateKeyError(err) {
+			return err
+		}
+		log.Printf("Estimation ID %s already taken (attempt %d of %d)", estimation.ID, attempt, maxSaveAttempts)
+		if attempt < maxSaveAttempts {
+			estimation.ID = uuid.New().String()
+		}
+	}
 	return err
 }
 
-// GetEstimationByID retrieves an estimation by ID
-func GetEstimationByID(id string) (*models.Estimation, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+// IsDuplicateKeyError reports whether err is a unique index violation, e.g. an
+// estimation ID that is already taken
+func IsDuplicateKeyError(err error) bool {
+	return mongo.IsDuplicateKeyError(err)
+}
+
+// SoftDeleteEnabled reports whether deletes only mark estimations as deleted
+func SoftDeleteEnabled() bool {
+	return softDelete
+}
+
+// notDeleted adds a condition excluding soft-deleted estimations to filter
+func notDeleted(filter bson.M) bson.M {
+	filter["deleted_at"] = bson.M{"$exists": false}
+	return filter
+}
+
+// GetEstimationByID retrieves an estimation by ID, skipping soft-deleted ones
+// unless includeDeleted is set
+func GetEstimationByID(id string, includeDeleted bool) (*models.Estimation, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), models.OpTimeout)
 	defer cancel()
 
 	var estimation models.Estimation
 	filter := bson.M{"id": id}
-	err := collection.FindOne(ctx, filter).Decode(&estimation)
-
+	if !includeDeleted {
+		filter = notDeleted(filter)
+	}
+	err := models.WithRetry(ctx, func(ctx context.Context) error {
+		return collection.FindOne(ctx, filter).Decode(&estimation)
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -82,36 +312,134 @@ func GetEstimationByID(id string) (*models.Estimation, error) {
 	return &estimation, nil
 }
 
-// ListEstimations retrieves a list of estimations with pagination
-func ListEstimations(limit, offset int) ([]models.Estimation, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+// GetEstimationsByIDs retrieves the estimations with the given IDs in one
+// query, skipping soft-deleted ones unless includeDeleted is set. IDs without
+// an estimation are simply missing from the result, which is in no
+// particular order.
+func GetEstimationsByIDs(ids []string, includeDeleted bool) ([]models.Estimation, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), models.OpTimeout)
+	defer cancel()
+
+	filter := bson.M{"id": bson.M{"$in": ids}}
+	if !includeDeleted {
+		filter = notDeleted(filter)
+	}
+
+	var estimations []models.Estimation
+	err := models.WithRetry(ctx, func(ctx context.Context) error {
+		cursor, err := collection.Find(ctx, filter)
+		if err != nil {
+			return err
+		}
+		defer cursor.Close(ctx)
+
+		estimations = nil
+		return cursor.All(ctx, &estimations)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return estimations, nil
+}
+
+// ListEstimations retrieves a list of estimations with pagination, skipping
+// soft-deleted ones unless includeDeleted is set. Documents that fail to
+// decode are logged and left out, so one bad record doesn't hide the rest;
+// their number is returned alongside the estimations.
+func ListEstimations(limit, offset int, includeDeleted bool) ([]models.Estimation, int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), models.OpTimeout)
 	defer cancel()
 
 	findOptions := options.Find()
 	findOptions.SetLimit(int64(limit))
 	findOptions.SetSkip(int64(offset))
-	findOptions.SetSort(bson.D{{"created_at", -1}}) // Sort by newest first
+	findOptions.SetSort(bson.D{{Key: "created_at", Value: -1}}) // Sort by newest first
 
-	cursor, err := collection.Find(ctx, bson.M{}, findOptions)
-	if err != nil {
-		return nil, err
+	filter := bson.M{}
+	if !includeDeleted {
+		filter = notDeleted(filter)
 	}
-	defer cursor.Close(ctx)
 
 	var estimations []models.Estimation
-	if err := cursor.All(ctx, &estimations); err != nil {
-		return nil, err
+	var skipped int
+	err := models.WithRetry(ctx, func(ctx context.Context) error {
+		cursor, err := collection.Find(ctx, filter, findOptions)
+		if err != nil {
+			return err
+		}
+		defer cursor.Close(ctx)
+
+		// A retry starts the list over
+		estimations, skipped = nil, 0
+		for cursor.Next(ctx) {
+			var estimation models.Estimation
+			if err := cursor.Decode(&estimation); err != nil {
+				log.Printf("Warning: Skipping malformed estimation %v: %v", cursor.Current.Lookup("_id"), err)
+				skipped++
+				continue
+			}
+			estimations = append(estimations, estimation)
+		}
+		return cursor.Err()
+	})
+	if err != nil {
+		return nil, 0, err
 	}
 
-	return estimations, nil
+	return estimations, skipped, nil
+}
+
+// CountEstimations returns the number of estimations, skipping soft-deleted
+// ones unless includeDeleted is set
+func CountEstimations(includeDeleted bool) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), models.OpTimeout)
+	defer cancel()
+
+	filter := bson.M{}
+	if !includeDeleted {
+		filter = notDeleted(filter)
+	}
+
+	var count int64
+	err := models.WithRetry(ctx, func(ctx context.Context) error {
+		var err error
+		count, err = collection.CountDocuments(ctx, filter)
+		return err
+	})
+	return count, err
 }
 
-// DeleteEstimation deletes an estimation by ID
+// DeleteEstimation deletes an estimation by ID. With soft delete enabled the
+// record is only marked with a deleted_at timestamp.
 func DeleteEstimation(id string) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), models.OpTimeout)
 	defer cancel()
 
 	filter := bson.M{"id": id}
+	if softDelete {
+		update := bson.M{"$set": bson.M{"deleted_at": time.Now()}}
+		_, err := collection.UpdateOne(ctx, notDeleted(filter), update)
+		return err
+	}
+
 	_, err := collection.DeleteOne(ctx, filter)
 	return err
 }
+
+// RestoreEstimation clears the deleted_at mark of a soft-deleted estimation
+func RestoreEstimation(id string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), models.OpTimeout)
+	defer cancel()
+
+	filter := bson.M{"id": id, "deleted_at": bson.M{"$exists": true}}
+	update := bson.M{"$unset": bson.M{"deleted_at": ""}}
+	result, err := collection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	return nil
+}
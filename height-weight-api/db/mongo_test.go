@@ -0,0 +1,317 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"os"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/lucasfepe/height-weight-api/config"
+	"github.com/lucasfepe/height-weight-api/internal/testutil"
+	"github.com/lucasfepe/height-weight-api/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+)
+
+// findIndex returns the specification of coll's index named name, or nil
+func findIndex(t *testing.T, coll *mongo.Collection, name string) bson.M {
+	t.Helper()
+	cursor, err := coll.Indexes().List(context.Background())
+	if err != nil {
+		t.Fatalf("list indexes of %s: %v", coll.Name(), err)
+	}
+	var indexes []bson.M
+	if err := cursor.All(context.Background(), &indexes); err != nil {
+		t.Fatalf("decode indexes of %s: %v", coll.Name(), err)
+	}
+	for _, index := range indexes {
+		if index["name"] == name {
+			return index
+		}
+	}
+	return nil
+}
+
+// expireAfterSeconds returns the expiry of a TTL index specification, which
+// the server may report as any numeric type
+func expireAfterSeconds(index bson.M) int64 {
+	switch seconds := index["expireAfterSeconds"].(type) {
+	case int32:
+		return int64(seconds)
+	case int64:
+		return seconds
+	case float64:
+		return int64(seconds)
+	}
+	return -1
+}
+
+func TestTTLIndex(t *testing.T) {
+	testDatabase(t, map[string]string{"ESTIMATION_TTL_DAYS": "30"})
+	const want = 30 * 24 * 60 * 60
+	collections := []*mongo.Collection{collection, models.DB.Collection(models.WeightEstimationCollection)}
+
+	for _, coll := range collections {
+		index := findIndex(t, coll, ttlIndexName)
+		if index == nil {
+			t.Fatalf("no %s index on %s", ttlIndexName, coll.Name())
+		}
+		if got := expireAfterSeconds(index); got != want {
+			t.Errorf("%s expireAfterSeconds = %d, want %d", coll.Name(), got, want)
+		}
+	}
+
+	// A changed retention period updates the existing index
+	if err := ensureTTLIndex(context.Background(), collection, 7*24*time.Hour); err != nil {
+		t.Fatalf("ensureTTLIndex: %v", err)
+	}
+	if got := expireAfterSeconds(findIndex(t, collection, ttlIndexName)); got != 7*24*60*60 {
+		t.Errorf("expireAfterSeconds after the change = %d, want %d", got, 7*24*60*60)
+	}
+
+	// Restarting without a retention period leaves the index alone
+	cfg := testutil.Config(t, map[string]string{"MONGO_URI": os.Getenv("MONGO_TEST_URI"), "MONGO_DB": models.DB.Name()})
+	CloseMongoDB()
+	if err := InitMongoDB(cfg); err != nil {
+		t.Fatalf("InitMongoDB without a TTL: %v", err)
+	}
+	for _, coll := range []*mongo.Collection{collection, models.DB.Collection(models.WeightEstimationCollection)} {
+		if findIndex(t, coll, ttlIndexName) == nil {
+			t.Errorf("%s index on %s dropped with the TTL unset", ttlIndexName, coll.Name())
+		}
+	}
+}
+
+func TestSaveEstimationRetriesTakenID(t *testing.T) {
+	testDatabase(t, nil)
+	if err := SaveEstimation(&models.Estimation{ID: "taken", Weight: 70}); err != nil {
+		t.Fatalf("seed estimation: %v", err)
+	}
+
+	estimation := &models.Estimation{ID: "taken", Weight: 80}
+	if err := SaveEstimation(estimation); err != nil {
+		t.Fatalf("SaveEstimation with a taken ID: %v", err)
+	}
+	if estimation.ID == "taken" {
+		t.Fatal("ID not regenerated after the duplicate key")
+	}
+	saved, err := GetEstimationByID(estimation.ID, false)
+	if err != nil || saved.Weight != 80 {
+		t.Errorf("GetEstimationByID(%s) = %+v, %v, want the retried estimation", estimation.ID, saved, err)
+	}
+}
+
+func TestInitMongoDBIndexes(t *testing.T) {
+	cfg := testDatabase(t, nil)
+
+	// A restart finds the indexes in place and leaves them be
+	CloseMongoDB()
+	if err := InitMongoDB(cfg); err != nil {
+		t.Fatalf("second InitMongoDB: %v", err)
+	}
+
+	tests := []struct {
+		collection string
+		index      string
+	}{
+		{cfg.MongoCollection, "id_1"},
+		{models.WeightEstimationCollection, "created_at_-1"},
+		{models.TrainingCollection, "created_at_-1"},
+		{models.AuditCollection, "created_at_-1"},
+		{models.WeightEstimationCollection, "user_id_1_created_at_-1"},
+		{models.WeightEstimationCollection, "submission_id_1"},
+		{models.TrainingCollection, "submission_id_1"},
+		{models.WeightEstimationCollection, "image_hash_1_created_at_-1"},
+	}
+	for _, tt := range tests {
+		if findIndex(t, models.DB.Collection(tt.collection), tt.index) == nil {
+			t.Errorf("no %s index on %s", tt.index, tt.collection)
+		}
+	}
+	if index := findIndex(t, collection, "id_1"); index != nil && index["unique"] != true {
+		t.Errorf("id index = %v, want unique", index)
+	}
+}
+
+func TestConfiguredCollections(t *testing.T) {
+	// InitMongoDB sets the package level names, which other tests rely on the defaults of
+	estimationsName, trainingName := models.WeightEstimationCollection, models.TrainingCollection
+	t.Cleanup(func() {
+		models.WeightEstimationCollection, models.TrainingCollection = estimationsName, trainingName
+	})
+	cfg := testDatabase(t, map[string]string{"WEIGHT_ESTIMATION_COLLECTION": "staging_estimations", "TRAINING_COLLECTION": "staging_training"})
+
+	if err := models.SaveWeightEstimation(&models.WeightEstimation{Height: 175, Weight: 70}); err != nil {
+		t.Fatalf("SaveWeightEstimation: %v", err)
+	}
+	if err := models.SaveTrainingData(&models.TrainingData{Height: 175, ActualWeight: 70}); err != nil {
+		t.Fatalf("SaveTrainingData: %v", err)
+	}
+
+	tests := []struct {
+		collection string
+		want       int64
+	}{
+		{cfg.WeightEstimationCollection, 1},
+		{cfg.TrainingCollection, 1},
+		{"weight_estimations", 0},
+		{"training_data", 0},
+	}
+	for _, tt := range tests {
+		count, err := models.DB.Collection(tt.collection).CountDocuments(context.Background(), bson.M{})
+		if err != nil {
+			t.Fatalf("count %s: %v", tt.collection, err)
+		}
+		if count != tt.want {
+			t.Errorf("%s has %d documents, want %d", tt.collection, count, tt.want)
+		}
+	}
+}
+
+func TestWithTransaction(t *testing.T) {
+	testDatabase(t, nil)
+	coll := models.DB.Collection("transaction_test")
+	ctx := context.Background()
+	errAbort := errors.New("abort")
+
+	// count returns the documents of coll with the given marker
+	count := func(marker string) int64 {
+		t.Helper()
+		n, err := coll.CountDocuments(ctx, bson.M{"marker": marker})
+		if err != nil {
+			t.Fatalf("count %s: %v", marker, err)
+		}
+		return n
+	}
+	// insertTwo writes two documents with marker, then returns result
+	insertTwo := func(marker string, result error) func(mongo.SessionContext) error {
+		return func(sessCtx mongo.SessionContext) error {
+			for i := 0; i < 2; i++ {
+				if _, err := coll.InsertOne(sessCtx, bson.M{"marker": marker}); err != nil {
+					return err
+				}
+			}
+			return result
+		}
+	}
+
+	// Collections can't be created inside a transaction on older servers
+	if _, err := coll.InsertOne(ctx, bson.M{"marker": "setup"}); err != nil {
+		t.Fatalf("create collection: %v", err)
+	}
+
+	if err := WithTransaction(ctx, insertTwo("commit", nil)); err != nil {
+		t.Fatalf("WithTransaction: %v", err)
+	}
+	if n := count("commit"); n != 2 {
+		t.Errorf("committed %d documents, want 2", n)
+	}
+
+	// A standalone server keeps the writes made before the failure
+	if err := WithTransaction(ctx, insertTwo("rollback", errAbort)); !errors.Is(err, errAbort) {
+		t.Fatalf("WithTransaction error = %v, want %v", err, errAbort)
+	}
+	want := int64(2)
+	if transactions {
+		want = 0
+	}
+	if n := count("rollback"); n != want {
+		t.Errorf("after an aborted transaction %d documents remain, want %d (transactions %v)", n, want, transactions)
+	}
+}
+
+func TestWithTransactionUninitialized(t *testing.T) {
+	saved := client
+	client = nil
+	defer func() { client = saved }()
+
+	called := false
+	err := WithTransaction(context.Background(), func(mongo.SessionContext) error {
+		called = true
+		return nil
+	})
+	if err == nil || called {
+		t.Errorf("without a connection got error %v, fn called %v; want an error before fn runs", err, called)
+	}
+}
+
+func TestMongoClientOptions(t *testing.T) {
+	tests := []struct {
+		name         string
+		uri          string
+		writeConcern string
+		readPref     string
+		wantW        interface{}
+		wantMode     readpref.Mode
+	}{
+		{"driver defaults", "mongodb://db.example:27017", "", "", nil, 0},
+		{"uri kept", "mongodb://db.example:27017/?w=1&readPreference=secondary", "", "", 1, readpref.SecondaryMode},
+		{"majority", "mongodb://db.example:27017", "majority", "", "majority", 0},
+		{"nodes", "mongodb://db.example:27017", "2", "", 2, 0},
+		{"overrides uri", "mongodb://db.example:27017/?w=1&readPreference=secondary", "majority", "nearest", "majority", readpref.NearestMode},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.Config{MongoURI: tt.uri, MongoWriteConcern: tt.writeConcern, MongoReadPreference: tt.readPref}
+			clientOptions, err := mongoClientOptions(cfg)
+			if err != nil {
+				t.Fatalf("mongoClientOptions: %v", err)
+			}
+
+			var w interface{}
+			if clientOptions.WriteConcern != nil {
+				w = clientOptions.WriteConcern.W
+			}
+			if w != tt.wantW {
+				t.Errorf("write concern w = %v, want %v", w, tt.wantW)
+			}
+
+			var mode readpref.Mode
+			if clientOptions.ReadPreference != nil {
+				mode = clientOptions.ReadPreference.Mode()
+			}
+			if mode != tt.wantMode {
+				t.Errorf("read preference = %v, want %v", mode, tt.wantMode)
+			}
+		})
+	}
+
+	for _, cfg := range []*config.Config{
+		{MongoURI: "mongodb://db.example:27017", MongoWriteConcern: "lots"},
+		{MongoURI: "mongodb://db.example:27017", MongoReadPreference: "fastest"},
+	} {
+		if _, err := mongoClientOptions(cfg); err == nil {
+			t.Errorf("mongoClientOptions(write concern %q, read preference %q) succeeded, want an error", cfg.MongoWriteConcern, cfg.MongoReadPreference)
+		}
+	}
+}
+
+func TestListEstimationsSkipsMalformed(t *testing.T) {
+	testDatabase(t, nil)
+	now := time.Now()
+	for i, id := range []string{"older", "newer"} {
+		if err := SaveEstimation(&models.Estimation{ID: id, Height: 175, Weight: 70, CreatedAt: now.Add(time.Duration(i) * time.Minute)}); err != nil {
+			t.Fatalf("SaveEstimation: %v", err)
+		}
+	}
+	// A height stored as text can't be decoded into an Estimation
+	malformed := bson.M{"id": "malformed", "height": "tall", "weight": 70, "created_at": now.Add(30 * time.Second)}
+	if _, err := collection.InsertOne(context.Background(), malformed); err != nil {
+		t.Fatalf("insert malformed estimation: %v", err)
+	}
+
+	estimations, skipped, err := ListEstimations(10, 0, false)
+	if err != nil {
+		t.Fatalf("ListEstimations: %v", err)
+	}
+	var ids []string
+	for _, estimation := range estimations {
+		ids = append(ids, estimation.ID)
+	}
+	if !slices.Equal(ids, []string{"newer", "older"}) || skipped != 1 {
+		t.Errorf("ListEstimations = %v with %d skipped, want [newer older] with 1 skipped", ids, skipped)
+	}
+}
@@ -0,0 +1,79 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/lucasfepe/height-weight-api/models"
+	"github.com/lucasfepe/height-weight-api/utils"
+)
+
+// anonymousActor is recorded as the actor when authentication isn't configured
+const anonymousActor = "anonymous"
+
+// recordAudit writes an audit entry for action on targetID by the user of r.
+// The change itself has already happened, so a failed write is only logged.
+func recordAudit(r *http.Request, action, targetID string, details map[string]interface{}) {
+	actor := utils.UserID(r.Context())
+	if actor == "" {
+		actor = anonymousActor
+	}
+
+	if err := models.WriteAuditEntry(actor, action, targetID, details); err != nil {
+		log.Printf("Warning: Failed to write audit entry (%s %s by %s): %v", action, targetID, actor, err)
+	}
+}
+
+// ListAuditEntries returns audit log entries, newest first
+func ListAuditEntries(w http.ResponseWriter, r *http.Request) {
+	if models.DB == nil {
+		sendErrorResponse(w, r, http.StatusInternalServerError, utils.ErrCodeDatabaseError, "Database not initialized")
+		return
+	}
+
+	// Get limit and offset parameters (optional)
+	var limit int64 = 50 // Default limit
+	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+		parsedLimit, err := strconv.ParseInt(limitStr, 10, 64)
+		if err == nil && parsedLimit > 0 {
+			limit = parsedLimit
+		}
+	}
+
+	var offset int64
+	if offsetStr := r.URL.Query().Get("offset"); offsetStr != "" {
+		parsedOffset, err := strconv.ParseInt(offsetStr, 10, 64)
+		if err == nil && parsedOffset > 0 {
+			offset = parsedOffset
+		}
+	}
+
+	entries, err := models.GetAuditEntries(limit, offset)
+	if err != nil {
+		sendErrorResponse(w, r, http.StatusInternalServerError, utils.ErrCodeDatabaseError, "Failed to fetch audit entries: "+err.Error())
+		return
+	}
+
+	// Wrap the records with pagination metadata when requested
+	var data interface{} = entries
+	if r.URL.Query().Get("paginated") == "true" {
+		total, err := models.CountAuditEntries()
+		if err != nil {
+			sendErrorResponse(w, r, http.StatusInternalServerError, utils.ErrCodeDatabaseError, "Failed to count audit entries: "+err.Error())
+			return
+		}
+		data = utils.NewPage(entries, len(entries), total, limit, offset)
+	}
+
+	// Return success response
+	response := Response{
+		Success: true,
+		Data:    data,
+		Message: fmt.Sprintf("Retrieved %d audit entries", len(entries)),
+	}
+
+	// Send response
+	utils.Respond(w, r, http.StatusOK, response)
+}
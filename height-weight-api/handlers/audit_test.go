@@ -0,0 +1,61 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/lucasfepe/height-weight-api/models"
+	"github.com/lucasfepe/height-weight-api/utils"
+)
+
+func TestDeleteWritesOneAuditEntry(t *testing.T) {
+	cfg := testDatabase(t, nil)
+	estimation := seedEstimation(t, cfg.UploadDir, "audited", time.Now())
+
+	// Deleting twice: the second finds nothing and must not be audited
+	for i, wantCode := range []int{http.StatusOK, http.StatusNotFound} {
+		r := withImageID(httptest.NewRequest(http.MethodDelete, "/estimate/audited", nil), estimation.ID)
+		r = r.WithContext(utils.WithUserID(r.Context(), "alice"))
+		if w, response := serve(t, http.HandlerFunc(DeleteEstimationHandler), r); w.Code != wantCode {
+			t.Fatalf("delete %d: got %d (%s), want %d", i+1, w.Code, response.Message, wantCode)
+		}
+	}
+
+	w, response := serve(t, http.HandlerFunc(ListAuditEntries), httptest.NewRequest(http.MethodGet, "/audit", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("list audit: got %d %s (%s), want 200", w.Code, response.ErrorCode, response.Message)
+	}
+	var entries []models.AuditEntry
+	if err := json.Unmarshal(response.Data, &entries); err != nil {
+		t.Fatalf("decode entries %s: %v", response.Data, err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("audit entries = %+v, want exactly 1", entries)
+	}
+	entry := entries[0]
+	if entry.Action != models.AuditActionDelete || entry.TargetID != estimation.ID || entry.Actor != "alice" {
+		t.Errorf("entry = %+v, want a delete of %s by alice", entry, estimation.ID)
+	}
+	if entry.CreatedAt.IsZero() {
+		t.Error("entry without a creation time")
+	}
+}
+
+func TestRecordAuditAnonymous(t *testing.T) {
+	testDatabase(t, nil)
+	recordAudit(httptest.NewRequest(http.MethodPost, "/", nil), models.AuditActionBulkDelete, "", map[string]interface{}{"deleted": 3})
+
+	entries, err := models.GetAuditEntries(0, 0)
+	if err != nil {
+		t.Fatalf("GetAuditEntries: %v", err)
+	}
+	if len(entries) != 1 || entries[0].Actor != anonymousActor || entries[0].Action != models.AuditActionBulkDelete {
+		t.Fatalf("audit entries = %+v, want one bulk delete by %s", entries, anonymousActor)
+	}
+	if deleted, _ := entries[0].Details["deleted"].(int32); deleted != 3 {
+		t.Errorf("details = %v, want deleted 3", entries[0].Details)
+	}
+}
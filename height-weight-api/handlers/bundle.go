@@ -0,0 +1,123 @@
+package handlers
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/lucasfepe/height-weight-api/models"
+	"github.com/lucasfepe/height-weight-api/utils"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// GetEstimationBundle streams a ZIP archive of a weight estimation for
+// debugging: its record as record.json and its images as front.jpg and
+// side.jpg, side_left.jpg and so on per side view, or with the extension
+// they were stored with. It responds 404
+// when the estimation or either image is missing. The archive is written
+// straight to the response, so once it has started failures only end it.
+func GetEstimationBundle(w http.ResponseWriter, r *http.Request) {
+	if models.DB == nil {
+		sendErrorResponse(w, r, http.StatusInternalServerError, utils.ErrCodeDatabaseError, "Database not initialized")
+		return
+	}
+
+	id := mux.Vars(r)["id"]
+	estimation, err := models.GetWeightEstimationByID(id, utils.UserID(r.Context()))
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrInvalidID):
+			sendErrorResponse(w, r, http.StatusBadRequest, utils.ErrCodeInvalidID, "Invalid estimation ID")
+		case errors.Is(err, mongo.ErrNoDocuments):
+			sendErrorResponse(w, r, http.StatusNotFound, utils.ErrCodeNotFound, "Estimation not found")
+		default:
+			sendErrorResponse(w, r, http.StatusInternalServerError, utils.ErrCodeDatabaseError, "Failed to fetch estimation: "+err.Error())
+		}
+		return
+	}
+
+	// Images are already compressed, so they're stored as they are
+	type bundleEntry struct {
+		name   string
+		method uint16
+		data   io.Reader
+	}
+
+	// Open every image up front, so a missing one still gets a clean 404
+	front, ok := openBundleImage(w, r, estimation.FrontImgPath)
+	if !ok {
+		return
+	}
+	defer front.Close()
+	images := []bundleEntry{{"front" + bundleImageExt(estimation.FrontImgPath), zip.Store, front}}
+	for _, sideImage := range estimation.Sides() {
+		side, ok := openBundleImage(w, r, sideImage.Path)
+		if !ok {
+			return
+		}
+		defer side.Close()
+		images = append(images, bundleEntry{imageViewName(sideImage.View) + bundleImageExt(sideImage.Path), zip.Store, side})
+	}
+
+	record, err := json.MarshalIndent(estimation, "", "  ")
+	if err != nil {
+		sendErrorResponse(w, r, http.StatusInternalServerError, utils.ErrCodeInternal, "Failed to encode estimation: "+err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="estimation-`+id+`.zip"`)
+	w.WriteHeader(http.StatusOK)
+
+	zw := zip.NewWriter(w)
+	entries := append([]bundleEntry{{"record.json", zip.Deflate, bytes.NewReader(record)}}, images...)
+	for _, entry := range entries {
+		ew, err := zw.CreateHeader(&zip.FileHeader{Name: entry.name, Method: entry.method, Modified: estimation.CreatedAt})
+		if err == nil {
+			_, err = io.Copy(ew, entry.data)
+		}
+		if err != nil {
+			log.Printf("Bundle of estimation %s stopped at %s: %v", id, entry.name, err)
+			return
+		}
+	}
+	if err := zw.Close(); err != nil {
+		log.Printf("Bundle of estimation %s not finished: %v", id, err)
+	}
+}
+
+// openBundleImage opens a stored estimation image for a bundle. It writes a
+// 404 when the image isn't stored and returns false on failure.
+func openBundleImage(w http.ResponseWriter, r *http.Request, path string) (*os.File, bool) {
+	if path == "" {
+		sendErrorResponse(w, r, http.StatusNotFound, utils.ErrCodeImageMissing, "Estimation images are no longer available")
+		return nil, false
+	}
+	file, err := utils.OpenStoredImage(path)
+	if err != nil {
+		if errors.Is(err, utils.ErrImageMissing) {
+			sendErrorResponse(w, r, http.StatusNotFound, utils.ErrCodeImageMissing, "Estimation images are no longer available")
+		} else {
+			sendErrorResponse(w, r, http.StatusInternalServerError, utils.ErrCodeStorageError, "Failed to open estimation image: "+err.Error())
+		}
+		return nil, false
+	}
+	return file, true
+}
+
+// bundleImageExt returns the extension a stored image is bundled with,
+// .jpg unless it was stored as another type
+func bundleImageExt(path string) string {
+	if ext := strings.ToLower(filepath.Ext(path)); ext != "" && ext != ".jpeg" {
+		return ext
+	}
+	return ".jpg"
+}
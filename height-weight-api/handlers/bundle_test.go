@@ -0,0 +1,97 @@
+package handlers
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/lucasfepe/height-weight-api/models"
+	"github.com/lucasfepe/height-weight-api/utils"
+)
+
+func TestGetEstimationBundle(t *testing.T) {
+	cfg := testDatabase(t, nil)
+	images := map[string][]byte{"front.jpg": []byte("front image"), "side.jpg": []byte("side image")}
+	for name, data := range images {
+		if err := os.WriteFile(filepath.Join(cfg.UploadDir, name), data, 0644); err != nil {
+			t.Fatalf("write image: %v", err)
+		}
+	}
+	sidePath := filepath.Join(cfg.UploadDir, "side.jpg")
+	estimation := seedWeightEstimation(t, &models.WeightEstimation{
+		FrontImgPath: filepath.Join(cfg.UploadDir, "front.jpg"),
+		SideImgPath:  sidePath,
+		SideImages:   []models.SideImage{{View: utils.SideViewSingle, Path: sidePath}},
+		CreatedAt:    time.Now(),
+	})
+
+	w := httptest.NewRecorder()
+	GetEstimationBundle(w, withID(httptest.NewRequest(http.MethodGet, "/estimate-weight/"+estimation.ID.Hex()+"/bundle", nil), estimation.ID.Hex()))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d %s, want 200", w.Code, w.Body.String())
+	}
+	if got := w.Header().Get("Content-Type"); got != "application/zip" {
+		t.Errorf("Content-Type = %q, want application/zip", got)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	if err != nil {
+		t.Fatalf("open bundle: %v", err)
+	}
+	entries := make(map[string][]byte, len(zr.File))
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatalf("open %s: %v", f.Name, err)
+		}
+		data, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatalf("read %s: %v", f.Name, err)
+		}
+		entries[f.Name] = data
+	}
+	if len(entries) != 3 {
+		t.Errorf("bundle has %d entries, want record.json, front.jpg and side.jpg", len(entries))
+	}
+
+	var record models.WeightEstimation
+	if err := json.Unmarshal(entries["record.json"], &record); err != nil {
+		t.Fatalf("decode record.json %q: %v", entries["record.json"], err)
+	}
+	if record.ID != estimation.ID {
+		t.Errorf("record ID = %s, want %s", record.ID.Hex(), estimation.ID.Hex())
+	}
+	for name, want := range images {
+		if got, ok := entries[name]; !ok || !bytes.Equal(got, want) {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestGetEstimationBundleMissingImage(t *testing.T) {
+	cfg := testDatabase(t, nil)
+	sidePath := filepath.Join(cfg.UploadDir, "side.jpg")
+	if err := os.WriteFile(sidePath, []byte("side image"), 0644); err != nil {
+		t.Fatalf("write image: %v", err)
+	}
+	estimation := seedWeightEstimation(t, &models.WeightEstimation{
+		FrontImgPath: filepath.Join(cfg.UploadDir, "front.jpg"),
+		SideImgPath:  sidePath,
+		SideImages:   []models.SideImage{{View: utils.SideViewSingle, Path: sidePath}},
+		CreatedAt:    time.Now(),
+	})
+
+	r := withID(httptest.NewRequest(http.MethodGet, "/estimate-weight/"+estimation.ID.Hex()+"/bundle", nil), estimation.ID.Hex())
+	w, response := serve(t, http.HandlerFunc(GetEstimationBundle), r)
+	if w.Code != http.StatusNotFound || response.ErrorCode != utils.ErrCodeImageMissing {
+		t.Errorf("got %d %s (%s), want 404 %s", w.Code, response.ErrorCode, response.Message, utils.ErrCodeImageMissing)
+	}
+}
@@ -0,0 +1,146 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/lucasfepe/height-weight-api/utils"
+)
+
+// NewInitUploadHandler creates a handler starting a chunked upload, for
+// clients on flaky networks that need to resume large images midway
+func NewInitUploadHandler(store *utils.ChunkedUploadStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		upload, err := store.Init(utils.UserID(r.Context()))
+		if err != nil {
+			sendErrorResponse(w, r, http.StatusInternalServerError, utils.ErrCodeStorageError, "Failed to start upload: "+err.Error())
+			return
+		}
+
+		response := Response{
+			Success: true,
+			Data: map[string]interface{}{
+				"upload_id":  upload.ID,
+				"expires_at": upload.ExpiresAt,
+				"max_size":   store.MaxSize(),
+			},
+		}
+
+		utils.Respond(w, r, http.StatusCreated, response)
+	}
+}
+
+// NewAppendUploadHandler creates a handler storing one chunk of an upload.
+// The Content-Range header places the body, e.g. "bytes 0-1023/4096", and
+// chunks must continue where the previous one ended.
+func NewAppendUploadHandler(store *utils.ChunkedUploadStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start, end, total, err := parseContentRange(r.Header.Get("Content-Range"))
+		if err != nil {
+			sendErrorResponse(w, r, http.StatusBadRequest, utils.ErrCodeInvalidRequest, "Invalid Content-Range: "+err.Error())
+			return
+		}
+
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			status, errCode := formError(err)
+			sendErrorResponse(w, r, status, errCode, "Failed to read chunk: "+err.Error())
+			return
+		}
+		if int64(len(data)) != end-start+1 {
+			sendErrorResponse(w, r, http.StatusBadRequest, utils.ErrCodeInvalidRequest, fmt.Sprintf("Chunk has %d bytes, Content-Range announces %d", len(data), end-start+1))
+			return
+		}
+
+		upload, err := store.Append(mux.Vars(r)["id"], utils.UserID(r.Context()), start, total, data)
+		if err != nil {
+			sendUploadError(w, r, err)
+			return
+		}
+
+		response := Response{
+			Success: true,
+			Data:    upload,
+		}
+
+		utils.Respond(w, r, http.StatusOK, response)
+	}
+}
+
+// NewCompleteUploadHandler creates a handler finalizing a chunked upload. It
+// returns the image key to pass as front_image_key or side_image_key.
+func NewCompleteUploadHandler(store *utils.ChunkedUploadStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key, upload, err := store.Complete(mux.Vars(r)["id"], utils.UserID(r.Context()))
+		if err != nil {
+			sendUploadError(w, r, err)
+			return
+		}
+
+		response := Response{
+			Success: true,
+			Data: map[string]interface{}{
+				"key":        key,
+				"size":       upload.Received,
+				"expires_at": upload.ExpiresAt,
+			},
+		}
+
+		utils.Respond(w, r, http.StatusOK, response)
+	}
+}
+
+// sendUploadError maps a chunked upload error to its response
+func sendUploadError(w http.ResponseWriter, r *http.Request, err error) {
+	var rangeErr *utils.RangeMismatchError
+	switch {
+	case errors.As(err, &rangeErr):
+		// Tell the client where to resume
+		sendErrorResponseWithDetails(w, r, http.StatusConflict, utils.ErrCodeUploadRange, err.Error(), map[string]interface{}{"received": rangeErr.Received})
+	case errors.Is(err, utils.ErrUploadNotFound):
+		sendErrorResponse(w, r, http.StatusNotFound, utils.ErrCodeNotFound, "Upload not found")
+	case errors.Is(err, utils.ErrUploadCompleted):
+		sendErrorResponse(w, r, http.StatusConflict, utils.ErrCodeInvalidRequest, "Upload already completed")
+	case errors.Is(err, utils.ErrUploadIncomplete):
+		sendErrorResponse(w, r, http.StatusConflict, utils.ErrCodeUploadIncomplete, "Upload is missing data")
+	case errors.Is(err, utils.ErrUploadTooLarge):
+		sendErrorResponse(w, r, http.StatusRequestEntityTooLarge, utils.ErrCodeImageTooLarge, err.Error())
+	default:
+		sendErrorResponse(w, r, http.StatusBadRequest, utils.ErrCodeInvalidRequest, err.Error())
+	}
+}
+
+// parseContentRange parses a "bytes start-end/total" header value. total is
+// 0 when given as "*", i.e. still unknown.
+func parseContentRange(header string) (start, end, total int64, err error) {
+	spec, ok := strings.CutPrefix(header, "bytes ")
+	if !ok {
+		return 0, 0, 0, errors.New(`expected "bytes start-end/total"`)
+	}
+	rangeSpec, totalSpec, ok := strings.Cut(spec, "/")
+	if !ok {
+		return 0, 0, 0, errors.New("missing total size")
+	}
+	startSpec, endSpec, ok := strings.Cut(rangeSpec, "-")
+	if !ok {
+		return 0, 0, 0, errors.New("missing byte range")
+	}
+
+	if start, err = strconv.ParseInt(startSpec, 10, 64); err != nil || start < 0 {
+		return 0, 0, 0, errors.New("invalid range start")
+	}
+	if end, err = strconv.ParseInt(endSpec, 10, 64); err != nil || end < start {
+		return 0, 0, 0, errors.New("invalid range end")
+	}
+	if totalSpec != "*" {
+		if total, err = strconv.ParseInt(totalSpec, 10, 64); err != nil || total <= end {
+			return 0, 0, 0, errors.New("invalid total size")
+		}
+	}
+	return start, end, total, nil
+}
@@ -0,0 +1,131 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/lucasfepe/height-weight-api/internal/testutil"
+	"github.com/lucasfepe/height-weight-api/utils"
+)
+
+// initUpload starts a chunked upload in store and returns its ID
+func initUpload(t *testing.T, store *utils.ChunkedUploadStore) string {
+	t.Helper()
+	w, response := serve(t, NewInitUploadHandler(store), httptest.NewRequest(http.MethodPost, "/uploads/init", nil))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("init: got %d %s (%s), want 201", w.Code, response.ErrorCode, response.Message)
+	}
+	var upload utils.ChunkedUpload
+	if err := json.Unmarshal(response.Data, &upload); err != nil || upload.ID == "" {
+		t.Fatalf("decode init %s: %v", response.Data, err)
+	}
+	return upload.ID
+}
+
+// newChunkRequest builds a PATCH of data at offset start of an upload
+// declaring total bytes
+func newChunkRequest(id string, data []byte, start, total int) *http.Request {
+	r := httptest.NewRequest(http.MethodPatch, "/uploads/"+id, bytes.NewReader(data))
+	r.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, start+len(data)-1, total))
+	return withID(r, id)
+}
+
+// uploadInChunks sends data to a new upload in store in n chunks, completes
+// it and returns its image key
+func uploadInChunks(t *testing.T, store *utils.ChunkedUploadStore, data []byte, n int) string {
+	t.Helper()
+	id := initUpload(t, store)
+	appendChunk := NewAppendUploadHandler(store)
+	size := (len(data) + n - 1) / n
+	for start := 0; start < len(data); start += size {
+		end := min(start+size, len(data))
+		w, response := serve(t, appendChunk, newChunkRequest(id, data[start:end], start, len(data)))
+		if w.Code != http.StatusOK {
+			t.Fatalf("chunk at %d: got %d %s (%s), want 200", start, w.Code, response.ErrorCode, response.Message)
+		}
+	}
+
+	w, response := serve(t, NewCompleteUploadHandler(store), withID(httptest.NewRequest(http.MethodPost, "/uploads/"+id+"/complete", nil), id))
+	if w.Code != http.StatusOK {
+		t.Fatalf("complete: got %d %s (%s), want 200", w.Code, response.ErrorCode, response.Message)
+	}
+	var completed struct {
+		Key  string `json:"key"`
+		Size int    `json:"size"`
+	}
+	if err := json.Unmarshal(response.Data, &completed); err != nil {
+		t.Fatalf("decode complete: %v", err)
+	}
+	if completed.Size != len(data) {
+		t.Fatalf("completed size = %d, want %d", completed.Size, len(data))
+	}
+	return completed.Key
+}
+
+func TestChunkedUploadEstimate(t *testing.T) {
+	cfg := testutil.Config(t, nil)
+	store := utils.NewChunkedUploadStore(filepath.Join(cfg.UploadDir, "chunks"), cfg.MaxFileSize, time.Hour)
+	ml := &fakeMLService{weight: 70}
+	estimate := NewEstimateWeightHandler(cfg, nil, fakeMLClients(ml), utils.NewIdempotencyStore(0), nil, store)
+
+	front := noisyPNG(t, 64, 96, 1)
+	frontKey := uploadInChunks(t, store, front, 3)
+	sideKey := uploadInChunks(t, store, noisyPNG(t, 64, 96, 2), 3)
+
+	data, err := store.Read(frontKey, utils.UserID(context.Background()))
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if !bytes.Equal(data, front) {
+		t.Fatalf("assembled %d bytes differ from the %d uploaded", len(data), len(front))
+	}
+
+	fields := map[string]string{"height": "175", "front_image_key": frontKey, "side_image_key": sideKey}
+	w, response := serve(t, estimate, newMultipartRequest(t, "/estimate-weight", fields, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("estimate: got %d %s (%s), want 200", w.Code, response.ErrorCode, response.Message)
+	}
+	if calls := ml.calls.Load(); calls != 1 {
+		t.Errorf("ML service called %d times, want 1", calls)
+	}
+}
+
+func TestChunkedUploadRangeGap(t *testing.T) {
+	cfg := testutil.Config(t, nil)
+	store := utils.NewChunkedUploadStore(filepath.Join(cfg.UploadDir, "chunks"), cfg.MaxFileSize, time.Hour)
+	appendChunk := NewAppendUploadHandler(store)
+	data := bytes.Repeat([]byte{0xab}, 300)
+	id := initUpload(t, store)
+
+	if w, response := serve(t, appendChunk, newChunkRequest(id, data[:100], 0, len(data))); w.Code != http.StatusOK {
+		t.Fatalf("first chunk: got %d %s (%s), want 200", w.Code, response.ErrorCode, response.Message)
+	}
+
+	// Skipping bytes 100-199 must be refused with where to resume
+	w, response := serve(t, appendChunk, newChunkRequest(id, data[200:], 200, len(data)))
+	if w.Code != http.StatusConflict || response.ErrorCode != utils.ErrCodeUploadRange {
+		t.Fatalf("gap: got %d %s (%s), want 409 %s", w.Code, response.ErrorCode, response.Message, utils.ErrCodeUploadRange)
+	}
+	var details struct {
+		Received int64 `json:"received"`
+	}
+	if err := json.Unmarshal(response.Details, &details); err != nil {
+		t.Fatalf("decode details %s: %v", response.Details, err)
+	}
+	if details.Received != 100 {
+		t.Errorf("received = %d, want 100", details.Received)
+	}
+
+	// The upload can't be completed with the gap
+	w, response = serve(t, NewCompleteUploadHandler(store), withID(httptest.NewRequest(http.MethodPost, "/uploads/"+id+"/complete", nil), id))
+	if w.Code != http.StatusConflict || response.ErrorCode != utils.ErrCodeUploadIncomplete {
+		t.Errorf("complete: got %d %s (%s), want 409 %s", w.Code, response.ErrorCode, response.Message, utils.ErrCodeUploadIncomplete)
+	}
+}
@@ -0,0 +1,97 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/lucasfepe/height-weight-api/internal/testutil"
+	"github.com/lucasfepe/height-weight-api/utils"
+)
+
+func TestEstimateWeightErrorCodes(t *testing.T) {
+	cfg := testutil.Config(t, map[string]string{"MAX_FILE_SIZE_MB": "1"})
+	front, side := testPNG(t, 64, 96, 40), testPNG(t, 64, 96, 80)
+
+	tests := []struct {
+		name     string
+		fields   map[string]string
+		files    map[string][]byte
+		mlErr    error
+		wantCode int
+		wantErr  string
+	}{
+		{"missing front image", map[string]string{"height": "175"}, map[string][]byte{"side_image": side}, nil, http.StatusBadRequest, utils.ErrCodeMissingImage},
+		{"missing side image", map[string]string{"height": "175"}, map[string][]byte{"front_image": front}, nil, http.StatusBadRequest, utils.ErrCodeMissingImage},
+		{"invalid height", map[string]string{"height": "tall"}, map[string][]byte{"front_image": front, "side_image": side}, nil, http.StatusBadRequest, utils.ErrCodeInvalidHeight},
+		{"invalid callback URL", map[string]string{"height": "175", "callback_url": "not a url"}, map[string][]byte{"front_image": front, "side_image": side}, nil, http.StatusBadRequest, utils.ErrCodeInvalidCallbackURL},
+		{"unsupported format", map[string]string{"height": "175"}, map[string][]byte{"front_image": []byte("plain text, not an image"), "side_image": side}, nil, http.StatusBadRequest, utils.ErrCodeUnsupportedFormat},
+		{"unknown model", map[string]string{"height": "175", "model": "missing"}, map[string][]byte{"front_image": front, "side_image": side}, nil, http.StatusBadRequest, utils.ErrCodeInvalidModel},
+		{"circuit open", map[string]string{"height": "175"}, map[string][]byte{"front_image": front, "side_image": side}, utils.ErrCircuitOpen, http.StatusServiceUnavailable, utils.ErrCodeMLUnavailable},
+		{"ML service busy", map[string]string{"height": "175"}, map[string][]byte{"front_image": front, "side_image": side}, utils.ErrMLBusy, http.StatusServiceUnavailable, utils.ErrCodeMLUnavailable},
+		{"no person detected", map[string]string{"height": "175"}, map[string][]byte{"front_image": front, "side_image": side}, utils.ErrNoPersonDetected, http.StatusUnprocessableEntity, utils.ErrCodeNoPersonDetected},
+		{"ML failure", map[string]string{"height": "175"}, map[string][]byte{"front_image": front, "side_image": side}, errors.New("model crashed"), http.StatusInternalServerError, utils.ErrCodeMLError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ml := &fakeMLService{weight: 70, err: tt.mlErr}
+			handler := NewEstimateWeightHandler(cfg, nil, fakeMLClients(ml), utils.NewIdempotencyStore(0), nil, nil)
+
+			w, response := serve(t, handler, newMultipartRequest(t, "/estimate-weight", tt.fields, tt.files))
+			if w.Code != tt.wantCode || response.ErrorCode != tt.wantErr {
+				t.Errorf("got %d %s (%s), want %d %s", w.Code, response.ErrorCode, response.Message, tt.wantCode, tt.wantErr)
+			}
+			if response.Success {
+				t.Error("success = true, want false")
+			}
+		})
+	}
+}
+
+func TestEstimateWeightJSONImageTooLarge(t *testing.T) {
+	cfg := testutil.Config(t, map[string]string{"MAX_FILE_SIZE_MB": "1"})
+	handler := NewEstimateWeightHandler(cfg, nil, fakeMLClients(&fakeMLService{weight: 70}), utils.NewIdempotencyStore(0), nil, nil)
+
+	r := newJSONRequest(t, "/estimate-weight", map[string]interface{}{
+		"height":      175,
+		"front_image": base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 2<<20)),
+		"side_image":  base64.StdEncoding.EncodeToString(testPNG(t, 64, 96, 80)),
+	})
+	w, response := serve(t, handler, r)
+	if w.Code != http.StatusBadRequest || response.ErrorCode != utils.ErrCodeImageTooLarge {
+		t.Errorf("got %d %s (%s), want 400 %s", w.Code, response.ErrorCode, response.Message, utils.ErrCodeImageTooLarge)
+	}
+}
+
+func TestGetWeightEstimationErrorCodes(t *testing.T) {
+	t.Run("no database", func(t *testing.T) {
+		r := mux.SetURLVars(newJSONRequest(t, "/estimate/abc", nil), map[string]string{"id": "abc"})
+		w, response := serve(t, http.HandlerFunc(GetWeightEstimation), r)
+		if w.Code != http.StatusInternalServerError || response.ErrorCode != utils.ErrCodeDatabaseError {
+			t.Errorf("got %d %s, want 500 %s", w.Code, response.ErrorCode, utils.ErrCodeDatabaseError)
+		}
+	})
+
+	testDatabase(t, nil)
+	tests := []struct {
+		name     string
+		id       string
+		wantCode int
+		wantErr  string
+	}{
+		{"malformed ID", "not-an-object-id", http.StatusBadRequest, utils.ErrCodeInvalidID},
+		{"unknown ID", "000000000000000000000000", http.StatusNotFound, utils.ErrCodeNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := mux.SetURLVars(newJSONRequest(t, "/estimate/"+tt.id, nil), map[string]string{"id": tt.id})
+			w, response := serve(t, http.HandlerFunc(GetWeightEstimation), r)
+			if w.Code != tt.wantCode || response.ErrorCode != tt.wantErr {
+				t.Errorf("got %d %s (%s), want %d %s", w.Code, response.ErrorCode, response.Message, tt.wantCode, tt.wantErr)
+			}
+		})
+	}
+}
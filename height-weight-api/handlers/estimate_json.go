@@ -0,0 +1,149 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/lucasfepe/height-weight-api/config"
+	"github.com/lucasfepe/height-weight-api/utils"
+)
+
+// cmPerInch converts imperial heights to the centimeters the model expects
+const cmPerInch = 2.54
+
+// estimateJSONRequest is a weight estimation request with base64 images, for
+// clients that can't easily build multipart bodies
+type estimateJSONRequest struct {
+	Height         *float64 `json:"height"`
+	Unit           string   `json:"unit"`             // "metric" (cm, the default) or "imperial" (inches)
+	FrontImage     string   `json:"front_image"`      // Base64 encoded
+	SideImage      string   `json:"side_image"`       // Base64 encoded; at least one side image is required
+	SideImageLeft  string   `json:"side_image_left"`  // Base64 encoded
+	SideImageRight string   `json:"side_image_right"` // Base64 encoded
+	CallbackURL    string   `json:"callback_url"`
+	Model          string   `json:"model"`
+	ValidateOnly   bool     `json:"validate_only"`
+}
+
+// isJSONRequest reports whether r declares a JSON body
+func isJSONRequest(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == "application/json"
+}
+
+// readEstimateJSON reads and validates a JSON weight estimation request,
+// decoding its base64 images. On failure it sends an error response and
+// returns false.
+func readEstimateJSON(w http.ResponseWriter, r *http.Request, cfg *config.Config) (*estimateInput, bool) {
+	var req estimateJSONRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		status, errCode := formError(err)
+		sendErrorResponse(w, r, status, errCode, "Failed to parse JSON body: "+err.Error())
+		return nil, false
+	}
+
+	// A slow upload may have used up the request timeout, which has already responded
+	if r.Context().Err() != nil {
+		return nil, false
+	}
+
+	// Report every invalid field at once rather than one per attempt
+	var errs []FieldError
+	if req.Height == nil {
+		errs = append(errs, FieldError{Field: "height", Message: "Height is required", ErrorCode: utils.ErrCodeInvalidHeight})
+	}
+	if req.Unit != "" && req.Unit != "metric" && req.Unit != "imperial" {
+		errs = append(errs, FieldError{Field: "unit", Message: "Unit must be metric or imperial", ErrorCode: utils.ErrCodeInvalidRequest})
+	}
+	var height float64
+	if req.Height != nil {
+		height = *req.Height
+		if req.Unit == "imperial" {
+			height *= cmPerInch
+		}
+		errs = validateHeight(cfg, height, errs)
+	}
+
+	frontData, errs := decodeImageField(cfg, req.FrontImage, "front_image", "Front", errs)
+
+	// Side images are decoded in the order of utils.SideViews
+	var sideData [][]byte
+	var sideViews []string
+	for i, value := range []string{req.SideImage, req.SideImageLeft, req.SideImageRight} {
+		if value == "" {
+			continue
+		}
+		view := utils.SideViews[i]
+		var data []byte
+		data, errs = decodeImageField(cfg, value, view, sideViewLabels[view], errs)
+		sideData = append(sideData, data)
+		sideViews = append(sideViews, view)
+	}
+	if len(sideViews) == 0 {
+		errs = append(errs, FieldError{Field: utils.SideViewSingle, Message: "At least one of " + strings.Join(utils.SideViews, ", ") + " is required", ErrorCode: utils.ErrCodeMissingImage})
+	}
+
+	if req.CallbackURL != "" {
+		if err := utils.ValidateCallbackURL(req.CallbackURL); err != nil {
+			errs = append(errs, FieldError{Field: "callback_url", Message: "Invalid callback URL: " + err.Error(), ErrorCode: utils.ErrCodeInvalidCallbackURL})
+		}
+	}
+
+	if len(errs) > 0 {
+		sendValidationErrors(w, r, errs)
+		return nil, false
+	}
+
+	// Without file names only the content decides the type and extension
+	front := memoryFile{bytes.NewReader(frontData)}
+	frontExt, ok := checkImageType(w, r, cfg, front, "", "Front")
+	if !ok {
+		return nil, false
+	}
+	sides := make([]*sideImage, len(sideViews))
+	for i, view := range sideViews {
+		side := memoryFile{bytes.NewReader(sideData[i])}
+		sideExt, ok := checkImageType(w, r, cfg, side, "", sideViewLabels[view])
+		if !ok {
+			return nil, false
+		}
+		sides[i] = &sideImage{View: view, File: side, Name: imageViewName(view) + sideExt}
+	}
+
+	return &estimateInput{
+		Height:       height,
+		Front:        front,
+		FrontName:    "front" + frontExt,
+		Sides:        sides,
+		CallbackURL:  req.CallbackURL,
+		Model:        req.Model,
+		ValidateOnly: req.ValidateOnly,
+	}, true
+}
+
+// decodeImageField decodes the base64 image of a JSON field, rejecting
+// images over the maximum file size before decoding them. Problems are
+// appended to errs.
+func decodeImageField(cfg *config.Config, value, field, label string, errs []FieldError) ([]byte, []FieldError) {
+	if value == "" {
+		return nil, append(errs, FieldError{Field: field, Message: label + " image is required", ErrorCode: utils.ErrCodeMissingImage})
+	}
+	if int64(base64.StdEncoding.DecodedLen(len(value))) > cfg.MaxFileSize+2 {
+		return nil, append(errs, FieldError{Field: field, Message: fmt.Sprintf("%s image too large. Max size: %d bytes", label, cfg.MaxFileSize), ErrorCode: utils.ErrCodeImageTooLarge})
+	}
+
+	data, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return nil, append(errs, FieldError{Field: field, Message: label + " image is not valid base64: " + err.Error(), ErrorCode: utils.ErrCodeInvalidImage})
+	}
+	// DecodedLen counts padding, so check the exact size too
+	if int64(len(data)) > cfg.MaxFileSize {
+		return nil, append(errs, FieldError{Field: field, Message: fmt.Sprintf("%s image too large. Max size: %d bytes", label, cfg.MaxFileSize), ErrorCode: utils.ErrCodeImageTooLarge})
+	}
+	return data, errs
+}
@@ -0,0 +1,80 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/lucasfepe/height-weight-api/internal/testutil"
+	"github.com/lucasfepe/height-weight-api/utils"
+)
+
+func TestEstimateWeightJSON(t *testing.T) {
+	cfg := testutil.Config(t, nil)
+	front := base64.StdEncoding.EncodeToString(testPNG(t, 64, 96, 40))
+	side := base64.StdEncoding.EncodeToString(testPNG(t, 64, 96, 80))
+
+	tests := []struct {
+		name string
+		body map[string]interface{}
+	}{
+		{"metric", map[string]interface{}{"height": 175, "front_image": front, "side_image": side}},
+		{"imperial", map[string]interface{}{"height": 69, "unit": "imperial", "front_image": front, "side_image": side}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ml := &fakeMLService{weight: 70}
+			handler := NewEstimateWeightHandler(cfg, nil, fakeMLClients(ml), utils.NewIdempotencyStore(0), nil, nil)
+
+			w, response := serve(t, handler, newJSONRequest(t, "/estimate-weight", tt.body))
+			if w.Code != http.StatusOK {
+				t.Fatalf("got %d %s (%s), want 200", w.Code, response.ErrorCode, response.Message)
+			}
+			var data struct {
+				Weight float64 `json:"weight"`
+			}
+			if err := json.Unmarshal(response.Data, &data); err != nil {
+				t.Fatalf("decode data: %v", err)
+			}
+			if data.Weight != 70 {
+				t.Errorf("weight = %v, want 70", data.Weight)
+			}
+			if calls := ml.calls.Load(); calls != 1 {
+				t.Errorf("ML service called %d times, want 1", calls)
+			}
+		})
+	}
+}
+
+func TestEstimateWeightJSONInvalidImages(t *testing.T) {
+	cfg := testutil.Config(t, map[string]string{"MAX_FILE_SIZE_MB": "1"})
+	side := base64.StdEncoding.EncodeToString(testPNG(t, 64, 96, 80))
+
+	tests := []struct {
+		name     string
+		front    string
+		wantCode string
+	}{
+		// One byte past the limit gets past the padded length estimate and is caught decoded
+		{"one byte too large", base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, int(cfg.MaxFileSize)+1)), utils.ErrCodeImageTooLarge},
+		{"not base64", "not base64!", utils.ErrCodeInvalidImage},
+		{"missing", "", utils.ErrCodeMissingImage},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ml := &fakeMLService{weight: 70}
+			handler := NewEstimateWeightHandler(cfg, nil, fakeMLClients(ml), utils.NewIdempotencyStore(0), nil, nil)
+
+			body := map[string]interface{}{"height": 175, "front_image": tt.front, "side_image": side}
+			w, response := serve(t, handler, newJSONRequest(t, "/estimate-weight", body))
+			if w.Code != http.StatusBadRequest || response.ErrorCode != tt.wantCode {
+				t.Errorf("got %d %s (%s), want 400 %s", w.Code, response.ErrorCode, response.Message, tt.wantCode)
+			}
+			if calls := ml.calls.Load(); calls != 0 {
+				t.Errorf("ML service called %d times, want 0", calls)
+			}
+		})
+	}
+}
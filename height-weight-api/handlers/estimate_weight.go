@@ -1,149 +1,1070 @@
 package handlers
 
 import (
-	"encoding/json"
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"log"
+	"math"
+	"mime/multipart"
 	"net/http"
 	"os"
 	"path/filepath"
+	"slices"
 	"strconv"
+	"strings"
 	"time"
 
+	"github.com/gorilla/mux"
+	"github.com/lucasfepe/height-weight-api/config"
+	"github.com/lucasfepe/height-weight-api/jobs"
 	"github.com/lucasfepe/height-weight-api/models"
 	"github.com/lucasfepe/height-weight-api/utils"
+	"go.mongodb.org/mongo-driver/mongo"
 )
 
-// Response represents the standard API response format
-type Response struct {
-	Success bool        `json:"success"`
-	Data    interface{} `json:"data,omitempty"`
-	Message string      `json:"message,omitempty"`
+// fallbackModel is the model version recorded for heuristic fallback
+// estimates, and their prediction mode
+const fallbackModel = "fallback"
+
+// predictionModeHeader tells clients whether a prediction came from the ML
+// model, the DEV_MODE mock or the fallback heuristic
+const predictionModeHeader = "X-Prediction-Mode"
+
+// setPredictionMode sets the prediction mode header of a response
+func setPredictionMode(w http.ResponseWriter, mode string) {
+	w.Header().Set(predictionModeHeader, mode)
+}
+
+// errHeightMismatch is returned when the model's predicted height is too far
+// from the height the user reported
+var errHeightMismatch = errors.New("predicted height differs too much from the reported height")
+
+// busyRetryAfter is the Retry-After, in seconds, of estimations turned away
+// because too many are in flight
+const busyRetryAfter = 5
+
+// errEstimationNotSaved is returned when an estimation that must be recorded
+// couldn't be saved
+var errEstimationNotSaved = errors.New("failed to save estimation")
+
+// Response represents the standard API response format, shared with utils
+// so the two can't drift apart
+type Response = utils.Response
+
+// NewEstimateWeightHandler creates a handler for weight estimation based on front image, side images, and height.
+// The side images are a single side_image and/or side_image_left and side_image_right profiles.
+// With ?async=true the prediction runs on the job queue and the handler responds with a job ID.
+// Requests repeating an Idempotency-Key get the first successful response replayed.
+// Images uploaded directly to S3 or in chunks are referenced by front_image_key and side_image_key.
+func NewEstimateWeightHandler(cfg *config.Config, queue *jobs.Queue, ml *utils.MLClients, idempotency *utils.IdempotencyStore, store *utils.S3Client, chunks *utils.ChunkedUploadStore) http.HandlerFunc {
+	// Identical submissions still being estimated, which the database can't see yet
+	inFlight := utils.NewIdempotencyStore(cfg.DuplicateWindow)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Turn clients away before reading their images when the ML service can't keep up
+		if !checkInFlight(w, r, cfg, queue) {
+			return
+		}
+
+		// Mobile clients retry on flaky networks; don't run the same estimation twice
+		if key := r.Header.Get(utils.IdempotencyKeyHeader); key != "" {
+			// Keys are per user so clients can't collide with each other, and per
+			// format so a replay matches the Accept header it answers
+			key = utils.UserID(r.Context()) + ":" + utils.ResponseContentType(r) + ":" + key
+
+			stored, reserved := idempotency.Reserve(key)
+			if !reserved {
+				if stored == nil {
+					sendErrorResponse(w, r, http.StatusConflict, utils.ErrCodeRequestInProgress, "A request with this Idempotency-Key is still in progress")
+					return
+				}
+				w.Header().Set("Content-Type", stored.ContentType)
+				w.Header().Set(utils.IdempotentReplayHeader, "true")
+				w.WriteHeader(stored.Status)
+				w.Write(stored.Body)
+				return
+			}
+
+			// Only successful responses are kept, so failed requests can be retried.
+			// A timed out request never reached the client, whatever it recorded.
+			recorder := utils.NewResponseRecorder(w)
+			w = recorder
+			defer func() {
+				if rec := recover(); rec != nil {
+					idempotency.Release(key)
+					panic(rec)
+				}
+				if response := recorder.Response(); response.Status < 300 && r.Context().Err() == nil {
+					idempotency.Complete(key, response)
+				} else {
+					idempotency.Release(key)
+				}
+			}()
+		}
+
+		// Clients that can't build multipart bodies send base64 images in JSON
+		var in *estimateInput
+		var ok bool
+		if isJSONRequest(r) {
+			in, ok = readEstimateJSON(w, r, cfg)
+		} else {
+			// Spilled parts are written to temp files, which must not outlive the request
+			defer removeMultipartFiles(r)
+			in, ok = readEstimateForm(w, r, cfg, store, chunks)
+		}
+		if !ok {
+			return
+		}
+		defer in.Front.Close()
+		for _, side := range in.Sides {
+			defer side.File.Close()
+		}
+		// The same photo for two views silently produces a bad estimate
+		for _, side := range in.Sides {
+			if !rejectIdenticalImages(w, r, in.Front, side.File) {
+				return
+			}
+		}
+		if !rejectIdenticalSides(w, r, in.Sides) {
+			return
+		}
+
+		// Phone photos are often stored sideways with an EXIF rotation hint
+		frontData, ok := autoOrientImage(w, r, in.Front, "front")
+		if !ok {
+			return
+		}
+		sideData := make([][]byte, len(in.Sides))
+		for i, side := range in.Sides {
+			if side.Data, ok = autoOrientImage(w, r, side.File, strings.ToLower(sideViewLabels[side.View])); !ok {
+				return
+			}
+			sideData[i] = side.Data
+		}
+
+		// Blurry or dark photos aren't worth an inference
+		if !checkImageQuality(w, r, cfg, frontData, in.Sides) {
+			return
+		}
+
+		// A dry run stops after validation, before any files are saved or the ML service is called
+		if in.ValidateOnly {
+			if _, _, err := ml.Resolve(in.Model); err != nil {
+				sendErrorResponse(w, r, http.StatusBadRequest, utils.ErrCodeInvalidModel, "Invalid model: "+err.Error())
+				return
+			}
+
+			response := Response{
+				Success: true,
+				Data:    map[string]interface{}{"valid": true},
+				Message: "Request is valid",
+			}
+
+			utils.Respond(w, r, http.StatusOK, response)
+			return
+		}
+
+		// A double-tapped submit returns the first estimation instead of creating another
+		imageHash := utils.ImageSetHash(frontData, sideData...)
+		duplicateKey, queued := "", false
+		if cfg.DuplicateWindow > 0 && models.DB != nil {
+			duplicateKey = fmt.Sprintf("%s:%s:%g", utils.UserID(r.Context()), imageHash, in.Height)
+			if _, reserved := inFlight.Reserve(duplicateKey); !reserved {
+				sendErrorResponse(w, r, http.StatusConflict, utils.ErrCodeRequestInProgress, "An identical estimation is still in progress")
+				return
+			}
+			// A queued estimation holds the key until its job finishes
+			defer func() {
+				if !queued {
+					inFlight.Release(duplicateKey)
+				}
+			}()
+
+			duplicate, err := models.FindRecentDuplicate(utils.UserID(r.Context()), imageHash, in.Height, time.Now().Add(-cfg.DuplicateWindow))
+			if err != nil {
+				sendErrorResponse(w, r, http.StatusInternalServerError, utils.ErrCodeDatabaseError, "Failed to check for duplicate estimations: "+err.Error())
+				return
+			}
+			if duplicate != nil {
+				result := duplicateResult(duplicate)
+				setPredictionMode(w, result["mode"].(string))
+
+				response := Response{
+					Success: true,
+					Data:    result,
+					Message: "Identical to a recent estimation",
+				}
+
+				utils.Respond(w, r, http.StatusOK, response)
+				return
+			}
+		}
+
+		// Remove the saved images again if the request fails before they're used
+		files := &utils.TempFileSet{}
+		defer files.Cleanup()
+
+		frontFilepath, sides, ok := saveEstimationImages(w, r, cfg, files, frontData, in.FrontName, in.Sides)
+		if !ok {
+			return
+		}
+
+		req := estimateRequest{
+			FrontImgPath: frontFilepath,
+			Sides:        sides,
+			ImageHash:    imageHash,
+			Height:       in.Height,
+			Model:        in.Model,
+			UserID:       utils.UserID(r.Context()),
+		}
+		if cfg.StoreCompressed {
+			req.FrontData, req.SideData = frontData, sideData
+		}
+
+		// In async mode queue the prediction and let the client poll for the result
+		if r.URL.Query().Get("async") == "true" {
+			if _, _, err := ml.Resolve(in.Model); err != nil {
+				sendErrorResponse(w, r, http.StatusBadRequest, utils.ErrCodeInvalidModel, "Invalid model: "+err.Error())
+				return
+			}
+
+			// The job reads the images later, and removes them if it fails
+			jobFiles := files.Handoff()
+			job, err := queue.Submit(req.UserID, func(ctx context.Context, jobID string) (interface{}, error) {
+				defer jobFiles.Cleanup()
+				if duplicateKey != "" {
+					defer inFlight.Release(duplicateKey)
+				}
+				result, _, err := runEstimation(ctx, cfg, ml, req)
+				if err != nil {
+					return nil, err
+				}
+				jobFiles.Keep()
+				if in.CallbackURL != "" {
+					notifyWebhook(in.CallbackURL, cfg.WebhookSecret, jobID, result)
+				}
+				return result, nil
+			})
+			if err != nil {
+				jobFiles.Cleanup() // The job never runs
+				sendErrorResponse(w, r, http.StatusServiceUnavailable, utils.ErrCodeQueueFull, "Failed to queue estimation: "+err.Error())
+				return
+			}
+			queued = true
+
+			response := Response{
+				Success: true,
+				Data: map[string]interface{}{
+					"job_id": job.ID,
+					"status": job.Status,
+				},
+				Message: "Weight estimation queued",
+			}
+
+			utils.Respond(w, r, http.StatusAccepted, response)
+			return
+		}
+
+		result, _, err := runEstimation(r.Context(), cfg, ml, req)
+		if err != nil {
+			sendPredictionError(w, r, err)
+			return
+		}
+		files.Keep()
+		setPredictionMode(w, result["mode"].(string))
+
+		if in.CallbackURL != "" {
+			go notifyWebhook(in.CallbackURL, cfg.WebhookSecret, "", result)
+		}
+
+		// Return the estimated weight
+		response := Response{
+			Success: true,
+			Data:    result,
+			Message: "Weight estimated successfully",
+		}
+
+		// Send response
+		utils.Respond(w, r, http.StatusOK, response)
+	}
 }
 
-// EstimateWeight handles the weight estimation based on front image, side image, and height
-func EstimateWeight(w http.ResponseWriter, r *http.Request) {
-	// Set content type
-	w.Header().Set("Content-Type", "application/json")
+// estimateInput holds the fields of a weight estimation request, read from
+// a multipart form or a JSON body
+type estimateInput struct {
+	Height       float64 // In cm
+	Front        multipart.File
+	FrontName    string       // File name to save the front image under
+	Sides        []*sideImage // At least one, in the order of utils.SideViews
+	CallbackURL  string
+	Model        string
+	ValidateOnly bool
+}
 
+// readEstimateForm reads and validates a multipart weight estimation request.
+// The images come as file parts or as keys of direct or chunked uploads. On
+// failure it sends an error response and returns false.
+func readEstimateForm(w http.ResponseWriter, r *http.Request, cfg *config.Config, store *utils.S3Client, chunks *utils.ChunkedUploadStore) (*estimateInput, bool) {
 	// Parse the multipart form
-	if err := r.ParseMultipartForm(32 << 20); err != nil { // 32MB max memory
-		sendErrorResponse(w, http.StatusBadRequest, "Failed to parse form: "+err.Error())
-		return
+	if err := r.ParseMultipartForm(cfg.MultipartMemory); err != nil {
+		status, errCode := formError(err)
+		sendErrorResponse(w, r, status, errCode, "Failed to parse form: "+err.Error())
+		return nil, false
 	}
 
-	// Get height from form
-	heightStr := r.FormValue("height")
-	if heightStr == "" {
-		sendErrorResponse(w, http.StatusBadRequest, "Height is required")
-		return
+	// A slow upload may have used up the request timeout, which has already responded
+	if r.Context().Err() != nil {
+		return nil, false
+	}
+
+	// Reject stray attachments before touching the images
+	if !checkUploadLimits(w, r, cfg) {
+		return nil, false
 	}
 
-	height, err := strconv.ParseFloat(heightStr, 64)
+	// Report every invalid field at once rather than one per attempt
+	if errs := validateEstimateRequest(r, cfg, utils.SideViews); len(errs) > 0 {
+		sendValidationErrors(w, r, errs)
+		return nil, false
+	}
+
+	// Already validated
+	height, _ := strconv.ParseFloat(r.FormValue("height"), 64)
+
+	// Get front image from form, or from a direct or chunked upload
+	frontFile, frontName, ok := formImage(w, r, cfg, store, chunks, "front_image", "Front")
+	if !ok {
+		return nil, false
+	}
+
+	// Get each side image sent from form, or from a direct or chunked upload
+	var sides []*sideImage
+	for _, view := range utils.SideViews {
+		if !hasFormImage(r, view) {
+			continue
+		}
+		sideFile, sideName, ok := formImage(w, r, cfg, store, chunks, view, sideViewLabels[view])
+		if !ok {
+			frontFile.Close()
+			for _, side := range sides {
+				side.File.Close()
+			}
+			return nil, false
+		}
+		sides = append(sides, &sideImage{View: view, File: sideFile, Name: sideName})
+	}
+
+	return &estimateInput{
+		Height:       height,
+		Front:        frontFile,
+		FrontName:    frontName,
+		Sides:        sides,
+		CallbackURL:  r.FormValue("callback_url"),
+		Model:        r.FormValue("model"),
+		ValidateOnly: r.FormValue("validate_only") == "true",
+	}, true
+}
+
+// estimationUploadDir returns where estimation images are stored
+func estimationUploadDir(cfg *config.Config) string {
+	return filepath.Join(cfg.UploadDir, cfg.EstimationSubdir)
+}
+
+// sideImage is a side photo of an estimation request as it is processed
+type sideImage struct {
+	View string         // One of utils.SideViews
+	File multipart.File // Upload
+	Name string         // File name to save the image under
+	Data []byte         // Upright image, once read
+}
+
+// saveEstimationImages saves the front and side images of an estimation to
+// the estimation upload directory and adds them to files. It returns the
+// front image path and the saved side images. It writes an error response
+// and returns false on failure.
+func saveEstimationImages(w http.ResponseWriter, r *http.Request, cfg *config.Config, files *utils.TempFileSet, frontData []byte, frontName string, sides []*sideImage) (string, []models.SideImage, bool) {
+	// Create timestamp for unique filenames
+	now := time.Now()
+	timestamp := now.UnixNano()
+
+	// Create uploads directory if it doesn't exist
+	uploadDir := estimationUploadDir(cfg)
+	if cfg.DatedUploads {
+		uploadDir = utils.DatedUploadPath(uploadDir, now)
+	}
+	if err := os.MkdirAll(uploadDir, 0755); err != nil {
+		sendErrorResponse(w, r, http.StatusInternalServerError, utils.ErrCodeStorageError, "Failed to create uploads directory: "+err.Error())
+		return "", nil, false
+	}
+
+	// Optionally store smaller copies; the ML service gets the originals via estimateRequest
+	if cfg.StoreCompressed {
+		frontData, frontName = compressForStorage(cfg, frontData, frontName)
+	}
+
+	// Save front image
+	frontFilename := fmt.Sprintf("%d_%s", timestamp, utils.SafeFilename(frontName))
+	frontFilepath := filepath.Join(uploadDir, frontFilename)
+	if err := files.WriteFile(frontFilepath, frontData, 0644); err != nil {
+		sendErrorResponse(w, r, http.StatusInternalServerError, utils.ErrCodeStorageError, "Failed to save front image: "+err.Error())
+		return "", nil, false
+	}
+
+	// Save side images, named by view since clients often send the same file name
+	saved := make([]models.SideImage, 0, len(sides))
+	for _, side := range sides {
+		sideData, sideName := side.Data, side.Name
+		if cfg.StoreCompressed {
+			sideData, sideName = compressForStorage(cfg, sideData, sideName)
+		}
+		sideFilename := fmt.Sprintf("%d_%s_%s", timestamp, imageViewName(side.View), utils.SafeFilename(sideName))
+		sideFilepath := filepath.Join(uploadDir, sideFilename)
+		if err := files.WriteFile(sideFilepath, sideData, 0644); err != nil {
+			sendErrorResponse(w, r, http.StatusInternalServerError, utils.ErrCodeStorageError, "Failed to save "+strings.ToLower(sideViewLabels[side.View])+" image: "+err.Error())
+			return "", nil, false
+		}
+		saved = append(saved, models.SideImage{View: side.View, Path: sideFilepath})
+	}
+	return frontFilepath, saved, true
+}
+
+// compressForStorage returns the re-encoded JPEG of an image to store in
+// place of the upload, named with a .jpg extension, when it is smaller. Other
+// images are returned unchanged.
+func compressForStorage(cfg *config.Config, data []byte, name string) ([]byte, string) {
+	compressed, err := utils.CompressImage(bytes.NewReader(data), cfg.CompressMaxDim, cfg.CompressQuality)
 	if err != nil {
-		sendErrorResponse(w, http.StatusBadRequest, "Invalid height value: "+err.Error())
+		log.Printf("Warning: Storing %s uncompressed: %v", name, err)
+		return data, name
+	}
+	if len(compressed) >= len(data) {
+		return data, name
+	}
+	return compressed, strings.TrimSuffix(name, filepath.Ext(name)) + ".jpg"
+}
+
+// duplicateResult describes a stored estimation returned for an identical
+// submission, in the shape of a fresh estimation result
+func duplicateResult(estimation *models.WeightEstimation) map[string]interface{} {
+	result := estimationResult(estimation, weightPercentile(estimation.Height, estimation.Weight, estimation.Degraded), true)
+	result["duplicate"] = true
+	return result
+}
+
+// estimationResult describes an estimation as the response data of an
+// estimate request. Only a persisted estimation has an ID and image links.
+func estimationResult(estimation *models.WeightEstimation, percentile *float64, persisted bool) map[string]interface{} {
+	result := map[string]interface{}{
+		"weight":     round(estimation.Weight),
+		"model":      estimation.ModelVersion,
+		"mode":       predictionMode(estimation),
+		"percentile": percentile, // null until enough similar estimations exist
+		"persisted":  persisted,
+	}
+	if persisted {
+		id := estimation.ID.Hex()
+		result["id"] = id
+		if estimation.FrontImgPath != "" {
+			result["image_urls"] = imageURLs(id, estimation.Sides())
+		}
+	}
+	if estimation.PredictedHeight > 0 {
+		result["predicted_height"] = round(estimation.PredictedHeight)
+	}
+	if estimation.BMI > 0 {
+		result["bmi"] = round(estimation.BMI)
+	}
+	if len(estimation.Measurements) > 0 {
+		result["measurements"] = estimation.Measurements
+	}
+	if estimation.InferenceMs > 0 {
+		result["inference_ms"] = estimation.InferenceMs
+	}
+	if estimation.Degraded {
+		result["degraded"] = true
+	}
+	return result
+}
+
+// predictionMode returns what made an estimation's prediction. Records made
+// before the mode was stored were either fallbacks or model predictions.
+func predictionMode(estimation *models.WeightEstimation) string {
+	switch {
+	case estimation.PredictionMode != "":
+		return estimation.PredictionMode
+	case estimation.Degraded:
+		return fallbackModel
+	default:
+		return utils.PredictionModeModel
+	}
+}
+
+// weightPercentile places weight among the stored estimations of similar
+// heights, returning nil while too few exist, for degraded estimates, or
+// without a database
+func weightPercentile(height, weight float64, degraded bool) *float64 {
+	if models.DB == nil || degraded {
+		return nil
+	}
+	value, err := models.WeightPercentile(height, weight)
+	if err != nil {
+		if !errors.Is(err, models.ErrTooFewSamples) {
+			log.Printf("Failed to compute weight percentile: %v", err)
+		}
+		return nil
+	}
+	value = math.Round(value*10) / 10
+	return &value
+}
+
+// estimateRequest holds the inputs of a weight estimation once its images are saved
+type estimateRequest struct {
+	FrontImgPath string
+	Sides        []models.SideImage // Saved side images
+	ImageHash    string
+	Height       float64
+	Model        string
+	UserID       string   // Owner of the estimation, empty when authentication is disabled
+	ActualWeight *float64 // Measured weight of a labeled estimation, nil otherwise
+	SubmissionID string   // Links a labeled estimation to its training record
+	FrontData    []byte   // Uploaded front image when the stored file is compressed, nil to read the file
+	SideData     [][]byte // Uploaded side images in the order of Sides when the stored files are compressed, nil to read the files
+	// Save records the estimation in place of SaveWeightEstimation, failing the
+	// request when it errors instead of only logging it
+	Save func(estimation *models.WeightEstimation) error
+}
+
+// runEstimation predicts the weight for saved images and records the estimation.
+// It is shared by the synchronous and async paths, and returns the response
+// data together with the record, which keeps the unrounded prediction.
+func runEstimation(ctx context.Context, cfg *config.Config, ml *utils.MLClients, req estimateRequest) (map[string]interface{}, *models.WeightEstimation, error) {
+	// A queued job may only start once shutdown has given up on it
+	if err := ctx.Err(); err != nil {
+		return nil, nil, fmt.Errorf("estimation cancelled before starting: %w", err)
+	}
+
+	model, service, err := ml.Resolve(req.Model)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	front, frontSize, closeFront, err := originalImage(req.FrontImgPath, req.FrontData)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open front image: %w", err)
+	}
+	defer closeFront()
+
+	sides := make([]utils.SideImage, len(req.Sides))
+	var sideSize int64
+	for i, side := range req.Sides {
+		var data []byte
+		if req.SideData != nil {
+			data = req.SideData[i]
+		}
+		image, size, closeSide, err := originalImage(side.Path, data)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to open %s: %w", side.View, err)
+		}
+		defer closeSide()
+		sides[i] = utils.SideImage{View: side.View, Image: image}
+		sideSize += size
+	}
+
+	// Process images with the TensorFlow model
+	prediction, degraded, err := predictWeight(ctx, cfg, service, front, sides, req.Height, frontSize, sideSize)
+	if err != nil {
+		return nil, nil, err
+	}
+	if degraded {
+		model = fallbackModel
+	}
+
+	// Without image retention only the metadata, and which views were sent, outlives the inference
+	frontImgPath, sideImages := req.FrontImgPath, slices.Clone(req.Sides)
+	if !cfg.KeepEstimationImages {
+		if err := os.Remove(frontImgPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Printf("Warning: Failed to delete image file %s: %v", frontImgPath, err)
+		}
+		frontImgPath = ""
+		for i := range sideImages {
+			if err := os.Remove(sideImages[i].Path); err != nil && !errors.Is(err, os.ErrNotExist) {
+				log.Printf("Warning: Failed to delete image file %s: %v", sideImages[i].Path, err)
+			}
+			sideImages[i].Path = ""
+		}
+	}
+
+	// A predicted height far from the reported one hints at a bad photo or a typo
+	var warnings []string
+	if prediction.PredictedHeight > 0 {
+		divergence := math.Abs(prediction.PredictedHeight - req.Height)
+		if cfg.HeightRejectCM > 0 && divergence > cfg.HeightRejectCM {
+			return nil, nil, fmt.Errorf("%w: reported %.1f cm, predicted %.1f cm", errHeightMismatch, req.Height, prediction.PredictedHeight)
+		}
+		if divergence > cfg.HeightToleranceCM {
+			warnings = append(warnings, fmt.Sprintf(
+				"Predicted height %.1f cm differs from the reported %.1f cm; check the photos and the entered height",
+				prediction.PredictedHeight, req.Height))
+		}
+	}
+
+	// Compare against similar heights before this estimation joins the data
+	percentile := weightPercentile(req.Height, prediction.Weight, degraded)
+
+	// The single side path predates side views and holds the first one, if any
+	var sideImgPath string
+	if len(sideImages) > 0 {
+		sideImgPath = sideImages[0].Path
+	}
+
+	// Create a record of the estimation
+	estimation := &models.WeightEstimation{
+		UserID:          req.UserID,
+		Height:          req.Height,
+		Weight:          prediction.Weight,
+		PredictedHeight: prediction.PredictedHeight,
+		FrontImgPath:    frontImgPath,
+		SideImgPath:     sideImgPath,
+		SideImages:      sideImages,
+		ImageHash:       req.ImageHash,
+		Measurements:    prediction.Measurements,
+		ModelVersion:    model,
+		InferenceMs:     prediction.InferenceMs,
+		PredictionMode:  prediction.Mode,
+		Degraded:        degraded,
+		ActualWeight:    req.ActualWeight,
+		SubmissionID:    req.SubmissionID,
+		CreatedAt:       time.Now(),
+	}
+
+	// Nobody is waiting for the result once the client is gone, so don't record it
+	if err := ctx.Err(); err != nil {
+		return nil, nil, fmt.Errorf("estimation cancelled before saving: %w", err)
+	}
+
+	// Save the estimation record to database (if db is set up)
+	saved := false
+	if req.Save != nil {
+		if err := req.Save(estimation); err != nil {
+			return nil, nil, fmt.Errorf("%w: %w", errEstimationNotSaved, err)
+		}
+		saved = true
+	} else if models.DB != nil {
+		if err := models.SaveWeightEstimation(estimation); err != nil {
+			if cfg.RequireEstimationPersistence {
+				return nil, nil, fmt.Errorf("%w: %w", errEstimationNotSaved, err)
+			}
+			// Log the error but don't fail the request; persisted tells the client
+			log.Printf("Failed to save estimation to database: %v", err)
+		} else {
+			saved = true
+		}
+	} else if cfg.RequireEstimationPersistence {
+		return nil, nil, fmt.Errorf("%w: database not initialized", errEstimationNotSaved)
+	}
+
+	result := estimationResult(estimation, percentile, saved)
+	if len(warnings) > 0 {
+		result["warnings"] = warnings
+	}
+	return result, estimation, nil
+}
+
+// predictWeight runs a prediction on service, counted in utils.MLInFlight. When
+// it fails and cfg allows it, a heuristic estimate from the image sizes is
+// returned instead, reported as degraded. Photos without a person would get a
+// made-up weight, so they always fail.
+func predictWeight(ctx context.Context, cfg *config.Config, service utils.MLService, front io.Reader, sides []utils.SideImage, height float64, frontSize, sideSize int64) (*utils.ModelResponse, bool, error) {
+	utils.MLInFlight.Begin()
+	prediction, err := service.PredictWeight(ctx, front, sides, height)
+	utils.MLInFlight.Done()
+	if err == nil {
+		return prediction, false, nil
+	}
+
+	if !cfg.AllowFallbackEstimation || ctx.Err() != nil || errors.Is(err, utils.ErrNoPersonDetected) {
+		return nil, false, err
+	}
+	log.Printf("ML prediction failed, using fallback estimation: %v", err)
+	return &utils.ModelResponse{Weight: utils.HeuristicWeight(height, frontSize, sideSize), Mode: fallbackModel}, true, nil
+}
+
+// originalImage returns the image to send to the ML service and its size:
+// data when set, otherwise the saved file at path, which done closes
+func originalImage(path string, data []byte) (image io.Reader, size int64, done func() error, err error) {
+	if data != nil {
+		return bytes.NewReader(data), int64(len(data)), func() error { return nil }, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, 0, nil, err
+	}
+	return file, info.Size(), file.Close, nil
+}
+
+// notifyWebhook delivers a completed estimation to the client's callback URL
+func notifyWebhook(callbackURL, secret, jobID string, result interface{}) {
+	payload := map[string]interface{}{
+		"event":  "estimation.completed",
+		"result": result,
+	}
+	if jobID != "" {
+		payload["job_id"] = jobID
+	}
+
+	if err := utils.DeliverWebhook(callbackURL, payload, secret); err != nil {
+		log.Printf("Failed to deliver webhook to %s: %v", callbackURL, err)
+	}
+}
+
+// checkInFlight sends a 503 with a Retry-After header and returns false when
+// the estimations queued on queue, which may be nil, and those waiting on or
+// running an ML prediction reach the configured high-water mark
+func checkInFlight(w http.ResponseWriter, r *http.Request, cfg *config.Config, queue *jobs.Queue) bool {
+	if cfg.MaxInFlightEstimations <= 0 {
+		return true
+	}
+
+	depth := utils.MLInFlight.Count()
+	if queue != nil {
+		depth += int64(queue.Pending())
+	}
+	if depth < int64(cfg.MaxInFlightEstimations) {
+		return true
+	}
+
+	w.Header().Set("Retry-After", strconv.Itoa(busyRetryAfter))
+	sendErrorResponseWithDetails(w, r, http.StatusServiceUnavailable, utils.ErrCodeServerBusy, "Too many estimations in progress, retry later", map[string]interface{}{
+		"in_flight":       depth,
+		"high_water_mark": cfg.MaxInFlightEstimations,
+	})
+	return false
+}
+
+// sendPredictionError sends the error response for a failed prediction
+func sendPredictionError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, config.ErrUnknownMLModel):
+		sendErrorResponse(w, r, http.StatusBadRequest, utils.ErrCodeInvalidModel, "Invalid model: "+err.Error())
+	case errors.Is(err, utils.ErrCircuitOpen), errors.Is(err, utils.ErrMLBusy):
+		sendErrorResponse(w, r, http.StatusServiceUnavailable, utils.ErrCodeMLUnavailable, err.Error())
+	case errors.Is(err, errHeightMismatch):
+		sendErrorResponse(w, r, http.StatusUnprocessableEntity, utils.ErrCodeHeightMismatch, err.Error())
+	case errors.Is(err, utils.ErrNoPersonDetected):
+		sendErrorResponse(w, r, http.StatusUnprocessableEntity, utils.ErrCodeNoPersonDetected, "No person detected in the images; make sure the whole body is visible: "+err.Error())
+	case errors.Is(err, errEstimationNotSaved):
+		sendErrorResponse(w, r, http.StatusInternalServerError, utils.ErrCodeDatabaseError, "Weight was estimated but not stored: "+err.Error())
+	case r.Context().Err() != nil:
+		// The client has disconnected or the request timeout has already responded
+		log.Printf("Estimation abandoned: %v", err)
+	default:
+		sendErrorResponse(w, r, http.StatusInternalServerError, utils.ErrCodeMLError, "Failed to predict weight: "+err.Error())
+	}
+}
+
+// GetWeightEstimation returns a single weight estimation by ID
+func GetWeightEstimation(w http.ResponseWriter, r *http.Request) {
+	if models.DB == nil {
+		sendErrorResponse(w, r, http.StatusInternalServerError, utils.ErrCodeDatabaseError, "Database not initialized")
 		return
 	}
 
-	// Get front image from form
-	frontFile, frontHeader, err := r.FormFile("front_image")
+	estimation, err := models.GetWeightEstimationByID(mux.Vars(r)["id"], utils.UserID(r.Context()))
 	if err != nil {
-		sendErrorResponse(w, http.StatusBadRequest, "Front image is required: "+err.Error())
+		switch {
+		case errors.Is(err, models.ErrInvalidID):
+			sendErrorResponse(w, r, http.StatusBadRequest, utils.ErrCodeInvalidID, "Invalid estimation ID")
+		case errors.Is(err, mongo.ErrNoDocuments):
+			sendErrorResponse(w, r, http.StatusNotFound, utils.ErrCodeNotFound, "Estimation not found")
+		default:
+			sendErrorResponse(w, r, http.StatusInternalServerError, utils.ErrCodeDatabaseError, "Failed to fetch estimation: "+err.Error())
+		}
+		return
+	}
+
+	// Return success response
+	response := Response{
+		Success: true,
+		Data:    roundedEstimation(estimation),
+	}
+
+	// Send response
+	utils.Respond(w, r, http.StatusOK, response)
+}
+
+// GetWeightEstimationHistory returns the caller's weight estimations as a
+// time series, oldest first, optionally limited with from/to and reduced to
+// the latest estimation of each day with daily=true
+func GetWeightEstimationHistory(w http.ResponseWriter, r *http.Request) {
+	if models.DB == nil {
+		sendErrorResponse(w, r, http.StatusInternalServerError, utils.ErrCodeDatabaseError, "Database not initialized")
 		return
 	}
-	defer frontFile.Close()
 
-	// Get side image from form
-	sideFile, sideHeader, err := r.FormFile("side_image")
+	from, to, ok := parseTimeRange(w, r)
+	if !ok {
+		return
+	}
+
+	history, err := models.GetEstimationHistory(utils.UserID(r.Context()), from, to)
 	if err != nil {
-		sendErrorResponse(w, http.StatusBadRequest, "Side image is required: "+err.Error())
+		sendErrorResponse(w, r, http.StatusInternalServerError, utils.ErrCodeDatabaseError, "Failed to fetch estimation history: "+err.Error())
 		return
 	}
-	defer sideFile.Close()
 
-	// Create uploads directory if it doesn't exist
-	if err := os.MkdirAll("uploads", 0755); err != nil {
-		sendErrorResponse(w, http.StatusInternalServerError, "Failed to create uploads directory: "+err.Error())
+	if r.URL.Query().Get("daily") == "true" {
+		history = latestPerDay(history)
+	}
+
+	response := Response{
+		Success: true,
+		Data:    roundedEstimations(history),
+		Message: fmt.Sprintf("Retrieved %d history points", len(history)),
+	}
+
+	utils.Respond(w, r, http.StatusOK, response)
+}
+
+// latestPerDay keeps the most recent of each UTC day's estimations. The
+// input must be sorted oldest first, as is the result.
+func latestPerDay(estimations []*models.WeightEstimation) []*models.WeightEstimation {
+	daily := make([]*models.WeightEstimation, 0, len(estimations))
+	for _, estimation := range estimations {
+		day := estimation.CreatedAt.UTC().Format(time.DateOnly)
+		if last := len(daily) - 1; last >= 0 && daily[last].CreatedAt.UTC().Format(time.DateOnly) == day {
+			daily[last] = estimation
+			continue
+		}
+		daily = append(daily, estimation)
+	}
+	return daily
+}
+
+// parseTimeRange reads the optional from and to query parameters, sending a
+// 400 and returning false when either is malformed. A bare to date includes
+// the whole day, so the returned to is exclusive.
+func parseTimeRange(w http.ResponseWriter, r *http.Request) (time.Time, time.Time, bool) {
+	var from, to time.Time
+	if fromStr := r.URL.Query().Get("from"); fromStr != "" {
+		parsed, _, err := parseTimeParam(fromStr)
+		if err != nil {
+			sendErrorResponse(w, r, http.StatusBadRequest, utils.ErrCodeInvalidRequest, "Invalid from date, expected RFC 3339 or YYYY-MM-DD")
+			return from, to, false
+		}
+		from = parsed
+	}
+	if toStr := r.URL.Query().Get("to"); toStr != "" {
+		parsed, dateOnly, err := parseTimeParam(toStr)
+		if err != nil {
+			sendErrorResponse(w, r, http.StatusBadRequest, utils.ErrCodeInvalidRequest, "Invalid to date, expected RFC 3339 or YYYY-MM-DD")
+			return from, to, false
+		}
+		if dateOnly {
+			parsed = parsed.AddDate(0, 0, 1)
+		}
+		to = parsed
+	}
+	return from, to, true
+}
+
+// parseTimeParam parses an RFC 3339 timestamp or a YYYY-MM-DD date, reporting
+// whether it was a bare date
+func parseTimeParam(value string) (time.Time, bool, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, false, nil
+	}
+	t, err := time.Parse(time.DateOnly, value)
+	return t, true, err
+}
+
+// formError maps a request body parsing error to its HTTP status and error code
+func formError(err error) (int, string) {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return http.StatusRequestEntityTooLarge, utils.ErrCodeRequestTooLarge
+	}
+	return http.StatusBadRequest, utils.ErrCodeInvalidRequest
+}
+
+// ListWeightEstimations returns a list of weight estimations, newest first.
+// With an after query parameter it pages by cursor instead of offset.
+func ListWeightEstimations(w http.ResponseWriter, r *http.Request) {
+	if models.DB == nil {
+		sendErrorResponse(w, r, http.StatusInternalServerError, utils.ErrCodeDatabaseError, "Database not initialized")
 		return
 	}
 
-	// Create timestamp for unique filenames
-	timestamp := time.Now().UnixNano()
+	// Get limit and offset parameters (optional)
+	var limit int64 = 50 // Default limit
+	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+		parsedLimit, err := strconv.ParseInt(limitStr, 10, 64)
+		if err == nil && parsedLimit > 0 {
+			limit = parsedLimit
+		}
+	}
 
-	// Save front image
-	frontFilename := fmt.Sprintf("%d_%s", timestamp, frontHeader.Filename)
-	frontFilepath := filepath.Join("uploads", frontFilename)
-	frontDst, err := os.Create(frontFilepath)
+	filter := models.WeightEstimationFilter{UserID: utils.UserID(r.Context())}
+	if category := r.URL.Query().Get("bmi_category"); category != "" {
+		if !models.IsBMICategory(category) {
+			sendErrorResponse(w, r, http.StatusBadRequest, utils.ErrCodeInvalidRequest, fmt.Sprintf("Invalid bmi_category %q, expected one of %s", category, strings.Join(models.BMICategories, ", ")))
+			return
+		}
+		filter.BMICategory = category
+	}
+
+	// Cursor paging stays consistent while new estimations arrive, unlike offsets
+	if r.URL.Query().Has("after") {
+		listWeightEstimationsAfter(w, r, filter, limit)
+		return
+	}
+
+	var offset int64
+	if offsetStr := r.URL.Query().Get("offset"); offsetStr != "" {
+		parsedOffset, err := strconv.ParseInt(offsetStr, 10, 64)
+		if err == nil && parsedOffset > 0 {
+			offset = parsedOffset
+		}
+	}
+
+	estimations, err := models.GetWeightEstimations(filter, limit, offset)
 	if err != nil {
-		sendErrorResponse(w, http.StatusInternalServerError, "Failed to save front image: "+err.Error())
+		sendErrorResponse(w, r, http.StatusInternalServerError, utils.ErrCodeDatabaseError, "Failed to fetch estimations: "+err.Error())
 		return
 	}
-	defer frontDst.Close()
 
-	if _, err = io.Copy(frontDst, frontFile); err != nil {
-		sendErrorResponse(w, http.StatusInternalServerError, "Failed to save front image data: "+err.Error())
+	// Wrap the records with pagination metadata when requested
+	var data interface{} = roundedEstimations(estimations)
+	if r.URL.Query().Get("paginated") == "true" {
+		total, err := models.CountWeightEstimations(filter)
+		if err != nil {
+			sendErrorResponse(w, r, http.StatusInternalServerError, utils.ErrCodeDatabaseError, "Failed to count estimations: "+err.Error())
+			return
+		}
+		data = utils.NewPage(roundedEstimations(estimations), len(estimations), total, limit, offset)
+	}
+
+	// Return success response
+	response := Response{
+		Success: true,
+		Data:    data,
+		Message: fmt.Sprintf("Retrieved %d estimations", len(estimations)),
+	}
+
+	// Send response
+	utils.Respond(w, r, http.StatusOK, response)
+}
+
+// listWeightEstimationsAfter responds with the page of estimations matching
+// filter following the after cursor, in the order given by the order
+// parameter ("asc" or the default "desc")
+func listWeightEstimationsAfter(w http.ResponseWriter, r *http.Request, filter models.WeightEstimationFilter, limit int64) {
+	var ascending bool
+	switch order := r.URL.Query().Get("order"); order {
+	case "", "desc":
+	case "asc":
+		ascending = true
+	default:
+		sendErrorResponse(w, r, http.StatusBadRequest, utils.ErrCodeInvalidRequest, fmt.Sprintf("Invalid order %q, expected \"asc\" or \"desc\"", order))
 		return
 	}
 
-	// Save side image
-	sideFilename := fmt.Sprintf("%d_%s", timestamp, sideHeader.Filename)
-	sideFilepath := filepath.Join("uploads", sideFilename)
-	sideDst, err := os.Create(sideFilepath)
+	// Fetch one extra estimation to learn whether another page follows
+	estimations, err := models.ListWeightEstimationsAfter(filter, r.URL.Query().Get("after"), limit+1, ascending)
 	if err != nil {
-		sendErrorResponse(w, http.StatusInternalServerError, "Failed to save side image: "+err.Error())
+		if errors.Is(err, models.ErrInvalidID) {
+			sendErrorResponse(w, r, http.StatusBadRequest, utils.ErrCodeInvalidRequest, "Invalid cursor")
+			return
+		}
+		sendErrorResponse(w, r, http.StatusInternalServerError, utils.ErrCodeDatabaseError, "Failed to fetch estimations: "+err.Error())
 		return
 	}
-	defer sideDst.Close()
 
-	if _, err = io.Copy(sideDst, sideFile); err != nil {
-		sendErrorResponse(w, http.StatusInternalServerError, "Failed to save side image data: "+err.Error())
+	page := utils.CursorPage{Limit: limit}
+	if int64(len(estimations)) > limit {
+		estimations = estimations[:limit]
+		page.NextCursor = estimations[limit-1].ID.Hex()
+		page.HasMore = true
+	}
+	page.Items = roundedEstimations(estimations)
+
+	// Return success response
+	response := Response{
+		Success: true,
+		Data:    page,
+		Message: fmt.Sprintf("Retrieved %d estimations", len(estimations)),
+	}
+
+	// Send response
+	utils.Respond(w, r, http.StatusOK, response)
+}
+
+// DeleteWeightEstimationsBefore removes all weight estimations created before
+// the "before" query date, RFC 3339 or YYYY-MM-DD, along with their image files
+func DeleteWeightEstimationsBefore(w http.ResponseWriter, r *http.Request) {
+	if models.DB == nil {
+		sendErrorResponse(w, r, http.StatusInternalServerError, utils.ErrCodeDatabaseError, "Database not initialized")
 		return
 	}
 
-	// Process images with the TensorFlow model
-	weight, err := utils.PredictWeight(frontFilepath, sideFilepath, height)
+	beforeStr := r.URL.Query().Get("before")
+	if beforeStr == "" {
+		sendErrorResponse(w, r, http.StatusBadRequest, utils.ErrCodeInvalidRequest, "The before query parameter is required")
+		return
+	}
+	before, _, err := parseTimeParam(beforeStr)
 	if err != nil {
-		sendErrorResponse(w, http.StatusInternalServerError, "Failed to predict weight: "+err.Error())
+		sendErrorResponse(w, r, http.StatusBadRequest, utils.ErrCodeInvalidRequest, "Invalid before date, expected RFC 3339 or YYYY-MM-DD")
 		return
 	}
 
-	// Create a record of the estimation
-	estimation := &models.WeightEstimation{
-		Height:       height,
-		Weight:       weight,
-		FrontImgPath: frontFilepath,
-		SideImgPath:  sideFilepath,
-		CreatedAt:    time.Now(),
+	paths, deleted, err := models.DeleteEstimationsBefore(before)
+	if err != nil {
+		sendErrorResponse(w, r, http.StatusInternalServerError, utils.ErrCodeDatabaseError, "Failed to delete estimations: "+err.Error())
+		return
 	}
 
-	// Save the estimation record to database (if db is set up)
-	if models.DB != nil {
-		if err := models.SaveWeightEstimation(estimation); err != nil {
-			// Log the error but don't fail the request
-			fmt.Printf("Failed to save estimation to database: %v\n", err)
+	// The records are gone, so a file that can't be removed is only logged
+	for _, path := range paths {
+		if path == "" {
+			continue
+		}
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Printf("Warning: Failed to delete image file %s: %v", path, err)
 		}
 	}
 
-	// Return the estimated weight
+	recordAudit(r, models.AuditActionBulkDelete, "", map[string]interface{}{"before": before, "deleted": deleted})
+
 	response := Response{
 		Success: true,
-		Data: map[string]float64{
-			"weight": weight,
-		},
-		Message: "Weight estimated successfully",
+		Data:    map[string]interface{}{"deleted": deleted},
+		Message: fmt.Sprintf("Deleted %d estimations", deleted),
 	}
 
-	// Send response
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(response)
+	utils.Respond(w, r, http.StatusOK, response)
 }
 
 // Helper function to send error responses
-func sendErrorResponse(w http.ResponseWriter, statusCode int, message string) {
-	w.WriteHeader(statusCode)
+func sendErrorResponse(w http.ResponseWriter, r *http.Request, statusCode int, errCode, message string) {
+	sendErrorResponseWithDetails(w, r, statusCode, errCode, message, nil)
+}
+
+// sendErrorResponseWithDetails sends an error response with extra context for clients
+func sendErrorResponseWithDetails(w http.ResponseWriter, r *http.Request, statusCode int, errCode, message string, details map[string]interface{}) {
 	response := Response{
-		Success: false,
-		Message: message,
+		Success:   false,
+		Message:   message,
+		ErrorCode: errCode,
+		Details:   details,
 	}
-	json.NewEncoder(w).Encode(response)
+	utils.Respond(w, r, statusCode, response)
 }
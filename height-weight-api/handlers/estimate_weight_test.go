@@ -0,0 +1,856 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lucasfepe/height-weight-api/internal/testutil"
+	"github.com/lucasfepe/height-weight-api/models"
+	"github.com/lucasfepe/height-weight-api/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+// seedWeightEstimation saves estimation, filling in a height and weight when unset
+func seedWeightEstimation(t *testing.T, estimation *models.WeightEstimation) *models.WeightEstimation {
+	t.Helper()
+	if estimation.Height == 0 {
+		estimation.Height = 175
+	}
+	if estimation.Weight == 0 {
+		estimation.Weight = 70
+	}
+	if err := models.SaveWeightEstimation(estimation); err != nil {
+		t.Fatalf("SaveWeightEstimation: %v", err)
+	}
+	return estimation
+}
+
+// withID routes r as if it matched a route with an {id} variable
+func withID(r *http.Request, id string) *http.Request {
+	return mux.SetURLVars(r, map[string]string{"id": id})
+}
+
+func TestGetWeightEstimation(t *testing.T) {
+	testDatabase(t, nil)
+	estimation := seedWeightEstimation(t, &models.WeightEstimation{Height: 180.26, Weight: 80.04, CreatedAt: time.Now()})
+
+	tests := []struct {
+		name     string
+		id       string
+		wantCode int
+		wantErr  string
+	}{
+		{"valid ID", estimation.ID.Hex(), http.StatusOK, ""},
+		{"malformed ID", "not-an-object-id", http.StatusBadRequest, utils.ErrCodeInvalidID},
+		{"missing ID", primitive.NewObjectID().Hex(), http.StatusNotFound, utils.ErrCodeNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := withID(httptest.NewRequest(http.MethodGet, "/estimate-weight/"+tt.id, nil), tt.id)
+			w, response := serve(t, http.HandlerFunc(GetWeightEstimation), r)
+			if w.Code != tt.wantCode || response.ErrorCode != tt.wantErr {
+				t.Fatalf("got %d %q (%s), want %d %q", w.Code, response.ErrorCode, response.Message, tt.wantCode, tt.wantErr)
+			}
+			if tt.wantCode != http.StatusOK {
+				return
+			}
+
+			var got models.WeightEstimation
+			if err := json.Unmarshal(response.Data, &got); err != nil {
+				t.Fatalf("decode estimation: %v", err)
+			}
+			if got.ID != estimation.ID || got.Height != 180.3 || got.Weight != 80 {
+				t.Errorf("got %s height %v weight %v, want %s rounded to 180.3 and 80", got.ID.Hex(), got.Height, got.Weight, estimation.ID.Hex())
+			}
+		})
+	}
+}
+
+func TestEstimateWeightCancelledSkipsSave(t *testing.T) {
+	cfg := testDatabase(t, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// A slow prediction that still completes after the client has gone away
+	ml := &fakeMLService{weight: 72.4, onPredict: func() {
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+	}}
+	handler := NewEstimateWeightHandler(cfg, nil, fakeMLClients(ml), utils.NewIdempotencyStore(0), nil, nil)
+
+	r := newMultipartRequest(t, "/estimate-weight", map[string]string{"height": "175"},
+		map[string][]byte{"front_image": testPNG(t, 64, 96, 40), "side_image": testPNG(t, 64, 96, 80)})
+	handler.ServeHTTP(httptest.NewRecorder(), r.WithContext(ctx))
+
+	if calls := ml.calls.Load(); calls != 1 {
+		t.Fatalf("ML service called %d times, want 1", calls)
+	}
+	count, err := models.CountWeightEstimations(models.WeightEstimationFilter{})
+	if err != nil {
+		t.Fatalf("CountWeightEstimations: %v", err)
+	}
+	if count != 0 {
+		t.Errorf("saved %d estimations for a cancelled request, want 0", count)
+	}
+}
+
+func TestGetWeightEstimationOtherUser(t *testing.T) {
+	testDatabase(t, nil)
+	estimation := seedWeightEstimation(t, &models.WeightEstimation{UserID: "alice", CreatedAt: time.Now()})
+	id := estimation.ID.Hex()
+
+	for _, tt := range []struct {
+		user     string
+		wantCode int
+	}{
+		{"alice", http.StatusOK},
+		{"bob", http.StatusNotFound},
+	} {
+		r := withID(httptest.NewRequest(http.MethodGet, "/estimate-weight/"+id, nil), id)
+		r = r.WithContext(utils.WithUserID(r.Context(), tt.user))
+		if w, response := serve(t, http.HandlerFunc(GetWeightEstimation), r); w.Code != tt.wantCode {
+			t.Errorf("as %s got %d (%s), want %d", tt.user, w.Code, response.Message, tt.wantCode)
+		}
+	}
+}
+
+func TestDeleteWeightEstimationsBefore(t *testing.T) {
+	cfg := testDatabase(t, nil)
+	cutoff := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+
+	seed := func(createdAt time.Time) *models.WeightEstimation {
+		t.Helper()
+		path := filepath.Join(cfg.UploadDir, primitive.NewObjectID().Hex()+".png")
+		if err := os.WriteFile(path, []byte("image"), 0644); err != nil {
+			t.Fatalf("write image: %v", err)
+		}
+		return seedWeightEstimation(t, &models.WeightEstimation{FrontImgPath: path, CreatedAt: createdAt})
+	}
+	old := []*models.WeightEstimation{seed(cutoff.AddDate(-1, 0, 0)), seed(cutoff.Add(-time.Second))}
+	kept := []*models.WeightEstimation{seed(cutoff), seed(cutoff.AddDate(0, 1, 0))}
+
+	r := httptest.NewRequest(http.MethodDelete, "/estimate-weight?before=2024-06-01", nil)
+	w, response := serve(t, http.HandlerFunc(DeleteWeightEstimationsBefore), r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d %s (%s), want 200", w.Code, response.ErrorCode, response.Message)
+	}
+	var data struct {
+		Deleted int `json:"deleted"`
+	}
+	if err := json.Unmarshal(response.Data, &data); err != nil || data.Deleted != len(old) {
+		t.Errorf("data = %s, want %d deleted", response.Data, len(old))
+	}
+
+	for _, estimation := range old {
+		if _, err := models.GetWeightEstimationByID(estimation.ID.Hex(), ""); err == nil {
+			t.Errorf("estimation created %v still stored", estimation.CreatedAt)
+		}
+		if _, err := os.Stat(estimation.FrontImgPath); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("image of estimation created %v still on disk", estimation.CreatedAt)
+		}
+	}
+	for _, estimation := range kept {
+		if _, err := models.GetWeightEstimationByID(estimation.ID.Hex(), ""); err != nil {
+			t.Errorf("estimation created %v: %v, want it kept", estimation.CreatedAt, err)
+		}
+		if _, err := os.Stat(estimation.FrontImgPath); err != nil {
+			t.Errorf("image of estimation created %v: %v, want it kept", estimation.CreatedAt, err)
+		}
+	}
+}
+
+func TestListWeightEstimationsBMICategory(t *testing.T) {
+	testDatabase(t, nil)
+	// BMIs of about 17, 21.6, 22.2, 27.8 and 34 at 180 cm
+	start := time.Now().Add(-time.Hour)
+	for i, weight := range []float64{55, 70, 72, 90, 110} {
+		seedWeightEstimation(t, &models.WeightEstimation{Height: 180, Weight: weight, CreatedAt: start.Add(time.Duration(i) * time.Minute)})
+	}
+
+	tests := []struct {
+		category string
+		want     []float64
+	}{
+		{models.BMIUnderweight, []float64{55}},
+		{models.BMINormal, []float64{72, 70}},
+		{models.BMIOverweight, []float64{90}},
+		{models.BMIObese, []float64{110}},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/estimate-weight?bmi_category="+tt.category, nil)
+		w, response := serve(t, http.HandlerFunc(ListWeightEstimations), r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: got %d %s (%s), want 200", tt.category, w.Code, response.ErrorCode, response.Message)
+		}
+		var estimations []models.WeightEstimation
+		if err := json.Unmarshal(response.Data, &estimations); err != nil {
+			t.Fatalf("%s: decode %s: %v", tt.category, response.Data, err)
+		}
+
+		weights := []float64{}
+		for _, estimation := range estimations {
+			if estimation.BMICategory != tt.category {
+				t.Errorf("%s: listed an estimation of category %q", tt.category, estimation.BMICategory)
+			}
+			weights = append(weights, estimation.Weight)
+		}
+		if !slices.Equal(weights, tt.want) {
+			t.Errorf("%s: weights = %v, want %v", tt.category, weights, tt.want)
+		}
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/estimate-weight?bmi_category=chubby", nil)
+	if w, response := serve(t, http.HandlerFunc(ListWeightEstimations), r); w.Code != http.StatusBadRequest || response.ErrorCode != utils.ErrCodeInvalidRequest {
+		t.Errorf("unknown category: got %d %s (%s), want 400 %s", w.Code, response.ErrorCode, response.Message, utils.ErrCodeInvalidRequest)
+	}
+}
+
+func TestEstimateWeightSideImages(t *testing.T) {
+	tests := []struct {
+		name  string
+		views []string
+	}{
+		{"single side", []string{utils.SideViewSingle}},
+		{"left and right", []string{utils.SideViewLeft, utils.SideViewRight}},
+		{"all three", []string{utils.SideViewSingle, utils.SideViewLeft, utils.SideViewRight}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testutil.Config(t, nil)
+			ml := &fakeMLService{weight: 72.4}
+			handler := NewEstimateWeightHandler(cfg, nil, fakeMLClients(ml), utils.NewIdempotencyStore(0), nil, nil)
+
+			images := map[string][]byte{"front_image": testPNG(t, 64, 96, 40)}
+			for i, view := range tt.views {
+				images[view] = testPNG(t, 64, 96, uint8(80+40*i))
+			}
+			w, response := serve(t, handler, newMultipartRequest(t, "/estimate-weight", map[string]string{"height": "175"}, images))
+			if w.Code != http.StatusOK {
+				t.Fatalf("got %d %s (%s), want 200", w.Code, response.ErrorCode, response.Message)
+			}
+			if views := ml.lastViews(); !slices.Equal(views, tt.views) {
+				t.Errorf("ML service got side views %v, want %v", views, tt.views)
+			}
+		})
+	}
+}
+
+func TestRunEstimationWithoutSides(t *testing.T) {
+	cfg := testutil.Config(t, map[string]string{"KEEP_ESTIMATION_IMAGES": "true"})
+	front := filepath.Join(cfg.UploadDir, "front.png")
+	if err := os.WriteFile(front, testPNG(t, 64, 96, 40), 0644); err != nil {
+		t.Fatalf("write front image: %v", err)
+	}
+
+	_, estimation, err := runEstimation(context.Background(), cfg, fakeMLClients(&fakeMLService{weight: 70}), estimateRequest{FrontImgPath: front, Height: 175})
+	if err != nil {
+		t.Fatalf("runEstimation: %v", err)
+	}
+	if estimation.SideImgPath != "" || len(estimation.SideImages) != 0 {
+		t.Errorf("record sides = %q, %v, want none", estimation.SideImgPath, estimation.SideImages)
+	}
+}
+
+func TestEstimateWeightHeightDivergence(t *testing.T) {
+	tests := []struct {
+		name            string
+		predictedHeight float64
+		wantCode        int
+		wantWarning     bool
+	}{
+		{"matching", 177, http.StatusOK, false},
+		{"older model without height", 0, http.StatusOK, false},
+		{"divergent", 190, http.StatusOK, true},
+		{"past the reject threshold", 200, http.StatusUnprocessableEntity, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testutil.Config(t, map[string]string{"HEIGHT_TOLERANCE_CM": "10", "HEIGHT_REJECT_CM": "20"})
+			ml := &fakeMLService{weight: 72.4, predictedHeight: tt.predictedHeight}
+			handler := NewEstimateWeightHandler(cfg, nil, fakeMLClients(ml), utils.NewIdempotencyStore(0), nil, nil)
+
+			w, response := serve(t, handler, newEstimateRequest(t, "175"))
+			if w.Code != tt.wantCode {
+				t.Fatalf("got %d %s (%s), want %d", w.Code, response.ErrorCode, response.Message, tt.wantCode)
+			}
+			if tt.wantCode != http.StatusOK {
+				if response.ErrorCode != utils.ErrCodeHeightMismatch {
+					t.Errorf("error code = %s, want %s", response.ErrorCode, utils.ErrCodeHeightMismatch)
+				}
+				return
+			}
+
+			var data struct {
+				PredictedHeight float64  `json:"predicted_height"`
+				Warnings        []string `json:"warnings"`
+			}
+			if err := json.Unmarshal(response.Data, &data); err != nil {
+				t.Fatalf("decode data: %v", err)
+			}
+			if data.PredictedHeight != tt.predictedHeight {
+				t.Errorf("predicted_height = %v, want %v", data.PredictedHeight, tt.predictedHeight)
+			}
+			if gotWarning := len(data.Warnings) > 0; gotWarning != tt.wantWarning {
+				t.Errorf("warnings = %v, want a warning %v", data.Warnings, tt.wantWarning)
+			}
+		})
+	}
+}
+
+func TestEstimateWeightMeasurements(t *testing.T) {
+	tests := []struct {
+		name         string
+		measurements map[string]float64
+	}{
+		{"with measurements", map[string]float64{"chest": 98.5, "waist": 82}},
+		{"without measurements", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testutil.Config(t, nil)
+			ml := &fakeMLService{weight: 70, measurements: tt.measurements}
+			handler := NewEstimateWeightHandler(cfg, nil, fakeMLClients(ml), utils.NewIdempotencyStore(0), nil, nil)
+
+			w, response := serve(t, handler, newEstimateRequest(t, "175"))
+			if w.Code != http.StatusOK {
+				t.Fatalf("got %d %s (%s), want 200", w.Code, response.ErrorCode, response.Message)
+			}
+			var data map[string]json.RawMessage
+			if err := json.Unmarshal(response.Data, &data); err != nil {
+				t.Fatalf("decode data: %v", err)
+			}
+			raw, ok := data["measurements"]
+			if ok != (tt.measurements != nil) {
+				t.Fatalf("measurements = %s, want present %v", raw, tt.measurements != nil)
+			}
+			if !ok {
+				return
+			}
+			var got map[string]float64
+			if err := json.Unmarshal(raw, &got); err != nil || !maps.Equal(got, tt.measurements) {
+				t.Errorf("measurements = %s, want %v", raw, tt.measurements)
+			}
+		})
+	}
+}
+
+func TestEstimateWeightIdempotencyKey(t *testing.T) {
+	cfg := testutil.Config(t, nil)
+	ml := &fakeMLService{weight: 70}
+	handler := NewEstimateWeightHandler(cfg, nil, fakeMLClients(ml), utils.NewIdempotencyStore(time.Hour), nil, nil)
+
+	send := func(key string) *httptest.ResponseRecorder {
+		r := newEstimateRequest(t, "175")
+		r.Header.Set(utils.IdempotencyKeyHeader, key)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	first, second := send("retry-1"), send("retry-1")
+	if first.Code != http.StatusOK {
+		t.Fatalf("first request got %d: %s", first.Code, first.Body)
+	}
+	if second.Code != first.Code || second.Body.String() != first.Body.String() {
+		t.Errorf("replay = %d %s, want %d %s", second.Code, second.Body, first.Code, first.Body)
+	}
+	if second.Header().Get(utils.IdempotentReplayHeader) != "true" || first.Header().Get(utils.IdempotentReplayHeader) != "" {
+		t.Errorf("only the replay should carry %s", utils.IdempotentReplayHeader)
+	}
+	if calls := ml.calls.Load(); calls != 1 {
+		t.Errorf("ML service called %d times, want 1", calls)
+	}
+
+	if w := send("retry-2"); w.Code != http.StatusOK || ml.calls.Load() != 2 {
+		t.Errorf("another key got %d after %d ML calls, want 200 after 2", w.Code, ml.calls.Load())
+	}
+}
+
+func TestEstimateWeightIdempotencyKeyFailures(t *testing.T) {
+	cfg := testutil.Config(t, nil)
+	idempotency := utils.NewIdempotencyStore(time.Hour)
+
+	// Failed requests aren't stored, so the client can retry them
+	failing := &fakeMLService{err: errors.New("model crashed")}
+	handler := NewEstimateWeightHandler(cfg, nil, fakeMLClients(failing), idempotency, nil, nil)
+	for i := 0; i < 2; i++ {
+		r := newEstimateRequest(t, "175")
+		r.Header.Set(utils.IdempotencyKeyHeader, "failing")
+		if w, response := serve(t, handler, r); w.Code != http.StatusInternalServerError {
+			t.Fatalf("attempt %d got %d %s, want 500", i+1, w.Code, response.ErrorCode)
+		}
+	}
+	if calls := failing.calls.Load(); calls != 2 {
+		t.Errorf("ML service called %d times, want each failed attempt to run", calls)
+	}
+
+	// A retry while the first request is still running is turned away
+	blocked := &fakeMLService{weight: 70, block: make(chan struct{})}
+	started := make(chan struct{})
+	blocked.onPredict = func() { close(started) }
+	handler = NewEstimateWeightHandler(cfg, nil, fakeMLClients(blocked), idempotency, nil, nil)
+
+	done := make(chan int)
+	slow := newEstimateRequest(t, "175")
+	slow.Header.Set(utils.IdempotencyKeyHeader, "slow")
+	go func() {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, slow)
+		done <- w.Code
+	}()
+	<-started
+
+	r := newEstimateRequest(t, "175")
+	r.Header.Set(utils.IdempotencyKeyHeader, "slow")
+	if w, response := serve(t, handler, r); w.Code != http.StatusConflict || response.ErrorCode != utils.ErrCodeRequestInProgress {
+		t.Errorf("concurrent retry got %d %s, want 409 %s", w.Code, response.ErrorCode, utils.ErrCodeRequestInProgress)
+	}
+	close(blocked.block)
+	if code := <-done; code != http.StatusOK {
+		t.Errorf("first request got %d, want 200", code)
+	}
+}
+
+func TestEstimateWeightFallback(t *testing.T) {
+	tests := []struct {
+		name         string
+		allow        string
+		mlErr        error
+		wantCode     int
+		wantDegraded bool
+	}{
+		{"disabled", "false", utils.ErrCircuitOpen, http.StatusServiceUnavailable, false},
+		{"disabled on ML error", "false", errors.New("model crashed"), http.StatusInternalServerError, false},
+		{"enabled", "true", utils.ErrCircuitOpen, http.StatusOK, true},
+		{"enabled on ML error", "true", errors.New("model crashed"), http.StatusOK, true},
+		{"enabled but no person", "true", utils.ErrNoPersonDetected, http.StatusUnprocessableEntity, false},
+		{"enabled and ML healthy", "true", nil, http.StatusOK, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testutil.Config(t, map[string]string{"ALLOW_FALLBACK_ESTIMATION": tt.allow})
+			ml := &fakeMLService{weight: 70, err: tt.mlErr}
+			handler := NewEstimateWeightHandler(cfg, nil, fakeMLClients(ml), utils.NewIdempotencyStore(0), nil, nil)
+
+			w, response := serve(t, handler, newEstimateRequest(t, "175"))
+			if w.Code != tt.wantCode {
+				t.Fatalf("got %d %s (%s), want %d", w.Code, response.ErrorCode, response.Message, tt.wantCode)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+			var data struct {
+				Weight   float64 `json:"weight"`
+				Model    string  `json:"model"`
+				Degraded bool    `json:"degraded"`
+			}
+			if err := json.Unmarshal(response.Data, &data); err != nil {
+				t.Fatalf("decode data: %v", err)
+			}
+			if data.Degraded != tt.wantDegraded {
+				t.Errorf("degraded = %v, want %v", data.Degraded, tt.wantDegraded)
+			}
+			if tt.wantDegraded && (data.Model != fallbackModel || data.Weight <= 0 || w.Header().Get(predictionModeHeader) != fallbackModel) {
+				t.Errorf("fallback estimate = %v kg by %q, mode header %q; want a weight by %q",
+					data.Weight, data.Model, w.Header().Get(predictionModeHeader), fallbackModel)
+			}
+		})
+	}
+}
+
+func TestLatestPerDay(t *testing.T) {
+	at := func(value string) *models.WeightEstimation {
+		createdAt, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			t.Fatalf("parse %s: %v", value, err)
+		}
+		return &models.WeightEstimation{CreatedAt: createdAt}
+	}
+	morning, evening := at("2024-03-01T08:00:00Z"), at("2024-03-01T21:30:00Z")
+	lateUTC := at("2024-03-01T23:30:00-05:00") // Already March 2 in UTC
+	nextDay := at("2024-03-02T12:00:00Z")
+	later := at("2024-03-05T09:00:00Z")
+
+	tests := []struct {
+		name string
+		in   []*models.WeightEstimation
+		want []*models.WeightEstimation
+	}{
+		{"empty", nil, nil},
+		{"one per day", []*models.WeightEstimation{morning, nextDay, later}, []*models.WeightEstimation{morning, nextDay, later}},
+		{"same day keeps the latest", []*models.WeightEstimation{morning, evening, later}, []*models.WeightEstimation{evening, later}},
+		{"days are UTC", []*models.WeightEstimation{evening, lateUTC, nextDay}, []*models.WeightEstimation{evening, nextDay}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := latestPerDay(tt.in)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("latestPerDay kept %d points, want %d: %v", len(got), len(tt.want), got)
+			}
+		})
+	}
+}
+
+func TestGetWeightEstimationHistory(t *testing.T) {
+	testDatabase(t, nil)
+	day := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	for _, e := range []struct {
+		hours  int
+		weight float64
+	}{{8, 70}, {20, 71}, {24 + 9, 72}, {48 + 7, 73}, {48 + 22, 74}} {
+		seedWeightEstimation(t, &models.WeightEstimation{Weight: e.weight, CreatedAt: day.Add(time.Duration(e.hours) * time.Hour)})
+	}
+
+	tests := []struct {
+		query string
+		want  []float64
+	}{
+		{"", []float64{70, 71, 72, 73, 74}},
+		{"daily=true", []float64{71, 72, 74}},
+		{"daily=true&from=2024-03-02", []float64{72, 74}},
+		{"daily=true&to=2024-03-02", []float64{71, 72}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/estimate/history?"+tt.query, nil)
+			w, response := serve(t, http.HandlerFunc(GetWeightEstimationHistory), r)
+			if w.Code != http.StatusOK {
+				t.Fatalf("got %d %s (%s), want 200", w.Code, response.ErrorCode, response.Message)
+			}
+			var history []models.WeightEstimation
+			if err := json.Unmarshal(response.Data, &history); err != nil {
+				t.Fatalf("decode history: %v", err)
+			}
+			var weights []float64
+			for _, point := range history {
+				weights = append(weights, point.Weight)
+			}
+			if !slices.Equal(weights, tt.want) {
+				t.Errorf("weights = %v, want %v", weights, tt.want)
+			}
+		})
+	}
+}
+
+func TestEstimateWeightFailureRemovesImages(t *testing.T) {
+	cfg := testutil.Config(t, map[string]string{"KEEP_ESTIMATION_IMAGES": "true"})
+	ml := &fakeMLService{err: errors.New("model crashed")}
+	handler := NewEstimateWeightHandler(cfg, nil, fakeMLClients(ml), utils.NewIdempotencyStore(0), nil, nil)
+
+	w, response := serve(t, handler, newEstimateRequest(t, "175"))
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("got %d %s (%s), want 500", w.Code, response.ErrorCode, response.Message)
+	}
+	if files := storedFiles(t, estimationUploadDir(cfg)); len(files) != 0 {
+		t.Errorf("failed estimation left %v behind", files)
+	}
+}
+
+func TestEstimateWeightImageRetention(t *testing.T) {
+	tests := []struct {
+		keep      bool
+		wantFiles int
+	}{
+		{false, 0},
+		{true, 2},
+	}
+	for _, tt := range tests {
+		t.Run("keep="+strconv.FormatBool(tt.keep), func(t *testing.T) {
+			cfg := testutil.Config(t, map[string]string{"KEEP_ESTIMATION_IMAGES": strconv.FormatBool(tt.keep)})
+			handler := NewEstimateWeightHandler(cfg, nil, fakeMLClients(&fakeMLService{weight: 70}), utils.NewIdempotencyStore(0), nil, nil)
+
+			w, response := serve(t, handler, newEstimateRequest(t, "175"))
+			if w.Code != http.StatusOK {
+				t.Fatalf("got %d %s (%s), want 200", w.Code, response.ErrorCode, response.Message)
+			}
+			if files := storedFiles(t, estimationUploadDir(cfg)); len(files) != tt.wantFiles {
+				t.Errorf("stored files = %v, want %d", files, tt.wantFiles)
+			}
+		})
+	}
+}
+
+func TestEstimateWeightImageRetentionRecord(t *testing.T) {
+	for _, keep := range []bool{false, true} {
+		t.Run("keep="+strconv.FormatBool(keep), func(t *testing.T) {
+			cfg := testDatabase(t, map[string]string{"KEEP_ESTIMATION_IMAGES": strconv.FormatBool(keep)})
+			handler := NewEstimateWeightHandler(cfg, nil, fakeMLClients(&fakeMLService{weight: 70}), utils.NewIdempotencyStore(0), nil, nil)
+
+			w, response := serve(t, handler, newEstimateRequest(t, "175"))
+			if w.Code != http.StatusOK {
+				t.Fatalf("got %d %s (%s), want 200", w.Code, response.ErrorCode, response.Message)
+			}
+			var data struct {
+				ID        string            `json:"id"`
+				ImageURLs map[string]string `json:"image_urls"`
+			}
+			if err := json.Unmarshal(response.Data, &data); err != nil {
+				t.Fatalf("decode data %s: %v", response.Data, err)
+			}
+			if (data.ImageURLs != nil) != keep {
+				t.Errorf("image_urls = %v, want links %v", data.ImageURLs, keep)
+			}
+
+			estimation, err := models.GetWeightEstimationByID(data.ID, "")
+			if err != nil {
+				t.Fatalf("GetWeightEstimationByID: %v", err)
+			}
+			if (estimation.FrontImgPath != "") != keep || (estimation.SideImgPath != "") != keep {
+				t.Errorf("stored paths = %q, %q, want them kept %v", estimation.FrontImgPath, estimation.SideImgPath, keep)
+			}
+			// Which views were sent is recorded either way
+			if len(estimation.SideImages) != 1 || estimation.SideImages[0].View != utils.SideViewSingle {
+				t.Errorf("side images = %+v, want the single side view", estimation.SideImages)
+			}
+		})
+	}
+}
+
+func TestEstimateWeightDuplicateSubmission(t *testing.T) {
+	cfg := testDatabase(t, map[string]string{"DUPLICATE_WINDOW_SEC": "60"})
+	ml := &fakeMLService{weight: 70}
+	handler := NewEstimateWeightHandler(cfg, nil, fakeMLClients(ml), utils.NewIdempotencyStore(0), nil, nil)
+
+	estimate := func(height string) (string, bool) {
+		t.Helper()
+		w, response := serve(t, handler, newEstimateRequest(t, height))
+		if w.Code != http.StatusOK {
+			t.Fatalf("got %d %s (%s), want 200", w.Code, response.ErrorCode, response.Message)
+		}
+		var data struct {
+			ID        string `json:"id"`
+			Persisted bool   `json:"persisted"`
+		}
+		if err := json.Unmarshal(response.Data, &data); err != nil {
+			t.Fatalf("decode data: %v", err)
+		}
+		return data.ID, data.Persisted
+	}
+
+	first, persisted := estimate("175")
+	if first == "" || !persisted {
+		t.Fatalf("first estimation = %q, persisted %v; want a stored estimation", first, persisted)
+	}
+	if second, persisted := estimate("175"); second != first || !persisted {
+		t.Errorf("identical resubmission = %q, persisted %v; want the stored %q", second, persisted, first)
+	}
+	if calls := ml.calls.Load(); calls != 1 {
+		t.Errorf("ML service called %d times, want 1", calls)
+	}
+
+	// A different height is a different submission
+	if other, _ := estimate("180"); other == first {
+		t.Error("submission with another height returned the first estimation")
+	}
+	count, err := models.CountWeightEstimations(models.WeightEstimationFilter{})
+	if err != nil {
+		t.Fatalf("CountWeightEstimations: %v", err)
+	}
+	if count != 2 {
+		t.Errorf("stored %d estimations, want 2", count)
+	}
+}
+
+func TestEstimateWeightDuplicateInFlight(t *testing.T) {
+	cfg := testDatabase(t, map[string]string{"DUPLICATE_WINDOW_SEC": "60"})
+	ml := &fakeMLService{weight: 70, block: make(chan struct{})}
+	started := make(chan struct{})
+	ml.onPredict = func() { close(started) }
+	handler := NewEstimateWeightHandler(cfg, nil, fakeMLClients(ml), utils.NewIdempotencyStore(0), nil, nil)
+
+	first := newEstimateRequest(t, "175")
+	done := make(chan int)
+	go func() {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, first)
+		done <- w.Code
+	}()
+	<-started
+
+	w, response := serve(t, handler, newEstimateRequest(t, "175"))
+	if w.Code != http.StatusConflict || response.ErrorCode != utils.ErrCodeRequestInProgress {
+		t.Errorf("second submission got %d %s, want 409 %s", w.Code, response.ErrorCode, utils.ErrCodeRequestInProgress)
+	}
+	close(ml.block)
+	if code := <-done; code != http.StatusOK {
+		t.Errorf("first submission got %d, want 200", code)
+	}
+}
+
+func TestEstimateWeightBackpressure(t *testing.T) {
+	cfg := testutil.Config(t, map[string]string{"MAX_IN_FLIGHT_ESTIMATIONS": "2"})
+	ml := &fakeMLService{weight: 70, block: make(chan struct{})}
+	started := make(chan struct{}, 2)
+	ml.onPredict = func() { started <- struct{}{} }
+	handler := NewEstimateWeightHandler(cfg, nil, fakeMLClients(ml), utils.NewIdempotencyStore(0), nil, nil)
+
+	// Fill up to the high-water mark with predictions held by the ML service
+	done := make(chan int, 2)
+	for i := 0; i < 2; i++ {
+		r := newEstimateRequest(t, "175")
+		go func() {
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			done <- w.Code
+		}()
+		<-started
+	}
+
+	w, response := serve(t, handler, newEstimateRequest(t, "175"))
+	if w.Code != http.StatusServiceUnavailable || response.ErrorCode != utils.ErrCodeServerBusy {
+		t.Errorf("saturated got %d %s (%s), want 503 %s", w.Code, response.ErrorCode, response.Message, utils.ErrCodeServerBusy)
+	}
+	if retryAfter := w.Header().Get("Retry-After"); retryAfter == "" {
+		t.Error("no Retry-After header on the 503")
+	}
+	var details struct {
+		InFlight      int64 `json:"in_flight"`
+		HighWaterMark int   `json:"high_water_mark"`
+	}
+	if err := json.Unmarshal(response.Details, &details); err != nil {
+		t.Fatalf("decode details %s: %v", response.Details, err)
+	}
+	if details.InFlight != 2 || details.HighWaterMark != 2 {
+		t.Errorf("details = %+v, want 2 in flight at a mark of 2", details)
+	}
+	if calls := ml.calls.Load(); calls != 2 {
+		t.Errorf("ML service called %d times, want the turned away request not to reach it", calls)
+	}
+
+	// Once the predictions finish, estimations are accepted again
+	close(ml.block)
+	for i := 0; i < 2; i++ {
+		if code := <-done; code != http.StatusOK {
+			t.Errorf("held request got %d, want 200", code)
+		}
+	}
+	if w, response := serve(t, handler, newEstimateRequest(t, "175")); w.Code != http.StatusOK {
+		t.Errorf("after draining got %d %s (%s), want 200", w.Code, response.ErrorCode, response.Message)
+	}
+}
+
+func TestEstimateWeightSaveFailure(t *testing.T) {
+	tests := []struct {
+		require  bool
+		wantCode int
+	}{
+		{true, http.StatusInternalServerError},
+		{false, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run("REQUIRE_ESTIMATION_PERSISTENCE="+strconv.FormatBool(tt.require), func(t *testing.T) {
+			cfg := testutil.Config(t, map[string]string{"REQUIRE_ESTIMATION_PERSISTENCE": strconv.FormatBool(tt.require)})
+			failingDatabase(t)
+			handler := NewEstimateWeightHandler(cfg, nil, fakeMLClients(&fakeMLService{weight: 70}), utils.NewIdempotencyStore(0), nil, nil)
+
+			w, response := serve(t, handler, newEstimateRequest(t, "175"))
+			if w.Code != tt.wantCode {
+				t.Fatalf("got %d %s (%s), want %d", w.Code, response.ErrorCode, response.Message, tt.wantCode)
+			}
+			if tt.require {
+				if response.ErrorCode != utils.ErrCodeDatabaseError || !strings.Contains(response.Message, "not stored") {
+					t.Errorf("error = %s %q, want %s saying the estimate wasn't stored", response.ErrorCode, response.Message, utils.ErrCodeDatabaseError)
+				}
+				return
+			}
+
+			// Best effort still answers, flagged as unrecorded and without an ID
+			var data struct {
+				ID        string  `json:"id"`
+				Weight    float64 `json:"weight"`
+				Persisted *bool   `json:"persisted"`
+			}
+			if err := json.Unmarshal(response.Data, &data); err != nil {
+				t.Fatalf("decode data: %v", err)
+			}
+			if data.Weight != 70 || data.Persisted == nil || *data.Persisted || data.ID != "" {
+				t.Errorf("data = %s, want weight 70 with persisted false and no ID", response.Data)
+			}
+		})
+	}
+}
+
+func TestEstimateWeightAPIVersion(t *testing.T) {
+	handler := NewEstimateWeightHandler(testutil.Config(t, nil), nil, fakeMLClients(&fakeMLService{weight: 70}), utils.NewIdempotencyStore(0), nil, nil)
+
+	tests := []struct {
+		height   string
+		wantCode int
+	}{
+		{"175", http.StatusOK},
+		{"tall", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.height, func(t *testing.T) {
+			w, response := serve(t, handler, newEstimateRequest(t, tt.height))
+			if w.Code != tt.wantCode {
+				t.Fatalf("got %d %s (%s), want %d", w.Code, response.ErrorCode, response.Message, tt.wantCode)
+			}
+			if response.APIVersion != utils.APIVersion {
+				t.Errorf("api_version = %q, want %q", response.APIVersion, utils.APIVersion)
+			}
+		})
+	}
+}
+
+func TestDeleteWeightEstimationsBeforeMocked(t *testing.T) {
+	testutil.MockDatabase(t, func(mt *mtest.T) {
+		cfg := testutil.Config(mt.T, nil)
+		models.DB = mt.DB
+		mt.Cleanup(func() { models.DB = nil })
+
+		var found []bson.D
+		var paths []string
+		for _, name := range []string{"a", "b"} {
+			path := filepath.Join(cfg.UploadDir, name+".png")
+			if err := os.WriteFile(path, []byte("image"), 0644); err != nil {
+				mt.Fatalf("write image: %v", err)
+			}
+			paths = append(paths, path)
+			found = append(found, bson.D{{Key: "_id", Value: primitive.NewObjectID()}, {Key: "front_img_path", Value: path}})
+		}
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, "test.weight_estimations", mtest.FirstBatch, found...),
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 2}),
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}), // Audit entry
+		)
+
+		r := httptest.NewRequest(http.MethodDelete, "/estimate-weight?before=2024-06-01", nil)
+		w, response := serve(mt.T, http.HandlerFunc(DeleteWeightEstimationsBefore), r)
+		if w.Code != http.StatusOK {
+			mt.Fatalf("got %d %s (%s), want 200", w.Code, response.ErrorCode, response.Message)
+		}
+		var data struct {
+			Deleted int `json:"deleted"`
+		}
+		if err := json.Unmarshal(response.Data, &data); err != nil || data.Deleted != 2 {
+			mt.Errorf("data = %s, want 2 deleted", response.Data)
+		}
+		for _, path := range paths {
+			if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+				mt.Errorf("%s still on disk", filepath.Base(path))
+			}
+		}
+
+		// Only the lookup and the delete ran before the audit entry; no separate count
+		for _, want := range []string{"find", "delete", "insert"} {
+			if event := mt.GetStartedEvent(); event == nil || event.CommandName != want {
+				mt.Errorf("command %v, want %s", event, want)
+			}
+		}
+	})
+}
@@ -1,10 +1,13 @@
 package handlers
 
 import (
+	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/lucasfepe/height-weight-api/db"
@@ -19,33 +22,133 @@ func GetEstimationHandler(w http.ResponseWriter, r *http.Request) {
 	imageID := vars["imageID"]
 
 	if imageID == "" {
-		utils.RespondWithError(w, http.StatusBadRequest, "Missing image ID")
+		utils.RespondWithError(w, r, http.StatusBadRequest, utils.ErrCodeInvalidID, "Missing image ID")
 		return
 	}
 
+	// Soft-deleted estimations are hidden unless explicitly requested
+	includeDeleted := r.URL.Query().Get("include_deleted") == "true"
+
 	// Fetch estimation from MongoDB
-	estimation, err := db.GetEstimationByID(imageID)
+	estimation, err := db.GetEstimationByID(imageID, includeDeleted)
 	if err != nil {
 		if err == mongo.ErrNoDocuments {
-			utils.RespondWithError(w, http.StatusNotFound, "Estimation not found")
+			utils.RespondWithError(w, r, http.StatusNotFound, utils.ErrCodeNotFound, "Estimation not found")
 		} else {
-			utils.RespondWithError(w, http.StatusInternalServerError, "Failed to retrieve estimation: "+err.Error())
+			utils.RespondWithError(w, r, http.StatusInternalServerError, utils.ErrCodeDatabaseError, "Failed to retrieve estimation: "+err.Error())
 		}
 		return
 	}
 
+	// Estimations only change when soft-deleted or restored, so clients polling
+	// an unchanged one get a 304 instead of the same body again
+	etag := utils.ETag(estimation.ID, estimation.CreatedAt.Format(time.RFC3339Nano), deletedAtTag(estimation.DeletedAt), utils.ResponseContentType(r))
+	if utils.NotModified(w, r, etag) {
+		return
+	}
+
 	// Create response
 	result := models.EstimationResult{
-		ID:        estimation.ID,
-		Height:    estimation.Height,
-		Weight:    estimation.Weight,
-		Accuracy:  estimation.Accuracy,
-		CreatedAt: estimation.CreatedAt,
+		ID:           estimation.ID,
+		Height:       round(estimation.Height),
+		Weight:       round(estimation.Weight),
+		Accuracy:     estimation.Accuracy,
+		Measurements: estimation.Measurements,
+		ImageURL:     imageURL(estimation.ID, ""),
+		CreatedAt:    estimation.CreatedAt,
+		DeletedAt:    estimation.DeletedAt,
 	}
 
-	utils.RespondWithJSON(w, http.StatusOK, result)
+	utils.RespondWithData(w, r, http.StatusOK, result)
 }
 
+// maxBatchIDs caps the estimations requested at once from the batch endpoint
+const maxBatchIDs = 100
+
+// GetEstimationsBatchHandler returns the estimations with the IDs listed in a
+// {"ids": [...]} body, in the order requested, fetched in a single query. IDs
+// without an estimation are listed under not_found instead of failing.
+func GetEstimationsBatchHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		IDs []string `json:"ids"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.RespondWithError(w, r, http.StatusBadRequest, utils.ErrCodeInvalidRequest, "Invalid JSON body: "+err.Error())
+		return
+	}
+
+	// Repeated IDs are only looked up and returned once
+	ids := make([]string, 0, len(req.IDs))
+	seen := make(map[string]bool, len(req.IDs))
+	for _, id := range req.IDs {
+		if id == "" {
+			utils.RespondWithError(w, r, http.StatusBadRequest, utils.ErrCodeInvalidID, "Empty image ID")
+			return
+		}
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		utils.RespondWithError(w, r, http.StatusBadRequest, utils.ErrCodeInvalidRequest, "At least one ID is required")
+		return
+	}
+	if len(ids) > maxBatchIDs {
+		utils.RespondWithError(w, r, http.StatusBadRequest, utils.ErrCodeInvalidRequest, fmt.Sprintf("Too many IDs: %d requested, at most %d allowed", len(ids), maxBatchIDs))
+		return
+	}
+
+	includeDeleted := r.URL.Query().Get("include_deleted") == "true"
+
+	estimations, err := db.GetEstimationsByIDs(ids, includeDeleted)
+	if err != nil {
+		utils.RespondWithError(w, r, http.StatusInternalServerError, utils.ErrCodeDatabaseError, "Failed to retrieve estimations: "+err.Error())
+		return
+	}
+
+	byID := make(map[string]models.Estimation, len(estimations))
+	for _, est := range estimations {
+		byID[est.ID] = est
+	}
+
+	results := []models.EstimationResult{}
+	notFound := []string{}
+	for _, id := range ids {
+		est, ok := byID[id]
+		if !ok {
+			notFound = append(notFound, id)
+			continue
+		}
+		results = append(results, models.EstimationResult{
+			ID:           est.ID,
+			Height:       round(est.Height),
+			Weight:       round(est.Weight),
+			Accuracy:     est.Accuracy,
+			Measurements: est.Measurements,
+			ImageURL:     imageURL(est.ID, ""),
+			CreatedAt:    est.CreatedAt,
+			DeletedAt:    est.DeletedAt,
+		})
+	}
+
+	utils.RespondWithData(w, r, http.StatusOK, map[string]interface{}{
+		"estimations": results,
+		"not_found":   notFound,
+	})
+}
+
+// deletedAtTag formats a soft-delete timestamp for ETags, empty when unset
+func deletedAtTag(deletedAt *time.Time) string {
+	if deletedAt == nil {
+		return ""
+	}
+	return deletedAt.Format(time.RFC3339Nano)
+}
+
+// skippedRecordsHeader reports how many malformed records a list left out
+const skippedRecordsHeader = "X-Skipped-Records"
+
 // ListEstimationsHandler returns a list of estimations with pagination
 func ListEstimationsHandler(w http.ResponseWriter, r *http.Request) {
 	limit := 10
@@ -64,26 +167,47 @@ func ListEstimationsHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	includeDeleted := r.URL.Query().Get("include_deleted") == "true"
+
 	// Get estimations from database
-	estimations, err := db.ListEstimations(limit, offset)
+	estimations, skipped, err := db.ListEstimations(limit, offset, includeDeleted)
 	if err != nil {
-		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to retrieve estimations: "+err.Error())
+		utils.RespondWithError(w, r, http.StatusInternalServerError, utils.ErrCodeDatabaseError, "Failed to retrieve estimations: "+err.Error())
 		return
 	}
 
+	// Let clients know the list is missing records that couldn't be read
+	if skipped > 0 {
+		w.Header().Set(skippedRecordsHeader, strconv.Itoa(skipped))
+	}
+
 	// Convert to response format
 	var results []models.EstimationResult
 	for _, est := range estimations {
 		results = append(results, models.EstimationResult{
-			ID:        est.ID,
-			Height:    est.Height,
-			Weight:    est.Weight,
-			Accuracy:  est.Accuracy,
-			CreatedAt: est.CreatedAt,
+			ID:           est.ID,
+			Height:       round(est.Height),
+			Weight:       round(est.Weight),
+			Accuracy:     est.Accuracy,
+			Measurements: est.Measurements,
+			ImageURL:     imageURL(est.ID, ""),
+			CreatedAt:    est.CreatedAt,
+			DeletedAt:    est.DeletedAt,
 		})
 	}
 
-	utils.RespondWithJSON(w, http.StatusOK, results)
+	// Wrap the results with pagination metadata when requested
+	if r.URL.Query().Get("paginated") == "true" {
+		total, err := db.CountEstimations(includeDeleted)
+		if err != nil {
+			utils.RespondWithError(w, r, http.StatusInternalServerError, utils.ErrCodeDatabaseError, "Failed to count estimations: "+err.Error())
+			return
+		}
+		utils.RespondWithData(w, r, http.StatusOK, utils.NewPage(results, len(results), total, int64(limit), int64(offset)))
+		return
+	}
+
+	utils.RespondWithData(w, r, http.StatusOK, results)
 }
 
 // DeleteEstimationHandler deletes an estimation by ID
@@ -92,24 +216,31 @@ func DeleteEstimationHandler(w http.ResponseWriter, r *http.Request) {
 	imageID := vars["imageID"]
 
 	if imageID == "" {
-		utils.RespondWithError(w, http.StatusBadRequest, "Missing image ID")
+		utils.RespondWithError(w, r, http.StatusBadRequest, utils.ErrCodeInvalidID, "Missing image ID")
 		return
 	}
 
 	// First get the estimation to check if it exists and to get the image path
-	estimation, err := db.GetEstimationByID(imageID)
+	estimation, err := db.GetEstimationByID(imageID, false)
 	if err != nil {
 		if err == mongo.ErrNoDocuments {
-			utils.RespondWithError(w, http.StatusNotFound, "Estimation not found")
+			utils.RespondWithError(w, r, http.StatusNotFound, utils.ErrCodeNotFound, "Estimation not found")
 		} else {
-			utils.RespondWithError(w, http.StatusInternalServerError, "Failed to retrieve estimation: "+err.Error())
+			utils.RespondWithError(w, r, http.StatusInternalServerError, utils.ErrCodeDatabaseError, "Failed to retrieve estimation: "+err.Error())
 		}
 		return
 	}
 
 	// Delete from database
 	if err := db.DeleteEstimation(imageID); err != nil {
-		utils.RespondWithError(w, http.StatusInternalServerError, "Failed to delete estimation: "+err.Error())
+		utils.RespondWithError(w, r, http.StatusInternalServerError, utils.ErrCodeDatabaseError, "Failed to delete estimation: "+err.Error())
+		return
+	}
+	recordAudit(r, models.AuditActionDelete, imageID, nil)
+
+	// Keep the image file around while the estimation can still be restored
+	if db.SoftDeleteEnabled() {
+		utils.RespondWithData(w, r, http.StatusOK, map[string]string{"message": "Estimation deleted successfully"})
 		return
 	}
 
@@ -119,5 +250,28 @@ func DeleteEstimationHandler(w http.ResponseWriter, r *http.Request) {
 		log.Printf("Warning: Failed to delete image file %s: %v", estimation.ImagePath, err)
 	}
 
-	utils.RespondWithJSON(w, http.StatusOK, map[string]string{"message": "Estimation deleted successfully"})
+	utils.RespondWithData(w, r, http.StatusOK, map[string]string{"message": "Estimation deleted successfully"})
+}
+
+// RestoreEstimationHandler restores a soft-deleted estimation by ID
+func RestoreEstimationHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	imageID := vars["imageID"]
+
+	if imageID == "" {
+		utils.RespondWithError(w, r, http.StatusBadRequest, utils.ErrCodeInvalidID, "Missing image ID")
+		return
+	}
+
+	if err := db.RestoreEstimation(imageID); err != nil {
+		if err == mongo.ErrNoDocuments {
+			utils.RespondWithError(w, r, http.StatusNotFound, utils.ErrCodeNotFound, "Deleted estimation not found")
+		} else {
+			utils.RespondWithError(w, r, http.StatusInternalServerError, utils.ErrCodeDatabaseError, "Failed to restore estimation: "+err.Error())
+		}
+		return
+	}
+	recordAudit(r, models.AuditActionRestore, imageID, nil)
+
+	utils.RespondWithData(w, r, http.StatusOK, map[string]string{"message": "Estimation restored successfully"})
 }
@@ -0,0 +1,239 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lucasfepe/height-weight-api/db"
+	"github.com/lucasfepe/height-weight-api/models"
+	"github.com/lucasfepe/height-weight-api/utils"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// seedEstimation saves a legacy estimation with an image file in the upload
+// directory and returns it
+func seedEstimation(t *testing.T, uploadDir, id string, createdAt time.Time) *models.Estimation {
+	t.Helper()
+	path := filepath.Join(uploadDir, id+".jpg")
+	if err := os.WriteFile(path, []byte("image"), 0o644); err != nil {
+		t.Fatalf("write image: %v", err)
+	}
+	estimation := &models.Estimation{ID: id, ImagePath: path, Height: 175, Weight: 70, CreatedAt: createdAt}
+	if err := db.SaveEstimation(estimation); err != nil {
+		t.Fatalf("SaveEstimation: %v", err)
+	}
+	return estimation
+}
+
+// withImageID routes r as if it matched a route with an {imageID} variable
+func withImageID(r *http.Request, id string) *http.Request {
+	return mux.SetURLVars(r, map[string]string{"imageID": id})
+}
+
+// listedIDs returns the IDs of the estimations listed at target
+func listedIDs(t *testing.T, target string) []string {
+	t.Helper()
+	w, response := serve(t, http.HandlerFunc(ListEstimationsHandler), httptest.NewRequest(http.MethodGet, target, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("list %s: got %d (%s)", target, w.Code, response.Message)
+	}
+	var results []models.EstimationResult
+	if err := json.Unmarshal(response.Data, &results); err != nil {
+		t.Fatalf("decode list: %v", err)
+	}
+	ids := make([]string, len(results))
+	for i, result := range results {
+		ids[i] = result.ID
+	}
+	return ids
+}
+
+func TestSoftDeleteAndRestore(t *testing.T) {
+	cfg := testDatabase(t, map[string]string{"SOFT_DELETE": "true"})
+	kept := seedEstimation(t, cfg.UploadDir, "kept", time.Now().Add(-time.Minute))
+	deleted := seedEstimation(t, cfg.UploadDir, "deleted", time.Now())
+
+	r := withImageID(httptest.NewRequest(http.MethodDelete, "/estimate/deleted", nil), deleted.ID)
+	if w, response := serve(t, http.HandlerFunc(DeleteEstimationHandler), r); w.Code != http.StatusOK {
+		t.Fatalf("delete: got %d (%s)", w.Code, response.Message)
+	}
+	if _, err := os.Stat(deleted.ImagePath); err != nil {
+		t.Errorf("soft-deleted estimation's image is gone: %v", err)
+	}
+
+	if ids := listedIDs(t, "/estimates"); len(ids) != 1 || ids[0] != kept.ID {
+		t.Errorf("list after delete = %v, want only %s", ids, kept.ID)
+	}
+	if ids := listedIDs(t, "/estimates?include_deleted=true"); len(ids) != 2 {
+		t.Errorf("list with include_deleted = %v, want both estimations", ids)
+	}
+	r = withImageID(httptest.NewRequest(http.MethodGet, "/estimate/deleted", nil), deleted.ID)
+	if w, _ := serve(t, http.HandlerFunc(GetEstimationHandler), r); w.Code != http.StatusNotFound {
+		t.Errorf("get deleted estimation: got %d, want 404", w.Code)
+	}
+
+	r = withImageID(httptest.NewRequest(http.MethodPost, "/estimate/deleted/restore", nil), deleted.ID)
+	if w, response := serve(t, http.HandlerFunc(RestoreEstimationHandler), r); w.Code != http.StatusOK {
+		t.Fatalf("restore: got %d (%s)", w.Code, response.Message)
+	}
+	if ids := listedIDs(t, "/estimates"); len(ids) != 2 {
+		t.Errorf("list after restore = %v, want both estimations", ids)
+	}
+
+	// Only deleted estimations can be restored
+	r = withImageID(httptest.NewRequest(http.MethodPost, "/estimate/kept/restore", nil), kept.ID)
+	if w, _ := serve(t, http.HandlerFunc(RestoreEstimationHandler), r); w.Code != http.StatusNotFound {
+		t.Errorf("restore of a live estimation: got %d, want 404", w.Code)
+	}
+}
+
+func TestHardDelete(t *testing.T) {
+	cfg := testDatabase(t, map[string]string{"SOFT_DELETE": "false"})
+	estimation := seedEstimation(t, cfg.UploadDir, "gone", time.Now())
+
+	r := withImageID(httptest.NewRequest(http.MethodDelete, "/estimate/gone", nil), estimation.ID)
+	if w, response := serve(t, http.HandlerFunc(DeleteEstimationHandler), r); w.Code != http.StatusOK {
+		t.Fatalf("delete: got %d (%s)", w.Code, response.Message)
+	}
+	if _, err := os.Stat(estimation.ImagePath); !os.IsNotExist(err) {
+		t.Errorf("deleted estimation's image still exists: %v", err)
+	}
+	if ids := listedIDs(t, "/estimates?include_deleted=true"); len(ids) != 0 {
+		t.Errorf("list after hard delete = %v, want none", ids)
+	}
+
+	r = withImageID(httptest.NewRequest(http.MethodPost, "/estimate/gone/restore", nil), estimation.ID)
+	if w, _ := serve(t, http.HandlerFunc(RestoreEstimationHandler), r); w.Code != http.StatusNotFound {
+		t.Errorf("restore after hard delete: got %d, want 404", w.Code)
+	}
+}
+
+func TestListEstimationsSkippedHeader(t *testing.T) {
+	cfg := testDatabase(t, nil)
+	seedEstimation(t, cfg.UploadDir, "valid", time.Now())
+
+	list := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		ListEstimationsHandler(w, httptest.NewRequest(http.MethodGet, "/estimates", nil))
+		return w
+	}
+	if skipped := list().Header().Get(skippedRecordsHeader); skipped != "" {
+		t.Errorf("%s = %q without malformed records, want it unset", skippedRecordsHeader, skipped)
+	}
+
+	malformed := bson.M{"id": "malformed", "height": "tall", "created_at": time.Now()}
+	if _, err := models.DB.Collection(cfg.MongoCollection).InsertOne(context.Background(), malformed); err != nil {
+		t.Fatalf("insert malformed estimation: %v", err)
+	}
+	w := list()
+	if skipped := w.Header().Get(skippedRecordsHeader); skipped != "1" {
+		t.Errorf("%s = %q, want 1", skippedRecordsHeader, skipped)
+	}
+	if ids := listedIDs(t, "/estimates"); len(ids) != 1 || ids[0] != "valid" {
+		t.Errorf("listed %v, want only the valid estimation", ids)
+	}
+}
+
+func TestGetEstimationConditional(t *testing.T) {
+	cfg := testDatabase(t, map[string]string{"SOFT_DELETE": "true"})
+	estimation := seedEstimation(t, cfg.UploadDir, "cached", time.Now())
+
+	get := func(ifNoneMatch, query string) *httptest.ResponseRecorder {
+		r := withImageID(httptest.NewRequest(http.MethodGet, "/estimate/cached"+query, nil), estimation.ID)
+		if ifNoneMatch != "" {
+			r.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		w := httptest.NewRecorder()
+		GetEstimationHandler(w, r)
+		return w
+	}
+
+	first := get("", "")
+	etag := first.Header().Get("ETag")
+	if first.Code != http.StatusOK || etag == "" {
+		t.Fatalf("first get = %d with ETag %q, want 200 with an ETag", first.Code, etag)
+	}
+
+	again := get(etag, "")
+	if again.Code != http.StatusNotModified || again.Body.Len() != 0 {
+		t.Errorf("conditional get = %d with %d body bytes, want 304 without a body", again.Code, again.Body.Len())
+	}
+	if stale := get(`"stale"`, ""); stale.Code != http.StatusOK {
+		t.Errorf("get with a stale ETag = %d, want 200", stale.Code)
+	}
+
+	// Soft-deleting changes the representation, so the old ETag no longer matches
+	r := withImageID(httptest.NewRequest(http.MethodDelete, "/estimate/cached", nil), estimation.ID)
+	if w, response := serve(t, http.HandlerFunc(DeleteEstimationHandler), r); w.Code != http.StatusOK {
+		t.Fatalf("delete: got %d (%s)", w.Code, response.Message)
+	}
+	deleted := get(etag, "?include_deleted=true")
+	if deleted.Code != http.StatusOK || deleted.Header().Get("ETag") == etag {
+		t.Errorf("get after delete = %d with ETag %q, want 200 with a new ETag", deleted.Code, deleted.Header().Get("ETag"))
+	}
+}
+
+func TestGetEstimationsBatch(t *testing.T) {
+	cfg := testDatabase(t, nil)
+	seedEstimation(t, cfg.UploadDir, "first", time.Now().Add(-time.Minute))
+	seedEstimation(t, cfg.UploadDir, "second", time.Now())
+
+	body := map[string][]string{"ids": {"second", "missing", "first", "second"}}
+	w, response := serve(t, http.HandlerFunc(GetEstimationsBatchHandler), newJSONRequest(t, "/estimates/batch", body))
+	if w.Code != http.StatusOK {
+		t.Fatalf("batch: got %d %s (%s), want 200", w.Code, response.ErrorCode, response.Message)
+	}
+	var data struct {
+		Estimations []models.EstimationResult `json:"estimations"`
+		NotFound    []string                  `json:"not_found"`
+	}
+	if err := json.Unmarshal(response.Data, &data); err != nil {
+		t.Fatalf("decode %s: %v", response.Data, err)
+	}
+
+	// Found estimations keep the requested order, each listed once
+	var ids []string
+	for _, est := range data.Estimations {
+		ids = append(ids, est.ID)
+	}
+	if len(ids) != 2 || ids[0] != "second" || ids[1] != "first" {
+		t.Errorf("estimations = %v, want [second first]", ids)
+	}
+	if len(data.NotFound) != 1 || data.NotFound[0] != "missing" {
+		t.Errorf("not_found = %v, want [missing]", data.NotFound)
+	}
+}
+
+func TestGetEstimationsBatchInvalid(t *testing.T) {
+	tooMany := make([]string, maxBatchIDs+1)
+	for i := range tooMany {
+		tooMany[i] = fmt.Sprintf("id-%d", i)
+	}
+
+	tests := []struct {
+		name string
+		ids  []string
+		want string
+	}{
+		{"no IDs", nil, utils.ErrCodeInvalidRequest},
+		{"empty ID", []string{"first", ""}, utils.ErrCodeInvalidID},
+		{"too many IDs", tooMany, utils.ErrCodeInvalidRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := map[string][]string{"ids": tt.ids}
+			w, response := serve(t, http.HandlerFunc(GetEstimationsBatchHandler), newJSONRequest(t, "/estimates/batch", body))
+			if w.Code != http.StatusBadRequest || response.ErrorCode != tt.want {
+				t.Errorf("got %d %s (%s), want 400 %s", w.Code, response.ErrorCode, response.Message, tt.want)
+			}
+		})
+	}
+}
@@ -1,22 +1,128 @@
 package handlers
 
 import (
-	"encoding/json"
+	"context"
+	"fmt"
 	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/lucasfepe/height-weight-api/config"
+	"github.com/lucasfepe/height-weight-api/db"
+	"github.com/lucasfepe/height-weight-api/utils"
 )
 
+// readinessTimeout bounds each dependency check of the readiness probe
+const readinessTimeout = 2 * time.Second
+
+// mlHealthCacheTTL is how long an ML service health result and version are
+// reused, so frequent probes don't hammer the ML service
+const mlHealthCacheTTL = 10 * time.Second
+
 // HealthResponse represents the health check response
 type HealthResponse struct {
-	Status string `json:"status"`
+	Status     string            `json:"status"`
+	MLCircuit  string            `json:"ml_circuit,omitempty"`  // Circuit breaker state of the default model's ML service
+	MLCircuits map[string]string `json:"ml_circuits,omitempty"` // Circuit breaker state per model
+}
+
+// ReadinessResponse represents the readiness check response
+type ReadinessResponse struct {
+	Status        string            `json:"status"`
+	Checks        map[string]string `json:"checks"`                    // "ok" or the failure reason per dependency
+	DiskFreeBytes *uint64           `json:"disk_free_bytes,omitempty"` // Free space for uploads, absent if it couldn't be measured
+	MLVersion     string            `json:"ml_version,omitempty"`      // Live ML service version, "unknown" if it doesn't report one
+}
+
+// NewHealthCheckHandler creates a handler for health check requests,
+// reporting the circuit breaker state of each model's ML service
+func NewHealthCheckHandler(ml *utils.MLClients) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		states := ml.CircuitStates()
+		defaultModel, _, _ := ml.Resolve("")
+
+		response := HealthResponse{
+			Status:     "OK",
+			MLCircuit:  states[defaultModel],
+			MLCircuits: states,
+		}
+
+		utils.Respond(w, r, http.StatusOK, response)
+	}
 }
 
-// HealthCheckHandler handles health check requests
-func HealthCheckHandler(w http.ResponseWriter, r *http.Request) {
-	response := HealthResponse{
-		Status: "OK",
+// NewReadinessHandler creates a handler reporting whether MongoDB and the ML
+// service are reachable and the upload disk has room left. It responds 503
+// if any check fails.
+func NewReadinessHandler(cfg *config.Config) http.HandlerFunc {
+	var (
+		mu        sync.Mutex
+		checkedAt time.Time
+		mlErr     error
+		mlVersion string
+	)
+
+	// pingML returns the cached ML service health and version, refreshing
+	// them once stale
+	pingML := func(ctx context.Context) (string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if time.Since(checkedAt) < mlHealthCacheTTL {
+			return mlVersion, mlErr
+		}
+		auth := utils.NewMLAuth(cfg)
+		mlErr = utils.PingMLService(ctx, cfg.MLServiceURL, auth)
+		mlVersion = utils.UnknownMLVersion
+		if mlErr == nil {
+			mlVersion = utils.MLServiceVersion(ctx, cfg.MLServiceURL, auth)
+		}
+		checkedAt = time.Now()
+		return mlVersion, mlErr
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(response)
-} 
\ No newline at end of file
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+		defer cancel()
+
+		response := ReadinessResponse{
+			Status: "ready",
+			Checks: map[string]string{},
+		}
+		statusCode := http.StatusOK
+
+		check := func(name string, err error) {
+			if err != nil {
+				response.Checks[name] = err.Error()
+				response.Status = "not ready"
+				statusCode = http.StatusServiceUnavailable
+				return
+			}
+			response.Checks[name] = "ok"
+		}
+
+		check("mongodb", db.Ping(ctx))
+
+		// Uploads start failing once the disk fills up
+		free, err := utils.DiskFree(cfg.UploadDir)
+		if err == nil {
+			response.DiskFreeBytes = &free
+			if free < uint64(cfg.MinFreeDiskBytes) {
+				err = fmt.Errorf("%d bytes free, below the minimum of %d", free, cfg.MinFreeDiskBytes)
+			}
+		}
+		check("disk", err)
+
+		// Dev mode predicts with the mock, so the ML service isn't needed
+		if os.Getenv("DEV_MODE") == "true" {
+			response.Checks["ml_service"] = "skipped (DEV_MODE)"
+		} else {
+			version, err := pingML(ctx)
+			response.MLVersion = version
+			check("ml_service", err)
+		}
+
+		utils.Respond(w, r, statusCode, response)
+	}
+}
@@ -0,0 +1,183 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lucasfepe/height-weight-api/internal/testutil"
+	"github.com/lucasfepe/height-weight-api/utils"
+)
+
+func TestHealthCheckReportsCircuitPerModel(t *testing.T) {
+	failing := utils.NewCircuitBreaker(1, time.Minute)
+	if err := failing.Allow(); err != nil {
+		t.Fatalf("fresh breaker refused a call: %v", err)
+	}
+	failing.RecordFailure()
+
+	clients := utils.NewMLClients(map[string]utils.MLService{
+		"a": utils.NewMLClient("http://127.0.0.1:1", time.Second, 0, 0, utils.MLAuth{}, nil, failing),
+		"b": utils.NewMLClient("http://127.0.0.1:1", time.Second, 0, 0, utils.MLAuth{}, nil, utils.NewCircuitBreaker(1, time.Minute)),
+	}, "b")
+
+	w := httptest.NewRecorder()
+	NewHealthCheckHandler(clients).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/health", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+	}
+
+	var health HealthResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &health); err != nil {
+		t.Fatalf("decode health: %v", err)
+	}
+	if health.MLCircuit != utils.CircuitClosed {
+		t.Errorf("ml_circuit = %q, want the default model's %q", health.MLCircuit, utils.CircuitClosed)
+	}
+	if health.MLCircuits["a"] != utils.CircuitOpen || health.MLCircuits["b"] != utils.CircuitClosed {
+		t.Errorf("ml_circuits = %v, want a open and b closed", health.MLCircuits)
+	}
+}
+
+// readiness runs a readiness probe and decodes its response
+func readiness(t *testing.T, handler http.Handler) (int, ReadinessResponse) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/ready", nil))
+
+	var response ReadinessResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("decode readiness %q: %v", w.Body.String(), err)
+	}
+	return w.Code, response
+}
+
+func TestReadinessMLService(t *testing.T) {
+	t.Setenv("DEV_MODE", "false")
+	var healthy atomic.Bool
+	var probes atomic.Int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" {
+			probes.Add(1)
+		}
+		if !healthy.Load() {
+			http.Error(w, "model not loaded", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"status":"ok"}`))
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name    string
+		healthy bool
+	}{
+		{"up", true},
+		{"down", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			healthy.Store(tt.healthy)
+			handler := NewReadinessHandler(testutil.Config(t, map[string]string{"ML_SERVICE_URL": server.URL}))
+
+			code, response := readiness(t, handler)
+			if ok := response.Checks["ml_service"] == "ok"; ok != tt.healthy {
+				t.Errorf("ml_service check = %q, want ok %v", response.Checks["ml_service"], tt.healthy)
+			}
+			// Without a database the probe is never ready
+			if code != http.StatusServiceUnavailable {
+				t.Errorf("status = %d, want %d", code, http.StatusServiceUnavailable)
+			}
+
+			// The result is cached, so a flapping service isn't probed again right away
+			before := probes.Load()
+			healthy.Store(!tt.healthy)
+			if _, response := readiness(t, handler); (response.Checks["ml_service"] == "ok") != tt.healthy {
+				t.Errorf("cached ml_service check = %q, want ok %v", response.Checks["ml_service"], tt.healthy)
+			}
+			if probes.Load() != before {
+				t.Error("ML service probed again within the cache TTL")
+			}
+		})
+	}
+
+	t.Run("unreachable", func(t *testing.T) {
+		down := httptest.NewServer(http.NotFoundHandler())
+		down.Close()
+		handler := NewReadinessHandler(testutil.Config(t, map[string]string{"ML_SERVICE_URL": down.URL}))
+		if _, response := readiness(t, handler); response.Checks["ml_service"] == "ok" {
+			t.Error("ml_service check ok with the service down")
+		}
+	})
+
+	t.Run("dev mode", func(t *testing.T) {
+		t.Setenv("DEV_MODE", "true")
+		handler := NewReadinessHandler(testutil.Config(t, map[string]string{"ML_SERVICE_URL": server.URL}))
+		before := probes.Load()
+		if _, response := readiness(t, handler); response.Checks["ml_service"] != "skipped (DEV_MODE)" {
+			t.Errorf("ml_service check = %q, want it skipped", response.Checks["ml_service"])
+		}
+		if probes.Load() != before {
+			t.Error("ML service probed in dev mode")
+		}
+	})
+}
+
+func TestReadinessMLVersion(t *testing.T) {
+	t.Setenv("DEV_MODE", "false")
+	tests := []struct {
+		name    string
+		version string
+		want    string
+	}{
+		{"reported", `{"version":"2.1.0"}`, "2.1.0"},
+		{"not reported", "", utils.UnknownMLVersion},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/version" && tt.version != "" {
+					w.Write([]byte(tt.version))
+					return
+				}
+				w.Write([]byte(`{"status":"ok"}`))
+			}))
+			defer server.Close()
+
+			handler := NewReadinessHandler(testutil.Config(t, map[string]string{"ML_SERVICE_URL": server.URL}))
+			if _, response := readiness(t, handler); response.MLVersion != tt.want {
+				t.Errorf("ml_version = %q, want %q", response.MLVersion, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadinessDisk(t *testing.T) {
+	t.Setenv("DEV_MODE", "true")
+
+	tests := []struct {
+		name      string
+		minFree   string
+		wantReady bool
+	}{
+		{"room left", "1", true},
+		{"below the threshold", "9000000000000000000", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := NewReadinessHandler(testutil.Config(t, map[string]string{"MIN_FREE_DISK_BYTES": tt.minFree}))
+
+			// disk_free_bytes only decodes into the response as a number
+			_, response := readiness(t, handler)
+			if response.DiskFreeBytes == nil || *response.DiskFreeBytes == 0 {
+				t.Errorf("disk_free_bytes = %v, want the free bytes", response.DiskFreeBytes)
+			}
+			if ok := response.Checks["disk"] == "ok"; ok != tt.wantReady {
+				t.Errorf("disk check = %q, want ok %v", response.Checks["disk"], tt.wantReady)
+			}
+		})
+	}
+}
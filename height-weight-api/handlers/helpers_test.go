@@ -0,0 +1,249 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"io/fs"
+	"math/rand"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lucasfepe/height-weight-api/config"
+	"github.com/lucasfepe/height-weight-api/db"
+	"github.com/lucasfepe/height-weight-api/internal/testutil"
+	"github.com/lucasfepe/height-weight-api/models"
+	"github.com/lucasfepe/height-weight-api/utils"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// testDatabase connects to a database of the test's own on the MongoDB at
+// MONGO_TEST_URI, dropped when the test ends, and returns the configuration
+// it connected with. Tests needing a database are skipped without one.
+func testDatabase(t *testing.T, env map[string]string) *config.Config {
+	t.Helper()
+	cfg := testutil.DatabaseConfig(t, env)
+	if err := db.InitMongoDB(cfg); err != nil {
+		t.Fatalf("InitMongoDB: %v", err)
+	}
+	t.Cleanup(func() {
+		models.DB.Drop(context.Background())
+		db.CloseMongoDB()
+		models.DB = nil
+	})
+	return cfg
+}
+
+// failingDatabase points models.DB at a server that isn't listening, so
+// every database operation fails shortly instead of being skipped
+func failingDatabase(t *testing.T) {
+	t.Helper()
+	client, err := mongo.Connect(context.Background(), options.Client().ApplyURI(testutil.UnreachableMongoURI).SetServerSelectionTimeout(100*time.Millisecond))
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	models.DB = client.Database("height_weight_unreachable")
+	t.Cleanup(func() {
+		client.Disconnect(context.Background())
+		models.DB = nil
+	})
+}
+
+// fakeMLService predicts a fixed weight, or fails with err, counting the
+// weight predictions it is asked for
+type fakeMLService struct {
+	weight          float64
+	predictedHeight float64
+	measurements    map[string]float64
+	faces           []image.Rectangle // Returned by face detection
+	err             error
+	calls           atomic.Int64
+	// block, when set, holds each prediction until it is closed or the context is done
+	block chan struct{}
+	// onPredict, when set, runs as each weight prediction starts
+	onPredict func()
+	mu        sync.Mutex
+	views     []string // Side views of the latest weight prediction
+}
+
+// lastViews returns the side views of the latest weight prediction
+func (f *fakeMLService) lastViews() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Clone(f.views)
+}
+
+func (f *fakeMLService) PredictWeight(ctx context.Context, front io.Reader, sides []utils.SideImage, height float64) (*utils.ModelResponse, error) {
+	f.calls.Add(1)
+	f.mu.Lock()
+	f.views = f.views[:0]
+	for _, side := range sides {
+		f.views = append(f.views, side.View)
+	}
+	f.mu.Unlock()
+	if f.onPredict != nil {
+		f.onPredict()
+	}
+	if f.block != nil {
+		select {
+		case <-f.block:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	if f.err != nil {
+		return nil, f.err
+	}
+	return &utils.ModelResponse{Weight: f.weight, PredictedHeight: f.predictedHeight, Measurements: f.measurements, Mode: utils.PredictionModeModel}, nil
+}
+
+func (f *fakeMLService) Predict(ctx context.Context, image io.Reader) (*models.MLServiceResponse, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	return &models.MLServiceResponse{Height: 170, Weight: f.weight}, nil
+}
+
+func (f *fakeMLService) DetectFaces(ctx context.Context, img io.Reader) ([]image.Rectangle, error) {
+	return f.faces, f.err
+}
+
+// fakeMLClients serves every request with service as the default model
+func fakeMLClients(service utils.MLService) *utils.MLClients {
+	return utils.NewMLClients(map[string]utils.MLService{"default": service}, "default")
+}
+
+// testPNG encodes a width by height PNG filled with shade, so images of
+// different shades are distinct
+func testPNG(t *testing.T, width, height int, shade uint8) []byte {
+	t.Helper()
+	img := image.NewGray(image.Rect(0, 0, width, height))
+	for i := range img.Pix {
+		img.Pix[i] = shade
+	}
+	// A stripe keeps the image from being perfectly flat for the quality checks
+	for y := 0; y < height; y++ {
+		img.SetGray(width/2, y, color.Gray{Y: 255 - shade})
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatalf("encode PNG: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// noisyPNG encodes a width by height PNG of random gray pixels, which barely
+// compresses, for uploads of a predictable size
+func noisyPNG(t *testing.T, width, height int, seed int64) []byte {
+	t.Helper()
+	rng := rand.New(rand.NewSource(seed))
+	img := image.NewGray(image.Rect(0, 0, width, height))
+	rng.Read(img.Pix)
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatalf("encode PNG: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// newMultipartRequest builds a POST to target with fields and files, each
+// file uploaded as <field>.png
+func newMultipartRequest(t *testing.T, target string, fields map[string]string, files map[string][]byte) *http.Request {
+	t.Helper()
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	for name, value := range fields {
+		if err := writer.WriteField(name, value); err != nil {
+			t.Fatalf("write field: %v", err)
+		}
+	}
+	for name, data := range files {
+		part, err := writer.CreateFormFile(name, name+".png")
+		if err != nil {
+			t.Fatalf("create form file: %v", err)
+		}
+		part.Write(data)
+	}
+	writer.Close()
+
+	r := httptest.NewRequest(http.MethodPost, target, &body)
+	r.Header.Set("Content-Type", writer.FormDataContentType())
+	return r
+}
+
+// newEstimateRequest builds a weight estimation of a person of height cm,
+// with distinct front and side images
+func newEstimateRequest(t *testing.T, height string) *http.Request {
+	t.Helper()
+	return newMultipartRequest(t, "/estimate-weight", map[string]string{"height": height},
+		map[string][]byte{"front_image": testPNG(t, 64, 96, 40), "side_image": testPNG(t, 64, 96, 80)})
+}
+
+// newJSONRequest builds a POST to target with body encoded as JSON
+func newJSONRequest(t *testing.T, target string, body interface{}) *http.Request {
+	t.Helper()
+	data, err := json.Marshal(body)
+	if err != nil {
+		t.Fatalf("marshal body: %v", err)
+	}
+	r := httptest.NewRequest(http.MethodPost, target, bytes.NewReader(data))
+	r.Header.Set("Content-Type", "application/json")
+	return r
+}
+
+// testResponse is the envelope of a JSON response, with its data and error
+// details left raw
+type testResponse struct {
+	Success    bool            `json:"success"`
+	APIVersion string          `json:"api_version"`
+	Data       json.RawMessage `json:"data"`
+	Message    string          `json:"message"`
+	ErrorCode  string          `json:"error_code"`
+	Details    json.RawMessage `json:"details"`
+}
+
+// serve runs r through handler and decodes the JSON envelope of the response
+func serve(t *testing.T, handler http.Handler, r *http.Request) (*httptest.ResponseRecorder, testResponse) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	var response testResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("decode response %q: %v", w.Body.String(), err)
+	}
+	return w, response
+}
+
+// storedFiles lists the regular files under dir
+func storedFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	var files []string
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() {
+			files = append(files, path)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("walk %s: %v", dir, err)
+	}
+	return files
+}
@@ -0,0 +1,477 @@
+package handlers
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io"
+	"log"
+	"math"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/lucasfepe/height-weight-api/config"
+	"github.com/lucasfepe/height-weight-api/db"
+	"github.com/lucasfepe/height-weight-api/models"
+	"github.com/lucasfepe/height-weight-api/utils"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// RoutePrefix is the path the API routes are mounted under, which image URLs
+// start with
+var RoutePrefix = "/api"
+
+// imageURL returns the URL serving an estimation's image. view selects the
+// front or side image of a weight estimation and is empty for legacy estimations.
+func imageURL(id, view string) string {
+	url := RoutePrefix + "/images/" + id
+	if view != "" {
+		url += "?view=" + view
+	}
+	return url
+}
+
+// imageURLs returns the URLs serving a weight estimation's front and side
+// images, keyed by view
+func imageURLs(id string, sides []models.SideImage) map[string]string {
+	urls := map[string]string{"front": imageURL(id, "front")}
+	for _, side := range sides {
+		view := imageViewName(side.View)
+		urls[view] = imageURL(id, view)
+	}
+	return urls
+}
+
+// imageViewName returns the view an image uploaded as field is served as,
+// e.g. side_left for side_image_left
+func imageViewName(field string) string {
+	return strings.Replace(field, "_image", "", 1)
+}
+
+// sideViewLabels name the side views in messages
+var sideViewLabels = map[string]string{
+	utils.SideViewSingle: "Side",
+	utils.SideViewLeft:   "Left side",
+	utils.SideViewRight:  "Right side",
+}
+
+// ServeImage serves a stored image for an estimation ID. Weight estimations
+// (ObjectID hex IDs) take a view query parameter of front (default), side,
+// side_left or side_right, where side is the first side image stored.
+// The file path always comes from the database record, never from the request,
+// so the ID can't be used to reach arbitrary files.
+func ServeImage(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	var imagePath string
+	if primitive.IsValidObjectID(id) {
+		if models.DB == nil {
+			utils.RespondWithError(w, r, http.StatusInternalServerError, utils.ErrCodeDatabaseError, "Database not initialized")
+			return
+		}
+
+		estimation, err := models.GetWeightEstimationByID(id, utils.UserID(r.Context()))
+		if err != nil {
+			respondImageLookupError(w, r, err)
+			return
+		}
+
+		switch view := r.URL.Query().Get("view"); view {
+		case "", "front":
+			imagePath = estimation.FrontImgPath
+		case "side":
+			imagePath = estimation.SideImgPath
+		case imageViewName(utils.SideViewLeft), imageViewName(utils.SideViewRight):
+			for _, side := range estimation.Sides() {
+				if imageViewName(side.View) == view {
+					imagePath = side.Path
+				}
+			}
+		default:
+			utils.RespondWithError(w, r, http.StatusBadRequest, utils.ErrCodeInvalidRequest, "Invalid view, expected front, side, side_left or side_right")
+			return
+		}
+	} else {
+		estimation, err := db.GetEstimationByID(id, false)
+		if err != nil {
+			respondImageLookupError(w, r, err)
+			return
+		}
+		imagePath = estimation.ImagePath
+	}
+
+	if imagePath == "" {
+		utils.RespondWithError(w, r, http.StatusNotFound, utils.ErrCodeNotFound, "Image not found")
+		return
+	}
+
+	file, err := os.Open(imagePath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			utils.RespondWithError(w, r, http.StatusNotFound, utils.ErrCodeNotFound, "Image not found")
+		} else {
+			utils.RespondWithError(w, r, http.StatusInternalServerError, utils.ErrCodeStorageError, "Failed to open image: "+err.Error())
+		}
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		utils.RespondWithError(w, r, http.StatusInternalServerError, utils.ErrCodeStorageError, "Failed to read image: "+err.Error())
+		return
+	}
+
+	// Stored images never change, so clients may cache them
+	w.Header().Set("Cache-Control", "private, max-age=86400, immutable")
+	http.ServeContent(w, r, filepath.Base(imagePath), info.ModTime(), file)
+}
+
+// overlayQuality is the JPEG quality of annotated estimation images
+const overlayQuality = 90
+
+// ServeEstimationOverlay serves an estimation's image as a JPEG with its
+// height and weight drawn on, for demo UIs. Weight estimations (ObjectID hex
+// IDs) use the front image and the predicted height when the model made one.
+func ServeEstimationOverlay(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["imageID"]
+
+	var imagePath string
+	var annotation models.Estimation
+	if primitive.IsValidObjectID(id) {
+		if models.DB == nil {
+			utils.RespondWithError(w, r, http.StatusInternalServerError, utils.ErrCodeDatabaseError, "Database not initialized")
+			return
+		}
+
+		estimation, err := models.GetWeightEstimationByID(id, utils.UserID(r.Context()))
+		if err != nil {
+			respondImageLookupError(w, r, err)
+			return
+		}
+		imagePath = estimation.FrontImgPath
+		annotation = models.Estimation{Height: estimation.Height, Weight: estimation.Weight}
+		if estimation.PredictedHeight > 0 {
+			annotation.Height = estimation.PredictedHeight
+		}
+	} else {
+		estimation, err := db.GetEstimationByID(id, false)
+		if err != nil {
+			respondImageLookupError(w, r, err)
+			return
+		}
+		imagePath = estimation.ImagePath
+		annotation = *estimation
+	}
+
+	file, err := utils.OpenStoredImage(imagePath)
+	if err != nil {
+		if errors.Is(err, utils.ErrImageMissing) {
+			utils.RespondWithError(w, r, http.StatusNotFound, utils.ErrCodeNotFound, "Image not found")
+		} else {
+			utils.RespondWithError(w, r, http.StatusInternalServerError, utils.ErrCodeStorageError, "Failed to open image: "+err.Error())
+		}
+		return
+	}
+	defer file.Close()
+
+	img, _, err := image.Decode(file)
+	if err != nil {
+		utils.RespondWithError(w, r, http.StatusInternalServerError, utils.ErrCodeStorageError, "Failed to decode image: "+err.Error())
+		return
+	}
+	annotated, err := utils.AnnotateImage(img, &annotation)
+	if err != nil {
+		utils.RespondWithError(w, r, http.StatusInternalServerError, utils.ErrCodeInternal, "Failed to annotate image: "+err.Error())
+		return
+	}
+
+	// Encode before writing, so a failure can still be answered with an error
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, annotated, &jpeg.Options{Quality: overlayQuality}); err != nil {
+		utils.RespondWithError(w, r, http.StatusInternalServerError, utils.ErrCodeInternal, "Failed to encode image: "+err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf.Bytes())
+}
+
+// respondImageLookupError sends the error response for a failed estimation lookup
+func respondImageLookupError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		utils.RespondWithError(w, r, http.StatusNotFound, utils.ErrCodeNotFound, "Estimation not found")
+		return
+	}
+	utils.RespondWithError(w, r, http.StatusInternalServerError, utils.ErrCodeDatabaseError, "Failed to retrieve estimation: "+err.Error())
+}
+
+// removeMultipartFiles deletes the temp files holding the parts of r's
+// multipart form that didn't fit in memory. Stored uploads are separate
+// copies and stay in place.
+func removeMultipartFiles(r *http.Request) {
+	if r.MultipartForm == nil {
+		return
+	}
+	if err := r.MultipartForm.RemoveAll(); err != nil {
+		log.Printf("Warning: Failed to remove multipart temp files: %v", err)
+	}
+}
+
+// checkUploadLimits sends an error and returns false when a parsed multipart
+// form attaches more files, or more bytes of files, than the config allows,
+// so stray attachments are rejected before any image is processed
+func checkUploadLimits(w http.ResponseWriter, r *http.Request, cfg *config.Config) bool {
+	var count int
+	var total int64
+	for _, headers := range r.MultipartForm.File {
+		for _, header := range headers {
+			count++
+			total += header.Size
+		}
+	}
+
+	if count > cfg.MaxUploadFiles {
+		sendErrorResponse(w, r, http.StatusBadRequest, utils.ErrCodeTooManyFiles, fmt.Sprintf("Too many files: %d attached, at most %d allowed", count, cfg.MaxUploadFiles))
+		return false
+	}
+	if total > cfg.MaxUploadTotalSize {
+		sendErrorResponse(w, r, http.StatusRequestEntityTooLarge, utils.ErrCodeRequestTooLarge, fmt.Sprintf("Files too large: %d bytes attached, at most %d allowed", total, cfg.MaxUploadTotalSize))
+		return false
+	}
+	return true
+}
+
+// checkImageType checks that an upload is an image of an allowed MIME type,
+// sniffed from its content, and that its file name has an allowed extension.
+// Unnamed uploads only have their content checked. Images of an allowed type
+// must also be single-frame and of a color model the pipeline handles. It
+// returns the extension to save the image with, which follows the content
+// rather than the name, and rewinds the file. On failure it sends a 400 and
+// returns false.
+func checkImageType(w http.ResponseWriter, r *http.Request, cfg *config.Config, file io.ReadSeeker, name, label string) (string, bool) {
+	if name != "" && !allowedExt(cfg, strings.ToLower(filepath.Ext(name))) {
+		sendErrorResponse(w, r, http.StatusBadRequest, utils.ErrCodeUnsupportedFormat, label+" image has an unsupported file extension")
+		return "", false
+	}
+
+	// DetectContentType considers at most the first 512 bytes
+	header := make([]byte, 512)
+	n, err := io.ReadFull(file, header)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		sendErrorResponse(w, r, http.StatusInternalServerError, utils.ErrCodeStorageError, "Failed to read "+strings.ToLower(label)+" image: "+err.Error())
+		return "", false
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		sendErrorResponse(w, r, http.StatusInternalServerError, utils.ErrCodeStorageError, "Failed to read "+strings.ToLower(label)+" image: "+err.Error())
+		return "", false
+	}
+
+	mimeType, ext, ok := allowedImageType(cfg, header[:n])
+	if !ok {
+		sendErrorResponse(w, r, http.StatusBadRequest, utils.ErrCodeUnsupportedFormat, fmt.Sprintf("%s image has an unsupported type: %s", label, mimeType))
+		return "", false
+	}
+
+	data, err := io.ReadAll(file)
+	if err == nil {
+		_, err = file.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		sendErrorResponse(w, r, http.StatusInternalServerError, utils.ErrCodeStorageError, "Failed to read "+strings.ToLower(label)+" image: "+err.Error())
+		return "", false
+	}
+	if err := utils.CheckStillImage(data); err != nil {
+		sendStillImageError(w, r, err, label)
+		return "", false
+	}
+	if !checkImageDimensions(w, r, cfg, data, label) {
+		return "", false
+	}
+	return ext, true
+}
+
+// checkImageDimensions sends a 400 and returns false when the width or height
+// of an image is outside the configured bounds. Formats without a registered
+// decoder aren't checked.
+func checkImageDimensions(w http.ResponseWriter, r *http.Request, cfg *config.Config, data []byte, label string) bool {
+	if cfg.MinImageDimension <= 0 && cfg.MaxImageDimension <= 0 {
+		return true
+	}
+	imgConfig, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return true
+	}
+	if message := imageDimensionsProblem(cfg, imgConfig.Width, imgConfig.Height); message != "" {
+		sendErrorResponseWithDetails(w, r, http.StatusBadRequest, utils.ErrCodeInvalidImage, label+" "+message, map[string]interface{}{
+			"width":  imgConfig.Width,
+			"height": imgConfig.Height,
+		})
+		return false
+	}
+	return true
+}
+
+// imageDimensionsProblem describes why an image of width by height pixels is
+// outside the configured bounds, or returns "" when it isn't
+func imageDimensionsProblem(cfg *config.Config, width, height int) string {
+	switch {
+	case cfg.MinImageDimension > 0 && min(width, height) < cfg.MinImageDimension:
+		return fmt.Sprintf("image is %dx%d pixels, smaller than the minimum of %d", width, height, cfg.MinImageDimension)
+	case cfg.MaxImageDimension > 0 && max(width, height) > cfg.MaxImageDimension:
+		return fmt.Sprintf("image is %dx%d pixels, larger than the maximum of %d", width, height, cfg.MaxImageDimension)
+	}
+	return ""
+}
+
+// sendStillImageError responds 400 to an image CheckStillImage rejected
+func sendStillImageError(w http.ResponseWriter, r *http.Request, err error, label string) {
+	switch {
+	case errors.Is(err, utils.ErrMultiFrameImage):
+		sendErrorResponse(w, r, http.StatusBadRequest, utils.ErrCodeUnsupportedFormat, label+" image is animated; please upload a single photo")
+	case errors.Is(err, utils.ErrUnsupportedColorModel):
+		sendErrorResponse(w, r, http.StatusBadRequest, utils.ErrCodeUnsupportedFormat, label+" image has an unsupported color model; please upload an RGB or grayscale photo")
+	default:
+		sendErrorResponse(w, r, http.StatusBadRequest, utils.ErrCodeInvalidImage, "Invalid "+strings.ToLower(label)+" image: "+err.Error())
+	}
+}
+
+// allowedImageType sniffs the type of an image from its first bytes and
+// returns its MIME type and the extension to save it with, and whether the
+// type is one of the configured ones
+func allowedImageType(cfg *config.Config, header []byte) (string, string, bool) {
+	mimeType, ext := utils.SniffImageType(header)
+	return mimeType, ext, ext != "" && allowedMIMEType(cfg, mimeType)
+}
+
+// rejectIdenticalImages sends a 400 and returns false when the front and side
+// uploads are the same photo. Both files are rewound for further reading.
+func rejectIdenticalImages(w http.ResponseWriter, r *http.Request, front, side multipart.File) bool {
+	return rejectIdenticalPair(w, r, front, side, "Front", "Side",
+		"Front and side images are identical; please upload a photo taken from the front and a separate one from the side")
+}
+
+// rejectIdenticalSides sends a 400 and returns false when any two side views
+// are the same photo. Every file is rewound for further reading.
+func rejectIdenticalSides(w http.ResponseWriter, r *http.Request, sides []*sideImage) bool {
+	for i, side := range sides {
+		for _, other := range sides[i+1:] {
+			label, otherLabel := sideViewLabels[side.View], sideViewLabels[other.View]
+			message := fmt.Sprintf("%s and %s images are identical; please upload a separate photo for each side", label, strings.ToLower(otherLabel))
+			if !rejectIdenticalPair(w, r, side.File, other.File, label, otherLabel, message) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// rejectIdenticalPair sends a 400 with message and returns false when the
+// uploads a and b, labeled for errors, are the same photo. Both files are
+// rewound for further reading.
+func rejectIdenticalPair(w http.ResponseWriter, r *http.Request, a, b multipart.File, labelA, labelB, message string) bool {
+	identical, err := utils.ImagesIdentical(a, b)
+	if err != nil {
+		sendErrorResponse(w, r, http.StatusInternalServerError, utils.ErrCodeStorageError, "Failed to compare images: "+err.Error())
+		return false
+	}
+
+	for _, file := range []struct {
+		file  multipart.File
+		label string
+	}{{a, labelA}, {b, labelB}} {
+		if _, err := file.file.Seek(0, io.SeekStart); err != nil {
+			sendErrorResponse(w, r, http.StatusInternalServerError, utils.ErrCodeStorageError, "Failed to read "+strings.ToLower(file.label)+" image: "+err.Error())
+			return false
+		}
+	}
+
+	if identical {
+		sendErrorResponse(w, r, http.StatusBadRequest, utils.ErrCodeIdenticalImages, message)
+		return false
+	}
+	return true
+}
+
+// checkImageQuality sends a 422 with advice on retaking the photo and returns
+// false when the front or a side image is blurrier or darker than the config
+// allows. Without thresholds configured the images aren't decoded at all.
+func checkImageQuality(w http.ResponseWriter, r *http.Request, cfg *config.Config, frontData []byte, sides []*sideImage) bool {
+	if cfg.MinImageSharpness <= 0 && cfg.MinImageBrightness <= 0 {
+		return true
+	}
+
+	type view struct {
+		name  string // Served view name, reported in the details
+		label string
+		data  []byte
+	}
+	views := []view{{"front", "front", frontData}}
+	for _, side := range sides {
+		views = append(views, view{imageViewName(side.View), strings.ToLower(sideViewLabels[side.View]), side.Data})
+	}
+
+	for _, view := range views {
+		img, _, err := image.Decode(bytes.NewReader(view.data))
+		if err != nil {
+			sendErrorResponse(w, r, http.StatusBadRequest, utils.ErrCodeInvalidImage, fmt.Sprintf("Invalid %s image: %v", view.label, err))
+			return false
+		}
+
+		sharpness, brightness := utils.ImageQuality(img)
+		details := map[string]interface{}{
+			"image":      view.name,
+			"sharpness":  math.Round(sharpness*10) / 10,
+			"brightness": math.Round(brightness*10) / 10,
+		}
+		switch {
+		case brightness < cfg.MinImageBrightness:
+			details["min_brightness"] = cfg.MinImageBrightness
+			sendErrorResponseWithDetails(w, r, http.StatusUnprocessableEntity, utils.ErrCodeLowImageQuality,
+				fmt.Sprintf("The %s image is too dark; please retake it in better light", view.label), details)
+			return false
+		case sharpness < cfg.MinImageSharpness:
+			details["min_sharpness"] = cfg.MinImageSharpness
+			sendErrorResponseWithDetails(w, r, http.StatusUnprocessableEntity, utils.ErrCodeLowImageQuality,
+				fmt.Sprintf("The %s image is too blurry; please hold the camera steady and make sure the person is in focus", view.label), details)
+			return false
+		}
+	}
+	return true
+}
+
+// autoOrientImages reads both uploads, turning them upright and stripping
+// their EXIF metadata. It sends a 400 and returns false if either can't be decoded.
+func autoOrientImages(w http.ResponseWriter, r *http.Request, front, side io.Reader) ([]byte, []byte, bool) {
+	frontData, ok := autoOrientImage(w, r, front, "front")
+	if !ok {
+		return nil, nil, false
+	}
+	sideData, ok := autoOrientImage(w, r, side, "side")
+	if !ok {
+		return nil, nil, false
+	}
+	return frontData, sideData, true
+}
+
+// autoOrientImage reads an upload, turning it upright and stripping its EXIF
+// metadata. It sends a 400 naming the image by label and returns false if it
+// can't be decoded.
+func autoOrientImage(w http.ResponseWriter, r *http.Request, image io.Reader, label string) ([]byte, bool) {
+	data, err := utils.AutoOrient(image)
+	if err != nil {
+		sendErrorResponse(w, r, http.StatusBadRequest, utils.ErrCodeInvalidImage, "Invalid "+label+" image: "+err.Error())
+		return nil, false
+	}
+	return data, true
+}
@@ -0,0 +1,454 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/lucasfepe/height-weight-api/config"
+	"github.com/lucasfepe/height-weight-api/internal/testutil"
+	"github.com/lucasfepe/height-weight-api/models"
+	"github.com/lucasfepe/height-weight-api/utils"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestServeImage(t *testing.T) {
+	cfg := testDatabase(t, nil)
+	frontData := testPNG(t, 16, 24, 40)
+	front := filepath.Join(cfg.UploadDir, "front.png")
+	if err := os.WriteFile(front, frontData, 0644); err != nil {
+		t.Fatalf("write image: %v", err)
+	}
+	estimation := seedWeightEstimation(t, &models.WeightEstimation{FrontImgPath: front, CreatedAt: time.Now()})
+	legacy := seedEstimation(t, cfg.UploadDir, "legacy-id", time.Now())
+
+	// A file next to the uploads that a traversal would be after
+	secret := filepath.Join(filepath.Dir(cfg.UploadDir), "secret.txt")
+	if err := os.WriteFile(secret, []byte("secret"), 0644); err != nil {
+		t.Fatalf("write secret: %v", err)
+	}
+	defer os.Remove(secret)
+
+	tests := []struct {
+		name     string
+		id       string
+		query    string
+		wantCode int
+		wantBody []byte
+		wantType string
+	}{
+		{"weight estimation front", estimation.ID.Hex(), "", http.StatusOK, frontData, "image/png"},
+		{"legacy estimation", legacy.ID, "", http.StatusOK, []byte("image"), "image/jpeg"},
+		{"missing ID", primitive.NewObjectID().Hex(), "", http.StatusNotFound, nil, ""},
+		{"missing side image", estimation.ID.Hex(), "?view=side", http.StatusNotFound, nil, ""},
+		{"invalid view", estimation.ID.Hex(), "?view=back", http.StatusBadRequest, nil, ""},
+		{"traversal", "../secret.txt", "", http.StatusNotFound, nil, ""},
+		{"encoded traversal", "..%2Fsecret.txt", "", http.StatusNotFound, nil, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := withID(httptest.NewRequest(http.MethodGet, "/images/x"+tt.query, nil), tt.id)
+			w := httptest.NewRecorder()
+			ServeImage(w, r)
+
+			if w.Code != tt.wantCode {
+				t.Fatalf("got %d %s, want %d", w.Code, w.Body.String(), tt.wantCode)
+			}
+			if tt.wantCode != http.StatusOK {
+				var response utils.Response
+				if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil || response.Success {
+					t.Errorf("body = %q, want a JSON error", w.Body.String())
+				}
+				return
+			}
+			if !bytes.Equal(w.Body.Bytes(), tt.wantBody) {
+				t.Errorf("served %d bytes, want the stored %d", w.Body.Len(), len(tt.wantBody))
+			}
+			if contentType := w.Header().Get("Content-Type"); contentType != tt.wantType {
+				t.Errorf("Content-Type = %q, want %q", contentType, tt.wantType)
+			}
+			if cache := w.Header().Get("Cache-Control"); cache == "" {
+				t.Error("image served without Cache-Control")
+			}
+		})
+	}
+}
+
+func TestServeEstimationOverlay(t *testing.T) {
+	cfg := testDatabase(t, nil)
+	front := filepath.Join(cfg.UploadDir, "front.png")
+	if err := os.WriteFile(front, testPNG(t, 160, 240, 40), 0644); err != nil {
+		t.Fatalf("write image: %v", err)
+	}
+	estimation := seedWeightEstimation(t, &models.WeightEstimation{FrontImgPath: front, PredictedHeight: 178, CreatedAt: time.Now()})
+	missingFile := seedWeightEstimation(t, &models.WeightEstimation{FrontImgPath: filepath.Join(cfg.UploadDir, "gone.png"), CreatedAt: time.Now()})
+
+	tests := []struct {
+		name     string
+		id       string
+		wantCode int
+	}{
+		{"annotated", estimation.ID.Hex(), http.StatusOK},
+		{"missing estimation", primitive.NewObjectID().Hex(), http.StatusNotFound},
+		{"missing image", missingFile.ID.Hex(), http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := withImageID(httptest.NewRequest(http.MethodGet, "/estimate/x/overlay", nil), tt.id)
+			w := httptest.NewRecorder()
+			ServeEstimationOverlay(w, r)
+
+			if w.Code != tt.wantCode {
+				t.Fatalf("got %d %s, want %d", w.Code, w.Body.String(), tt.wantCode)
+			}
+			if tt.wantCode != http.StatusOK {
+				return
+			}
+			if contentType := w.Header().Get("Content-Type"); contentType != "image/jpeg" {
+				t.Errorf("Content-Type = %q, want image/jpeg", contentType)
+			}
+			img, err := jpeg.Decode(w.Body)
+			if err != nil {
+				t.Fatalf("overlay is not a JPEG: %v", err)
+			}
+			if got := img.Bounds().Size(); got != image.Pt(160, 240) {
+				t.Errorf("overlay size = %v, want the photo's 160x240", got)
+			}
+		})
+	}
+}
+
+func TestUploadLimitsRejectExtraFiles(t *testing.T) {
+	cfg := testutil.Config(t, map[string]string{"MAX_UPLOAD_FILES": "3", "MAX_UPLOAD_TOTAL_MB": "1"})
+	side := testPNG(t, 64, 96, 80)
+	large := bytes.Repeat([]byte{1}, 1<<20)
+
+	ml := &fakeMLService{weight: 70}
+	handlers := []struct {
+		name    string
+		handler http.Handler
+		fields  map[string]string
+		images  []string
+	}{
+		{"estimate weight", NewEstimateWeightHandler(cfg, nil, fakeMLClients(ml), utils.NewIdempotencyStore(0), nil, nil), map[string]string{"height": "175"}, []string{"front_image", "side_image"}},
+		{"training data", NewSaveTrainingDataHandler(cfg, fakeMLClients(ml)), map[string]string{"height": "175", "actual_weight": "70"}, []string{"front_image", "side_image"}},
+		{"legacy upload", NewImageUploadHandler(cfg, fakeMLClients(ml)), nil, []string{"image"}},
+	}
+	tests := []struct {
+		name     string
+		extra    map[string][]byte
+		wantCode int
+		wantErr  string
+	}{
+		{"extra file fields", map[string][]byte{"extra_1": side, "extra_2": side, "extra_3": side}, http.StatusBadRequest, utils.ErrCodeTooManyFiles},
+		{"oversized extra file", map[string][]byte{"extra_1": large}, http.StatusRequestEntityTooLarge, utils.ErrCodeRequestTooLarge},
+	}
+	for _, h := range handlers {
+		for _, tt := range tests {
+			t.Run(h.name+"/"+tt.name, func(t *testing.T) {
+				files := maps.Clone(tt.extra)
+				for i, field := range h.images {
+					files[field] = testPNG(t, 64, 96, uint8(40*(i+1)))
+				}
+				before := ml.calls.Load()
+
+				w, response := serve(t, h.handler, newMultipartRequest(t, "/", h.fields, files))
+				if w.Code != tt.wantCode || response.ErrorCode != tt.wantErr {
+					t.Errorf("got %d %s (%s), want %d %s", w.Code, response.ErrorCode, response.Message, tt.wantCode, tt.wantErr)
+				}
+				if ml.calls.Load() != before {
+					t.Error("ML service called for a rejected upload")
+				}
+			})
+		}
+	}
+
+	// The same handler accepts the images alone
+	handler := NewEstimateWeightHandler(cfg, nil, fakeMLClients(ml), utils.NewIdempotencyStore(0), nil, nil)
+	if w, response := serve(t, handler, newEstimateRequest(t, "175")); w.Code != http.StatusOK {
+		t.Errorf("images within the limits got %d %s (%s), want 200", w.Code, response.ErrorCode, response.Message)
+	}
+}
+
+func TestEstimateWeightSpilledUpload(t *testing.T) {
+	cfg := testutil.Config(t, map[string]string{"MULTIPART_MEMORY_BYTES": "1024", "MAX_IMAGE_DIMENSION": "1000", "KEEP_ESTIMATION_IMAGES": "true"})
+	front, side := noisyPNG(t, 400, 600, 1), noisyPNG(t, 400, 600, 2)
+	if len(front) < 100*int(cfg.MultipartMemory) {
+		t.Fatalf("front image is %d bytes, want it far past the %d bytes kept in memory", len(front), cfg.MultipartMemory)
+	}
+	ml := &fakeMLService{weight: 70}
+	handler := NewEstimateWeightHandler(cfg, nil, fakeMLClients(ml), utils.NewIdempotencyStore(0), nil, nil)
+
+	r := newMultipartRequest(t, "/estimate-weight", map[string]string{"height": "175"}, map[string][]byte{"front_image": front, "side_image": side})
+	w, response := serve(t, handler, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d %s (%s), want 200", w.Code, response.ErrorCode, response.Message)
+	}
+	if calls := ml.calls.Load(); calls != 1 {
+		t.Errorf("ML service called %d times, want 1", calls)
+	}
+
+	// The spilled parts are read back in full
+	stored := storedFiles(t, estimationUploadDir(cfg))
+	if len(stored) != 2 {
+		t.Fatalf("stored %d images, want 2", len(stored))
+	}
+	for _, path := range stored {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("read stored image: %v", err)
+		}
+		if !bytes.Equal(data, front) && !bytes.Equal(data, side) {
+			t.Errorf("stored %s (%d bytes) matches neither upload", filepath.Base(path), len(data))
+		}
+	}
+}
+
+func TestMultipartTempFilesRemoved(t *testing.T) {
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+	cfg := testutil.Config(t, map[string]string{"MULTIPART_MEMORY_BYTES": "1024", "MAX_IMAGE_DIMENSION": "1000"})
+	front, side := noisyPNG(t, 400, 600, 1), noisyPNG(t, 400, 600, 2)
+
+	tests := []struct {
+		name    string
+		handler http.Handler
+		fields  map[string]string
+		files   map[string][]byte
+	}{
+		{"estimate weight", NewEstimateWeightHandler(cfg, nil, fakeMLClients(&fakeMLService{weight: 70}), utils.NewIdempotencyStore(0), nil, nil),
+			map[string]string{"height": "175"}, map[string][]byte{"front_image": front, "side_image": side}},
+		{"invalid estimate", NewEstimateWeightHandler(cfg, nil, fakeMLClients(&fakeMLService{weight: 70}), utils.NewIdempotencyStore(0), nil, nil),
+			map[string]string{"height": "tall"}, map[string][]byte{"front_image": front, "side_image": side}},
+		{"failed estimate", NewEstimateWeightHandler(cfg, nil, fakeMLClients(&fakeMLService{err: utils.ErrCircuitOpen}), utils.NewIdempotencyStore(0), nil, nil),
+			map[string]string{"height": "175"}, map[string][]byte{"front_image": front, "side_image": side}},
+		{"training data", NewSaveTrainingDataHandler(cfg, fakeMLClients(&fakeMLService{})),
+			map[string]string{"height": "175", "actual_weight": "70"}, map[string][]byte{"front_image": front, "side_image": side}},
+		{"legacy upload", NewImageUploadHandler(cfg, fakeMLClients(&fakeMLService{err: utils.ErrCircuitOpen})),
+			nil, map[string][]byte{"image": front}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			serve(t, tt.handler, newMultipartRequest(t, "/", tt.fields, tt.files))
+
+			entries, err := os.ReadDir(tmp)
+			if err != nil {
+				t.Fatalf("read temp dir: %v", err)
+			}
+			for _, entry := range entries {
+				t.Errorf("temp file %s left behind", entry.Name())
+			}
+		})
+	}
+}
+
+func TestEstimateWeightStoreCompressed(t *testing.T) {
+	cfg := testutil.Config(t, map[string]string{"STORE_COMPRESSED": "true", "COMPRESS_MAX_DIM": "200", "MAX_IMAGE_DIMENSION": "1000", "KEEP_ESTIMATION_IMAGES": "true"})
+	front, side := noisyPNG(t, 400, 600, 1), noisyPNG(t, 400, 600, 2)
+	handler := NewEstimateWeightHandler(cfg, nil, fakeMLClients(&fakeMLService{weight: 70}), utils.NewIdempotencyStore(0), nil, nil)
+
+	r := newMultipartRequest(t, "/estimate-weight", map[string]string{"height": "175"}, map[string][]byte{"front_image": front, "side_image": side})
+	w, response := serve(t, handler, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d %s (%s), want 200", w.Code, response.ErrorCode, response.Message)
+	}
+
+	stored := storedFiles(t, estimationUploadDir(cfg))
+	if len(stored) != 2 {
+		t.Fatalf("stored %d images, want 2", len(stored))
+	}
+	for _, path := range stored {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("read stored image: %v", err)
+		}
+		if filepath.Ext(path) != ".jpg" || len(data) >= len(front) {
+			t.Errorf("stored %s of %d bytes, want a .jpg smaller than the %d byte upload", filepath.Base(path), len(data), len(front))
+		}
+		img, format, err := image.DecodeConfig(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("stored %s doesn't decode: %v", filepath.Base(path), err)
+		}
+		if format != "jpeg" || img.Width != 133 || img.Height != 200 {
+			t.Errorf("stored %s is a %dx%d %s, want a 133x200 jpeg", filepath.Base(path), img.Width, img.Height, format)
+		}
+	}
+}
+
+func TestCheckImageType(t *testing.T) {
+	var jpegData bytes.Buffer
+	if err := jpeg.Encode(&jpegData, image.NewGray(image.Rect(0, 0, 64, 96)), nil); err != nil {
+		t.Fatalf("encode JPEG: %v", err)
+	}
+	pngData := testPNG(t, 64, 96, 40)
+	gifData := []byte("GIF89a\x01\x00\x01\x00\x00\x00\x00;")
+	// Only the RIFF header is sniffed; there is no WebP decoder to read further
+	webpData := append([]byte("RIFF\x24\x00\x00\x00WEBPVP8 "), make([]byte, 32)...)
+
+	defaults := testutil.Config(t, nil)
+	withWebP := testutil.Config(t, map[string]string{
+		"ALLOWED_MIME_TYPES": "image/jpeg,image/png,image/webp",
+		"ALLOWED_EXTENSIONS": ".jpg,.jpeg,.png,.webp,.jfif",
+	})
+
+	tests := []struct {
+		name    string
+		cfg     *config.Config
+		data    []byte
+		file    string
+		wantExt string // Empty when the image is rejected
+	}{
+		{"PNG named .png", defaults, pngData, "front.png", ".png"},
+		{"JPEG named .jpeg", defaults, jpegData.Bytes(), "front.jpeg", ".jpg"},
+		{"unnamed PNG", defaults, pngData, "", ".png"},
+		{"JPEG named .png", defaults, jpegData.Bytes(), "front.png", ".jpg"},
+		{"GIF named .png", defaults, gifData, "front.png", ""},
+		{"PNG named .gif", defaults, pngData, "front.gif", ""},
+		{"WebP not allowed", defaults, webpData, "front.png", ""},
+		{"WebP named .jfif", withWebP, webpData, "front.jfif", ".webp"},
+		{"WebP named .webp", withWebP, webpData, "front.webp", ".webp"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			file := bytes.NewReader(tt.data)
+			ext, ok := checkImageType(w, httptest.NewRequest(http.MethodPost, "/estimate-weight", nil), tt.cfg, file, tt.file, "Front")
+			if ok != (tt.wantExt != "") || ext != tt.wantExt {
+				t.Fatalf("got %q, ok %v (%s), want %q", ext, ok, w.Body.String(), tt.wantExt)
+			}
+			if !ok {
+				var response testResponse
+				json.Unmarshal(w.Body.Bytes(), &response)
+				if w.Code != http.StatusBadRequest || response.ErrorCode != utils.ErrCodeUnsupportedFormat {
+					t.Errorf("rejected with %d %s, want 400 %s", w.Code, response.ErrorCode, utils.ErrCodeUnsupportedFormat)
+				}
+				return
+			}
+			// The file is rewound for saving
+			if offset, _ := file.Seek(0, io.SeekCurrent); offset != 0 {
+				t.Errorf("file left at offset %d, want 0", offset)
+			}
+		})
+	}
+}
+
+func TestCheckImageTypeAnimated(t *testing.T) {
+	cfg := testutil.Config(t, map[string]string{
+		"ALLOWED_MIME_TYPES": "image/jpeg,image/png,image/gif",
+		"ALLOWED_EXTENSIONS": ".jpg,.jpeg,.png,.gif",
+	})
+
+	tests := []struct {
+		frames int
+		wantOK bool
+	}{
+		{1, true},
+		{2, false},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%d frames", tt.frames), func(t *testing.T) {
+			animation := &gif.GIF{}
+			for i := 0; i < tt.frames; i++ {
+				animation.Image = append(animation.Image, image.NewPaletted(image.Rect(0, 0, 64, 96), color.Palette{color.Black, color.White}))
+				animation.Delay = append(animation.Delay, 10)
+			}
+			var data bytes.Buffer
+			if err := gif.EncodeAll(&data, animation); err != nil {
+				t.Fatalf("encode GIF: %v", err)
+			}
+
+			w := httptest.NewRecorder()
+			_, ok := checkImageType(w, httptest.NewRequest(http.MethodPost, "/estimate-weight", nil), cfg, bytes.NewReader(data.Bytes()), "front.gif", "Front")
+			if ok != tt.wantOK {
+				t.Fatalf("ok = %v (%s), want %v", ok, w.Body.String(), tt.wantOK)
+			}
+			if !ok {
+				var response testResponse
+				json.Unmarshal(w.Body.Bytes(), &response)
+				if w.Code != http.StatusBadRequest || response.ErrorCode != utils.ErrCodeUnsupportedFormat {
+					t.Errorf("rejected with %d %s, want 400 %s", w.Code, response.ErrorCode, utils.ErrCodeUnsupportedFormat)
+				}
+			}
+		})
+	}
+}
+
+// smoothPNG encodes a width by height PNG of a soft horizontal gradient,
+// which has no edges, like an out of focus photo
+func smoothPNG(t *testing.T, width, height int) []byte {
+	t.Helper()
+	img := image.NewGray(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Pix[y*img.Stride+x] = uint8(80 + x*80/width)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatalf("encode PNG: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestEstimateWeightImageQuality(t *testing.T) {
+	sharp, blurred := noisyPNG(t, 64, 96, 1), smoothPNG(t, 64, 96)
+	tests := []struct {
+		name      string
+		front     []byte
+		side      []byte
+		wantImage string // Image reported too blurry, empty when accepted
+	}{
+		{"sharp", sharp, noisyPNG(t, 64, 96, 2), ""},
+		{"blurred front", blurred, sharp, "front"},
+		{"blurred side", sharp, blurred, "side"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testutil.Config(t, map[string]string{"MIN_IMAGE_SHARPNESS": "50"})
+			ml := &fakeMLService{weight: 72.4}
+			handler := NewEstimateWeightHandler(cfg, nil, fakeMLClients(ml), utils.NewIdempotencyStore(0), nil, nil)
+
+			r := newMultipartRequest(t, "/estimate-weight", map[string]string{"height": "175"},
+				map[string][]byte{"front_image": tt.front, "side_image": tt.side})
+			w, response := serve(t, handler, r)
+			if tt.wantImage == "" {
+				if w.Code != http.StatusOK {
+					t.Errorf("got %d %s (%s), want 200", w.Code, response.ErrorCode, response.Message)
+				}
+				return
+			}
+
+			if w.Code != http.StatusUnprocessableEntity || response.ErrorCode != utils.ErrCodeLowImageQuality {
+				t.Fatalf("got %d %s (%s), want 422 %s", w.Code, response.ErrorCode, response.Message, utils.ErrCodeLowImageQuality)
+			}
+			var details struct {
+				Image        string  `json:"image"`
+				Sharpness    float64 `json:"sharpness"`
+				MinSharpness float64 `json:"min_sharpness"`
+			}
+			if err := json.Unmarshal(response.Details, &details); err != nil {
+				t.Fatalf("decode details %s: %v", response.Details, err)
+			}
+			if details.Image != tt.wantImage || details.Sharpness >= 50 || details.MinSharpness != 50 {
+				t.Errorf("details = %+v, want the %s image below a sharpness of 50", details, tt.wantImage)
+			}
+			if calls := ml.calls.Load(); calls != 0 {
+				t.Errorf("ML service called %d times for a blurry photo, want 0", calls)
+			}
+		})
+	}
+}
@@ -0,0 +1,30 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/lucasfepe/height-weight-api/jobs"
+	"github.com/lucasfepe/height-weight-api/utils"
+)
+
+// NewGetJobHandler creates a handler returning the status and result of an
+// async job. Jobs of other users are not found.
+func NewGetJobHandler(store *jobs.JobStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		job, ok := store.Get(mux.Vars(r)["job_id"], utils.UserID(r.Context()))
+		if !ok {
+			sendErrorResponse(w, r, http.StatusNotFound, utils.ErrCodeNotFound, "Job not found")
+			return
+		}
+
+		// Return success response
+		response := Response{
+			Success: true,
+			Data:    job,
+		}
+
+		// Send response
+		utils.Respond(w, r, http.StatusOK, response)
+	}
+}
@@ -0,0 +1,74 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lucasfepe/height-weight-api/internal/testutil"
+	"github.com/lucasfepe/height-weight-api/jobs"
+	"github.com/lucasfepe/height-weight-api/utils"
+)
+
+func TestAsyncEstimation(t *testing.T) {
+	cfg := testutil.Config(t, nil)
+	queue := jobs.NewQueue(jobs.NewJobStore(time.Minute), 1, 4)
+	defer queue.Shutdown(context.Background())
+
+	ml := &fakeMLService{weight: 72.4, block: make(chan struct{})}
+	handler := NewEstimateWeightHandler(cfg, queue, fakeMLClients(ml), utils.NewIdempotencyStore(0), nil, nil)
+	getJob := NewGetJobHandler(queue.Store())
+
+	r := newMultipartRequest(t, "/estimate-weight?async=true", map[string]string{"height": "175"},
+		map[string][]byte{"front_image": testPNG(t, 64, 96, 40), "side_image": testPNG(t, 64, 96, 80)})
+	w, response := serve(t, handler, r)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("submit got %d %s (%s), want 202", w.Code, response.ErrorCode, response.Message)
+	}
+	var submitted jobs.Job
+	if err := json.Unmarshal(response.Data, &submitted); err != nil || submitted.ID == "" {
+		t.Fatalf("submit data = %s, want a job ID", response.Data)
+	}
+
+	poll := func() jobs.Job {
+		t.Helper()
+		r := mux.SetURLVars(httptest.NewRequest(http.MethodGet, "/jobs/"+submitted.ID, nil), map[string]string{"job_id": submitted.ID})
+		w, response := serve(t, getJob, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("poll got %d (%s), want 200", w.Code, response.Message)
+		}
+		var job jobs.Job
+		if err := json.Unmarshal(response.Data, &job); err != nil {
+			t.Fatalf("decode job: %v", err)
+		}
+		return job
+	}
+
+	if job := poll(); job.Status != jobs.StatusPending {
+		t.Fatalf("status while predicting = %s, want %s", job.Status, jobs.StatusPending)
+	}
+	close(ml.block)
+
+	var job jobs.Job
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		if job = poll(); job.Status != jobs.StatusPending {
+			break
+		}
+	}
+	if job.Status != jobs.StatusDone {
+		t.Fatalf("job = %+v, want done", job)
+	}
+	result, _ := job.Result.(map[string]interface{})
+	if result["weight"] != 72.4 {
+		t.Errorf("result = %v, want weight 72.4", job.Result)
+	}
+
+	r = mux.SetURLVars(httptest.NewRequest(http.MethodGet, "/jobs/unknown", nil), map[string]string{"job_id": "unknown"})
+	if w, _ := serve(t, getJob, r); w.Code != http.StatusNotFound {
+		t.Errorf("unknown job got %d, want 404", w.Code)
+	}
+}
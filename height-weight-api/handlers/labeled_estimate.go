@@ -0,0 +1,198 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lucasfepe/height-weight-api/config"
+	"github.com/lucasfepe/height-weight-api/db"
+	"github.com/lucasfepe/height-weight-api/models"
+	"github.com/lucasfepe/height-weight-api/utils"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// NewLabeledEstimateHandler creates a handler estimating weight for images
+// whose actual weight is known. It records the estimation with its label and
+// the images as training data in one transaction, and returns the prediction
+// with its error.
+func NewLabeledEstimateHandler(cfg *config.Config, ml *utils.MLClients, store *utils.S3Client, chunks *utils.ChunkedUploadStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Both records must be stored, so there is no point estimating without a database
+		if models.DB == nil {
+			sendErrorResponse(w, r, http.StatusInternalServerError, utils.ErrCodeDatabaseError, "Database not initialized")
+			return
+		}
+
+		// Turn clients away before reading their images when the ML service can't keep up
+		if !checkInFlight(w, r, cfg, nil) {
+			return
+		}
+
+		// Spilled parts are written to temp files, which must not outlive the request
+		defer removeMultipartFiles(r)
+
+		// Parse the multipart form
+		if err := r.ParseMultipartForm(cfg.MultipartMemory); err != nil {
+			status, errCode := formError(err)
+			sendErrorResponse(w, r, status, errCode, "Failed to parse form: "+err.Error())
+			return
+		}
+
+		// A slow upload may have used up the request timeout, which has already responded
+		if r.Context().Err() != nil {
+			return
+		}
+
+		// Reject stray attachments before touching the images
+		if !checkUploadLimits(w, r, cfg) {
+			return
+		}
+
+		// Report every invalid field at once rather than one per attempt
+		if errs := validateLabeledEstimateRequest(r, cfg); len(errs) > 0 {
+			sendValidationErrors(w, r, errs)
+			return
+		}
+
+		// Already validated
+		height, _ := strconv.ParseFloat(r.FormValue("height"), 64)
+		actualWeight, _ := strconv.ParseFloat(r.FormValue("actual_weight"), 64)
+
+		// Get front image from form, or from a direct or chunked upload
+		frontFile, frontName, ok := formImage(w, r, cfg, store, chunks, "front_image", "Front")
+		if !ok {
+			return
+		}
+		defer frontFile.Close()
+
+		// Get side image from form, or from a direct or chunked upload
+		sideFile, sideName, ok := formImage(w, r, cfg, store, chunks, "side_image", "Side")
+		if !ok {
+			return
+		}
+		defer sideFile.Close()
+
+		// The same photo for both views silently produces a bad estimate
+		if !rejectIdenticalImages(w, r, frontFile, sideFile) {
+			return
+		}
+
+		// Phone photos are often stored sideways with an EXIF rotation hint
+		frontData, sideData, ok := autoOrientImages(w, r, frontFile, sideFile)
+		if !ok {
+			return
+		}
+
+		// The training copies are blurred, the estimation keeps the originals
+		trainingFront, trainingSide := frontData, sideData
+		if cfg.AnonymizeTrainingImages {
+			_, service, err := ml.Resolve("")
+			if err != nil {
+				sendPredictionError(w, r, err)
+				return
+			}
+			if trainingFront, trainingSide, ok = anonymizeImages(w, r, service, frontData, sideData); !ok {
+				return
+			}
+		}
+
+		// Check the quota before predicting, so a full store doesn't leave a lone estimation
+		if cfg.TrainingQuotaBytes > 0 {
+			used, err := utils.DirSize(trainingUploadDir(cfg))
+			if err != nil {
+				sendErrorResponse(w, r, http.StatusInternalServerError, utils.ErrCodeStorageError, "Failed to check training data storage: "+err.Error())
+				return
+			}
+			if used+int64(len(trainingFront)+len(trainingSide)) > cfg.TrainingQuotaBytes {
+				sendErrorResponse(w, r, http.StatusInsufficientStorage, utils.ErrCodeQuotaExceeded, fmt.Sprintf("Training data storage quota of %d bytes exceeded", cfg.TrainingQuotaBytes))
+				return
+			}
+		}
+
+		// Remove the saved images again if the request fails before they're used
+		files := &utils.TempFileSet{}
+		defer files.Cleanup()
+
+		frontFilepath, sides, ok := saveEstimationImages(w, r, cfg, files, frontData, frontName, []*sideImage{{View: utils.SideViewSingle, Name: sideName, Data: sideData}})
+		if !ok {
+			return
+		}
+
+		// The training images are written up front so both records can be saved together
+		now := time.Now()
+		submissionID := uuid.New().String()
+		trainingFrontPath, trainingSidePath, err := writeTrainingImages(cfg, files, now, trainingFront, trainingSide, frontName, sideName)
+		if err != nil {
+			sendErrorResponse(w, r, http.StatusInternalServerError, utils.ErrCodeStorageError, "Failed to save training images: "+err.Error())
+			return
+		}
+
+		trainingData := &models.TrainingData{
+			Height:       height,
+			ActualWeight: actualWeight,
+			FrontImgPath: trainingFrontPath,
+			SideImgPath:  trainingSidePath,
+			Anonymized:   cfg.AnonymizeTrainingImages,
+			SubmissionID: submissionID,
+			CreatedAt:    now,
+		}
+
+		req := estimateRequest{
+			FrontImgPath: frontFilepath,
+			Sides:        sides,
+			ImageHash:    utils.ImageSetHash(frontData, sideData),
+			Height:       height,
+			Model:        r.FormValue("model"),
+			UserID:       utils.UserID(r.Context()),
+			ActualWeight: &actualWeight,
+			SubmissionID: submissionID,
+			// Neither record is kept unless both are saved
+			Save: func(estimation *models.WeightEstimation) error {
+				return db.WithTransaction(r.Context(), func(sessCtx mongo.SessionContext) error {
+					if err := models.InsertWeightEstimation(sessCtx, estimation); err != nil {
+						return err
+					}
+					return models.InsertTrainingData(sessCtx, trainingData)
+				})
+			},
+		}
+		if cfg.StoreCompressed {
+			req.FrontData, req.SideData = frontData, [][]byte{sideData}
+		}
+
+		result, estimation, err := runEstimation(r.Context(), cfg, ml, req)
+		if errors.Is(err, errEstimationNotSaved) {
+			sendErrorResponse(w, r, http.StatusInternalServerError, utils.ErrCodeDatabaseError, err.Error())
+			return
+		}
+		if err != nil {
+			sendPredictionError(w, r, err)
+			return
+		}
+		files.Keep()
+		setPredictionMode(w, result["mode"].(string))
+
+		// The error is of the model's prediction, not of the rounded weight
+		predicted := estimation.Weight
+		result["actual_weight"] = round(actualWeight)
+		result["error"] = round(predicted - actualWeight) // Positive when the model overestimates
+		result["absolute_error"] = round(math.Abs(predicted - actualWeight))
+		result["training_data_id"] = trainingData.ID.Hex()
+		result["submission_id"] = submissionID
+
+		// Return the estimated weight
+		response := Response{
+			Success: true,
+			Data:    result,
+			Message: "Weight estimated and training data saved",
+		}
+
+		// Send response
+		utils.Respond(w, r, http.StatusOK, response)
+	}
+}
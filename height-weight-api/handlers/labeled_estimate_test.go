@@ -0,0 +1,145 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/lucasfepe/height-weight-api/models"
+	"github.com/lucasfepe/height-weight-api/utils"
+)
+
+// newLabeledRequest builds a labeled estimation of a person of height cm
+// weighing actualWeight kg, with distinct front and side images
+func newLabeledRequest(t *testing.T, height, actualWeight string) *http.Request {
+	t.Helper()
+	return newMultipartRequest(t, "/estimate-weight/labeled", map[string]string{"height": height, "actual_weight": actualWeight},
+		map[string][]byte{"front_image": testPNG(t, 64, 96, 40), "side_image": testPNG(t, 64, 96, 80)})
+}
+
+func TestLabeledEstimate(t *testing.T) {
+	cfg := testDatabase(t, nil)
+	handler := NewLabeledEstimateHandler(cfg, fakeMLClients(&fakeMLService{weight: 73.5}), nil, nil)
+
+	w, response := serve(t, handler, newLabeledRequest(t, "175", "70"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d %s (%s), want 200", w.Code, response.ErrorCode, response.Message)
+	}
+	var data struct {
+		ID             string  `json:"id"`
+		Weight         float64 `json:"weight"`
+		ActualWeight   float64 `json:"actual_weight"`
+		Error          float64 `json:"error"`
+		AbsoluteError  float64 `json:"absolute_error"`
+		TrainingDataID string  `json:"training_data_id"`
+		SubmissionID   string  `json:"submission_id"`
+	}
+	if err := json.Unmarshal(response.Data, &data); err != nil {
+		t.Fatalf("decode data: %v", err)
+	}
+	if data.Weight != 73.5 || data.ActualWeight != 70 || data.Error != 3.5 || data.AbsoluteError != 3.5 {
+		t.Errorf("weight %v, actual %v, error %v, absolute %v; want 73.5, 70, 3.5, 3.5", data.Weight, data.ActualWeight, data.Error, data.AbsoluteError)
+	}
+
+	estimation, err := models.GetWeightEstimationByID(data.ID, "")
+	if err != nil {
+		t.Fatalf("GetWeightEstimationByID: %v", err)
+	}
+	if estimation.ActualWeight == nil || *estimation.ActualWeight != 70 || estimation.SubmissionID != data.SubmissionID {
+		t.Errorf("estimation actual weight %v, submission %q; want 70, %q", estimation.ActualWeight, estimation.SubmissionID, data.SubmissionID)
+	}
+
+	training, err := models.GetTrainingData(models.TrainingDataOptions{})
+	if err != nil {
+		t.Fatalf("GetTrainingData: %v", err)
+	}
+	if len(training) != 1 {
+		t.Fatalf("training records = %d, want 1", len(training))
+	}
+	if got := training[0]; got.ID.Hex() != data.TrainingDataID || got.ActualWeight != 70 || got.Height != 175 || got.SubmissionID != data.SubmissionID {
+		t.Errorf("training record = %+v, want %s of 175 cm, 70 kg in submission %q", got, data.TrainingDataID, data.SubmissionID)
+	}
+}
+
+func TestLabeledEstimateFailureSavesNothing(t *testing.T) {
+	cfg := testDatabase(t, nil)
+	handler := NewLabeledEstimateHandler(cfg, fakeMLClients(&fakeMLService{err: errors.New("model crashed")}), nil, nil)
+
+	w, response := serve(t, handler, newLabeledRequest(t, "175", "70"))
+	if w.Code != http.StatusInternalServerError || response.ErrorCode != utils.ErrCodeMLError {
+		t.Fatalf("got %d %s (%s), want 500 %s", w.Code, response.ErrorCode, response.Message, utils.ErrCodeMLError)
+	}
+
+	estimations, err := models.CountWeightEstimations(models.WeightEstimationFilter{})
+	if err != nil {
+		t.Fatalf("CountWeightEstimations: %v", err)
+	}
+	training, err := models.CountTrainingData(models.TrainingDataFilter{})
+	if err != nil {
+		t.Fatalf("CountTrainingData: %v", err)
+	}
+	if estimations != 0 || training != 0 {
+		t.Errorf("%d estimations and %d training records saved, want none", estimations, training)
+	}
+	if files := storedFiles(t, cfg.UploadDir); len(files) != 0 {
+		t.Errorf("stored files = %v, want none", files)
+	}
+}
+
+func TestGetSubmission(t *testing.T) {
+	cfg := testDatabase(t, nil)
+	handler := NewLabeledEstimateHandler(cfg, fakeMLClients(&fakeMLService{weight: 73.5}), nil, nil)
+	w, response := serve(t, handler, newLabeledRequest(t, "175", "70"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("labeled estimate: got %d %s (%s), want 200", w.Code, response.ErrorCode, response.Message)
+	}
+	var labeled struct {
+		ID             string `json:"id"`
+		TrainingDataID string `json:"training_data_id"`
+		SubmissionID   string `json:"submission_id"`
+	}
+	if err := json.Unmarshal(response.Data, &labeled); err != nil || labeled.SubmissionID == "" {
+		t.Fatalf("decode data %s: %v, want a submission ID", response.Data, err)
+	}
+
+	w, response = serve(t, http.HandlerFunc(GetSubmission), withID(httptest.NewRequest(http.MethodGet, "/submissions/x", nil), labeled.SubmissionID))
+	if w.Code != http.StatusOK {
+		t.Fatalf("get submission: got %d %s (%s), want 200", w.Code, response.ErrorCode, response.Message)
+	}
+	var submission models.Submission
+	if err := json.Unmarshal(response.Data, &submission); err != nil {
+		t.Fatalf("decode submission %s: %v", response.Data, err)
+	}
+	if submission.ID != labeled.SubmissionID || submission.Estimation == nil || submission.TrainingData == nil {
+		t.Fatalf("submission = %+v, want %s with both records", submission, labeled.SubmissionID)
+	}
+	if submission.Estimation.ID.Hex() != labeled.ID || submission.TrainingData.ID.Hex() != labeled.TrainingDataID {
+		t.Errorf("records %s and %s, want %s and %s", submission.Estimation.ID.Hex(), submission.TrainingData.ID.Hex(), labeled.ID, labeled.TrainingDataID)
+	}
+	if submission.Estimation.SubmissionID != labeled.SubmissionID || submission.TrainingData.SubmissionID != labeled.SubmissionID {
+		t.Errorf("submission IDs %q and %q, want both %q", submission.Estimation.SubmissionID, submission.TrainingData.SubmissionID, labeled.SubmissionID)
+	}
+
+	tests := []struct {
+		name     string
+		id       string
+		userID   string
+		wantCode int
+	}{
+		{"unknown", uuid.NewString(), "", http.StatusNotFound},
+		{"other user", labeled.SubmissionID, "mallory", http.StatusNotFound},
+		{"invalid", "not-a-uuid", "", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		r := withID(httptest.NewRequest(http.MethodGet, "/submissions/x", nil), tt.id)
+		if tt.userID != "" {
+			r = r.WithContext(utils.WithUserID(r.Context(), tt.userID))
+		}
+		if w, response := serve(t, http.HandlerFunc(GetSubmission), r); w.Code != tt.wantCode {
+			t.Errorf("%s: got %d %s (%s), want %d", tt.name, w.Code, response.ErrorCode, response.Message, tt.wantCode)
+		}
+	}
+}
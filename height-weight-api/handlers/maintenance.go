@@ -0,0 +1,36 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/lucasfepe/height-weight-api/models"
+	"github.com/lucasfepe/height-weight-api/utils"
+)
+
+// RecomputeBMI backfills the BMI of weight estimations stored without one
+// from their height and weight. Running it again only picks up what is left.
+func RecomputeBMI(w http.ResponseWriter, r *http.Request) {
+	if models.DB == nil {
+		sendErrorResponse(w, r, http.StatusInternalServerError, utils.ErrCodeDatabaseError, "Database not initialized")
+		return
+	}
+
+	updated, err := models.RecomputeMissingBMI(r.Context())
+	if updated > 0 {
+		recordAudit(r, models.AuditActionBMIBackfill, "", map[string]interface{}{"updated": updated})
+	}
+	if err != nil {
+		// Earlier batches are already written, so report how far it got
+		sendErrorResponseWithDetails(w, r, http.StatusInternalServerError, utils.ErrCodeDatabaseError, "Failed to recompute BMI: "+err.Error(), map[string]interface{}{"updated": updated})
+		return
+	}
+
+	response := Response{
+		Success: true,
+		Data:    map[string]interface{}{"updated": updated},
+		Message: fmt.Sprintf("Recomputed BMI of %d estimations", updated),
+	}
+
+	utils.Respond(w, r, http.StatusOK, response)
+}
@@ -0,0 +1,74 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/lucasfepe/height-weight-api/internal/testutil"
+	"github.com/lucasfepe/height-weight-api/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestRecomputeBMI(t *testing.T) {
+	cfg := testDatabase(t, nil)
+	legacy := []interface{}{
+		bson.M{"height": 200.0, "weight": 100.0, "created_at": time.Now()},
+		bson.M{"height": 160.0, "weight": 64.0, "created_at": time.Now()},
+	}
+	if _, err := models.DB.Collection(cfg.WeightEstimationCollection).InsertMany(context.Background(), legacy); err != nil {
+		t.Fatalf("insert legacy records: %v", err)
+	}
+	seedWeightEstimation(t, &models.WeightEstimation{CreatedAt: time.Now()})
+
+	recompute := func() int {
+		t.Helper()
+		w, response := serve(t, http.HandlerFunc(RecomputeBMI), httptest.NewRequest(http.MethodPost, "/maintenance/recompute-bmi", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("got %d %s (%s), want 200", w.Code, response.ErrorCode, response.Message)
+		}
+		var data struct {
+			Updated int `json:"updated"`
+		}
+		if err := json.Unmarshal(response.Data, &data); err != nil {
+			t.Fatalf("decode data %s: %v", response.Data, err)
+		}
+		return data.Updated
+	}
+
+	if updated := recompute(); updated != 2 {
+		t.Errorf("first run updated %d, want the 2 legacy records", updated)
+	}
+	if updated := recompute(); updated != 0 {
+		t.Errorf("second run updated %d, want 0", updated)
+	}
+}
+
+func TestRecomputeBMIMocked(t *testing.T) {
+	testutil.MockDatabase(t, func(mt *mtest.T) {
+		models.DB = mt.DB
+		mt.Cleanup(func() { models.DB = nil })
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, "test.weight_estimations", mtest.FirstBatch,
+				bson.D{{Key: "_id", Value: primitive.NewObjectID()}, {Key: "height", Value: 200.0}, {Key: "weight", Value: 100.0}}),
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}, bson.E{Key: "nModified", Value: 1}),
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}), // Audit entry
+		)
+
+		w, response := serve(mt.T, http.HandlerFunc(RecomputeBMI), httptest.NewRequest(http.MethodPost, "/maintenance/recompute-bmi", nil))
+		if w.Code != http.StatusOK {
+			mt.Fatalf("got %d %s (%s), want 200", w.Code, response.ErrorCode, response.Message)
+		}
+		var data struct {
+			Updated int `json:"updated"`
+		}
+		if err := json.Unmarshal(response.Data, &data); err != nil || data.Updated != 1 {
+			mt.Errorf("data = %s, want 1 updated", response.Data)
+		}
+	})
+}
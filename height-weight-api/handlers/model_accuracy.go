@@ -0,0 +1,38 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/lucasfepe/height-weight-api/models"
+	"github.com/lucasfepe/height-weight-api/utils"
+)
+
+// GetModelAccuracy reports the error of predicted weights against the actual
+// weights recorded for estimations, overall and per week, to spot model drift.
+// The optional from and to query parameters limit the estimations considered.
+func GetModelAccuracy(w http.ResponseWriter, r *http.Request) {
+	if models.DB == nil {
+		sendErrorResponse(w, r, http.StatusInternalServerError, utils.ErrCodeDatabaseError, "Database not initialized")
+		return
+	}
+
+	from, to, ok := parseTimeRange(w, r)
+	if !ok {
+		return
+	}
+
+	report, err := models.GetModelAccuracy(from, to)
+	if err != nil {
+		sendErrorResponse(w, r, http.StatusInternalServerError, utils.ErrCodeDatabaseError, "Failed to compute model accuracy: "+err.Error())
+		return
+	}
+
+	// Return success response
+	response := Response{
+		Success: true,
+		Data:    report,
+	}
+
+	// Send response
+	utils.Respond(w, r, http.StatusOK, response)
+}
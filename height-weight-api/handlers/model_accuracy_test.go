@@ -0,0 +1,71 @@
+package handlers
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/lucasfepe/height-weight-api/models"
+)
+
+func TestGetModelAccuracy(t *testing.T) {
+	testDatabase(t, nil)
+	week10 := time.Date(2024, 3, 4, 12, 0, 0, 0, time.UTC) // Monday of 2024-W10
+	week11 := week10.AddDate(0, 0, 7)
+	labeled := func(weight, actual float64, createdAt time.Time, degraded bool) *models.WeightEstimation {
+		return &models.WeightEstimation{Weight: weight, ActualWeight: &actual, CreatedAt: createdAt, Degraded: degraded}
+	}
+	seedWeightEstimation(t, labeled(72, 70, week10, false))                          // +2
+	seedWeightEstimation(t, labeled(76, 80, week10.Add(time.Hour), false))           // -4
+	seedWeightEstimation(t, labeled(63, 60, week11, false))                          // +3
+	seedWeightEstimation(t, labeled(90, 60, week11, true))                           // Degraded, ignored
+	seedWeightEstimation(t, &models.WeightEstimation{Weight: 90, CreatedAt: week11}) // Unlabeled, ignored
+
+	tests := []struct {
+		query       string
+		wantSamples int64
+		wantMAE     float64
+		wantRMSE    float64
+		wantWeeks   []models.WeeklyAccuracy
+	}{
+		{"", 3, 3, math.Sqrt(29.0 / 3), []models.WeeklyAccuracy{
+			{Week: "2024-W10", Samples: 2, MAE: 3, RMSE: math.Sqrt(10)},
+			{Week: "2024-W11", Samples: 1, MAE: 3, RMSE: 3},
+		}},
+		{"from=2024-03-11", 1, 3, 3, []models.WeeklyAccuracy{{Week: "2024-W11", Samples: 1, MAE: 3, RMSE: 3}}},
+		{"to=2023-12-31", 0, 0, 0, []models.WeeklyAccuracy{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			w, response := serve(t, http.HandlerFunc(GetModelAccuracy), httptest.NewRequest(http.MethodGet, "/model/accuracy?"+tt.query, nil))
+			if w.Code != http.StatusOK {
+				t.Fatalf("got %d %s (%s), want 200", w.Code, response.ErrorCode, response.Message)
+			}
+			var report models.AccuracyReport
+			if err := json.Unmarshal(response.Data, &report); err != nil {
+				t.Fatalf("decode report: %v", err)
+			}
+			if report.Samples != tt.wantSamples || !closeTo(report.MAE, tt.wantMAE) || !closeTo(report.RMSE, tt.wantRMSE) {
+				t.Errorf("overall = %d samples, MAE %v, RMSE %v; want %d, %v, %v",
+					report.Samples, report.MAE, report.RMSE, tt.wantSamples, tt.wantMAE, tt.wantRMSE)
+			}
+			if len(report.Weekly) != len(tt.wantWeeks) {
+				t.Fatalf("weekly = %+v, want %+v", report.Weekly, tt.wantWeeks)
+			}
+			for i, want := range tt.wantWeeks {
+				got := report.Weekly[i]
+				if got.Week != want.Week || got.Samples != want.Samples || !closeTo(got.MAE, want.MAE) || !closeTo(got.RMSE, want.RMSE) {
+					t.Errorf("week %d = %+v, want %+v", i, got, want)
+				}
+			}
+		})
+	}
+}
+
+// closeTo reports whether two computed errors agree to floating point noise
+func closeTo(a, b float64) bool {
+	return math.Abs(a-b) < 1e-9
+}
@@ -0,0 +1,39 @@
+package handlers
+
+import (
+	"github.com/lucasfepe/height-weight-api/models"
+	"github.com/lucasfepe/height-weight-api/utils"
+)
+
+// ResponsePrecision is the number of decimal places heights, weights and
+// BMIs are rounded to in responses. Stored records keep full precision.
+var ResponsePrecision = 1
+
+// round rounds a height, weight or BMI for a response
+func round(v float64) float64 {
+	return utils.Round(v, ResponsePrecision)
+}
+
+// roundedEstimation returns a copy of estimation with its heights, weights
+// and BMI rounded for a response, leaving the record itself untouched
+func roundedEstimation(estimation *models.WeightEstimation) *models.WeightEstimation {
+	rounded := *estimation
+	rounded.Height = round(estimation.Height)
+	rounded.Weight = round(estimation.Weight)
+	rounded.PredictedHeight = round(estimation.PredictedHeight)
+	rounded.BMI = round(estimation.BMI)
+	if estimation.ActualWeight != nil {
+		actualWeight := round(*estimation.ActualWeight)
+		rounded.ActualWeight = &actualWeight
+	}
+	return &rounded
+}
+
+// roundedEstimations rounds each of estimations with roundedEstimation
+func roundedEstimations(estimations []*models.WeightEstimation) []*models.WeightEstimation {
+	rounded := make([]*models.WeightEstimation, len(estimations))
+	for i, estimation := range estimations {
+		rounded[i] = roundedEstimation(estimation)
+	}
+	return rounded
+}
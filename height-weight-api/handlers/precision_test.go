@@ -0,0 +1,71 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/lucasfepe/height-weight-api/internal/testutil"
+	"github.com/lucasfepe/height-weight-api/models"
+	"github.com/lucasfepe/height-weight-api/utils"
+)
+
+func TestRoundedEstimation(t *testing.T) {
+	t.Cleanup(func() { ResponsePrecision = 1 })
+	actualWeight := 70.049
+	estimation := &models.WeightEstimation{Height: 175.25, Weight: 72.4567, PredictedHeight: 176.04, BMI: 23.6597, ActualWeight: &actualWeight}
+
+	tests := []struct {
+		precision  int
+		want       models.WeightEstimation
+		wantActual float64
+	}{
+		{0, models.WeightEstimation{Height: 175, Weight: 72, PredictedHeight: 176, BMI: 24}, 70},
+		{2, models.WeightEstimation{Height: 175.25, Weight: 72.46, PredictedHeight: 176.04, BMI: 23.66}, 70.05},
+	}
+	for _, tt := range tests {
+		ResponsePrecision = tt.precision
+		got := roundedEstimation(estimation)
+		if got.Height != tt.want.Height || got.Weight != tt.want.Weight || got.PredictedHeight != tt.want.PredictedHeight || got.BMI != tt.want.BMI {
+			t.Errorf("precision %d: height %v, weight %v, predicted %v, BMI %v; want %v, %v, %v, %v", tt.precision,
+				got.Height, got.Weight, got.PredictedHeight, got.BMI, tt.want.Height, tt.want.Weight, tt.want.PredictedHeight, tt.want.BMI)
+		}
+		if got.ActualWeight == nil || *got.ActualWeight != tt.wantActual {
+			t.Errorf("precision %d: actual weight %v, want %v", tt.precision, got.ActualWeight, tt.wantActual)
+		}
+	}
+
+	// The record keeps full precision
+	if estimation.Weight != 72.4567 || actualWeight != 70.049 {
+		t.Errorf("record rounded to weight %v, actual %v", estimation.Weight, actualWeight)
+	}
+}
+
+func TestEstimateWeightPrecision(t *testing.T) {
+	t.Cleanup(func() { ResponsePrecision = 1 })
+	tests := []struct {
+		precision int
+		want      float64
+	}{
+		{0, 72},
+		{1, 72.5},
+		{3, 72.457},
+	}
+	for _, tt := range tests {
+		ResponsePrecision = tt.precision
+		handler := NewEstimateWeightHandler(testutil.Config(t, nil), nil, fakeMLClients(&fakeMLService{weight: 72.4567}), utils.NewIdempotencyStore(0), nil, nil)
+		w, response := serve(t, handler, newEstimateRequest(t, "175"))
+		if w.Code != http.StatusOK {
+			t.Fatalf("precision %d: got %d %s (%s), want 200", tt.precision, w.Code, response.ErrorCode, response.Message)
+		}
+		var data struct {
+			Weight float64 `json:"weight"`
+		}
+		if err := json.Unmarshal(response.Data, &data); err != nil {
+			t.Fatalf("decode data: %v", err)
+		}
+		if data.Weight != tt.want {
+			t.Errorf("precision %d: weight = %v, want %v", tt.precision, data.Weight, tt.want)
+		}
+	}
+}
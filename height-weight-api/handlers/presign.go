@@ -0,0 +1,180 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lucasfepe/height-weight-api/config"
+	"github.com/lucasfepe/height-weight-api/utils"
+)
+
+// NewPresignUploadHandler creates a handler returning a presigned URL the
+// client can PUT an image to directly, and the object key to reference it by
+// in estimate-weight. Without S3 storage configured it responds 501.
+func NewPresignUploadHandler(cfg *config.Config, store *utils.S3Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if store == nil {
+			sendErrorResponse(w, r, http.StatusNotImplemented, utils.ErrCodeNotImplemented, "Direct uploads require S3 storage")
+			return
+		}
+
+		// The key keeps the extension so the saved image gets the right one
+		ext := strings.ToLower(r.FormValue("ext"))
+		if ext == "" {
+			ext = ".jpg"
+		}
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		if !allowedExt(cfg, ext) {
+			sendErrorResponse(w, r, http.StatusBadRequest, utils.ErrCodeUnsupportedFormat, "Unsupported file format")
+			return
+		}
+
+		key := presignedKeyPrefix(utils.UserID(r.Context())) + uuid.New().String() + ext
+		uploadURL, err := store.PresignPut(r.Context(), key, cfg.PresignExpiry)
+		if err != nil {
+			sendErrorResponse(w, r, http.StatusInternalServerError, utils.ErrCodeStorageError, "Failed to presign upload: "+err.Error())
+			return
+		}
+
+		response := Response{
+			Success: true,
+			Data: map[string]interface{}{
+				"key":        key,
+				"url":        uploadURL,
+				"method":     http.MethodPut,
+				"expires_at": time.Now().Add(cfg.PresignExpiry),
+			},
+		}
+
+		utils.Respond(w, r, http.StatusOK, response)
+	}
+}
+
+// presignedKeyPrefix returns the object key prefix of userID's direct
+// uploads, so one user can't reference another's images by key
+func presignedKeyPrefix(userID string) string {
+	if userID == "" {
+		return "uploads/anonymous/"
+	}
+	sum := sha256.Sum256([]byte(userID))
+	return "uploads/" + hex.EncodeToString(sum[:8]) + "/"
+}
+
+// allowedExt reports whether ext is one of the configured image extensions
+func allowedExt(cfg *config.Config, ext string) bool {
+	for _, allowed := range cfg.AllowedExts {
+		if ext == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// allowedMIMEType reports whether mimeType is one of the configured image types
+func allowedMIMEType(cfg *config.Config, mimeType string) bool {
+	for _, allowed := range cfg.AllowedMIMETypes {
+		if mimeType == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// memoryFile serves an image fetched from object storage as a multipart.File
+type memoryFile struct {
+	*bytes.Reader
+}
+
+// Close implements multipart.File; there is nothing to release
+func (memoryFile) Close() error {
+	return nil
+}
+
+// formImage returns the image for field, taken from the file part of that
+// name or from the upload named by the field+"_key" form value: a completed
+// chunked upload or, with S3 storage, an object. The returned name carries
+// the extension of the image's actual type. On failure it sends an error
+// response and returns false.
+func formImage(w http.ResponseWriter, r *http.Request, cfg *config.Config, store *utils.S3Client, chunks *utils.ChunkedUploadStore, field, label string) (multipart.File, string, bool) {
+	key := r.FormValue(field + "_key")
+	if key == "" {
+		file, header, err := r.FormFile(field)
+		if err != nil {
+			sendErrorResponse(w, r, http.StatusBadRequest, utils.ErrCodeMissingImage, label+" image is required: "+err.Error())
+			return nil, "", false
+		}
+		ext, ok := checkImageType(w, r, cfg, file, header.Filename, label)
+		if !ok {
+			file.Close()
+			return nil, "", false
+		}
+		return file, withExt(header.Filename, ext), true
+	}
+
+	if strings.HasPrefix(key, utils.ChunkedKeyPrefix) {
+		data, err := chunks.Read(key, utils.UserID(r.Context()))
+		switch {
+		case errors.Is(err, utils.ErrUploadNotFound):
+			sendErrorResponse(w, r, http.StatusBadRequest, utils.ErrCodeInvalidImageKey, "Invalid "+strings.ToLower(label)+" image key")
+			return nil, "", false
+		case errors.Is(err, utils.ErrUploadIncomplete):
+			sendErrorResponse(w, r, http.StatusBadRequest, utils.ErrCodeUploadIncomplete, label+" image upload has not been completed")
+			return nil, "", false
+		case err != nil:
+			sendErrorResponse(w, r, http.StatusInternalServerError, utils.ErrCodeStorageError, "Failed to read "+strings.ToLower(label)+" image: "+err.Error())
+			return nil, "", false
+		}
+		// Chunked uploads have no file name, so only their content is checked
+		file := memoryFile{bytes.NewReader(data)}
+		ext, ok := checkImageType(w, r, cfg, file, "", label)
+		if !ok {
+			return nil, "", false
+		}
+		return file, path.Base(key) + ext, true
+	}
+
+	if store == nil {
+		sendErrorResponse(w, r, http.StatusNotImplemented, utils.ErrCodeNotImplemented, "Image keys require S3 storage")
+		return nil, "", false
+	}
+	prefix := presignedKeyPrefix(utils.UserID(r.Context()))
+	if !strings.HasPrefix(key, prefix) || path.Clean(key) != key || strings.Contains(key, "..") {
+		sendErrorResponse(w, r, http.StatusBadRequest, utils.ErrCodeInvalidImageKey, "Invalid "+strings.ToLower(label)+" image key")
+		return nil, "", false
+	}
+
+	data, err := store.GetObject(r.Context(), key, cfg.MaxFileSize)
+	switch {
+	case errors.Is(err, utils.ErrObjectNotFound):
+		sendErrorResponse(w, r, http.StatusBadRequest, utils.ErrCodeMissingImage, label+" image has not been uploaded")
+		return nil, "", false
+	case errors.Is(err, utils.ErrObjectTooLarge):
+		sendErrorResponse(w, r, http.StatusBadRequest, utils.ErrCodeImageTooLarge, fmt.Sprintf("%s image too large. Max size: %d bytes", label, cfg.MaxFileSize))
+		return nil, "", false
+	case err != nil:
+		sendErrorResponse(w, r, http.StatusInternalServerError, utils.ErrCodeStorageError, "Failed to fetch "+strings.ToLower(label)+" image: "+err.Error())
+		return nil, "", false
+	}
+	file := memoryFile{bytes.NewReader(data)}
+	ext, ok := checkImageType(w, r, cfg, file, key, label)
+	if !ok {
+		return nil, "", false
+	}
+	return file, withExt(path.Base(key), ext), true
+}
+
+// withExt replaces the extension of name with ext
+func withExt(name, ext string) string {
+	return strings.TrimSuffix(name, path.Ext(name)) + ext
+}
@@ -0,0 +1,136 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/lucasfepe/height-weight-api/internal/testutil"
+	"github.com/lucasfepe/height-weight-api/utils"
+)
+
+// newFakeS3 starts an object store keeping PUT objects in memory and serving
+// them to presigned GETs, and returns a client for its bucket
+func newFakeS3(t *testing.T) *utils.S3Client {
+	t.Helper()
+	var mu sync.Mutex
+	objects := map[string][]byte{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("X-Amz-Signature") == "" {
+			http.Error(w, "unsigned request", http.StatusForbidden)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.Method {
+		case http.MethodPut:
+			data, _ := io.ReadAll(r.Body)
+			objects[r.URL.Path] = data
+		case http.MethodGet:
+			data, ok := objects[r.URL.Path]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			w.Write(data)
+		default:
+			http.Error(w, "unsupported method", http.StatusMethodNotAllowed)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	cfg := testutil.Config(t, map[string]string{"S3_BUCKET": "estimations", "S3_ENDPOINT": server.URL, "AWS_ACCESS_KEY_ID": "key", "AWS_SECRET_ACCESS_KEY": "secret"})
+	store, err := utils.NewS3ClientFromConfig(cfg)
+	if err != nil {
+		t.Fatalf("NewS3ClientFromConfig: %v", err)
+	}
+	return store
+}
+
+// presignAndUpload presigns an upload with handler and PUTs data to the URL it returns
+func presignAndUpload(t *testing.T, handler http.Handler, data []byte) string {
+	t.Helper()
+	w, response := serve(t, handler, httptest.NewRequest(http.MethodPost, "/uploads/presign?ext=png", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("presign: got %d %s (%s)", w.Code, response.ErrorCode, response.Message)
+	}
+	var presigned struct {
+		Key    string `json:"key"`
+		URL    string `json:"url"`
+		Method string `json:"method"`
+	}
+	if err := json.Unmarshal(response.Data, &presigned); err != nil {
+		t.Fatalf("decode presign: %v", err)
+	}
+	if !strings.HasSuffix(presigned.Key, ".png") || presigned.Method != http.MethodPut {
+		t.Fatalf("presigned %s %s, want a PUT to a .png key", presigned.Method, presigned.Key)
+	}
+
+	req, err := http.NewRequest(presigned.Method, presigned.URL, bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("build upload: %v", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("upload: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("upload got %d, want 200", resp.StatusCode)
+	}
+	return presigned.Key
+}
+
+func TestPresignedUploadEstimate(t *testing.T) {
+	cfg := testutil.Config(t, nil)
+	store := newFakeS3(t)
+	presign := NewPresignUploadHandler(cfg, store)
+	ml := &fakeMLService{weight: 70}
+	estimate := NewEstimateWeightHandler(cfg, nil, fakeMLClients(ml), utils.NewIdempotencyStore(0), store, nil)
+
+	frontKey := presignAndUpload(t, presign, testPNG(t, 64, 96, 40))
+	sideKey := presignAndUpload(t, presign, testPNG(t, 64, 96, 80))
+
+	tests := []struct {
+		name     string
+		frontKey string
+		wantCode int
+		wantErr  string
+	}{
+		{"uploaded keys", frontKey, http.StatusOK, ""},
+		{"never uploaded", "uploads/anonymous/missing.png", http.StatusBadRequest, utils.ErrCodeMissingImage},
+		{"another user's key", "uploads/0123456789abcdef/" + strings.TrimPrefix(frontKey, "uploads/anonymous/"), http.StatusBadRequest, utils.ErrCodeInvalidImageKey},
+		{"traversal", "uploads/anonymous/../0123456789abcdef/front.png", http.StatusBadRequest, utils.ErrCodeInvalidImageKey},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fields := map[string]string{"height": "175", "front_image_key": tt.frontKey, "side_image_key": sideKey}
+			w, response := serve(t, estimate, newMultipartRequest(t, "/estimate-weight", fields, nil))
+			if w.Code != tt.wantCode || response.ErrorCode != tt.wantErr {
+				t.Errorf("got %d %s (%s), want %d %s", w.Code, response.ErrorCode, response.Message, tt.wantCode, tt.wantErr)
+			}
+		})
+	}
+	if calls := ml.calls.Load(); calls != 1 {
+		t.Errorf("ML service called %d times, want 1", calls)
+	}
+}
+
+func TestPresignUploadErrors(t *testing.T) {
+	cfg := testutil.Config(t, nil)
+
+	w, response := serve(t, NewPresignUploadHandler(cfg, nil), httptest.NewRequest(http.MethodPost, "/uploads/presign", nil))
+	if w.Code != http.StatusNotImplemented || response.ErrorCode != utils.ErrCodeNotImplemented {
+		t.Errorf("without S3 got %d %s, want 501 %s", w.Code, response.ErrorCode, utils.ErrCodeNotImplemented)
+	}
+
+	w, response = serve(t, NewPresignUploadHandler(cfg, newFakeS3(t)), httptest.NewRequest(http.MethodPost, "/uploads/presign?ext=exe", nil))
+	if w.Code != http.StatusBadRequest || response.ErrorCode != utils.ErrCodeUnsupportedFormat {
+		t.Errorf("disallowed extension got %d %s, want 400 %s", w.Code, response.ErrorCode, utils.ErrCodeUnsupportedFormat)
+	}
+}
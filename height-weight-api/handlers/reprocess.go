@@ -0,0 +1,156 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lucasfepe/height-weight-api/config"
+	"github.com/lucasfepe/height-weight-api/models"
+	"github.com/lucasfepe/height-weight-api/utils"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// NewReprocessEstimationHandler creates a handler that re-runs a stored weight
+// estimation through the ML service, e.g. after deploying a better model. The
+// optional model query parameter selects the model version. Depending on
+// cfg.ReprocessMode the estimation is updated or a new linked one is saved.
+func NewReprocessEstimationHandler(cfg *config.Config, ml *utils.MLClients) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if models.DB == nil {
+			sendErrorResponse(w, r, http.StatusInternalServerError, utils.ErrCodeDatabaseError, "Database not initialized")
+			return
+		}
+
+		// Reprocessing competes with new estimations for the ML service
+		if !checkInFlight(w, r, cfg, nil) {
+			return
+		}
+
+		estimation, err := models.GetWeightEstimationByID(mux.Vars(r)["id"], utils.UserID(r.Context()))
+		if err != nil {
+			switch {
+			case errors.Is(err, models.ErrInvalidID):
+				sendErrorResponse(w, r, http.StatusBadRequest, utils.ErrCodeInvalidID, "Invalid estimation ID")
+			case errors.Is(err, mongo.ErrNoDocuments):
+				sendErrorResponse(w, r, http.StatusNotFound, utils.ErrCodeNotFound, "Estimation not found")
+			default:
+				sendErrorResponse(w, r, http.StatusInternalServerError, utils.ErrCodeDatabaseError, "Failed to fetch estimation: "+err.Error())
+			}
+			return
+		}
+
+		model, service, err := ml.Resolve(r.URL.Query().Get("model"))
+		if err != nil {
+			sendErrorResponse(w, r, http.StatusBadRequest, utils.ErrCodeInvalidModel, "Invalid model: "+err.Error())
+			return
+		}
+
+		// The images may have been cleaned up since the estimation was made
+		frontFile, err := utils.OpenStoredImage(estimation.FrontImgPath)
+		if err != nil {
+			sendStoredImageError(w, r, err)
+			return
+		}
+		defer frontFile.Close()
+		frontSize, err := storedImageSize(frontFile)
+		if err != nil {
+			sendStoredImageError(w, r, err)
+			return
+		}
+
+		var sides []utils.SideImage
+		var sideSize int64
+		for _, side := range estimation.Sides() {
+			sideFile, err := utils.OpenStoredImage(side.Path)
+			if err != nil {
+				sendStoredImageError(w, r, err)
+				return
+			}
+			defer sideFile.Close()
+			size, err := storedImageSize(sideFile)
+			if err != nil {
+				sendStoredImageError(w, r, err)
+				return
+			}
+			sides = append(sides, utils.SideImage{View: side.View, Image: sideFile})
+			sideSize += size
+		}
+
+		// Like a new estimation, a failed prediction may fall back to a degraded estimate
+		prediction, degraded, err := predictWeight(r.Context(), cfg, service, frontFile, sides, estimation.Height, frontSize, sideSize)
+		if err != nil {
+			sendPredictionError(w, r, err)
+			return
+		}
+		if degraded {
+			model = fallbackModel
+		}
+
+		originalID := estimation.ID
+		if cfg.ReprocessMode == config.ReprocessNew {
+			estimation = &models.WeightEstimation{
+				UserID:          estimation.UserID,
+				Height:          estimation.Height,
+				FrontImgPath:    estimation.FrontImgPath,
+				SideImgPath:     estimation.SideImgPath,
+				SideImages:      estimation.SideImages,
+				ReprocessedFrom: &originalID,
+				CreatedAt:       time.Now(),
+			}
+		}
+		estimation.Weight = prediction.Weight
+		estimation.PredictedHeight = prediction.PredictedHeight
+		estimation.Measurements = prediction.Measurements
+		estimation.ModelVersion = model
+		estimation.InferenceMs = prediction.InferenceMs
+		estimation.PredictionMode = prediction.Mode
+		estimation.Degraded = degraded
+
+		// Don't record a result the client is no longer waiting for
+		if r.Context().Err() != nil {
+			return
+		}
+
+		if cfg.ReprocessMode == config.ReprocessNew {
+			err = models.SaveWeightEstimation(estimation)
+		} else {
+			err = models.UpdateWeightEstimationPrediction(estimation)
+		}
+		if err != nil {
+			sendErrorResponse(w, r, http.StatusInternalServerError, utils.ErrCodeDatabaseError, "Failed to save reprocessed estimation: "+err.Error())
+			return
+		}
+		recordAudit(r, models.AuditActionReprocess, originalID.Hex(), map[string]interface{}{"mode": cfg.ReprocessMode, "model": model})
+
+		setPredictionMode(w, prediction.Mode)
+
+		response := Response{
+			Success: true,
+			Data:    roundedEstimation(estimation),
+			Message: "Estimation reprocessed successfully",
+		}
+
+		utils.Respond(w, r, http.StatusOK, response)
+	}
+}
+
+// storedImageSize returns the size of an opened stored image
+func storedImageSize(file *os.File) (int64, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// sendStoredImageError responds 409 when a stored image is gone, 500 otherwise
+func sendStoredImageError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, utils.ErrImageMissing) {
+		sendErrorResponse(w, r, http.StatusConflict, utils.ErrCodeImageMissing, "Estimation images are no longer available")
+		return
+	}
+	sendErrorResponse(w, r, http.StatusInternalServerError, utils.ErrCodeStorageError, "Failed to open estimation image: "+err.Error())
+}
@@ -0,0 +1,94 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/lucasfepe/height-weight-api/models"
+	"github.com/lucasfepe/height-weight-api/utils"
+)
+
+// seedStoredEstimation saves a 70 kg estimation whose front and side images
+// are written to dir
+func seedStoredEstimation(t *testing.T, dir string) *models.WeightEstimation {
+	t.Helper()
+	front, side := filepath.Join(dir, "front.png"), filepath.Join(dir, "side.png")
+	if err := os.WriteFile(front, testPNG(t, 64, 96, 40), 0644); err != nil {
+		t.Fatalf("write front image: %v", err)
+	}
+	if err := os.WriteFile(side, testPNG(t, 64, 96, 80), 0644); err != nil {
+		t.Fatalf("write side image: %v", err)
+	}
+	return seedWeightEstimation(t, &models.WeightEstimation{FrontImgPath: front, SideImgPath: side, ModelVersion: "default"})
+}
+
+func TestReprocessEstimation(t *testing.T) {
+	tests := []struct {
+		mode          string
+		keepsOriginal bool // Whether the original keeps its weight
+	}{
+		{"update", false},
+		{"new", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			cfg := testDatabase(t, map[string]string{"REPROCESS_MODE": tt.mode})
+			estimation := seedStoredEstimation(t, t.TempDir())
+			ml := &fakeMLService{weight: 82}
+			handler := NewReprocessEstimationHandler(cfg, fakeMLClients(ml))
+
+			r := withID(httptest.NewRequest(http.MethodPost, "/estimate/"+estimation.ID.Hex()+"/reprocess", nil), estimation.ID.Hex())
+			w, response := serve(t, handler, r)
+			if w.Code != http.StatusOK {
+				t.Fatalf("got %d %s (%s), want 200", w.Code, response.ErrorCode, response.Message)
+			}
+			var data models.WeightEstimation
+			if err := json.Unmarshal(response.Data, &data); err != nil {
+				t.Fatalf("decode data: %v", err)
+			}
+			if data.Weight != 82 {
+				t.Errorf("reprocessed weight = %v, want 82", data.Weight)
+			}
+			if calls := ml.calls.Load(); calls != 1 {
+				t.Errorf("ML service called %d times, want 1", calls)
+			}
+
+			original, err := models.GetWeightEstimationByID(estimation.ID.Hex(), "")
+			if err != nil {
+				t.Fatalf("GetWeightEstimationByID: %v", err)
+			}
+			if tt.keepsOriginal {
+				if original.Weight != 70 || data.ID == estimation.ID || data.ReprocessedFrom == nil || *data.ReprocessedFrom != estimation.ID {
+					t.Errorf("new mode: original weight %v, reprocessed %v from %v; want 70 kept and a new estimation linked to %v",
+						original.Weight, data.ID, data.ReprocessedFrom, estimation.ID)
+				}
+			} else if original.Weight != 82 || data.ID != estimation.ID {
+				t.Errorf("update mode: stored weight %v, reprocessed ID %v; want 82 on %v", original.Weight, data.ID, estimation.ID)
+			}
+		})
+	}
+}
+
+func TestReprocessEstimationMissingImage(t *testing.T) {
+	cfg := testDatabase(t, nil)
+	dir := t.TempDir()
+	estimation := seedStoredEstimation(t, dir)
+	if err := os.Remove(estimation.SideImgPath); err != nil {
+		t.Fatalf("remove side image: %v", err)
+	}
+	ml := &fakeMLService{weight: 82}
+	handler := NewReprocessEstimationHandler(cfg, fakeMLClients(ml))
+
+	r := withID(httptest.NewRequest(http.MethodPost, "/estimate/"+estimation.ID.Hex()+"/reprocess", nil), estimation.ID.Hex())
+	w, response := serve(t, handler, r)
+	if w.Code != http.StatusConflict || response.ErrorCode != utils.ErrCodeImageMissing {
+		t.Errorf("got %d %s (%s), want 409 %s", w.Code, response.ErrorCode, response.Message, utils.ErrCodeImageMissing)
+	}
+	if calls := ml.calls.Load(); calls != 0 {
+		t.Errorf("ML service called %d times, want 0", calls)
+	}
+}
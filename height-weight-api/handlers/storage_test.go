@@ -0,0 +1,104 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/lucasfepe/height-weight-api/internal/testutil"
+	"github.com/lucasfepe/height-weight-api/utils"
+)
+
+func TestSaveEstimationImagesPartitioning(t *testing.T) {
+	tests := []struct {
+		name      string
+		partition string
+		dated     bool
+	}{
+		{"dated", "true", true},
+		{"flat", "false", false},
+		{"default", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testutil.Config(t, map[string]string{"UPLOAD_DATE_PARTITION": tt.partition, "STORE_COMPRESSED": "false"})
+			files := &utils.TempFileSet{}
+			defer files.Cleanup()
+
+			w := httptest.NewRecorder()
+			sides := []*sideImage{{View: utils.SideViews[0], Name: "side.png", Data: testPNG(t, 8, 8, 80)}}
+			front, saved, ok := saveEstimationImages(w, httptest.NewRequest("POST", "/estimate-weight", nil), cfg, files, testPNG(t, 8, 8, 40), "front.png", sides)
+			if !ok {
+				t.Fatalf("saveEstimationImages failed: %s", w.Body.String())
+			}
+
+			wantDir := estimationUploadDir(cfg)
+			if tt.dated {
+				wantDir = utils.DatedUploadPath(wantDir, time.Now())
+			}
+			for _, path := range []string{front, saved[0].Path} {
+				if dir := filepath.Dir(path); dir != wantDir {
+					t.Errorf("saved %s in %s, want %s", filepath.Base(path), dir, wantDir)
+				}
+				if _, err := os.Stat(path); err != nil {
+					t.Errorf("saved image missing: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestUploadSubdirs(t *testing.T) {
+	env := map[string]string{"ESTIMATION_SUBDIR": "est/images", "TRAINING_SUBDIR": "labels", "STORE_COMPRESSED": "false"}
+
+	t.Run("estimation", func(t *testing.T) {
+		cfg := testutil.Config(t, env)
+		files := &utils.TempFileSet{}
+		defer files.Cleanup()
+		w := httptest.NewRecorder()
+		sides := []*sideImage{{View: utils.SideViews[0], Name: "side.png", Data: testPNG(t, 8, 8, 80)}}
+		front, saved, ok := saveEstimationImages(w, httptest.NewRequest("POST", "/estimate-weight", nil), cfg, files, testPNG(t, 8, 8, 40), "front.png", sides)
+		if !ok {
+			t.Fatalf("saveEstimationImages failed: %s", w.Body.String())
+		}
+		wantDir := filepath.Join(cfg.UploadDir, "est", "images")
+		for _, path := range []string{front, saved[0].Path} {
+			if dir := filepath.Dir(path); dir != wantDir {
+				t.Errorf("saved %s in %s, want %s", filepath.Base(path), dir, wantDir)
+			}
+		}
+	})
+
+	t.Run("training", func(t *testing.T) {
+		cfg := testutil.Config(t, env)
+		files := &utils.TempFileSet{}
+		defer files.Cleanup()
+		front, side, err := writeTrainingImages(cfg, files, time.Now(), testPNG(t, 8, 8, 40), testPNG(t, 8, 8, 80), "front.png", "side.png")
+		if err != nil {
+			t.Fatalf("writeTrainingImages: %v", err)
+		}
+		wantDir := filepath.Join(cfg.UploadDir, "labels")
+		for _, path := range []string{front, side} {
+			if dir := filepath.Dir(path); dir != wantDir {
+				t.Errorf("saved %s in %s, want %s", filepath.Base(path), dir, wantDir)
+			}
+		}
+	})
+
+	t.Run("legacy upload", func(t *testing.T) {
+		cfg := testDatabase(t, env)
+		handler := NewImageUploadHandler(cfg, fakeMLClients(&fakeMLService{weight: 70}))
+		w, response := serve(t, handler, newUploadRequest(t))
+		if w.Code != http.StatusOK {
+			t.Fatalf("got %d %s (%s), want 200", w.Code, response.ErrorCode, response.Message)
+		}
+		files := storedFiles(t, cfg.UploadDir)
+		wantDir := filepath.Join(cfg.UploadDir, "est", "images")
+		if len(files) != 1 || filepath.Dir(files[0]) != wantDir {
+			t.Errorf("stored files = %v, want one in %s", files, wantDir)
+		}
+	})
+}
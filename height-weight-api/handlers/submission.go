@@ -0,0 +1,50 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/lucasfepe/height-weight-api/models"
+	"github.com/lucasfepe/height-weight-api/utils"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// GetSubmission returns the weight estimation and training record of a
+// labeled submission together, tracing a prediction to its ground truth
+func GetSubmission(w http.ResponseWriter, r *http.Request) {
+	if models.DB == nil {
+		sendErrorResponse(w, r, http.StatusInternalServerError, utils.ErrCodeDatabaseError, "Database not initialized")
+		return
+	}
+
+	id := mux.Vars(r)["id"]
+	if _, err := uuid.Parse(id); err != nil {
+		sendErrorResponse(w, r, http.StatusBadRequest, utils.ErrCodeInvalidID, "Invalid submission ID")
+		return
+	}
+
+	submission, err := models.GetBySubmissionID(id, utils.UserID(r.Context()))
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			sendErrorResponse(w, r, http.StatusNotFound, utils.ErrCodeNotFound, "Submission not found")
+			return
+		}
+		sendErrorResponse(w, r, http.StatusInternalServerError, utils.ErrCodeDatabaseError, "Failed to fetch submission: "+err.Error())
+		return
+	}
+
+	if submission.Estimation != nil {
+		submission.Estimation = roundedEstimation(submission.Estimation)
+	}
+
+	// Return success response
+	response := Response{
+		Success: true,
+		Data:    submission,
+	}
+
+	// Send response
+	utils.Respond(w, r, http.StatusOK, response)
+}
@@ -1,219 +1,459 @@
 package handlers
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
+	"log"
+	"math"
 	"net/http"
 	"os"
 	"path/filepath"
 	"strconv"
 	"time"
 
+	"github.com/lucasfepe/height-weight-api/config"
 	"github.com/lucasfepe/height-weight-api/models"
+	"github.com/lucasfepe/height-weight-api/utils"
 )
 
-// SaveTrainingData handles saving training data (images + actual weight + height)
-func SaveTrainingData(w http.ResponseWriter, r *http.Request) {
-	// Set content type
-	w.Header().Set("Content-Type", "application/json")
+// trainingUploadDir returns where training images are stored
+func trainingUploadDir(cfg *config.Config) string {
+	return filepath.Join(cfg.UploadDir, cfg.TrainingSubdir)
+}
 
-	// Parse the multipart form
-	if err := r.ParseMultipartForm(32 << 20); err != nil { // 32MB max memory
-		sendErrorResponse(w, http.StatusBadRequest, "Failed to parse form: "+err.Error())
-		return
-	}
+// NewSaveTrainingDataHandler creates a handler for saving training data (images + actual weight + height).
+// With AnonymizeTrainingImages set, faces found by the default ML model are blurred first.
+func NewSaveTrainingDataHandler(cfg *config.Config, ml *utils.MLClients) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Spilled parts are written to temp files, which must not outlive the request
+		defer removeMultipartFiles(r)
+
+		// Parse the multipart form
+		if err := r.ParseMultipartForm(cfg.MultipartMemory); err != nil {
+			status, errCode := formError(err)
+			sendErrorResponse(w, r, status, errCode, "Failed to parse form: "+err.Error())
+			return
+		}
 
-	// Get height from form
-	heightStr := r.FormValue("height")
-	if heightStr == "" {
-		sendErrorResponse(w, http.StatusBadRequest, "Height is required")
-		return
-	}
+		// A slow upload may have used up the request timeout, which has already responded
+		if r.Context().Err() != nil {
+			return
+		}
 
-	// Get actual weight from form
-	actualWeightStr := r.FormValue("actual_weight")
-	if actualWeightStr == "" {
-		sendErrorResponse(w, http.StatusBadRequest, "Actual weight is required")
-		return
-	}
+		// Reject stray attachments before touching the images
+		if !checkUploadLimits(w, r, cfg) {
+			return
+		}
 
-	// Parse values
-	height, err := strconv.ParseFloat(heightStr, 64)
-	if err != nil {
-		sendErrorResponse(w, http.StatusBadRequest, "Invalid height value: "+err.Error())
-		return
-	}
+		// Get height from form
+		heightStr := r.FormValue("height")
+		if heightStr == "" {
+			sendErrorResponse(w, r, http.StatusBadRequest, utils.ErrCodeInvalidHeight, "Height is required")
+			return
+		}
 
-	actualWeight, err := strconv.ParseFloat(actualWeightStr, 64)
-	if err != nil {
-		sendErrorResponse(w, http.StatusBadRequest, "Invalid weight value: "+err.Error())
-		return
+		// Get actual weight from form
+		actualWeightStr := r.FormValue("actual_weight")
+		if actualWeightStr == "" {
+			sendErrorResponse(w, r, http.StatusBadRequest, utils.ErrCodeInvalidWeight, "Actual weight is required")
+			return
+		}
+
+		// Parse values
+		height, err := strconv.ParseFloat(heightStr, 64)
+		if err != nil {
+			sendErrorResponse(w, r, http.StatusBadRequest, utils.ErrCodeInvalidHeight, "Invalid height value: "+err.Error())
+			return
+		}
+
+		actualWeight, err := strconv.ParseFloat(actualWeightStr, 64)
+		if err != nil {
+			sendErrorResponse(w, r, http.StatusBadRequest, utils.ErrCodeInvalidWeight, "Invalid weight value: "+err.Error())
+			return
+		}
+
+		// Get front image from form
+		frontFile, frontHeader, err := r.FormFile("front_image")
+		if err != nil {
+			sendErrorResponse(w, r, http.StatusBadRequest, utils.ErrCodeMissingImage, "Front image is required: "+err.Error())
+			return
+		}
+		defer frontFile.Close()
+
+		// Get side image from form
+		sideFile, sideHeader, err := r.FormFile("side_image")
+		if err != nil {
+			sendErrorResponse(w, r, http.StatusBadRequest, utils.ErrCodeMissingImage, "Side image is required: "+err.Error())
+			return
+		}
+		defer sideFile.Close()
+
+		// The same photo for both views silently produces a bad estimate
+		if !rejectIdenticalImages(w, r, frontFile, sideFile) {
+			return
+		}
+
+		// Phone photos are often stored sideways with an EXIF rotation hint
+		frontData, sideData, ok := autoOrientImages(w, r, frontFile, sideFile)
+		if !ok {
+			return
+		}
+
+		// Identifiable faces must not reach the training set
+		if cfg.AnonymizeTrainingImages {
+			_, service, err := ml.Resolve("")
+			if err != nil {
+				sendPredictionError(w, r, err)
+				return
+			}
+			frontData, sideData, ok = anonymizeImages(w, r, service, frontData, sideData)
+			if !ok {
+				return
+			}
+		}
+
+		// Reject new training data once the storage quota is used up
+		if cfg.TrainingQuotaBytes > 0 {
+			used, err := utils.DirSize(trainingUploadDir(cfg))
+			if err != nil {
+				sendErrorResponse(w, r, http.StatusInternalServerError, utils.ErrCodeStorageError, "Failed to check training data storage: "+err.Error())
+				return
+			}
+			if used+int64(len(frontData)+len(sideData)) > cfg.TrainingQuotaBytes {
+				sendErrorResponse(w, r, http.StatusInsufficientStorage, utils.ErrCodeQuotaExceeded, fmt.Sprintf("Training data storage quota of %d bytes exceeded", cfg.TrainingQuotaBytes))
+				return
+			}
+		}
+
+		// Remove the saved images again if the request fails before they're used
+		files := &utils.TempFileSet{}
+		defer files.Cleanup()
+
+		frontFilepath, sideFilepath, err := writeTrainingImages(cfg, files, time.Now(), frontData, sideData, frontHeader.Filename, sideHeader.Filename)
+		if err != nil {
+			sendErrorResponse(w, r, http.StatusInternalServerError, utils.ErrCodeStorageError, "Failed to save training images: "+err.Error())
+			return
+		}
+
+		// Create a training data record
+		trainingData := &models.TrainingData{
+			Height:       height,
+			ActualWeight: actualWeight,
+			FrontImgPath: frontFilepath,
+			SideImgPath:  sideFilepath,
+			Anonymized:   cfg.AnonymizeTrainingImages,
+			CreatedAt:    time.Now(),
+		}
+
+		// Save the training data record to database
+		if models.DB != nil {
+			if err := models.SaveTrainingData(trainingData); err != nil {
+				sendErrorResponse(w, r, http.StatusInternalServerError, utils.ErrCodeDatabaseError, "Failed to save training data to database: "+err.Error())
+				return
+			}
+		}
+		files.Keep()
+
+		// Return success response
+		response := Response{
+			Success: true,
+			Data: map[string]interface{}{
+				"id":            trainingData.ID.Hex(),
+				"height":        trainingData.Height,
+				"actual_weight": trainingData.ActualWeight,
+				"anonymized":    trainingData.Anonymized,
+				"created_at":    trainingData.CreatedAt,
+			},
+			Message: "Training data saved successfully",
+		}
+
+		// Send response
+		utils.Respond(w, r, http.StatusOK, response)
 	}
+}
 
-	// Get front image from form
-	frontFile, frontHeader, err := r.FormFile("front_image")
-	if err != nil {
-		sendErrorResponse(w, http.StatusBadRequest, "Front image is required: "+err.Error())
-		return
+// anonymizeImages blurs the faces service detects in the front and side
+// images. It writes an error response and returns false on failure.
+func anonymizeImages(w http.ResponseWriter, r *http.Request, service utils.MLService, front, side []byte) ([]byte, []byte, bool) {
+	views := []struct {
+		label string
+		data  []byte
+	}{{"front", front}, {"side", side}}
+
+	for i, view := range views {
+		blurred, err := anonymizeImage(r.Context(), service, view.data)
+		switch {
+		case errors.Is(err, utils.ErrCircuitOpen), errors.Is(err, utils.ErrMLBusy):
+			sendErrorResponse(w, r, http.StatusServiceUnavailable, utils.ErrCodeMLUnavailable, err.Error())
+			return nil, nil, false
+		case errors.Is(err, errFaceDetection):
+			sendErrorResponse(w, r, http.StatusInternalServerError, utils.ErrCodeMLError, "Failed to anonymize "+view.label+" image: "+err.Error())
+			return nil, nil, false
+		case err != nil:
+			sendErrorResponse(w, r, http.StatusBadRequest, utils.ErrCodeInvalidImage, "Invalid "+view.label+" image: "+err.Error())
+			return nil, nil, false
+		}
+		views[i].data = blurred
 	}
-	defer frontFile.Close()
+	return views[0].data, views[1].data, true
+}
+
+// errFaceDetection wraps failures of the ML service's face detector
+var errFaceDetection = errors.New("face detection failed")
 
-	// Get side image from form
-	sideFile, sideHeader, err := r.FormFile("side_image")
+// anonymizeImage blurs the faces service detects in an image
+func anonymizeImage(ctx context.Context, service utils.MLService, data []byte) ([]byte, error) {
+	faces, err := service.DetectFaces(ctx, bytes.NewReader(data))
 	if err != nil {
-		sendErrorResponse(w, http.StatusBadRequest, "Side image is required: "+err.Error())
-		return
+		return nil, fmt.Errorf("%w: %w", errFaceDetection, err)
 	}
-	defer sideFile.Close()
+	return utils.BlurRegions(data, faces)
+}
 
-	// Create uploads directory if it doesn't exist
-	trainingDir := filepath.Join("uploads", "training")
+// writeTrainingImages saves a front and side image pair to the training image
+// directory and returns their paths. The files are added to files, so they
+// are removed again unless the caller keeps them.
+func writeTrainingImages(cfg *config.Config, files *utils.TempFileSet, now time.Time, frontData, sideData []byte, frontName, sideName string) (string, string, error) {
+	trainingDir := trainingUploadDir(cfg)
+	if cfg.DatedUploads {
+		trainingDir = utils.DatedUploadPath(trainingDir, now)
+	}
 	if err := os.MkdirAll(trainingDir, 0755); err != nil {
-		sendErrorResponse(w, http.StatusInternalServerError, "Failed to create uploads directory: "+err.Error())
-		return
+		return "", "", fmt.Errorf("failed to create uploads directory: %w", err)
 	}
 
-	// Create timestamp for unique filenames
-	timestamp := time.Now().UnixNano()
-
-	// Save front image
-	frontFilename := fmt.Sprintf("train_%d_%s", timestamp, frontHeader.Filename)
-	frontFilepath := filepath.Join(trainingDir, frontFilename)
-	frontDst, err := os.Create(frontFilepath)
-	if err != nil {
-		sendErrorResponse(w, http.StatusInternalServerError, "Failed to save front image: "+err.Error())
-		return
+	// Both views often come with the same file name, e.g. from separate folders
+	frontFilepath := filepath.Join(trainingDir, fmt.Sprintf("train_%d_front_%s", now.UnixNano(), utils.SafeFilename(frontName)))
+	if err := files.WriteFile(frontFilepath, frontData, 0644); err != nil {
+		return "", "", fmt.Errorf("failed to save front image: %w", err)
 	}
-	defer frontDst.Close()
+	sideFilepath := filepath.Join(trainingDir, fmt.Sprintf("train_%d_side_%s", now.UnixNano(), utils.SafeFilename(sideName)))
+	if err := files.WriteFile(sideFilepath, sideData, 0644); err != nil {
+		return "", "", fmt.Errorf("failed to save side image: %w", err)
+	}
+	return frontFilepath, sideFilepath, nil
+}
 
-	if _, err = io.Copy(frontDst, frontFile); err != nil {
-		sendErrorResponse(w, http.StatusInternalServerError, "Failed to save front image data: "+err.Error())
+// GetTrainingData returns a list of training data records, newest first. The
+// labeling team reviews cohorts by filtering on height and actual weight ranges.
+func GetTrainingData(w http.ResponseWriter, r *http.Request) {
+	if models.DB == nil {
+		sendErrorResponse(w, r, http.StatusInternalServerError, utils.ErrCodeDatabaseError, "Database not initialized")
 		return
 	}
 
-	// Save side image
-	sideFilename := fmt.Sprintf("train_%d_%s", timestamp, sideHeader.Filename)
-	sideFilepath := filepath.Join(trainingDir, sideFilename)
-	sideDst, err := os.Create(sideFilepath)
-	if err != nil {
-		sendErrorResponse(w, http.StatusInternalServerError, "Failed to save side image: "+err.Error())
-		return
+	// Get limit and offset parameters (optional)
+	opts := models.TrainingDataOptions{Limit: 50} // Default limit
+	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+		parsedLimit, err := strconv.ParseInt(limitStr, 10, 64)
+		if err == nil && parsedLimit > 0 {
+			opts.Limit = parsedLimit
+		}
+	}
+	if offsetStr := r.URL.Query().Get("offset"); offsetStr != "" {
+		parsedOffset, err := strconv.ParseInt(offsetStr, 10, 64)
+		if err == nil && parsedOffset > 0 {
+			opts.Offset = parsedOffset
+		}
 	}
-	defer sideDst.Close()
 
-	if _, err = io.Copy(sideDst, sideFile); err != nil {
-		sendErrorResponse(w, http.StatusInternalServerError, "Failed to save side image data: "+err.Error())
+	// Report every invalid range bound at once
+	var errs []FieldError
+	opts.MinHeight, opts.MaxHeight, errs = parseRangeParams(r, "min_height", "max_height", utils.ErrCodeInvalidHeight, errs)
+	opts.MinWeight, opts.MaxWeight, errs = parseRangeParams(r, "min_weight", "max_weight", utils.ErrCodeInvalidWeight, errs)
+	if len(errs) > 0 {
+		sendValidationErrors(w, r, errs)
 		return
 	}
 
-	// Create a training data record
-	trainingData := &models.TrainingData{
-		Height:       height,
-		ActualWeight: actualWeight,
-		FrontImgPath: frontFilepath,
-		SideImgPath:  sideFilepath,
-		CreatedAt:    time.Now(),
+	// Get training data from database
+	trainingData, err := models.GetTrainingData(opts)
+	if err != nil {
+		sendErrorResponse(w, r, http.StatusInternalServerError, utils.ErrCodeDatabaseError, "Failed to fetch training data: "+err.Error())
+		return
 	}
 
-	// Save the training data record to database
-	if models.DB != nil {
-		if err := models.SaveTrainingData(trainingData); err != nil {
-			sendErrorResponse(w, http.StatusInternalServerError, "Failed to save training data to database: "+err.Error())
+	// Wrap the records with pagination metadata when requested
+	var data interface{} = trainingData
+	if r.URL.Query().Get("paginated") == "true" {
+		total, err := models.CountTrainingData(opts.TrainingDataFilter)
+		if err != nil {
+			sendErrorResponse(w, r, http.StatusInternalServerError, utils.ErrCodeDatabaseError, "Failed to count training data: "+err.Error())
 			return
 		}
+		data = utils.NewPage(trainingData, len(trainingData), total, opts.Limit, opts.Offset)
 	}
 
 	// Return success response
 	response := Response{
 		Success: true,
-		Data: map[string]interface{}{
-			"id":            trainingData.ID.Hex(),
-			"height":        trainingData.Height,
-			"actual_weight": trainingData.ActualWeight,
-			"created_at":    trainingData.CreatedAt,
-		},
-		Message: "Training data saved successfully",
+		Data:    data,
+		Message: fmt.Sprintf("Retrieved %d training data records", len(trainingData)),
 	}
 
 	// Send response
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(response)
+	utils.Respond(w, r, http.StatusOK, response)
 }
 
-// GetTrainingData returns a list of training data records
-func GetTrainingData(w http.ResponseWriter, r *http.Request) {
-	// Set content type
-	w.Header().Set("Content-Type", "application/json")
-
+// GetTrainingDistribution returns the number of training records per height
+// bin, to show which heights the data covers before retraining
+func GetTrainingDistribution(w http.ResponseWriter, r *http.Request) {
 	if models.DB == nil {
-		sendErrorResponse(w, http.StatusInternalServerError, "Database not initialized")
+		sendErrorResponse(w, r, http.StatusInternalServerError, utils.ErrCodeDatabaseError, "Database not initialized")
 		return
 	}
 
-	// Get limit parameter (optional)
-	limitStr := r.URL.Query().Get("limit")
-	var limit int64 = 50 // Default limit
-	if limitStr != "" {
-		parsedLimit, err := strconv.ParseInt(limitStr, 10, 64)
-		if err == nil && parsedLimit > 0 {
-			limit = parsedLimit
+	// Get bin size parameter (optional)
+	binSize := 10.0 // Default bin size in cm
+	if binStr := r.URL.Query().Get("bin_size"); binStr != "" {
+		parsed, err := strconv.ParseFloat(binStr, 64)
+		if err != nil || parsed <= 0 || math.IsInf(parsed, 0) {
+			sendErrorResponse(w, r, http.StatusBadRequest, utils.ErrCodeInvalidRequest, "bin_size must be a positive number")
+			return
 		}
+		binSize = parsed
 	}
 
-	// Get training data from database
-	trainingData, err := models.GetTrainingData(limit)
+	bins, err := models.GetTrainingDistribution(binSize)
+	if errors.Is(err, models.ErrTooManyBins) {
+		sendErrorResponse(w, r, http.StatusBadRequest, utils.ErrCodeInvalidRequest, "bin_size is too small: "+err.Error())
+		return
+	}
 	if err != nil {
-		sendErrorResponse(w, http.StatusInternalServerError, "Failed to fetch training data: "+err.Error())
+		sendErrorResponse(w, r, http.StatusInternalServerError, utils.ErrCodeDatabaseError, "Failed to compute training data distribution: "+err.Error())
 		return
 	}
 
+	var total int64
+	for _, bin := range bins {
+		total += bin.Count
+	}
+
 	// Return success response
 	response := Response{
 		Success: true,
-		Data:    trainingData,
-		Message: fmt.Sprintf("Retrieved %d training data records", len(trainingData)),
+		Data: map[string]interface{}{
+			"bin_size": binSize,
+			"total":    total,
+			"bins":     bins,
+		},
 	}
 
 	// Send response
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(response)
+	utils.Respond(w, r, http.StatusOK, response)
 }
 
-// ExportTrainingData exports all training data for model training
-func ExportTrainingData(w http.ResponseWriter, r *http.Request) {
-	// Set content type
-	w.Header().Set("Content-Type", "application/json")
+// NewTrainingDataStatsHandler creates a handler reporting training data volume and storage usage
+func NewTrainingDataStatsHandler(cfg *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if models.DB == nil {
+			sendErrorResponse(w, r, http.StatusInternalServerError, utils.ErrCodeDatabaseError, "Database not initialized")
+			return
+		}
+
+		count, err := models.CountTrainingData(models.TrainingDataFilter{})
+		if err != nil {
+			sendErrorResponse(w, r, http.StatusInternalServerError, utils.ErrCodeDatabaseError, "Failed to count training data: "+err.Error())
+			return
+		}
+
+		used, err := utils.DirSize(trainingUploadDir(cfg))
+		if err != nil {
+			sendErrorResponse(w, r, http.StatusInternalServerError, utils.ErrCodeStorageError, "Failed to check training data storage: "+err.Error())
+			return
+		}
+
+		// Return success response
+		response := Response{
+			Success: true,
+			Data: map[string]interface{}{
+				"records":       count,
+				"storage_bytes": used,
+				"quota_bytes":   cfg.TrainingQuotaBytes,
+			},
+		}
+
+		// Send response
+		utils.Respond(w, r, http.StatusOK, response)
+	}
+}
+
+// ndjsonFlushEvery is how many NDJSON export lines are sent per flush
+const ndjsonFlushEvery = 100
+
+// trainingExportRecord is a training record formatted for model training
+type trainingExportRecord struct {
+	FrontImgPath string  `json:"front_image_path"`
+	SideImgPath  string  `json:"side_image_path"`
+	Height       float64 `json:"height"`
+	ActualWeight float64 `json:"actual_weight"`
+}
+
+// newTrainingExportRecord formats td for export
+func newTrainingExportRecord(td *models.TrainingData) trainingExportRecord {
+	return trainingExportRecord{
+		FrontImgPath: td.FrontImgPath,
+		SideImgPath:  td.SideImgPath,
+		Height:       td.Height,
+		ActualWeight: td.ActualWeight,
+	}
+}
+
+// latestTimestampHeader carries the newest creation time of the exported
+// records, for the next incremental export's since parameter
+const latestTimestampHeader = "X-Latest-Timestamp"
 
+// ExportTrainingData exports all training data for model training. With
+// format=ndjson the records are streamed one JSON object per line instead of
+// being collected into a single response. The optional since parameter
+// limits the export to records created after it, and the X-Latest-Timestamp
+// header gives the value to pass as since next time.
+func ExportTrainingData(w http.ResponseWriter, r *http.Request) {
 	if models.DB == nil {
-		sendErrorResponse(w, http.StatusInternalServerError, "Database not initialized")
+		sendErrorResponse(w, r, http.StatusInternalServerError, utils.ErrCodeDatabaseError, "Database not initialized")
+		return
+	}
+
+	var filter models.TrainingDataFilter
+	if sinceStr := r.URL.Query().Get("since"); sinceStr != "" {
+		since, err := time.Parse(time.RFC3339, sinceStr)
+		if err != nil {
+			sendErrorResponse(w, r, http.StatusBadRequest, utils.ErrCodeInvalidRequest, "Invalid since, expected an RFC 3339 timestamp")
+			return
+		}
+		filter.CreatedAfter = since
+	}
+
+	switch format := r.URL.Query().Get("format"); format {
+	case "", "json":
+	case "ndjson":
+		streamTrainingDataNDJSON(w, r, filter)
+		return
+	default:
+		sendErrorResponse(w, r, http.StatusBadRequest, utils.ErrCodeInvalidRequest, fmt.Sprintf("Invalid format %q, expected json or ndjson", format))
 		return
 	}
 
 	// Get all training data
-	trainingData, err := models.ExportTrainingData()
+	trainingData, err := models.ExportTrainingData(filter)
 	if err != nil {
-		sendErrorResponse(w, http.StatusInternalServerError, "Failed to fetch training data: "+err.Error())
+		sendErrorResponse(w, r, http.StatusInternalServerError, utils.ErrCodeDatabaseError, "Failed to fetch training data: "+err.Error())
 		return
 	}
 
 	// Format data for export
-	type ExportData struct {
-		FrontImgPath string  `json:"front_image_path"`
-		SideImgPath  string  `json:"side_image_path"`
-		Height       float64 `json:"height"`
-		ActualWeight float64 `json:"actual_weight"`
-	}
-
-	exportData := make([]ExportData, len(trainingData))
+	latest := filter.CreatedAfter
+	exportData := make([]trainingExportRecord, len(trainingData))
 	for i, td := range trainingData {
-		exportData[i] = ExportData{
-			FrontImgPath: td.FrontImgPath,
-			SideImgPath:  td.SideImgPath,
-			Height:       td.Height,
-			ActualWeight: td.ActualWeight,
+		exportData[i] = newTrainingExportRecord(td)
+		if td.CreatedAt.After(latest) {
+			latest = td.CreatedAt
 		}
 	}
+	setLatestTimestamp(w, latest)
 
 	// Return success response
 	response := Response{
@@ -223,6 +463,68 @@ func ExportTrainingData(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Send response
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(response)
+	utils.Respond(w, r, http.StatusOK, response)
+}
+
+// streamTrainingDataNDJSON writes every training record matching filter as
+// a line of JSON, straight from the database cursor, flushing every
+// ndjsonFlushEvery lines. Once streaming has started the status can't
+// change, so later failures are logged and end the stream early.
+func streamTrainingDataNDJSON(w http.ResponseWriter, r *http.Request, filter models.TrainingDataFilter) {
+	// The header goes out before the records, so find the newest one first and
+	// leave out records added while streaming; the next export picks them up
+	latest, err := models.LatestTrainingDataTime(filter)
+	if err != nil {
+		sendErrorResponse(w, r, http.StatusInternalServerError, utils.ErrCodeDatabaseError, "Failed to fetch training data: "+err.Error())
+		return
+	}
+	if latest.IsZero() {
+		// Nothing new: keep the client's position
+		setLatestTimestamp(w, filter.CreatedAfter)
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	filter.CreatedUntil = latest
+	setLatestTimestamp(w, latest)
+
+	flusher, _ := w.(http.Flusher)
+	encoder := json.NewEncoder(w)
+
+	var written int
+	err = models.StreamTrainingData(r.Context(), filter, func(td *models.TrainingData) error {
+		if written == 0 {
+			w.Header().Set("Content-Type", "application/x-ndjson")
+			w.WriteHeader(http.StatusOK)
+		}
+		if err := encoder.Encode(newTrainingExportRecord(td)); err != nil {
+			return err
+		}
+		written++
+		if written%ndjsonFlushEvery == 0 && flusher != nil {
+			flusher.Flush()
+		}
+		return nil
+	})
+
+	switch {
+	case err != nil && written == 0 && r.Context().Err() == nil:
+		// Nothing was exported, so the client mustn't advance its position
+		w.Header().Del(latestTimestampHeader)
+		sendErrorResponse(w, r, http.StatusInternalServerError, utils.ErrCodeDatabaseError, "Failed to fetch training data: "+err.Error())
+	case err != nil:
+		log.Printf("Training data export stopped after %d records: %v", written, err)
+	case written == 0:
+		// Nothing was streamed, so the headers are still unsent
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// setLatestTimestamp sets the X-Latest-Timestamp header to latest, unless it
+// is zero because nothing was exported and no since was given
+func setLatestTimestamp(w http.ResponseWriter, latest time.Time) {
+	if !latest.IsZero() {
+		w.Header().Set(latestTimestampHeader, latest.UTC().Format(time.RFC3339Nano))
+	}
 }
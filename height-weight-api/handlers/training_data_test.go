@@ -0,0 +1,429 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lucasfepe/height-weight-api/internal/testutil"
+	"github.com/lucasfepe/height-weight-api/models"
+	"github.com/lucasfepe/height-weight-api/utils"
+)
+
+// newTrainingRequest builds a training data upload with distinct images
+func newTrainingRequest(t *testing.T, fields map[string]string) *http.Request {
+	t.Helper()
+	if fields == nil {
+		fields = map[string]string{"height": "175", "actual_weight": "70"}
+	}
+	return newMultipartRequest(t, "/training-data", fields,
+		map[string][]byte{"front_image": testPNG(t, 64, 96, 40), "side_image": testPNG(t, 64, 96, 80)})
+}
+
+func TestTrainingDataQuota(t *testing.T) {
+	cfg := testutil.Config(t, map[string]string{"TRAINING_QUOTA_BYTES": "4096"})
+	handler := NewSaveTrainingDataHandler(cfg, fakeMLClients(&fakeMLService{}))
+
+	// An empty training directory leaves room for the upload
+	w, response := serve(t, handler, newTrainingRequest(t, nil))
+	if w.Code == http.StatusInsufficientStorage {
+		t.Fatalf("upload into an empty directory got %d (%s), want it under the quota", w.Code, response.Message)
+	}
+
+	// Fill the training directory past the quota
+	dir := trainingUploadDir(cfg)
+	if err := os.MkdirAll(filepath.Join(dir, "2024"), 0755); err != nil {
+		t.Fatalf("create training dir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "2024", "old.png"), make([]byte, 4096), 0644); err != nil {
+		t.Fatalf("fill training dir: %v", err)
+	}
+
+	before := len(storedFiles(t, dir))
+
+	w, response = serve(t, handler, newTrainingRequest(t, nil))
+	if w.Code != http.StatusInsufficientStorage || response.ErrorCode != utils.ErrCodeQuotaExceeded {
+		t.Errorf("upload past the quota got %d %s (%s), want 507 %s", w.Code, response.ErrorCode, response.Message, utils.ErrCodeQuotaExceeded)
+	}
+	if files := storedFiles(t, dir); len(files) != before {
+		t.Errorf("training files = %v, want none added past the quota", files)
+	}
+}
+
+func TestTrainingDataAnonymized(t *testing.T) {
+	cfg := testutil.Config(t, map[string]string{"ANONYMIZE_TRAINING_IMAGES": "true"})
+	face := image.Rect(16, 16, 48, 48)
+	handler := NewSaveTrainingDataHandler(cfg, fakeMLClients(&fakeMLService{faces: []image.Rectangle{face}}))
+
+	front := noisyPNG(t, 64, 96, 1)
+	r := newMultipartRequest(t, "/training-data", map[string]string{"height": "175", "actual_weight": "70"},
+		map[string][]byte{"front_image": front, "side_image": noisyPNG(t, 64, 96, 2)})
+	w, response := serve(t, handler, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d %s (%s), want 200", w.Code, response.ErrorCode, response.Message)
+	}
+	var saved struct {
+		Anonymized bool `json:"anonymized"`
+	}
+	if err := json.Unmarshal(response.Data, &saved); err != nil {
+		t.Fatalf("decode data: %v", err)
+	}
+	if !saved.Anonymized {
+		t.Error("anonymized = false, want true")
+	}
+
+	var stored []byte
+	for _, path := range storedFiles(t, trainingUploadDir(cfg)) {
+		if strings.Contains(filepath.Base(path), "_front_") {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("read stored image: %v", err)
+			}
+			stored = data
+		}
+	}
+	if stored == nil {
+		t.Fatal("no front image stored")
+	}
+
+	want, err := png.Decode(bytes.NewReader(front))
+	if err != nil {
+		t.Fatalf("decode upload: %v", err)
+	}
+	got, err := png.Decode(bytes.NewReader(stored))
+	if err != nil {
+		t.Fatalf("decode stored image: %v", err)
+	}
+
+	// The face, widened by the blur margin, changes and nothing else does
+	blurred := face.Inset(-5)
+	changedInFace := 0
+	bounds := want.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			wantGray := color.GrayModel.Convert(want.At(x, y)).(color.Gray)
+			gotGray := color.GrayModel.Convert(got.At(x, y)).(color.Gray)
+			switch {
+			case image.Pt(x, y).In(face):
+				if gotGray != wantGray {
+					changedInFace++
+				}
+			case !image.Pt(x, y).In(blurred) && gotGray != wantGray:
+				t.Fatalf("pixel (%d, %d) outside the face changed from %d to %d", x, y, wantGray.Y, gotGray.Y)
+			}
+		}
+	}
+	if area := face.Dx() * face.Dy(); changedInFace < area*9/10 {
+		t.Errorf("%d of %d face pixels changed, want nearly all blurred", changedInFace, area)
+	}
+}
+
+// seedTrainingData saves 10 training records of 150 to 195 cm, 5 cm apart
+// and created a minute apart from the shortest, and weighing 50 to 77 kg
+func seedTrainingData(t *testing.T) {
+	t.Helper()
+	base := time.Now().Add(-time.Hour)
+	for i := 0; i < 10; i++ {
+		record := &models.TrainingData{
+			Height:       150 + 5*float64(i),
+			ActualWeight: 50 + 3*float64(i),
+			CreatedAt:    base.Add(time.Duration(i) * time.Minute),
+		}
+		if err := models.SaveTrainingData(record); err != nil {
+			t.Fatalf("SaveTrainingData: %v", err)
+		}
+	}
+}
+
+// listedHeights lists training data with query and returns the heights of
+// the records, and the page when paginated
+func listedHeights(t *testing.T, query string) ([]float64, utils.Page) {
+	t.Helper()
+	w, response := serve(t, http.HandlerFunc(GetTrainingData), httptest.NewRequest(http.MethodGet, "/training-data?"+query, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("%s: got %d %s (%s), want 200", query, w.Code, response.ErrorCode, response.Message)
+	}
+
+	var records []models.TrainingData
+	var page utils.Page
+	raw := response.Data
+	if strings.Contains(query, "paginated=true") {
+		var paged struct {
+			utils.Page
+			Items json.RawMessage `json:"items"`
+		}
+		if err := json.Unmarshal(raw, &paged); err != nil {
+			t.Fatalf("decode page: %v", err)
+		}
+		page, raw = paged.Page, paged.Items
+	}
+	if err := json.Unmarshal(raw, &records); err != nil {
+		t.Fatalf("decode records: %v", err)
+	}
+
+	heights := []float64{}
+	for _, record := range records {
+		heights = append(heights, record.Height)
+	}
+	return heights, page
+}
+
+func TestGetTrainingDataPaging(t *testing.T) {
+	testDatabase(t, nil)
+	seedTrainingData(t)
+
+	// Offset pages newest first without gaps or repeats
+	var paged []float64
+	for offset := 0; offset < 12; offset += 3 {
+		heights, _ := listedHeights(t, fmt.Sprintf("limit=3&offset=%d", offset))
+		paged = append(paged, heights...)
+	}
+	if want := []float64{195, 190, 185, 180, 175, 170, 165, 160, 155, 150}; !slices.Equal(paged, want) {
+		t.Errorf("paged heights = %v, want %v", paged, want)
+	}
+
+	tests := []struct {
+		name      string
+		query     string
+		want      []float64
+		wantTotal int64
+	}{
+		{"height range", "min_height=160&max_height=180", []float64{180, 175, 170, 165, 160}, 0},
+		{"open height range", "min_height=185", []float64{195, 190, 185}, 0},
+		{"height and weight range", "min_height=160&max_weight=65", []float64{175, 170, 165, 160}, 0},
+		{"filtered page", "min_height=160&max_height=180&limit=2&offset=2&paginated=true", []float64{170, 165}, 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			heights, page := listedHeights(t, tt.query)
+			if !slices.Equal(heights, tt.want) {
+				t.Errorf("heights = %v, want %v", heights, tt.want)
+			}
+			if page.Total != tt.wantTotal {
+				t.Errorf("total = %d, want %d", page.Total, tt.wantTotal)
+			}
+		})
+	}
+}
+
+func TestGetTrainingDataInvalidRange(t *testing.T) {
+	testDatabase(t, nil)
+
+	tests := []struct {
+		query    string
+		wantCode string
+	}{
+		{"min_height=180&max_height=160", utils.ErrCodeInvalidHeight},
+		{"min_weight=-1", utils.ErrCodeInvalidWeight},
+		{"min_height=tall&min_weight=90&max_weight=60", utils.ErrCodeInvalidRequest},
+	}
+	for _, tt := range tests {
+		w, response := serve(t, http.HandlerFunc(GetTrainingData), httptest.NewRequest(http.MethodGet, "/training-data?"+tt.query, nil))
+		if w.Code != http.StatusBadRequest || response.ErrorCode != tt.wantCode {
+			t.Errorf("%s: got %d %s (%s), want 400 %s", tt.query, w.Code, response.ErrorCode, response.Message, tt.wantCode)
+		}
+	}
+}
+
+func TestGetTrainingDistribution(t *testing.T) {
+	testDatabase(t, nil)
+	seedTrainingData(t)
+
+	tests := []struct {
+		query     string
+		wantSize  float64
+		wantBins  string
+		wantCode  string
+		wantTotal int64
+	}{
+		{"", 10, "[{150 160 2} {160 170 2} {170 180 2} {180 190 2} {190 200 2}]", "", 10},
+		{"bin_size=20", 20, "[{140 160 2} {160 180 4} {180 200 4}]", "", 10},
+		{"bin_size=abc", 0, "", utils.ErrCodeInvalidRequest, 0},
+		{"bin_size=-5", 0, "", utils.ErrCodeInvalidRequest, 0},
+		{"bin_size=0.01", 0, "", utils.ErrCodeInvalidRequest, 0},
+	}
+	for _, tt := range tests {
+		w, response := serve(t, http.HandlerFunc(GetTrainingDistribution), httptest.NewRequest(http.MethodGet, "/training-data/distribution?"+tt.query, nil))
+		if tt.wantCode != "" {
+			if w.Code != http.StatusBadRequest || response.ErrorCode != tt.wantCode {
+				t.Errorf("%q: got %d %s (%s), want 400 %s", tt.query, w.Code, response.ErrorCode, response.Message, tt.wantCode)
+			}
+			continue
+		}
+		if w.Code != http.StatusOK {
+			t.Fatalf("%q: got %d %s (%s), want 200", tt.query, w.Code, response.ErrorCode, response.Message)
+		}
+
+		var data struct {
+			BinSize float64            `json:"bin_size"`
+			Total   int64              `json:"total"`
+			Bins    []models.HeightBin `json:"bins"`
+		}
+		if err := json.Unmarshal(response.Data, &data); err != nil {
+			t.Fatalf("%q: decode %s: %v", tt.query, response.Data, err)
+		}
+		if data.BinSize != tt.wantSize || data.Total != tt.wantTotal {
+			t.Errorf("%q: bin_size %v total %d, want %v and %d", tt.query, data.BinSize, data.Total, tt.wantSize, tt.wantTotal)
+		}
+		if bins := fmt.Sprint(data.Bins); bins != tt.wantBins {
+			t.Errorf("%q: bins = %s, want %s", tt.query, bins, tt.wantBins)
+		}
+	}
+}
+
+func TestExportTrainingDataNDJSON(t *testing.T) {
+	testDatabase(t, nil)
+	server := httptest.NewServer(http.HandlerFunc(ExportTrainingData))
+	defer server.Close()
+
+	// exportLines streams the export and returns its decoded lines
+	exportLines := func() []trainingExportRecord {
+		t.Helper()
+		resp, err := http.Get(server.URL + "?format=ndjson")
+		if err != nil {
+			t.Fatalf("export: %v", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("export: got %d, want 200", resp.StatusCode)
+		}
+		if contentType := resp.Header.Get("Content-Type"); contentType != "application/x-ndjson" {
+			t.Errorf("Content-Type = %q, want application/x-ndjson", contentType)
+		}
+
+		records := []trainingExportRecord{}
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			var record trainingExportRecord
+			if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+				t.Fatalf("line %d %q: %v", len(records)+1, scanner.Text(), err)
+			}
+			records = append(records, record)
+		}
+		if err := scanner.Err(); err != nil {
+			t.Fatalf("read export: %v", err)
+		}
+		return records
+	}
+
+	if records := exportLines(); len(records) != 0 {
+		t.Errorf("exported %d records from an empty collection, want 0", len(records))
+	}
+
+	// More records than are flushed at once
+	const count = 2*ndjsonFlushEvery + 50
+	base := time.Now().Add(-time.Hour)
+	for i := 0; i < count; i++ {
+		record := &models.TrainingData{Height: 150 + float64(i%50), ActualWeight: 60, CreatedAt: base.Add(time.Duration(i) * time.Second)}
+		if err := models.SaveTrainingData(record); err != nil {
+			t.Fatalf("SaveTrainingData: %v", err)
+		}
+	}
+
+	records := exportLines()
+	if len(records) != count {
+		t.Fatalf("exported %d records, want %d", len(records), count)
+	}
+	for _, record := range records {
+		if record.Height < 150 || record.Height >= 200 || record.ActualWeight != 60 {
+			t.Fatalf("record = %+v, want one of the seeded", record)
+		}
+	}
+
+	w, response := serve(t, http.HandlerFunc(ExportTrainingData), httptest.NewRequest(http.MethodGet, "/training-data/export?format=csv", nil))
+	if w.Code != http.StatusBadRequest || response.ErrorCode != utils.ErrCodeInvalidRequest {
+		t.Errorf("format=csv: got %d %s (%s), want 400 %s", w.Code, response.ErrorCode, response.Message, utils.ErrCodeInvalidRequest)
+	}
+}
+
+func TestExportTrainingDataSince(t *testing.T) {
+	testDatabase(t, nil)
+	seedTrainingData(t)
+
+	// export returns the heights exported after since and the latest timestamp header
+	export := func(format, since string) ([]float64, string) {
+		t.Helper()
+		target := "/training-data/export?" + url.Values{"format": {format}, "since": {since}}.Encode()
+		w := httptest.NewRecorder()
+		ExportTrainingData(w, httptest.NewRequest(http.MethodGet, target, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("export since %q: got %d %s, want 200", since, w.Code, w.Body.String())
+		}
+
+		var records []trainingExportRecord
+		if format == "ndjson" {
+			for _, line := range strings.Split(strings.TrimSpace(w.Body.String()), "\n") {
+				if line == "" {
+					continue
+				}
+				var record trainingExportRecord
+				if err := json.Unmarshal([]byte(line), &record); err != nil {
+					t.Fatalf("decode line %q: %v", line, err)
+				}
+				records = append(records, record)
+			}
+		} else {
+			var response testResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+				t.Fatalf("decode response: %v", err)
+			}
+			if err := json.Unmarshal(response.Data, &records); err != nil {
+				t.Fatalf("decode records %s: %v", response.Data, err)
+			}
+		}
+
+		heights := []float64{}
+		for _, record := range records {
+			heights = append(heights, record.Height)
+		}
+		slices.Sort(heights)
+		return heights, w.Header().Get(latestTimestampHeader)
+	}
+
+	heights, latest := export("json", "")
+	if len(heights) != 10 || latest == "" {
+		t.Fatalf("full export = %v heights with %s %q, want 10 and a timestamp", heights, latestTimestampHeader, latest)
+	}
+
+	// Records added since the last export are all the next one returns
+	for _, height := range []float64{201, 202} {
+		if err := models.SaveTrainingData(&models.TrainingData{Height: height, ActualWeight: 90}); err != nil {
+			t.Fatalf("SaveTrainingData: %v", err)
+		}
+	}
+	for _, format := range []string{"json", "ndjson"} {
+		heights, next := export(format, latest)
+		if !slices.Equal(heights, []float64{201, 202}) {
+			t.Errorf("%s export since %s = %v, want the 2 new records", format, latest, heights)
+		}
+		nextTime, err := time.Parse(time.RFC3339Nano, next)
+		latestTime, _ := time.Parse(time.RFC3339Nano, latest)
+		if err != nil || !nextTime.After(latestTime) {
+			t.Errorf("%s %s = %q, want a time after %s", format, latestTimestampHeader, next, latest)
+		}
+
+		// Nothing newer: no records, and the position is kept
+		heights, again := export(format, next)
+		if len(heights) != 0 || again != next {
+			t.Errorf("%s export since %s = %v with %q, want none and the same timestamp", format, next, heights, again)
+		}
+	}
+
+	w, response := serve(t, http.HandlerFunc(ExportTrainingData), httptest.NewRequest(http.MethodGet, "/training-data/export?since=yesterday", nil))
+	if w.Code != http.StatusBadRequest || response.ErrorCode != utils.ErrCodeInvalidRequest {
+		t.Errorf("since=yesterday: got %d %s (%s), want 400 %s", w.Code, response.ErrorCode, response.Message, utils.ErrCodeInvalidRequest)
+	}
+}
@@ -0,0 +1,298 @@
+package handlers
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lucasfepe/height-weight-api/config"
+	"github.com/lucasfepe/height-weight-api/models"
+	"github.com/lucasfepe/height-weight-api/utils"
+)
+
+// importManifestName is the manifest listing the records of an import archive
+const importManifestName = "manifest.csv"
+
+// importManifestColumns are the columns the manifest header must name
+var importManifestColumns = []string{"front", "side", "height", "actual_weight"}
+
+// ImportRowError reports why a manifest row wasn't imported. Row numbers
+// count the header as row 1, like a spreadsheet.
+type ImportRowError struct {
+	Row     int    `json:"row"`
+	Message string `json:"message"`
+}
+
+// trainingImport saves the records of one import archive
+type trainingImport struct {
+	cfg     *config.Config
+	service utils.MLService // Face detector, nil unless images are anonymized
+	images  map[string]*zip.File
+	used    int64 // Bytes of training images stored so far, for the quota
+}
+
+// NewImportTrainingDataHandler creates a handler importing labeled image pairs
+// from a ZIP archive with a manifest CSV. Each row is saved on its own, so a
+// bad row is reported without failing the rest of the import.
+func NewImportTrainingDataHandler(cfg *config.Config, ml *utils.MLClients) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if models.DB == nil {
+			sendErrorResponse(w, r, http.StatusInternalServerError, utils.ErrCodeDatabaseError, "Database not initialized")
+			return
+		}
+
+		// Spool the archive to disk so it is never held in memory whole
+		archive, err := os.CreateTemp("", "training-import-*.zip")
+		if err != nil {
+			sendErrorResponse(w, r, http.StatusInternalServerError, utils.ErrCodeStorageError, "Failed to buffer archive: "+err.Error())
+			return
+		}
+		defer func() {
+			archive.Close()
+			if err := os.Remove(archive.Name()); err != nil {
+				log.Printf("Warning: Failed to remove import archive %s: %v", archive.Name(), err)
+			}
+		}()
+
+		size, err := io.Copy(archive, r.Body)
+		if err != nil {
+			status, errCode := formError(err)
+			sendErrorResponse(w, r, status, errCode, "Failed to read archive: "+err.Error())
+			return
+		}
+
+		zr, err := zip.NewReader(archive, size)
+		if err != nil {
+			sendErrorResponse(w, r, http.StatusBadRequest, utils.ErrCodeInvalidRequest, "Invalid ZIP archive: "+err.Error())
+			return
+		}
+
+		imp := &trainingImport{cfg: cfg, images: make(map[string]*zip.File, len(zr.File))}
+		var manifest *zip.File
+		for _, f := range zr.File {
+			if f.Name == importManifestName {
+				manifest = f
+			} else if !f.FileInfo().IsDir() {
+				imp.images[f.Name] = f
+			}
+		}
+		if manifest == nil {
+			sendErrorResponse(w, r, http.StatusBadRequest, utils.ErrCodeInvalidRequest, "Archive has no "+importManifestName)
+			return
+		}
+
+		if cfg.AnonymizeTrainingImages {
+			_, imp.service, err = ml.Resolve("")
+			if err != nil {
+				sendPredictionError(w, r, err)
+				return
+			}
+		}
+
+		if cfg.TrainingQuotaBytes > 0 {
+			if imp.used, err = utils.DirSize(trainingUploadDir(cfg)); err != nil {
+				sendErrorResponse(w, r, http.StatusInternalServerError, utils.ErrCodeStorageError, "Failed to check training data storage: "+err.Error())
+				return
+			}
+		}
+
+		mf, err := manifest.Open()
+		if err != nil {
+			sendErrorResponse(w, r, http.StatusBadRequest, utils.ErrCodeInvalidRequest, "Failed to open manifest: "+err.Error())
+			return
+		}
+		defer mf.Close()
+
+		reader := csv.NewReader(mf)
+		reader.FieldsPerRecord = -1 // Short rows are reported per row instead of failing the import
+		header, err := reader.Read()
+		if err != nil {
+			sendErrorResponse(w, r, http.StatusBadRequest, utils.ErrCodeInvalidRequest, "Failed to read manifest header: "+err.Error())
+			return
+		}
+		columns, err := manifestColumns(header)
+		if err != nil {
+			sendErrorResponse(w, r, http.StatusBadRequest, utils.ErrCodeInvalidRequest, "Invalid manifest header: "+err.Error())
+			return
+		}
+
+		imported := 0
+		rowErrors := []ImportRowError{}
+		for row := 2; ; row++ {
+			// Stop between rows once the client is gone or the request timed out
+			if r.Context().Err() != nil {
+				return
+			}
+
+			record, err := reader.Read()
+			if err == io.EOF {
+				break
+			}
+			if err == nil {
+				err = imp.saveRow(r.Context(), record, columns)
+			}
+			if err != nil {
+				rowErrors = append(rowErrors, ImportRowError{Row: row, Message: err.Error()})
+				// A malformed CSV line can't be skipped reliably, so stop there
+				var parseErr *csv.ParseError
+				if errors.As(err, &parseErr) {
+					break
+				}
+				continue
+			}
+			imported++
+		}
+
+		// Return success response
+		response := Response{
+			Success: true,
+			Data: map[string]interface{}{
+				"imported": imported,
+				"failed":   len(rowErrors),
+				"errors":   rowErrors,
+			},
+			Message: fmt.Sprintf("Imported %d of %d training data records", imported, imported+len(rowErrors)),
+		}
+
+		// Send response
+		utils.Respond(w, r, http.StatusOK, response)
+	}
+}
+
+// manifestColumns maps each required column to its index in the header
+func manifestColumns(header []string) (map[string]int, error) {
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, name := range importManifestColumns {
+		if _, ok := columns[name]; !ok {
+			return nil, fmt.Errorf("missing column %q", name)
+		}
+	}
+	return columns, nil
+}
+
+// saveRow validates one manifest row and stores its images and record. The
+// images are removed again if the record can't be saved.
+func (imp *trainingImport) saveRow(ctx context.Context, record []string, columns map[string]int) error {
+	field := func(name string) string {
+		if i := columns[name]; i < len(record) {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+
+	height, err := strconv.ParseFloat(field("height"), 64)
+	if err != nil || height <= 0 {
+		return fmt.Errorf("invalid height %q", field("height"))
+	}
+	actualWeight, err := strconv.ParseFloat(field("actual_weight"), 64)
+	if err != nil || actualWeight <= 0 {
+		return fmt.Errorf("invalid actual_weight %q", field("actual_weight"))
+	}
+
+	frontName, sideName := field("front"), field("side")
+	frontData, err := imp.readImage(frontName)
+	if err != nil {
+		return fmt.Errorf("front image: %w", err)
+	}
+	sideData, err := imp.readImage(sideName)
+	if err != nil {
+		return fmt.Errorf("side image: %w", err)
+	}
+	if bytes.Equal(frontData, sideData) {
+		return errors.New("front and side images are identical")
+	}
+
+	// Same treatment as images sent to save-training-data
+	if frontData, err = utils.AutoOrient(bytes.NewReader(frontData)); err != nil {
+		return fmt.Errorf("front image: %w", err)
+	}
+	if sideData, err = utils.AutoOrient(bytes.NewReader(sideData)); err != nil {
+		return fmt.Errorf("side image: %w", err)
+	}
+	if imp.service != nil {
+		if frontData, err = anonymizeImage(ctx, imp.service, frontData); err != nil {
+			return fmt.Errorf("front image: %w", err)
+		}
+		if sideData, err = anonymizeImage(ctx, imp.service, sideData); err != nil {
+			return fmt.Errorf("side image: %w", err)
+		}
+	}
+
+	size := int64(len(frontData) + len(sideData))
+	if imp.cfg.TrainingQuotaBytes > 0 && imp.used+size > imp.cfg.TrainingQuotaBytes {
+		return fmt.Errorf("training data storage quota of %d bytes exceeded", imp.cfg.TrainingQuotaBytes)
+	}
+
+	files := &utils.TempFileSet{}
+	defer files.Cleanup()
+
+	now := time.Now()
+	frontFilepath, sideFilepath, err := writeTrainingImages(imp.cfg, files, now, frontData, sideData, path.Base(frontName), path.Base(sideName))
+	if err != nil {
+		return err
+	}
+
+	trainingData := &models.TrainingData{
+		Height:       height,
+		ActualWeight: actualWeight,
+		FrontImgPath: frontFilepath,
+		SideImgPath:  sideFilepath,
+		Anonymized:   imp.service != nil,
+		CreatedAt:    now,
+	}
+	if err := models.SaveTrainingData(trainingData); err != nil {
+		return fmt.Errorf("failed to save training data to database: %w", err)
+	}
+	files.Keep()
+
+	imp.used += size
+	return nil
+}
+
+// readImage reads the archive image at name, enforcing the allowed
+// extensions and the maximum file size
+func (imp *trainingImport) readImage(name string) ([]byte, error) {
+	if name == "" {
+		return nil, errors.New("path is required")
+	}
+	f, ok := imp.images[name]
+	if !ok {
+		return nil, fmt.Errorf("%q not found in archive", name)
+	}
+	if !allowedExt(imp.cfg, strings.ToLower(path.Ext(name))) {
+		return nil, fmt.Errorf("%q has an unsupported format", name)
+	}
+	if f.UncompressedSize64 > uint64(imp.cfg.MaxFileSize) {
+		return nil, fmt.Errorf("%q exceeds the maximum size of %d bytes", name, imp.cfg.MaxFileSize)
+	}
+
+	rc, err := f.Open()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %q: %w", name, err)
+	}
+	defer rc.Close()
+
+	// The declared size can't be trusted, so cap the decompressed bytes too
+	data, err := io.ReadAll(io.LimitReader(rc, imp.cfg.MaxFileSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %q: %w", name, err)
+	}
+	if int64(len(data)) > imp.cfg.MaxFileSize {
+		return nil, fmt.Errorf("%q exceeds the maximum size of %d bytes", name, imp.cfg.MaxFileSize)
+	}
+	return data, nil
+}
@@ -0,0 +1,112 @@
+package handlers
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"github.com/lucasfepe/height-weight-api/models"
+	"github.com/lucasfepe/height-weight-api/utils"
+)
+
+// testArchive builds a ZIP archive holding files, in the given name order
+func testArchive(t *testing.T, names []string, files map[string][]byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, name := range names {
+		f, err := zw.Create(name)
+		if err != nil {
+			t.Fatalf("create %s: %v", name, err)
+		}
+		f.Write(files[name])
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("close archive: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestImportTrainingData(t *testing.T) {
+	cfg := testDatabase(t, nil)
+	handler := NewImportTrainingDataHandler(cfg, fakeMLClients(&fakeMLService{}))
+
+	manifest := "front,side,height,actual_weight\n" +
+		"alice/front.png,alice/side.png,175,70\n" + // Row 2 is valid
+		"alice/front.png,alice/side.png,tall,70\n" + // Row 3 has no numeric height
+		"bob/front.png,bob/side.png,180,85\n" + // Row 4 references missing images
+		"alice/front.png,alice/front.png,175,70\n" + // Row 5 repeats one image
+		"alice/front.png,notes.txt,175,70\n" // Row 6 has an unsupported format
+	files := map[string][]byte{
+		importManifestName: []byte(manifest),
+		"alice/front.png":  testPNG(t, 64, 96, 40),
+		"alice/side.png":   testPNG(t, 64, 96, 80),
+		"notes.txt":        []byte("not an image"),
+	}
+	archive := testArchive(t, []string{"alice/front.png", "alice/side.png", "notes.txt", importManifestName}, files)
+
+	r := httptest.NewRequest(http.MethodPost, "/training-data/import", bytes.NewReader(archive))
+	r.Header.Set("Content-Type", "application/zip")
+	w, response := serve(t, handler, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d %s (%s), want 200", w.Code, response.ErrorCode, response.Message)
+	}
+
+	var report struct {
+		Imported int              `json:"imported"`
+		Failed   int              `json:"failed"`
+		Errors   []ImportRowError `json:"errors"`
+	}
+	if err := json.Unmarshal(response.Data, &report); err != nil {
+		t.Fatalf("decode report: %v", err)
+	}
+	if report.Imported != 1 || report.Failed != 4 {
+		t.Errorf("imported %d, failed %d, want 1 and 4", report.Imported, report.Failed)
+	}
+	var rows []int
+	for _, rowErr := range report.Errors {
+		rows = append(rows, rowErr.Row)
+	}
+	if want := []int{3, 4, 5, 6}; !slices.Equal(rows, want) {
+		t.Errorf("failed rows = %v, want %v", rows, want)
+	}
+
+	// Only the valid row leaves a record and its two images behind
+	count, err := models.CountTrainingData(models.TrainingDataFilter{})
+	if err != nil {
+		t.Fatalf("CountTrainingData: %v", err)
+	}
+	if count != 1 {
+		t.Errorf("training records = %d, want 1", count)
+	}
+	if stored := storedFiles(t, trainingUploadDir(cfg)); len(stored) != 2 {
+		t.Errorf("stored files = %v, want the 2 images of the valid row", stored)
+	}
+}
+
+func TestImportTrainingDataInvalidArchive(t *testing.T) {
+	cfg := testDatabase(t, nil)
+	handler := NewImportTrainingDataHandler(cfg, fakeMLClients(&fakeMLService{}))
+
+	tests := []struct {
+		name    string
+		archive []byte
+	}{
+		{"not a ZIP", []byte("plain text")},
+		{"no manifest", testArchive(t, []string{"front.png"}, map[string][]byte{"front.png": testPNG(t, 8, 8, 0)})},
+		{"manifest missing a column", testArchive(t, []string{importManifestName}, map[string][]byte{importManifestName: []byte("front,side,height\n")})},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/training-data/import", bytes.NewReader(tt.archive))
+			w, response := serve(t, handler, r)
+			if w.Code != http.StatusBadRequest || response.ErrorCode != utils.ErrCodeInvalidRequest {
+				t.Errorf("got %d %s (%s), want 400 %s", w.Code, response.ErrorCode, response.Message, utils.ErrCodeInvalidRequest)
+			}
+		})
+	}
+}
@@ -2,14 +2,11 @@ package handlers
 
 import (
 	"bytes"
-	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
-	"mime/multipart"
 	"net/http"
 	"os"
 	"path/filepath"
-	"strings"
 	"time"
 
 	"github.com/google/uuid"
@@ -19,155 +16,127 @@ import (
 	"github.com/lucasfepe/height-weight-api/utils"
 )
 
-// NewImageUploadHandler creates a handler for image uploads with config
-func NewImageUploadHandler(cfg *config.Config) http.HandlerFunc {
+// NewImageUploadHandler creates a handler for image uploads with config.
+// Images are estimated by the default ML model.
+func NewImageUploadHandler(cfg *config.Config, ml *utils.MLClients) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		// Spilled parts are written to temp files, which must not outlive the request
+		defer removeMultipartFiles(r)
+
 		// Parse multipart form with specified max memory
-		if err := r.ParseMultipartForm(cfg.MaxFileSize); err != nil {
-			utils.RespondWithError(w, http.StatusBadRequest, "Invalid request: "+err.Error())
+		if err := r.ParseMultipartForm(cfg.MultipartMemory); err != nil {
+			status, errCode := formError(err)
+			utils.RespondWithError(w, r, status, errCode, "Invalid request: "+err.Error())
+			return
+		}
+
+		// Reject stray attachments before touching the image
+		if !checkUploadLimits(w, r, cfg) {
 			return
 		}
 
 		// Get file from form
 		file, fileHeader, err := r.FormFile("image")
 		if err != nil {
-			utils.RespondWithError(w, http.StatusBadRequest, "Failed to get image: "+err.Error())
+			utils.RespondWithError(w, r, http.StatusBadRequest, utils.ErrCodeMissingImage, "Failed to get image: "+err.Error())
 			return
 		}
 		defer file.Close()
 
 		// Validate file size
 		if fileHeader.Size > cfg.MaxFileSize {
-			utils.RespondWithError(w, http.StatusBadRequest, fmt.Sprintf("File too large. Max size: %d bytes", cfg.MaxFileSize))
+			utils.RespondWithError(w, r, http.StatusBadRequest, utils.ErrCodeImageTooLarge, fmt.Sprintf("File too large. Max size: %d bytes", cfg.MaxFileSize))
 			return
 		}
 
-		// Validate file extension
-		ext := strings.ToLower(filepath.Ext(fileHeader.Filename))
-		validExt := false
-		for _, allowedExt := range cfg.AllowedExts {
-			if ext == allowedExt {
-				validExt = true
-				break
-			}
-		}
-		if !validExt {
-			utils.RespondWithError(w, http.StatusBadRequest, "Unsupported file format")
+		// Validate the file extension and the type of its content
+		ext, ok := checkImageType(w, r, cfg, file, fileHeader.Filename, "Uploaded")
+		if !ok {
 			return
 		}
 
 		// Generate unique ID and save file
 		imageID := uuid.New().String()
 		filename := imageID + ext
-		filePath := filepath.Join(cfg.UploadDir, filename)
+		uploadDir := estimationUploadDir(cfg)
+		if cfg.DatedUploads {
+			uploadDir = utils.DatedUploadPath(uploadDir, time.Now())
+		}
+		if err := os.MkdirAll(uploadDir, 0755); err != nil {
+			utils.RespondWithError(w, r, http.StatusInternalServerError, utils.ErrCodeStorageError, "Failed to create upload directory: "+err.Error())
+			return
+		}
+		filePath := filepath.Join(uploadDir, filename)
 
-		// Create file
-		dst, err := os.Create(filePath)
+		// Turn the photo upright and strip its EXIF metadata
+		fileContent, err := utils.AutoOrient(file)
 		if err != nil {
-			utils.RespondWithError(w, http.StatusInternalServerError, "Failed to create file: "+err.Error())
+			utils.RespondWithError(w, r, http.StatusBadRequest, utils.ErrCodeInvalidImage, "Invalid image: "+err.Error())
 			return
 		}
-		defer dst.Close()
 
-		// Copy file content
-		if _, err = io.Copy(dst, file); err != nil {
-			utils.RespondWithError(w, http.StatusInternalServerError, "Failed to save file: "+err.Error())
+		// Save file, removed again unless the estimation is recorded
+		files := &utils.TempFileSet{}
+		defer files.Cleanup()
+		if err := files.WriteFile(filePath, fileContent, 0644); err != nil {
+			utils.RespondWithError(w, r, http.StatusInternalServerError, utils.ErrCodeStorageError, "Failed to save file: "+err.Error())
 			return
 		}
 
-		// Reopen file for reading to send to ML service
-		fileContent, err := os.ReadFile(filePath)
+		// Call ML service for estimation
+		_, service, err := ml.Resolve("")
 		if err != nil {
-			utils.RespondWithError(w, http.StatusInternalServerError, "Failed to read saved file: "+err.Error())
+			utils.RespondWithError(w, r, http.StatusInternalServerError, utils.ErrCodeInvalidModel, "Failed to select ML model: "+err.Error())
+			return
+		}
+		result, err := service.Predict(r.Context(), bytes.NewReader(fileContent))
+		if errors.Is(err, utils.ErrCircuitOpen) || errors.Is(err, utils.ErrMLBusy) {
+			utils.RespondWithError(w, r, http.StatusServiceUnavailable, utils.ErrCodeMLUnavailable, err.Error())
 			return
 		}
-
-		// Call ML service for estimation
-		result, err := callMLService(fileContent, cfg.MLServiceURL)
 		if err != nil {
-			utils.RespondWithError(w, http.StatusInternalServerError, "Failed to process image: "+err.Error())
+			utils.RespondWithError(w, r, http.StatusInternalServerError, utils.ErrCodeMLError, "Failed to process image: "+err.Error())
 			return
 		}
 
 		// Create and store estimation result
 		estimation := models.Estimation{
-			ID:        imageID,
-			ImagePath: filePath,
-			Height:    result.Height,
-			Weight:    result.Weight,
-			Accuracy:  result.Confidence, // Note: adjusted field name from the ML service
-			CreatedAt: time.Now(),
+			ID:           imageID,
+			ImagePath:    filePath,
+			Height:       result.Height,
+			Weight:       result.Weight,
+			Accuracy:     result.Confidence, // Note: adjusted field name from the ML service
+			Measurements: result.Measurements,
+			CreatedAt:    time.Now(),
+		}
+
+		// Don't record a result the client is no longer waiting for
+		if r.Context().Err() != nil {
+			return
 		}
 
 		// Save to MongoDB
 		if err := db.SaveEstimation(&estimation); err != nil {
-			utils.RespondWithError(w, http.StatusInternalServerError, "Failed to save estimation: "+err.Error())
+			if db.IsDuplicateKeyError(err) {
+				utils.RespondWithError(w, r, http.StatusConflict, utils.ErrCodeConflict, "Estimation ID already in use, please retry")
+				return
+			}
+			utils.RespondWithError(w, r, http.StatusInternalServerError, utils.ErrCodeDatabaseError, "Failed to save estimation: "+err.Error())
 			return
 		}
+		files.Keep()
 
 		// Return result
 		response := models.EstimationResult{
-			ID:        estimation.ID,
-			Height:    estimation.Height,
-			Weight:    estimation.Weight,
-			Accuracy:  estimation.Accuracy,
-			CreatedAt: estimation.CreatedAt,
+			ID:           estimation.ID,
+			Height:       round(estimation.Height),
+			Weight:       round(estimation.Weight),
+			Accuracy:     estimation.Accuracy,
+			Measurements: estimation.Measurements,
+			ImageURL:     imageURL(estimation.ID, ""),
+			CreatedAt:    estimation.CreatedAt,
 		}
 
-		utils.RespondWithJSON(w, http.StatusOK, response)
+		utils.RespondWithData(w, r, http.StatusOK, response)
 	}
 }
-
-// callMLService calls the Python ML service for height and weight estimation
-func callMLService(imageData []byte, mlServiceURL string) (*models.MLServiceResponse, error) {
-	// Create a new multipart form request
-	body := &bytes.Buffer{}
-	writer := multipart.NewWriter(body)
-
-	// Create a form file field
-	part, err := writer.CreateFormFile("image", "image.jpg")
-	if err != nil {
-		return nil, fmt.Errorf("failed to create form file: %w", err)
-	}
-
-	// Write the image data to the form
-	if _, err := part.Write(imageData); err != nil {
-		return nil, fmt.Errorf("failed to write image to form: %w", err)
-	}
-
-	// Close the multipart writer
-	if err := writer.Close(); err != nil {
-		return nil, fmt.Errorf("failed to close multipart writer: %w", err)
-	}
-
-	// Create and send the HTTP request
-	req, err := http.NewRequest("POST", mlServiceURL+"/predict", body)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create request: %w", err)
-	}
-
-	// Set the content type header
-	req.Header.Set("Content-Type", writer.FormDataContentType())
-
-	// Send the request
-	client := &http.Client{Timeout: 30 * time.Second}
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("failed to call ML service: %w", err)
-	}
-	defer resp.Body.Close()
-
-	// Check response status
-	if resp.StatusCode != http.StatusOK {
-		respBody, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("ML service returned error: %s, body: %s", resp.Status, string(respBody))
-	}
-
-	// Parse the response
-	var result models.MLServiceResponse
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-		return nil, fmt.Errorf("failed to parse ML service response: %w", err)
-	}
-
-	return &result, nil
-}
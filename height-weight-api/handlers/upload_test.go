@@ -0,0 +1,59 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/lucasfepe/height-weight-api/internal/testutil"
+	"github.com/lucasfepe/height-weight-api/models"
+	"github.com/lucasfepe/height-weight-api/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// newUploadRequest builds a legacy upload of a single image
+func newUploadRequest(t *testing.T) *http.Request {
+	t.Helper()
+	return newMultipartRequest(t, "/upload", nil, map[string][]byte{"image": testPNG(t, 64, 96, 40)})
+}
+
+func TestImageUploadMLErrorRemovesFile(t *testing.T) {
+	cfg := testutil.Config(t, nil)
+	handler := NewImageUploadHandler(cfg, fakeMLClients(&fakeMLService{err: errors.New("model crashed")}))
+
+	w, response := serve(t, handler, newUploadRequest(t))
+	if w.Code != http.StatusInternalServerError || response.ErrorCode != utils.ErrCodeMLError {
+		t.Fatalf("got %d %s (%s), want 500 %s", w.Code, response.ErrorCode, response.Message, utils.ErrCodeMLError)
+	}
+	if files := storedFiles(t, cfg.UploadDir); len(files) != 0 {
+		t.Errorf("files left after the ML error: %v", files)
+	}
+}
+
+func TestImageUploadDuplicateKey(t *testing.T) {
+	cfg := testDatabase(t, nil)
+	const weight = 81.5
+
+	// Every attempt collides with the seeded estimation on a unique weight,
+	// whatever ID it is given
+	coll := models.DB.Collection(cfg.MongoCollection)
+	unique := mongo.IndexModel{Keys: bson.D{{Key: "weight", Value: 1}}, Options: options.Index().SetUnique(true)}
+	if _, err := coll.Indexes().CreateOne(context.Background(), unique); err != nil {
+		t.Fatalf("create unique index: %v", err)
+	}
+	if _, err := coll.InsertOne(context.Background(), models.Estimation{ID: "taken", Weight: weight}); err != nil {
+		t.Fatalf("seed estimation: %v", err)
+	}
+
+	handler := NewImageUploadHandler(cfg, fakeMLClients(&fakeMLService{weight: weight}))
+	w, response := serve(t, handler, newUploadRequest(t))
+	if w.Code != http.StatusConflict || response.ErrorCode != utils.ErrCodeConflict {
+		t.Fatalf("got %d %s (%s), want 409 %s", w.Code, response.ErrorCode, response.Message, utils.ErrCodeConflict)
+	}
+	if files := storedFiles(t, cfg.UploadDir); len(files) != 0 {
+		t.Errorf("files left after the conflict: %v", files)
+	}
+}
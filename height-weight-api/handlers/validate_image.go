@@ -0,0 +1,305 @@
+package handlers
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"math"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/lucasfepe/height-weight-api/config"
+	"github.com/lucasfepe/height-weight-api/models"
+	"github.com/lucasfepe/height-weight-api/utils"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// ImageCheck is the outcome of one check of an image being validated
+type ImageCheck struct {
+	Name       string      `json:"name"`
+	Passed     bool        `json:"passed"`
+	Value      interface{} `json:"value,omitempty"` // Measured value, when the check measures one
+	Limit      interface{} `json:"limit,omitempty"` // Configured bound the value is checked against
+	Message    string      `json:"message,omitempty"`
+	Suggestion string      `json:"suggestion,omitempty"`
+}
+
+// NewValidateImageHandler creates a handler that runs the checks of the
+// estimation endpoints on a single uploaded image, without saving it or
+// calling the ML service, so clients can give feedback before submitting.
+// Every check is reported; a failed one skips only the checks depending on it.
+func NewValidateImageHandler(cfg *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseMultipartForm(cfg.MultipartMemory); err != nil {
+			status, errCode := formError(err)
+			sendErrorResponse(w, r, status, errCode, "Failed to parse form: "+err.Error())
+			return
+		}
+		defer removeMultipartFiles(r)
+
+		file, header, err := r.FormFile("image")
+		if err != nil {
+			sendErrorResponse(w, r, http.StatusBadRequest, utils.ErrCodeMissingImage, "Image is required: "+err.Error())
+			return
+		}
+		defer file.Close()
+
+		// Read one byte past the limit to tell an oversized image apart
+		data, err := io.ReadAll(io.LimitReader(file, cfg.MaxFileSize+1))
+		if err != nil {
+			sendErrorResponse(w, r, http.StatusInternalServerError, utils.ErrCodeStorageError, "Failed to read image: "+err.Error())
+			return
+		}
+
+		checks := validateImage(cfg, header.Filename, data, header.Size)
+		failed := failedChecks(checks)
+
+		message := "Image is valid"
+		if failed > 0 {
+			message = fmt.Sprintf("Image failed %d of %d checks", failed, len(checks))
+		}
+
+		// Return success response
+		response := Response{
+			Success: true,
+			Data: map[string]interface{}{
+				"valid":  failed == 0,
+				"checks": checks,
+			},
+			Message: message,
+		}
+
+		// Send response
+		utils.Respond(w, r, http.StatusOK, response)
+	}
+}
+
+// NewRevalidateEstimationHandler creates a handler that runs the current
+// checks on the stored images of a weight estimation, without calling the ML
+// service, to find past estimations that tightened rules would now reject.
+// It responds 409 when the images are no longer stored.
+func NewRevalidateEstimationHandler(cfg *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if models.DB == nil {
+			sendErrorResponse(w, r, http.StatusInternalServerError, utils.ErrCodeDatabaseError, "Database not initialized")
+			return
+		}
+
+		estimation, err := models.GetWeightEstimationByID(mux.Vars(r)["id"], utils.UserID(r.Context()))
+		if err != nil {
+			switch {
+			case errors.Is(err, models.ErrInvalidID):
+				sendErrorResponse(w, r, http.StatusBadRequest, utils.ErrCodeInvalidID, "Invalid estimation ID")
+			case errors.Is(err, mongo.ErrNoDocuments):
+				sendErrorResponse(w, r, http.StatusNotFound, utils.ErrCodeNotFound, "Estimation not found")
+			default:
+				sendErrorResponse(w, r, http.StatusInternalServerError, utils.ErrCodeDatabaseError, "Failed to fetch estimation: "+err.Error())
+			}
+			return
+		}
+
+		frontData, frontSize, err := readStoredImage(cfg, estimation.FrontImgPath)
+		if err != nil {
+			sendStoredImageError(w, r, err)
+			return
+		}
+		front := validateImage(cfg, filepath.Base(estimation.FrontImgPath), frontData, frontSize)
+
+		data := map[string]interface{}{
+			"id":    estimation.ID.Hex(),
+			"front": front,
+		}
+		failed := failedChecks(front)
+		identical := ImageCheck{Name: "distinct_views", Passed: true}
+
+		// Views are labeled for the distinct_views message
+		type storedView struct {
+			label string
+			data  []byte
+		}
+		views := []storedView{{"Front", frontData}}
+
+		// Each side view is reported under its name, e.g. side_left
+		for _, side := range estimation.Sides() {
+			sideData, sideSize, err := readStoredImage(cfg, side.Path)
+			if err != nil {
+				sendStoredImageError(w, r, err)
+				return
+			}
+			checks := validateImage(cfg, filepath.Base(side.Path), sideData, sideSize)
+			data[imageViewName(side.View)] = checks
+			failed += failedChecks(checks)
+			views = append(views, storedView{sideViewLabels[side.View], sideData})
+		}
+
+		// The same photo for two views is rejected by the estimate path too,
+		// which compares every pair of views
+	compare:
+		for i, view := range views {
+			for _, other := range views[i+1:] {
+				same, err := utils.ImagesIdentical(bytes.NewReader(view.data), bytes.NewReader(other.data))
+				if err != nil {
+					sendErrorResponse(w, r, http.StatusInternalServerError, utils.ErrCodeStorageError, "Failed to compare images: "+err.Error())
+					return
+				}
+				if same {
+					identical.Passed = false
+					identical.Message = fmt.Sprintf("%s and %s images are identical", view.label, strings.ToLower(other.label))
+					identical.Suggestion = "Take a separate photo for each view"
+					failed++
+					break compare
+				}
+			}
+		}
+
+		message := "Estimation images are valid"
+		if failed > 0 {
+			message = fmt.Sprintf("Estimation images failed %d checks", failed)
+		}
+
+		data["valid"] = failed == 0
+		data["checks"] = []ImageCheck{identical}
+
+		// Return success response
+		response := Response{
+			Success: true,
+			Data:    data,
+			Message: message,
+		}
+
+		// Send response
+		utils.Respond(w, r, http.StatusOK, response)
+	}
+}
+
+// readStoredImage reads a stored image for validation along with its size on
+// disk, stopping one byte past the maximum file size
+func readStoredImage(cfg *config.Config, path string) ([]byte, int64, error) {
+	file, err := utils.OpenStoredImage(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, 0, err
+	}
+	data, err := io.ReadAll(io.LimitReader(file, cfg.MaxFileSize+1))
+	if err != nil {
+		return nil, 0, err
+	}
+	return data, info.Size(), nil
+}
+
+// failedChecks counts the checks that didn't pass
+func failedChecks(checks []ImageCheck) int {
+	failed := 0
+	for _, check := range checks {
+		if !check.Passed {
+			failed++
+		}
+	}
+	return failed
+}
+
+// validateImage runs the estimation checks on an image named name of size
+// bytes, whose content is data, cut off past the maximum file size
+func validateImage(cfg *config.Config, name string, data []byte, size int64) []ImageCheck {
+	var checks []ImageCheck
+
+	if name != "" {
+		check := ImageCheck{Name: "extension", Passed: allowedExt(cfg, strings.ToLower(filepath.Ext(name))), Value: filepath.Ext(name)}
+		if !check.Passed {
+			check.Message = "Image has an unsupported file extension"
+			check.Suggestion = "Use one of " + strings.Join(cfg.AllowedExts, ", ")
+		}
+		checks = append(checks, check)
+	}
+
+	sizeCheck := ImageCheck{Name: "size", Passed: size <= cfg.MaxFileSize, Value: size, Limit: cfg.MaxFileSize}
+	if !sizeCheck.Passed {
+		sizeCheck.Message = fmt.Sprintf("Image too large. Max size: %d bytes", cfg.MaxFileSize)
+		sizeCheck.Suggestion = "Lower the photo resolution or quality"
+	}
+	checks = append(checks, sizeCheck)
+
+	mimeType, _, ok := allowedImageType(cfg, data[:min(len(data), 512)])
+	formatCheck := ImageCheck{Name: "format", Passed: ok, Value: mimeType}
+	if !ok {
+		formatCheck.Message = "Image has an unsupported type: " + mimeType
+		formatCheck.Suggestion = "Use one of " + strings.Join(cfg.AllowedMIMETypes, ", ")
+	}
+	checks = append(checks, formatCheck)
+	if !ok || !sizeCheck.Passed {
+		return checks
+	}
+
+	stillCheck := ImageCheck{Name: "still", Passed: true}
+	if err := utils.CheckStillImage(data); errors.Is(err, utils.ErrMultiFrameImage) {
+		stillCheck.Passed = false
+		stillCheck.Message = "Image is animated"
+		stillCheck.Suggestion = "Upload a single photo rather than an animation"
+	} else if errors.Is(err, utils.ErrUnsupportedColorModel) {
+		stillCheck.Passed = false
+		stillCheck.Message = "Image has an unsupported color model"
+		stillCheck.Suggestion = "Save the photo as RGB or grayscale"
+	}
+	if !stillCheck.Passed {
+		return append(checks, stillCheck)
+	}
+	checks = append(checks, stillCheck)
+
+	// Decode the image the way the estimation endpoints see it, turned upright
+	var img image.Image
+	oriented, err := utils.AutoOrient(bytes.NewReader(data))
+	if err == nil {
+		img, _, err = image.Decode(bytes.NewReader(oriented))
+	}
+	decodeCheck := ImageCheck{Name: "decode", Passed: err == nil}
+	if err != nil {
+		decodeCheck.Message = "Invalid image: " + err.Error()
+		decodeCheck.Suggestion = "Upload the original photo; the file may be damaged"
+		return append(checks, decodeCheck)
+	}
+	bounds := img.Bounds()
+	decodeCheck.Value = map[string]int{"width": bounds.Dx(), "height": bounds.Dy()}
+	checks = append(checks, decodeCheck)
+
+	dimensionsCheck := ImageCheck{Name: "dimensions", Passed: true, Value: decodeCheck.Value}
+	if cfg.MinImageDimension > 0 || cfg.MaxImageDimension > 0 {
+		dimensionsCheck.Limit = map[string]int{"min": cfg.MinImageDimension, "max": cfg.MaxImageDimension}
+	}
+	if message := imageDimensionsProblem(cfg, bounds.Dx(), bounds.Dy()); message != "" {
+		dimensionsCheck.Passed = false
+		dimensionsCheck.Message = "Image" + strings.TrimPrefix(message, "image")
+		dimensionsCheck.Suggestion = "Upload the photo at a different resolution"
+	}
+	checks = append(checks, dimensionsCheck)
+
+	sharpness, brightness := utils.ImageQuality(img)
+
+	brightnessCheck := ImageCheck{Name: "brightness", Passed: brightness >= cfg.MinImageBrightness, Value: math.Round(brightness*10) / 10}
+	if cfg.MinImageBrightness > 0 {
+		brightnessCheck.Limit = cfg.MinImageBrightness
+	}
+	if !brightnessCheck.Passed {
+		brightnessCheck.Message = "Image is too dark"
+		brightnessCheck.Suggestion = "Retake the photo in better light"
+	}
+	checks = append(checks, brightnessCheck)
+
+	sharpnessCheck := ImageCheck{Name: "sharpness", Passed: sharpness >= cfg.MinImageSharpness, Value: math.Round(sharpness*10) / 10}
+	if cfg.MinImageSharpness > 0 {
+		sharpnessCheck.Limit = cfg.MinImageSharpness
+	}
+	if !sharpnessCheck.Passed {
+		sharpnessCheck.Message = "Image is too blurry"
+		sharpnessCheck.Suggestion = "Hold the camera steady and make sure the person is in focus"
+	}
+	return append(checks, sharpnessCheck)
+}
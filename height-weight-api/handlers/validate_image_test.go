@@ -0,0 +1,204 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/lucasfepe/height-weight-api/internal/testutil"
+	"github.com/lucasfepe/height-weight-api/models"
+	"github.com/lucasfepe/height-weight-api/utils"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// newValidateRequest builds an image validation upload of data named filename
+func newValidateRequest(t *testing.T, filename string, data []byte) *http.Request {
+	t.Helper()
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	part, err := writer.CreateFormFile("image", filename)
+	if err != nil {
+		t.Fatalf("create form file: %v", err)
+	}
+	part.Write(data)
+	writer.Close()
+
+	r := httptest.NewRequest(http.MethodPost, "/validate-image", &body)
+	r.Header.Set("Content-Type", writer.FormDataContentType())
+	return r
+}
+
+// checkOutcomes returns whether each check passed, by name, in order
+func checkOutcomes(checks []ImageCheck) ([]string, map[string]bool) {
+	names := []string{}
+	passed := map[string]bool{}
+	for _, check := range checks {
+		names = append(names, check.Name)
+		passed[check.Name] = check.Passed
+	}
+	return names, passed
+}
+
+func TestValidateImage(t *testing.T) {
+	png := noisyPNG(t, 64, 96, 1)
+	allChecks := []string{"extension", "size", "format", "still", "decode", "dimensions", "brightness", "sharpness"}
+
+	tests := []struct {
+		name       string
+		env        map[string]string
+		filename   string
+		data       []byte
+		wantChecks []string // Checks run, in order
+		wantFailed string   // The one failing check, empty when valid
+	}{
+		{"valid", nil, "photo.png", png, allChecks, ""},
+		{"extension", nil, "photo.bmp", png, allChecks, "extension"},
+		{"format", nil, "photo.png", []byte("plain text, not an image"), allChecks[:3], "format"},
+		{"truncated", nil, "photo.png", png[:len(png)/2], allChecks[:5], "decode"},
+		{"too small", map[string]string{"MIN_IMAGE_DIMENSION": "100"}, "photo.png", png, allChecks, "dimensions"},
+		{"too dark", map[string]string{"MIN_IMAGE_BRIGHTNESS": "200"}, "photo.png", png, allChecks, "brightness"},
+		{"blurry", map[string]string{"MIN_IMAGE_SHARPNESS": "50"}, "photo.png", smoothPNG(t, 64, 96), allChecks, "sharpness"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := NewValidateImageHandler(testutil.Config(t, tt.env))
+			w, response := serve(t, handler, newValidateRequest(t, tt.filename, tt.data))
+			if w.Code != http.StatusOK {
+				t.Fatalf("got %d %s (%s), want 200", w.Code, response.ErrorCode, response.Message)
+			}
+
+			var data struct {
+				Valid  bool         `json:"valid"`
+				Checks []ImageCheck `json:"checks"`
+			}
+			if err := json.Unmarshal(response.Data, &data); err != nil {
+				t.Fatalf("decode data %s: %v", response.Data, err)
+			}
+			if data.Valid != (tt.wantFailed == "") {
+				t.Errorf("valid = %v, want %v", data.Valid, tt.wantFailed == "")
+			}
+
+			names, _ := checkOutcomes(data.Checks)
+			if !slices.Equal(names, tt.wantChecks) {
+				t.Errorf("checks = %v, want %v", names, tt.wantChecks)
+			}
+			for _, check := range data.Checks {
+				if wantPassed := check.Name != tt.wantFailed; check.Passed != wantPassed {
+					t.Errorf("%s passed = %v, want %v (%s)", check.Name, check.Passed, wantPassed, check.Message)
+				}
+				if !check.Passed && (check.Message == "" || check.Suggestion == "") {
+					t.Errorf("failed %s check without a message and suggestion: %+v", check.Name, check)
+				}
+			}
+		})
+	}
+
+	t.Run("too large", func(t *testing.T) {
+		cfg := testutil.Config(t, nil)
+		names, passed := checkOutcomes(validateImage(cfg, "photo.png", png, cfg.MaxFileSize+1))
+		if !slices.Equal(names, allChecks[:3]) || passed["size"] {
+			t.Errorf("checks = %v with size passed %v, want %v with size failed", names, passed["size"], allChecks[:3])
+		}
+	})
+
+	t.Run("missing", func(t *testing.T) {
+		handler := NewValidateImageHandler(testutil.Config(t, nil))
+		w, response := serve(t, handler, newMultipartRequest(t, "/validate-image", map[string]string{"height": "175"}, nil))
+		if w.Code != http.StatusBadRequest || response.ErrorCode != utils.ErrCodeMissingImage {
+			t.Errorf("got %d %s (%s), want 400 %s", w.Code, response.ErrorCode, response.Message, utils.ErrCodeMissingImage)
+		}
+	})
+}
+
+// seedEstimationImages saves a weight estimation whose front and side images
+// are stored in dir with the given contents
+func seedEstimationImages(t *testing.T, dir string, front, side []byte) *models.WeightEstimation {
+	t.Helper()
+	id := primitive.NewObjectID().Hex()
+	frontPath := filepath.Join(dir, id+"_front.png")
+	sidePath := filepath.Join(dir, id+"_side.png")
+	for path, data := range map[string][]byte{frontPath: front, sidePath: side} {
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatalf("write image: %v", err)
+		}
+	}
+	return seedWeightEstimation(t, &models.WeightEstimation{
+		FrontImgPath: frontPath,
+		SideImgPath:  sidePath,
+		SideImages:   []models.SideImage{{View: utils.SideViewSingle, Path: sidePath}},
+		CreatedAt:    time.Now(),
+	})
+}
+
+func TestRevalidateEstimation(t *testing.T) {
+	cfg := testDatabase(t, map[string]string{"MIN_IMAGE_SHARPNESS": "50"})
+	handler := NewRevalidateEstimationHandler(cfg)
+	sharp := noisyPNG(t, 64, 96, 1)
+
+	tests := []struct {
+		name        string
+		front, side []byte
+		wantValid   bool
+		wantFailed  map[string]string // Failed check by part of the response
+	}{
+		{"passing", sharp, noisyPNG(t, 64, 96, 2), true, nil},
+		{"blurry side", sharp, smoothPNG(t, 64, 96), false, map[string]string{"side": "sharpness"}},
+		{"same photo twice", sharp, sharp, false, map[string]string{"checks": "distinct_views"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			estimation := seedEstimationImages(t, cfg.UploadDir, tt.front, tt.side)
+			r := withID(httptest.NewRequest(http.MethodPost, "/estimate-weight/x/revalidate", nil), estimation.ID.Hex())
+			w, response := serve(t, handler, r)
+			if w.Code != http.StatusOK {
+				t.Fatalf("got %d %s (%s), want 200", w.Code, response.ErrorCode, response.Message)
+			}
+
+			var data struct {
+				Valid  bool         `json:"valid"`
+				Front  []ImageCheck `json:"front"`
+				Side   []ImageCheck `json:"side"`
+				Checks []ImageCheck `json:"checks"`
+			}
+			if err := json.Unmarshal(response.Data, &data); err != nil {
+				t.Fatalf("decode data %s: %v", response.Data, err)
+			}
+			if data.Valid != tt.wantValid {
+				t.Errorf("valid = %v, want %v", data.Valid, tt.wantValid)
+			}
+			if len(data.Front) == 0 || len(data.Side) == 0 || len(data.Checks) != 1 {
+				t.Fatalf("data = %s, want front, side and distinct_views checks", response.Data)
+			}
+			for part, checks := range map[string][]ImageCheck{"front": data.Front, "side": data.Side, "checks": data.Checks} {
+				for _, check := range checks {
+					if wantPassed := check.Name != tt.wantFailed[part]; check.Passed != wantPassed {
+						t.Errorf("%s %s passed = %v, want %v (%s)", part, check.Name, check.Passed, wantPassed, check.Message)
+					}
+				}
+			}
+		})
+	}
+
+	t.Run("images gone", func(t *testing.T) {
+		estimation := seedEstimationImages(t, cfg.UploadDir, sharp, noisyPNG(t, 64, 96, 3))
+		os.Remove(estimation.SideImgPath)
+		r := withID(httptest.NewRequest(http.MethodPost, "/estimate-weight/x/revalidate", nil), estimation.ID.Hex())
+		if w, response := serve(t, handler, r); w.Code != http.StatusConflict || response.ErrorCode != utils.ErrCodeImageMissing {
+			t.Errorf("got %d %s (%s), want 409 %s", w.Code, response.ErrorCode, response.Message, utils.ErrCodeImageMissing)
+		}
+	})
+
+	for id, wantCode := range map[string]int{"not-an-id": http.StatusBadRequest, primitive.NewObjectID().Hex(): http.StatusNotFound} {
+		r := withID(httptest.NewRequest(http.MethodPost, "/estimate-weight/x/revalidate", nil), id)
+		if w, response := serve(t, handler, r); w.Code != wantCode {
+			t.Errorf("revalidate %s: got %d %s (%s), want %d", id, w.Code, response.ErrorCode, response.Message, wantCode)
+		}
+	}
+}
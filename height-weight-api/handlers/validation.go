@@ -0,0 +1,126 @@
+package handlers
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/lucasfepe/height-weight-api/config"
+	"github.com/lucasfepe/height-weight-api/utils"
+)
+
+// FieldError is a validation problem with one request field
+type FieldError struct {
+	Field     string `json:"field"`
+	Message   string `json:"message"`
+	ErrorCode string `json:"error_code"`
+}
+
+// validateEstimateRequest checks the fields of a parsed weight estimation
+// form, which needs a front image and an image of at least one of sideViews,
+// and returns every problem found, so clients can fix them all at once
+func validateEstimateRequest(r *http.Request, cfg *config.Config, sideViews []string) []FieldError {
+	var errs []FieldError
+
+	if heightStr := r.FormValue("height"); heightStr == "" {
+		errs = append(errs, FieldError{Field: "height", Message: "Height is required", ErrorCode: utils.ErrCodeInvalidHeight})
+	} else if height, err := strconv.ParseFloat(heightStr, 64); err != nil {
+		errs = append(errs, FieldError{Field: "height", Message: "Invalid height value: " + err.Error(), ErrorCode: utils.ErrCodeInvalidHeight})
+	} else {
+		errs = validateHeight(cfg, height, errs)
+	}
+
+	// Images come as file parts or as keys of direct uploads
+	if !hasFormImage(r, "front_image") {
+		errs = append(errs, FieldError{Field: "front_image", Message: "Front image is required", ErrorCode: utils.ErrCodeMissingImage})
+	}
+	if !slices.ContainsFunc(sideViews, func(view string) bool { return hasFormImage(r, view) }) {
+		message := "Side image is required"
+		if len(sideViews) > 1 {
+			message = "At least one of " + strings.Join(sideViews, ", ") + " is required"
+		}
+		errs = append(errs, FieldError{Field: sideViews[0], Message: message, ErrorCode: utils.ErrCodeMissingImage})
+	}
+
+	if callbackURL := r.FormValue("callback_url"); callbackURL != "" {
+		if err := utils.ValidateCallbackURL(callbackURL); err != nil {
+			errs = append(errs, FieldError{Field: "callback_url", Message: "Invalid callback URL: " + err.Error(), ErrorCode: utils.ErrCodeInvalidCallbackURL})
+		}
+	}
+
+	return errs
+}
+
+// validateLabeledEstimateRequest checks a labeled weight estimation form,
+// which is an estimation form with a single side image plus the measured
+// actual_weight
+func validateLabeledEstimateRequest(r *http.Request, cfg *config.Config) []FieldError {
+	errs := validateEstimateRequest(r, cfg, []string{utils.SideViewSingle})
+
+	if weightStr := r.FormValue("actual_weight"); weightStr == "" {
+		errs = append(errs, FieldError{Field: "actual_weight", Message: "Actual weight is required", ErrorCode: utils.ErrCodeInvalidWeight})
+	} else if weight, err := strconv.ParseFloat(weightStr, 64); err != nil {
+		errs = append(errs, FieldError{Field: "actual_weight", Message: "Invalid weight value: " + err.Error(), ErrorCode: utils.ErrCodeInvalidWeight})
+	} else if weight <= 0 {
+		errs = append(errs, FieldError{Field: "actual_weight", Message: "Actual weight must be positive", ErrorCode: utils.ErrCodeInvalidWeight})
+	}
+
+	return errs
+}
+
+// validateHeight appends a FieldError to errs when a reported height in cm
+// isn't a finite number within the configured range. ParseFloat accepts "NaN"
+// and "Inf", so form values need this as much as JSON ones.
+func validateHeight(cfg *config.Config, height float64, errs []FieldError) []FieldError {
+	switch {
+	case math.IsNaN(height) || math.IsInf(height, 0):
+		return append(errs, FieldError{Field: "height", Message: "Height must be a finite number", ErrorCode: utils.ErrCodeInvalidHeight})
+	case height < cfg.MinHeightCM || height > cfg.MaxHeightCM:
+		return append(errs, FieldError{Field: "height", Message: fmt.Sprintf("Height must be between %g and %g cm", cfg.MinHeightCM, cfg.MaxHeightCM), ErrorCode: utils.ErrCodeInvalidHeight})
+	}
+	return errs
+}
+
+// hasFormImage reports whether a parsed multipart form sends an image for
+// field, as a file part or as the key of a direct or chunked upload
+func hasFormImage(r *http.Request, field string) bool {
+	return len(r.MultipartForm.File[field]) > 0 || r.FormValue(field+"_key") != ""
+}
+
+// parseRangeParams reads an optional pair of positive query parameters
+// bounding a range, appending a FieldError with errCode to errs for each bad
+// value and for a minimum above the maximum. Missing bounds are 0.
+func parseRangeParams(r *http.Request, minParam, maxParam, errCode string, errs []FieldError) (float64, float64, []FieldError) {
+	var bounds [2]float64
+	for i, param := range []string{minParam, maxParam} {
+		value := r.URL.Query().Get(param)
+		if value == "" {
+			continue
+		}
+		bound, err := strconv.ParseFloat(value, 64)
+		if err != nil || bound <= 0 {
+			errs = append(errs, FieldError{Field: param, Message: fmt.Sprintf("%s must be a positive number", param), ErrorCode: errCode})
+			continue
+		}
+		bounds[i] = bound
+	}
+
+	if bounds[0] > 0 && bounds[1] > 0 && bounds[0] > bounds[1] {
+		errs = append(errs, FieldError{Field: minParam, Message: fmt.Sprintf("%s must not exceed %s", minParam, maxParam), ErrorCode: errCode})
+	}
+	return bounds[0], bounds[1], errs
+}
+
+// sendValidationErrors sends a 400 listing errs under details.errors. A
+// single error keeps its own message and code.
+func sendValidationErrors(w http.ResponseWriter, r *http.Request, errs []FieldError) {
+	message, errCode := errs[0].Message, errs[0].ErrorCode
+	if len(errs) > 1 {
+		message = fmt.Sprintf("%d fields are invalid", len(errs))
+		errCode = utils.ErrCodeInvalidRequest
+	}
+	sendErrorResponseWithDetails(w, r, http.StatusBadRequest, errCode, message, map[string]interface{}{"errors": errs})
+}
@@ -0,0 +1,233 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"maps"
+	"math"
+	"net/http"
+	"testing"
+
+	"github.com/lucasfepe/height-weight-api/internal/testutil"
+	"github.com/lucasfepe/height-weight-api/utils"
+)
+
+func TestValidateHeight(t *testing.T) {
+	cfg := testutil.Config(t, map[string]string{"MIN_HEIGHT_CM": "100", "MAX_HEIGHT_CM": "220"})
+
+	tests := []struct {
+		name   string
+		height float64
+		valid  bool
+	}{
+		{"in range", 175, true},
+		{"minimum", 100, true},
+		{"maximum", 220, true},
+		{"below minimum", 99.9, false},
+		{"above maximum", 220.1, false},
+		{"zero", 0, false},
+		{"negative", -170, false},
+		{"NaN", math.NaN(), false},
+		{"positive infinity", math.Inf(1), false},
+		{"negative infinity", math.Inf(-1), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			errs := validateHeight(cfg, tt.height, nil)
+			if valid := len(errs) == 0; valid != tt.valid {
+				t.Fatalf("validateHeight(%v) = %v, want valid %v", tt.height, errs, tt.valid)
+			}
+			if !tt.valid && errs[0].ErrorCode != utils.ErrCodeInvalidHeight {
+				t.Errorf("error code = %s, want %s", errs[0].ErrorCode, utils.ErrCodeInvalidHeight)
+			}
+		})
+	}
+}
+
+func TestImageDimensionsProblem(t *testing.T) {
+	cfg := testutil.Config(t, map[string]string{"MIN_IMAGE_DIMENSION": "100", "MAX_IMAGE_DIMENSION": "1000"})
+
+	tests := []struct {
+		name          string
+		width, height int
+		valid         bool
+	}{
+		{"in range", 400, 600, true},
+		{"at the bounds", 100, 1000, true},
+		{"narrow", 99, 600, false},
+		{"short", 600, 99, false},
+		{"wide", 1001, 600, false},
+		{"tall", 600, 1001, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			problem := imageDimensionsProblem(cfg, tt.width, tt.height)
+			if valid := problem == ""; valid != tt.valid {
+				t.Errorf("imageDimensionsProblem(%d, %d) = %q, want valid %v", tt.width, tt.height, problem, tt.valid)
+			}
+		})
+	}
+
+	unbounded := testutil.Config(t, map[string]string{"MIN_IMAGE_DIMENSION": "0", "MAX_IMAGE_DIMENSION": "0"})
+	if problem := imageDimensionsProblem(unbounded, 1, 100000); problem != "" {
+		t.Errorf("without bounds got %q, want no problem", problem)
+	}
+}
+
+func TestEstimateWeightFormValidation(t *testing.T) {
+	cfg := testutil.Config(t, map[string]string{"MIN_IMAGE_DIMENSION": "32", "MAX_IMAGE_DIMENSION": "256"})
+	front, side := testPNG(t, 64, 96, 40), testPNG(t, 64, 96, 80)
+
+	tests := []struct {
+		name      string
+		height    string
+		front     []byte
+		side      []byte
+		wantCode  string
+		wantField string
+	}{
+		{"NaN height", "NaN", front, side, utils.ErrCodeInvalidHeight, "height"},
+		{"infinite height", "Inf", front, side, utils.ErrCodeInvalidHeight, "height"},
+		{"height below range", "12", front, side, utils.ErrCodeInvalidHeight, "height"},
+		{"height above range", "400", front, side, utils.ErrCodeInvalidHeight, "height"},
+		{"unparsable height", "tall", front, side, utils.ErrCodeInvalidHeight, "height"},
+		{"front image too small", "175", testPNG(t, 16, 96, 40), side, utils.ErrCodeInvalidImage, ""},
+		{"side image too large", "175", front, testPNG(t, 64, 300, 80), utils.ErrCodeInvalidImage, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ml := &fakeMLService{weight: 70}
+			handler := NewEstimateWeightHandler(cfg, nil, fakeMLClients(ml), utils.NewIdempotencyStore(0), nil, nil)
+
+			r := newMultipartRequest(t, "/estimate-weight", map[string]string{"height": tt.height, "validate_only": "true"},
+				map[string][]byte{"front_image": tt.front, "side_image": tt.side})
+			w, response := serve(t, handler, r)
+
+			if w.Code != http.StatusBadRequest || response.ErrorCode != tt.wantCode {
+				t.Fatalf("got %d %s (%s), want 400 %s", w.Code, response.ErrorCode, response.Message, tt.wantCode)
+			}
+			if tt.wantField != "" {
+				var details struct {
+					Errors []FieldError `json:"errors"`
+				}
+				if err := json.Unmarshal(response.Details, &details); err != nil || len(details.Errors) == 0 || details.Errors[0].Field != tt.wantField {
+					t.Errorf("details = %s, want an error for %s", response.Details, tt.wantField)
+				}
+			}
+			if calls := ml.calls.Load(); calls != 0 {
+				t.Errorf("ML service called %d times, want 0", calls)
+			}
+		})
+	}
+}
+
+func TestEstimateWeightJSONValidation(t *testing.T) {
+	cfg := testutil.Config(t, map[string]string{"MAX_IMAGE_DIMENSION": "256"})
+	front := base64.StdEncoding.EncodeToString(testPNG(t, 64, 96, 40))
+	side := base64.StdEncoding.EncodeToString(testPNG(t, 64, 96, 80))
+	large := base64.StdEncoding.EncodeToString(testPNG(t, 300, 96, 80))
+
+	tests := []struct {
+		name     string
+		body     map[string]interface{}
+		wantCode string
+	}{
+		{"missing height", map[string]interface{}{"front_image": front, "side_image": side}, utils.ErrCodeInvalidHeight},
+		{"height below range", map[string]interface{}{"height": 20, "front_image": front, "side_image": side}, utils.ErrCodeInvalidHeight},
+		{"imperial height above range", map[string]interface{}{"height": 120, "unit": "imperial", "front_image": front, "side_image": side}, utils.ErrCodeInvalidHeight},
+		{"image too large", map[string]interface{}{"height": 175, "front_image": large, "side_image": side}, utils.ErrCodeInvalidImage},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ml := &fakeMLService{weight: 70}
+			handler := NewEstimateWeightHandler(cfg, nil, fakeMLClients(ml), utils.NewIdempotencyStore(0), nil, nil)
+
+			tt.body["validate_only"] = true
+			w, response := serve(t, handler, newJSONRequest(t, "/estimate-weight", tt.body))
+			if w.Code != http.StatusBadRequest || response.ErrorCode != tt.wantCode {
+				t.Fatalf("got %d %s (%s), want 400 %s", w.Code, response.ErrorCode, response.Message, tt.wantCode)
+			}
+			if calls := ml.calls.Load(); calls != 0 {
+				t.Errorf("ML service called %d times, want 0", calls)
+			}
+		})
+	}
+}
+
+func TestEstimateWeightValidateOnly(t *testing.T) {
+	cfg := testutil.Config(t, nil)
+	ml := &fakeMLService{weight: 70}
+	handler := NewEstimateWeightHandler(cfg, nil, fakeMLClients(ml), utils.NewIdempotencyStore(0), nil, nil)
+
+	r := newMultipartRequest(t, "/estimate-weight", map[string]string{"height": "175", "validate_only": "true"},
+		map[string][]byte{"front_image": testPNG(t, 64, 96, 40), "side_image": testPNG(t, 64, 96, 80)})
+	w, response := serve(t, handler, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d %s (%s), want 200", w.Code, response.ErrorCode, response.Message)
+	}
+	var data struct {
+		Valid bool `json:"valid"`
+	}
+	if err := json.Unmarshal(response.Data, &data); err != nil || !data.Valid {
+		t.Errorf("data = %s, want valid", response.Data)
+	}
+	if calls := ml.calls.Load(); calls != 0 {
+		t.Errorf("ML service called %d times, want 0", calls)
+	}
+}
+
+func TestIdenticalImagesRejected(t *testing.T) {
+	cfg := testutil.Config(t, nil)
+	image := testPNG(t, 64, 96, 40)
+	handlers := []struct {
+		name    string
+		handler http.Handler
+		fields  map[string]string
+	}{
+		{"estimate weight", NewEstimateWeightHandler(cfg, nil, fakeMLClients(&fakeMLService{weight: 70}), utils.NewIdempotencyStore(0), nil, nil), map[string]string{"height": "175"}},
+		{"training data", NewSaveTrainingDataHandler(cfg, fakeMLClients(&fakeMLService{})), map[string]string{"height": "175", "actual_weight": "70"}},
+	}
+	for _, h := range handlers {
+		t.Run(h.name, func(t *testing.T) {
+			r := newMultipartRequest(t, "/", h.fields, map[string][]byte{"front_image": image, "side_image": image})
+			w, response := serve(t, h.handler, r)
+			if w.Code != http.StatusBadRequest || response.ErrorCode != utils.ErrCodeIdenticalImages {
+				t.Errorf("identical images got %d %s (%s), want 400 %s", w.Code, response.ErrorCode, response.Message, utils.ErrCodeIdenticalImages)
+			}
+		})
+	}
+}
+
+func TestEstimateWeightEmptyForm(t *testing.T) {
+	cfg := testutil.Config(t, nil)
+	ml := &fakeMLService{weight: 70}
+	handler := NewEstimateWeightHandler(cfg, nil, fakeMLClients(ml), utils.NewIdempotencyStore(0), nil, nil)
+
+	w, response := serve(t, handler, newMultipartRequest(t, "/estimate-weight", nil, nil))
+	if w.Code != http.StatusBadRequest || response.ErrorCode != utils.ErrCodeInvalidRequest {
+		t.Fatalf("got %d %s (%s), want 400 %s", w.Code, response.ErrorCode, response.Message, utils.ErrCodeInvalidRequest)
+	}
+
+	var details struct {
+		Errors []FieldError `json:"errors"`
+	}
+	if err := json.Unmarshal(response.Details, &details); err != nil {
+		t.Fatalf("decode details %s: %v", response.Details, err)
+	}
+	want := map[string]string{
+		"height":             utils.ErrCodeInvalidHeight,
+		"front_image":        utils.ErrCodeMissingImage,
+		utils.SideViewSingle: utils.ErrCodeMissingImage,
+	}
+	got := map[string]string{}
+	for _, fieldErr := range details.Errors {
+		got[fieldErr.Field] = fieldErr.ErrorCode
+	}
+	if !maps.Equal(got, want) {
+		t.Errorf("field errors = %v, want %v", got, want)
+	}
+	if calls := ml.calls.Load(); calls != 0 {
+		t.Errorf("ML service called %d times, want 0", calls)
+	}
+}
@@ -0,0 +1,69 @@
+// Package testutil holds the test fixtures shared by the packages of the API
+package testutil
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/lucasfepe/height-weight-api/config"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+// UnreachableMongoURI lets the configuration load without a database, and
+// makes every operation on a client connected to it fail
+const UnreachableMongoURI = "mongodb://127.0.0.1:1"
+
+// Config loads the configuration with uploads in a temporary directory and
+// an unreachable database, after applying env on top of the defaults
+func Config(t testing.TB, env map[string]string) *config.Config {
+	t.Helper()
+	t.Setenv("MONGO_URI", UnreachableMongoURI)
+	t.Setenv("UPLOAD_DIR", t.TempDir())
+	for key, value := range env {
+		t.Setenv(key, value)
+	}
+
+	cfg, err := config.LoadConfig()
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	return cfg
+}
+
+// MongoURI returns the MongoDB at MONGO_TEST_URI, skipping tests needing a
+// database without one
+func MongoURI(t testing.TB) string {
+	t.Helper()
+	uri := os.Getenv("MONGO_TEST_URI")
+	if uri == "" {
+		t.Skip("MONGO_TEST_URI not set")
+	}
+	return uri
+}
+
+// DatabaseName returns the name of a database of a test's own, so tests
+// don't see each other's records
+func DatabaseName() string {
+	return fmt.Sprintf("height_weight_test_%d", time.Now().UnixNano())
+}
+
+// DatabaseConfig is Config pointed at a database of the test's own on the
+// MongoDB at MONGO_TEST_URI. Connecting and dropping it is left to the caller.
+func DatabaseConfig(t testing.TB, env map[string]string) *config.Config {
+	t.Helper()
+	dbEnv := map[string]string{"MONGO_URI": MongoURI(t), "MONGO_DB": DatabaseName()}
+	for key, value := range env {
+		dbEnv[key] = value
+	}
+	return Config(t, dbEnv)
+}
+
+// MockDatabase runs fn with a client of a mocked deployment, whose replies
+// are queued with mt.AddMockResponses and whose commands are read back with
+// mt.GetStartedEvent. It covers query logic without a MongoDB.
+func MockDatabase(t *testing.T, fn func(mt *mtest.T)) {
+	t.Helper()
+	mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock)).Run("mock", fn)
+}
@@ -0,0 +1,128 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+)
+
+// ErrQueueFull is returned when no more jobs can be accepted
+var ErrQueueFull = errors.New("job queue is full")
+
+// ErrQueueClosed is returned for jobs submitted once shutdown has begun
+var ErrQueueClosed = errors.New("job queue is shutting down")
+
+// TaskFunc is the work performed by a job, given the job's ID. ctx is
+// cancelled when a shutdown stops waiting for the job; tasks still queued
+// then are called with it only to release their resources, and must return
+// promptly. Their results are dropped.
+type TaskFunc func(ctx context.Context, jobID string) (interface{}, error)
+
+// task is a queued job waiting for a worker
+type task struct {
+	jobID string
+	fn    TaskFunc
+}
+
+// Queue runs submitted jobs on a fixed pool of workers
+type Queue struct {
+	store   *JobStore
+	tasks   chan task
+	ctx     context.Context // Passed to every task, cancelled when shutdown gives up waiting
+	cancel  context.CancelFunc
+	mu      sync.RWMutex // Guards closed against concurrent submits
+	closed  bool
+	workers sync.WaitGroup
+}
+
+// NewQueue starts workers goroutines consuming a queue holding up to size jobs
+func NewQueue(store *JobStore, workers, size int) *Queue {
+	ctx, cancel := context.WithCancel(context.Background())
+	q := &Queue{
+		store:  store,
+		tasks:  make(chan task, size),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	q.workers.Add(workers)
+	for i := 0; i < workers; i++ {
+		go q.work()
+	}
+	return q
+}
+
+// Store returns the job store backing the queue
+func (q *Queue) Store() *JobStore {
+	return q.store
+}
+
+// Pending returns the number of jobs waiting for a worker
+func (q *Queue) Pending() int {
+	return len(q.tasks)
+}
+
+// Submit creates a pending job of owner and queues fn to run it
+func (q *Queue) Submit(owner string, fn TaskFunc) (Job, error) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	if q.closed {
+		return Job{}, ErrQueueClosed
+	}
+
+	job := q.store.Create(owner)
+	select {
+	case q.tasks <- task{jobID: job.ID, fn: fn}:
+		return job, nil
+	default:
+		q.store.Fail(job.ID, ErrQueueFull)
+		return Job{}, ErrQueueFull
+	}
+}
+
+// Shutdown stops accepting jobs and waits for the queued and running ones
+// to finish. If ctx ends first, the unfinished jobs are marked interrupted,
+// the context of their tasks is cancelled and ctx's error is returned.
+func (q *Queue) Shutdown(ctx context.Context) error {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.tasks)
+	}
+	q.mu.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		q.workers.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		if n := q.store.InterruptPending(); n > 0 {
+			log.Printf("Interrupted %d unfinished jobs", n)
+		}
+		q.cancel()
+		return ctx.Err()
+	}
+}
+
+// work runs queued tasks until the queue is closed
+func (q *Queue) work() {
+	defer q.workers.Done()
+	for t := range q.tasks {
+		result, err := t.fn(q.ctx, t.jobID)
+		if q.ctx.Err() != nil {
+			// Shutdown gave up on the job and marked it interrupted
+			continue
+		}
+		if err != nil {
+			log.Printf("Job %s failed: %v", t.jobID, err)
+			q.store.Fail(t.jobID, err)
+			continue
+		}
+		q.store.Complete(t.jobID, result)
+	}
+}
@@ -0,0 +1,193 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// waitForJob polls store until the job leaves the pending state
+func waitForJob(t *testing.T, store *JobStore, id string) Job {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		job, ok := store.Get(id, "")
+		if !ok {
+			t.Fatalf("job %s not found", id)
+		}
+		if job.Status != StatusPending {
+			return job
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("job %s still pending", id)
+	return Job{}
+}
+
+func TestQueueRunsJobs(t *testing.T) {
+	queue := NewQueue(NewJobStore(time.Minute), 2, 4)
+	defer queue.Shutdown(context.Background())
+
+	release := make(chan struct{})
+	done, err := queue.Submit("", func(ctx context.Context, jobID string) (interface{}, error) {
+		<-release
+		return map[string]interface{}{"weight": 70.5, "job": jobID}, nil
+	})
+	if err != nil {
+		t.Fatalf("Submit: %v", err)
+	}
+	failed, err := queue.Submit("", func(ctx context.Context, jobID string) (interface{}, error) {
+		return nil, errors.New("ML service unavailable")
+	})
+	if err != nil {
+		t.Fatalf("Submit: %v", err)
+	}
+
+	if job, _ := queue.Store().Get(done.ID, ""); job.Status != StatusPending {
+		t.Fatalf("status before the task finished = %s, want %s", job.Status, StatusPending)
+	}
+	close(release)
+
+	job := waitForJob(t, queue.Store(), done.ID)
+	result, _ := job.Result.(map[string]interface{})
+	if job.Status != StatusDone || result["weight"] != 70.5 || result["job"] != done.ID {
+		t.Errorf("finished job = %+v, want done with its result", job)
+	}
+
+	job = waitForJob(t, queue.Store(), failed.ID)
+	if job.Status != StatusFailed || job.Error != "ML service unavailable" {
+		t.Errorf("failed job = %+v, want failed with the task's error", job)
+	}
+}
+
+func TestQueueFull(t *testing.T) {
+	queue := NewQueue(NewJobStore(time.Minute), 1, 1)
+	release := make(chan struct{})
+	defer func() {
+		close(release)
+		queue.Shutdown(context.Background())
+	}()
+
+	blocked := func(ctx context.Context, jobID string) (interface{}, error) {
+		<-release
+		return nil, nil
+	}
+	started := make(chan struct{})
+	if _, err := queue.Submit("", func(ctx context.Context, jobID string) (interface{}, error) {
+		close(started)
+		return blocked(ctx, jobID)
+	}); err != nil {
+		t.Fatalf("Submit running job: %v", err)
+	}
+	<-started
+	if _, err := queue.Submit("", blocked); err != nil {
+		t.Fatalf("Submit queued job: %v", err)
+	}
+	if _, err := queue.Submit("", blocked); !errors.Is(err, ErrQueueFull) {
+		t.Errorf("Submit past capacity error = %v, want ErrQueueFull", err)
+	}
+}
+
+func TestQueueShutdown(t *testing.T) {
+	tests := []struct {
+		name       string
+		jobTime    time.Duration
+		drain      time.Duration
+		wantStatus Status
+	}{
+		{"finishes within the drain", 50 * time.Millisecond, 5 * time.Second, StatusDone},
+		{"outlives the drain", 5 * time.Second, 50 * time.Millisecond, StatusInterrupted},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			queue := NewQueue(NewJobStore(time.Minute), 1, 2)
+			started := make(chan struct{})
+			cancelled := make(chan struct{})
+			slow := func(ctx context.Context, jobID string) (interface{}, error) {
+				close(started)
+				select {
+				case <-time.After(tt.jobTime):
+					return "finished", nil
+				case <-ctx.Done():
+					close(cancelled)
+					return nil, ctx.Err()
+				}
+			}
+			running, err := queue.Submit("", slow)
+			if err != nil {
+				t.Fatalf("Submit: %v", err)
+			}
+			<-started
+
+			ctx, cancel := context.WithTimeout(context.Background(), tt.drain)
+			defer cancel()
+			start := time.Now()
+			err = queue.Shutdown(ctx)
+			if elapsed := time.Since(start); elapsed > tt.drain+time.Second {
+				t.Errorf("Shutdown took %v, past the %v drain", elapsed, tt.drain)
+			}
+			if _, err := queue.Submit("", slow); !errors.Is(err, ErrQueueClosed) {
+				t.Errorf("Submit after shutdown error = %v, want ErrQueueClosed", err)
+			}
+
+			job, _ := queue.Store().Get(running.ID, "")
+			if job.Status != tt.wantStatus {
+				t.Errorf("job status = %s, want %s", job.Status, tt.wantStatus)
+			}
+			if tt.wantStatus == StatusDone {
+				if err != nil || job.Result != "finished" {
+					t.Errorf("Shutdown = %v with result %v, want nil with the job's result", err, job.Result)
+				}
+				return
+			}
+
+			if !errors.Is(err, context.DeadlineExceeded) {
+				t.Errorf("Shutdown = %v, want context.DeadlineExceeded", err)
+			}
+			select {
+			case <-cancelled:
+			case <-time.After(time.Second):
+				t.Error("interrupted job's context not cancelled")
+			}
+			// The task's own late failure doesn't overwrite the interruption
+			time.Sleep(10 * time.Millisecond)
+			if job, _ := queue.Store().Get(running.ID, ""); job.Status != StatusInterrupted {
+				t.Errorf("status after the task returned = %s, want %s", job.Status, StatusInterrupted)
+			}
+		})
+	}
+}
+
+func TestJobStoreEvictsExpiredJobs(t *testing.T) {
+	const ttl = 20 * time.Millisecond
+	store := NewJobStore(ttl)
+	finished := store.Create("")
+	pending := store.Create("")
+	store.Complete(finished.ID, "result")
+
+	time.Sleep(2 * ttl)
+	if _, ok := store.Get(finished.ID, ""); ok {
+		t.Error("finished job still found after its TTL")
+	}
+	if _, ok := store.Get(pending.ID, ""); !ok {
+		t.Error("pending job evicted, want it kept until it finishes")
+	}
+	if _, ok := store.Get("unknown", ""); ok {
+		t.Error("unknown job found")
+	}
+}
+
+func TestJobStoreScopesJobsToOwner(t *testing.T) {
+	store := NewJobStore(time.Minute)
+	job := store.Create("alice")
+
+	if _, ok := store.Get(job.ID, "alice"); !ok {
+		t.Error("owner can't find their job")
+	}
+	for _, owner := range []string{"bob", ""} {
+		if _, ok := store.Get(job.ID, owner); ok {
+			t.Errorf("job of alice found for owner %q", owner)
+		}
+	}
+}
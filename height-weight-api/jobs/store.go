@@ -0,0 +1,139 @@
+package jobs
+
+import (
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Status is the lifecycle state of a job
+type Status string
+
+// Job statuses
+const (
+	StatusPending     Status = "pending"
+	StatusDone        Status = "done"
+	StatusFailed      Status = "failed"
+	StatusInterrupted Status = "interrupted" // Cut off by a shutdown
+)
+
+// Job represents an asynchronous unit of work and its outcome
+type Job struct {
+	ID        string      `json:"job_id"`
+	Status    Status      `json:"status"`
+	Result    interface{} `json:"result,omitempty"`
+	Error     string      `json:"error,omitempty"`
+	CreatedAt time.Time   `json:"created_at"`
+	UpdatedAt time.Time   `json:"updated_at"`
+	owner     string      // User who submitted the job, empty when authentication is disabled
+}
+
+// JobStore keeps jobs in memory, evicting finished jobs once their TTL expires
+type JobStore struct {
+	mu   sync.RWMutex
+	jobs map[string]*Job
+	ttl  time.Duration
+}
+
+// NewJobStore creates an empty job store whose finished jobs expire after ttl
+func NewJobStore(ttl time.Duration) *JobStore {
+	return &JobStore{
+		jobs: make(map[string]*Job),
+		ttl:  ttl,
+	}
+}
+
+// Create adds a new pending job of owner and returns a copy of it
+func (s *JobStore) Create(owner string) Job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.evictExpired()
+
+	now := time.Now()
+	job := &Job{
+		ID:        uuid.New().String(),
+		Status:    StatusPending,
+		CreatedAt: now,
+		UpdatedAt: now,
+		owner:     owner,
+	}
+	s.jobs[job.ID] = job
+	return *job
+}
+
+// Get returns a copy of owner's job with the given ID. Other owners' jobs are
+// reported as missing, so their IDs can't be probed.
+func (s *JobStore) Get(id, owner string) (Job, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	job, ok := s.jobs[id]
+	if !ok || job.owner != owner || s.expired(job) {
+		return Job{}, false
+	}
+	return *job, true
+}
+
+// Complete marks a job as done with its result, unless it already finished,
+// e.g. by being interrupted
+func (s *JobStore) Complete(id string, result interface{}) {
+	s.finish(id, StatusDone, result, "")
+}
+
+// Fail marks a job as failed with an error message, unless it already
+// finished, e.g. by being interrupted
+func (s *JobStore) Fail(id string, err error) {
+	s.finish(id, StatusFailed, nil, err.Error())
+}
+
+// InterruptPending marks every job that hasn't finished as interrupted and
+// returns how many there were
+func (s *JobStore) InterruptPending() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	interrupted := 0
+	for _, job := range s.jobs {
+		if job.Status != StatusPending {
+			continue
+		}
+		job.Status = StatusInterrupted
+		job.Error = "job interrupted by server shutdown"
+		job.UpdatedAt = now
+		interrupted++
+	}
+	return interrupted
+}
+
+// finish records the final state of a job. Jobs that already finished, e.g.
+// by being interrupted, keep their state.
+func (s *JobStore) finish(id string, status Status, result interface{}, errMsg string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	job, ok := s.jobs[id]
+	if !ok || job.Status != StatusPending {
+		return
+	}
+	job.Status = status
+	job.Result = result
+	job.Error = errMsg
+	job.UpdatedAt = time.Now()
+}
+
+// expired reports whether a finished job has outlived the TTL
+func (s *JobStore) expired(job *Job) bool {
+	return job.Status != StatusPending && time.Since(job.UpdatedAt) > s.ttl
+}
+
+// evictExpired drops expired jobs. The caller must hold the write lock.
+func (s *JobStore) evictExpired() {
+	for id, job := range s.jobs {
+		if s.expired(job) {
+			delete(s.jobs, id)
+		}
+	}
+}
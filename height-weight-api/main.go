@@ -2,25 +2,39 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/lucasfepe/height-weight-api/api"
 	"github.com/lucasfepe/height-weight-api/config"
 	"github.com/lucasfepe/height-weight-api/db"
+	"github.com/lucasfepe/height-weight-api/jobs"
+	"github.com/lucasfepe/height-weight-api/utils"
+	"golang.org/x/crypto/acme/autocert"
 )
 
 func main() {
 	// Initialize configuration
 	cfg, err := config.LoadConfig()
+	if errors.Is(err, config.ErrMissingMongoURI) {
+		log.Fatal("MONGO_URI is not set. Set it to your MongoDB connection string, " +
+			"or set MONGO_ALLOW_LOCAL_DEFAULT=true to use a local MongoDB at mongodb://localhost:27017")
+	}
 	if err != nil {
 		log.Fatalf("Failed to load configuration: %v", err)
 	}
 
+	// Indent every JSON response when debugging
+	utils.PrettyJSON = cfg.PrettyJSON
+
 	// Initialize MongoDB connection
 	if err := db.InitMongoDB(cfg); err != nil {
 		log.Fatalf("Failed to connect to MongoDB: %v", err)
@@ -28,8 +42,25 @@ func main() {
 	defer db.CloseMongoDB()
 	log.Println("Connected to MongoDB successfully")
 
+	// Start the async estimation job workers
+	jobQueue := jobs.NewQueue(jobs.NewJobStore(cfg.JobTTL), cfg.JobWorkers, cfg.JobQueueSize)
+
+	// One ML service client per model version
+	mlClients := utils.NewMLClientsFromConfig(cfg)
+
+	// Check the ML round trip before the server starts listening and reports ready
+	if cfg.RunStartupSelfTest {
+		runMLSelfTest(cfg, mlClients)
+	}
+
+	// S3 storage for direct client uploads, nil when not configured
+	objectStore, err := utils.NewS3ClientFromConfig(cfg)
+	if err != nil {
+		log.Fatalf("Failed to configure S3 storage: %v", err)
+	}
+
 	// Initialize router
-	router := api.SetupRouter(cfg)
+	router := api.SetupRouter(cfg, jobQueue, mlClients, objectStore)
 
 	// Start the server
 	port := os.Getenv("PORT")
@@ -37,9 +68,10 @@ func main() {
 		port = "8080" // Default port
 	}
 
-	server := &http.Server{
-		Addr:    ":" + port,
-		Handler: router,
+	server, certManager := newServer(cfg, port, router)
+	listener, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		log.Fatalf("Error starting server: %v", err)
 	}
 
 	// Setup graceful shutdown
@@ -47,12 +79,42 @@ func main() {
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 
 	go func() {
-		log.Printf("Server starting on port %s", port)
-		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		switch {
+		case certManager != nil:
+			log.Printf("Server starting with HTTPS on port %s, certificates from Let's Encrypt for %s", port, strings.Join(cfg.TLSAutocertDomains, ", "))
+		case cfg.TLSEnabled():
+			log.Printf("Server starting with HTTPS on port %s", port)
+		default:
+			log.Printf("Server starting on port %s", port)
+		}
+		if err := serve(server, listener, cfg, certManager); err != nil && err != http.ErrServerClosed {
 			log.Fatalf("Error starting server: %v", err)
 		}
 	}()
 
+	// Send plain HTTP clients over to HTTPS
+	var redirectServer *http.Server
+	if cfg.TLSEnabled() && cfg.TLSRedirectPort != "" {
+		redirectHandler := api.HTTPSRedirectHandler(port)
+		if certManager != nil {
+			// Let's Encrypt HTTP-01 challenges are answered here, everything else is redirected
+			redirectHandler = certManager.HTTPHandler(redirectHandler)
+		}
+		redirectServer = &http.Server{
+			Addr:              ":" + cfg.TLSRedirectPort,
+			Handler:           redirectHandler,
+			ReadHeaderTimeout: 5 * time.Second,
+		}
+
+		go func() {
+			log.Printf("Redirecting HTTP on port %s to HTTPS", cfg.TLSRedirectPort)
+			// Losing the redirect mustn't take HTTPS down with it
+			if err := redirectServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Printf("WARNING: HTTP redirect server stopped, HTTPS keeps serving: %v", err)
+			}
+		}()
+	}
+
 	<-quit
 	log.Println("Server shutting down...")
 
@@ -60,9 +122,79 @@ func main() {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
+	if redirectServer != nil {
+		redirectServer.Shutdown(ctx)
+	}
+	// Requests still running are cut off, but the job queue is drained regardless
 	if err := server.Shutdown(ctx); err != nil {
-		log.Fatalf("Server forced to shutdown: %v", err)
+		log.Printf("Server forced to shutdown: %v", err)
+	}
+
+	// No requests can queue jobs any more, so let the queued and running ones finish
+	drainCtx, drainCancel := context.WithTimeout(context.Background(), cfg.JobDrainTimeout)
+	defer drainCancel()
+	if err := jobQueue.Shutdown(drainCtx); err != nil {
+		log.Printf("Job queue not drained within %v: %v", cfg.JobDrainTimeout, err)
 	}
 
 	log.Println("Server exited properly")
 }
+
+// newServer builds the API server listening on port with handler, and the
+// Let's Encrypt certificate manager when autocert is configured
+func newServer(cfg *config.Config, port string, handler http.Handler) (*http.Server, *autocert.Manager) {
+	server := &http.Server{
+		Addr:      ":" + port,
+		Handler:   handler,
+		TLSConfig: &tls.Config{MinVersion: cfg.TLSMinVersion},
+	}
+
+	// With autocert the certificates come from Let's Encrypt instead of files
+	var certManager *autocert.Manager
+	if cfg.TLSAutocertEnabled() {
+		certManager = &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(cfg.TLSAutocertDomains...),
+			Cache:      autocert.DirCache(cfg.TLSAutocertCacheDir),
+		}
+		server.TLSConfig = certManager.TLSConfig()
+		server.TLSConfig.MinVersion = cfg.TLSMinVersion
+	}
+	return server, certManager
+}
+
+// serve accepts connections on listener until the server is shut down, over
+// HTTPS when TLS is configured
+func serve(server *http.Server, listener net.Listener, cfg *config.Config, certManager *autocert.Manager) error {
+	switch {
+	case certManager != nil:
+		return server.ServeTLS(listener, "", "")
+	case cfg.TLSEnabled():
+		return server.ServeTLS(listener, cfg.TLSCertFile, cfg.TLSKeyFile)
+	default:
+		return server.Serve(listener)
+	}
+}
+
+// mlSelfTestTimeout bounds the startup self-test, including its retries
+const mlSelfTestTimeout = 30 * time.Second
+
+// runMLSelfTest sends the self-test images to the default ML model and logs
+// the outcome, exiting when the self-test is required and fails
+func runMLSelfTest(cfg *config.Config, mlClients *utils.MLClients) {
+	model, service, err := mlClients.Resolve("")
+	if err == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), mlSelfTestTimeout)
+		err = utils.SelfTestML(ctx, service)
+		cancel()
+	}
+
+	switch {
+	case err == nil:
+		log.Printf("ML self-test passed for model %s", model)
+	case cfg.SelfTestRequired:
+		log.Fatalf("ML self-test failed: %v", err)
+	default:
+		log.Printf("WARNING: ML self-test failed: %v", err)
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lucasfepe/height-weight-api/api"
+	"github.com/lucasfepe/height-weight-api/internal/testutil"
+	"github.com/lucasfepe/height-weight-api/jobs"
+	"github.com/lucasfepe/height-weight-api/utils"
+)
+
+// writeSelfSignedCert writes a certificate for 127.0.0.1 and its key to dir,
+// returning their paths and the parsed certificate
+func writeSelfSignedCert(t *testing.T, dir string) (certFile, keyFile string, cert *x509.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("create certificate: %v", err)
+	}
+	if cert, err = x509.ParseCertificate(der); err != nil {
+		t.Fatalf("parse certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("marshal key: %v", err)
+	}
+
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatalf("write certificate: %v", err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatalf("write key: %v", err)
+	}
+	return certFile, keyFile, cert
+}
+
+func TestServeHTTPS(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile, cert := writeSelfSignedCert(t, dir)
+	cfg := testutil.Config(t, map[string]string{
+		"UPLOAD_DIR":    dir,
+		"DEV_MODE":      "true",
+		"TLS_CERT_FILE": certFile,
+		"TLS_KEY_FILE":  keyFile,
+	})
+
+	queue := jobs.NewQueue(jobs.NewJobStore(cfg.JobTTL), 1, 1)
+	defer queue.Shutdown(context.Background())
+	server, certManager := newServer(cfg, "0", api.SetupRouter(cfg, queue, utils.NewMLClientsFromConfig(cfg), nil))
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	go serve(server, listener, cfg, certManager)
+	defer server.Shutdown(context.Background())
+
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	client := &http.Client{
+		Timeout:   5 * time.Second,
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}},
+	}
+	resp, err := client.Get("https://" + listener.Addr().String() + cfg.RoutePrefix + "/health")
+	if err != nil {
+		t.Fatalf("HTTPS request: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if resp.TLS == nil || resp.TLS.Version < cfg.TLSMinVersion {
+		t.Errorf("connection state = %+v, want TLS of at least version %x", resp.TLS, cfg.TLSMinVersion)
+	}
+}
+
+func TestRunMLSelfTest(t *testing.T) {
+	tests := []struct {
+		name    string
+		weight  float64
+		wantLog string
+	}{
+		{"passing", 72, "ML self-test passed for model v1"},
+		{"failing", 900, "WARNING: ML self-test failed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				json.NewEncoder(w).Encode(utils.ModelResponse{Weight: tt.weight})
+			}))
+			defer server.Close()
+
+			cfg := testutil.Config(t, map[string]string{"ML_MODELS": "v1=" + server.URL})
+
+			var logs bytes.Buffer
+			log.SetOutput(&logs)
+			defer log.SetOutput(os.Stderr)
+
+			// A failure only warns, as the self-test isn't required
+			runMLSelfTest(cfg, utils.NewMLClientsFromConfig(cfg))
+			if !strings.Contains(logs.String(), tt.wantLog) {
+				t.Errorf("logged %q, want %q", logs.String(), tt.wantLog)
+			}
+		})
+	}
+}
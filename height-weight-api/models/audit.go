@@ -0,0 +1,84 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// AuditCollection is the collection of audit log entries, set from the
+// configuration when connecting
+var AuditCollection = "audit_log"
+
+// Audited actions
+const (
+	AuditActionDelete      = "delete"
+	AuditActionRestore     = "restore"
+	AuditActionReprocess   = "reprocess"
+	AuditActionBulkDelete  = "bulk_delete"
+	AuditActionBMIBackfill = "recompute_bmi"
+)
+
+// AuditEntry records who changed or removed stored data, and when
+type AuditEntry struct {
+	ID        primitive.ObjectID     `bson:"_id,omitempty" json:"id"`
+	Actor     string                 `bson:"actor" json:"actor"`                             // User ID of the token, or "anonymous"
+	Action    string                 `bson:"action" json:"action"`                           // One of the AuditAction constants
+	TargetID  string                 `bson:"target_id,omitempty" json:"target_id,omitempty"` // Empty for bulk operations
+	Details   map[string]interface{} `bson:"details,omitempty" json:"details,omitempty"`
+	CreatedAt time.Time              `bson:"created_at" json:"created_at"`
+}
+
+// WriteAuditEntry stores an audit record of actor performing action on targetID
+func WriteAuditEntry(actor, action, targetID string, details map[string]interface{}) error {
+	collection := DB.Collection(AuditCollection)
+
+	ctx, cancel := opContext()
+	defer cancel()
+
+	entry := AuditEntry{
+		Actor:     actor,
+		Action:    action,
+		TargetID:  targetID,
+		Details:   details,
+		CreatedAt: time.Now(),
+	}
+	_, err := collection.InsertOne(ctx, entry)
+	return err
+}
+
+// GetAuditEntries returns audit entries newest first
+func GetAuditEntries(limit, offset int64) ([]*AuditEntry, error) {
+	collection := DB.Collection(AuditCollection)
+
+	ctx, cancel := opContext()
+	defer cancel()
+
+	findOptions := options.Find()
+	findOptions.SetSort(bson.D{{Key: "created_at", Value: -1}, {Key: "_id", Value: -1}})
+	if limit > 0 {
+		findOptions.SetLimit(limit)
+	}
+	if offset > 0 {
+		findOptions.SetSkip(offset)
+	}
+
+	var results []*AuditEntry
+	if err := findAll(ctx, collection, bson.M{}, &results, findOptions); err != nil {
+		return nil, err
+	}
+
+	return results, nil
+}
+
+// CountAuditEntries returns the number of audit entries
+func CountAuditEntries() (int64, error) {
+	collection := DB.Collection(AuditCollection)
+
+	ctx, cancel := opContext()
+	defer cancel()
+
+	return countDocuments(ctx, collection, bson.M{})
+}
@@ -6,21 +6,26 @@ import (
 
 // Estimation represents the height and weight estimation result
 type Estimation struct {
-	ID        string    `json:"id" bson:"id"`
-	ImagePath string    `json:"image_path" bson:"image_path"`
-	Height    float64   `json:"height" bson:"height"`     // Height in centimeters
-	Weight    float64   `json:"weight" bson:"weight"`     // Weight in kilograms
-	Accuracy  float64   `json:"accuracy" bson:"accuracy"` // Estimation accuracy percentage
-	CreatedAt time.Time `json:"created_at" bson:"created_at"`
+	ID           string             `json:"id" bson:"id"`
+	ImagePath    string             `json:"image_path" bson:"image_path"`
+	Height       float64            `json:"height" bson:"height"`                                 // Height in centimeters
+	Weight       float64            `json:"weight" bson:"weight"`                                 // Weight in kilograms
+	Accuracy     float64            `json:"accuracy" bson:"accuracy"`                             // Estimation accuracy percentage
+	Measurements map[string]float64 `json:"measurements,omitempty" bson:"measurements,omitempty"` // Body circumferences in cm
+	CreatedAt    time.Time          `json:"created_at" bson:"created_at"`
+	DeletedAt    *time.Time         `json:"deleted_at,omitempty" bson:"deleted_at,omitempty"` // Set when soft-deleted
 }
 
 // EstimationResult is the response sent to clients
 type EstimationResult struct {
-	ID        string    `json:"id"`
-	Height    float64   `json:"height"`
-	Weight    float64   `json:"weight"`
-	Accuracy  float64   `json:"accuracy"`
-	CreatedAt time.Time `json:"created_at"`
+	ID           string             `json:"id"`
+	Height       float64            `json:"height"`
+	Weight       float64            `json:"weight"`
+	Accuracy     float64            `json:"accuracy"`
+	Measurements map[string]float64 `json:"measurements,omitempty"`
+	ImageURL     string             `json:"image_url,omitempty"`
+	CreatedAt    time.Time          `json:"created_at"`
+	DeletedAt    *time.Time         `json:"deleted_at,omitempty"`
 }
 
 // MLServiceRequest is the request sent to the ML service
@@ -31,8 +36,9 @@ type MLServiceRequest struct {
 // MLServiceResponse is the response from the ML service
 // MLServiceResponse represents the response from the ML service
 type MLServiceResponse struct {
-	Height     float64 `json:"height"`
-	Weight     float64 `json:"weight"`
-	Confidence float64 `json:"confidence"`
-	Error      string  `json:"error,omitempty"`
+	Height       float64            `json:"height"`
+	Weight       float64            `json:"weight"`
+	Confidence   float64            `json:"confidence"`
+	Measurements map[string]float64 `json:"measurements,omitempty"` // Optional body circumferences in cm
+	Error        string             `json:"error,omitempty"`
 }
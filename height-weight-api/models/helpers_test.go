@@ -0,0 +1,42 @@
+package models
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/lucasfepe/height-weight-api/internal/testutil"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// testDatabase points DB at a database of the test's own on the MongoDB at
+// MONGO_TEST_URI, dropped when the test ends. Tests needing a database are
+// skipped without one.
+func testDatabase(t *testing.T) {
+	t.Helper()
+	uri := testutil.MongoURI(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		t.Fatalf("connect to MongoDB: %v", err)
+	}
+	DB = client.Database(testutil.DatabaseName())
+	t.Cleanup(func() {
+		DB.Drop(context.Background())
+		client.Disconnect(context.Background())
+		DB = nil
+	})
+}
+
+// seedWeightEstimations saves each estimation, failing the test on error
+func seedWeightEstimations(t *testing.T, estimations ...*WeightEstimation) {
+	t.Helper()
+	for _, estimation := range estimations {
+		if err := SaveWeightEstimation(estimation); err != nil {
+			t.Fatalf("SaveWeightEstimation: %v", err)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package models
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// OpTimeout bounds each database operation, retries included. It is set from
+// the configuration when connecting.
+var OpTimeout = 10 * time.Second
+
+// OpRetries is how many times WithRetry retries a read
+var OpRetries int
+
+// opRetryBackoff is the wait before the first retry of a read, doubling with each further one
+const opRetryBackoff = 100 * time.Millisecond
+
+// longOpTimeout is the least time given to aggregations and bulk operations
+// that scan a whole collection
+const longOpTimeout = 30 * time.Second
+
+// opContext returns a context bounded by OpTimeout for a single operation
+func opContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), OpTimeout)
+}
+
+// longOpContext returns a context for an operation scanning a whole
+// collection, bounded by OpTimeout but no shorter than longOpTimeout
+func longOpContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), max(OpTimeout, longOpTimeout))
+}
+
+// WithRetry runs the read fn, retrying it up to OpRetries times with backoff
+// while it fails on a transient network error and ctx isn't done. Only
+// idempotent reads may go through it, since a write may have been applied
+// before its connection dropped.
+func WithRetry(ctx context.Context, fn func(ctx context.Context) error) error {
+	backoff := opRetryBackoff
+	for attempt := 1; ; attempt++ {
+		err := fn(ctx)
+		if err == nil || attempt > OpRetries || !mongo.IsNetworkError(err) {
+			return err
+		}
+		log.Printf("MongoDB read failed on a network error, retrying (retry %d of %d): %v", attempt, OpRetries, err)
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// findOne decodes the first document of coll matching filter into out,
+// retrying on transient network errors
+func findOne(ctx context.Context, coll *mongo.Collection, filter interface{}, out interface{}, opts ...*options.FindOneOptions) error {
+	return WithRetry(ctx, func(ctx context.Context) error {
+		return coll.FindOne(ctx, filter, opts...).Decode(out)
+	})
+}
+
+// findAll decodes every document of coll matching filter into out, a pointer
+// to a slice, retrying on transient network errors. A retry refills the
+// slice from the start.
+func findAll(ctx context.Context, coll *mongo.Collection, filter interface{}, out interface{}, opts ...*options.FindOptions) error {
+	return WithRetry(ctx, func(ctx context.Context) error {
+		cursor, err := coll.Find(ctx, filter, opts...)
+		if err != nil {
+			return err
+		}
+		defer cursor.Close(ctx)
+		return cursor.All(ctx, out)
+	})
+}
+
+// aggregateAll runs pipeline on coll and decodes every result into out, a
+// pointer to a slice, retrying on transient network errors
+func aggregateAll(ctx context.Context, coll *mongo.Collection, pipeline interface{}, out interface{}) error {
+	return WithRetry(ctx, func(ctx context.Context) error {
+		cursor, err := coll.Aggregate(ctx, pipeline)
+		if err != nil {
+			return err
+		}
+		defer cursor.Close(ctx)
+		return cursor.All(ctx, out)
+	})
+}
+
+// countDocuments counts the documents of coll matching filter, retrying on
+// transient network errors
+func countDocuments(ctx context.Context, coll *mongo.Collection, filter interface{}) (int64, error) {
+	var count int64
+	err := WithRetry(ctx, func(ctx context.Context) error {
+		var err error
+		count, err = coll.CountDocuments(ctx, filter)
+		return err
+	})
+	return count, err
+}
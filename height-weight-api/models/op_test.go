@@ -0,0 +1,49 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func TestWithRetry(t *testing.T) {
+	previous := OpRetries
+	OpRetries = 2
+	t.Cleanup(func() { OpRetries = previous })
+
+	networkErr := mongo.CommandError{Message: "connection reset", Labels: []string{"NetworkError"}}
+	otherErr := errors.New("invalid filter")
+
+	tests := []struct {
+		name      string
+		failures  int // Calls failing before the read succeeds
+		err       error
+		wantCalls int
+		wantErr   bool
+	}{
+		{"succeeds at once", 0, networkErr, 1, false},
+		{"flaky once", 1, networkErr, 2, false},
+		{"down for good", 10, networkErr, 3, true},
+		{"not a network error", 1, otherErr, 1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			err := WithRetry(context.Background(), func(ctx context.Context) error {
+				calls++
+				if calls <= tt.failures {
+					return tt.err
+				}
+				return nil
+			})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("WithRetry error = %v, want error %v", err, tt.wantErr)
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("read ran %d times, want %d", calls, tt.wantCalls)
+			}
+		})
+	}
+}
@@ -0,0 +1,50 @@
+package models
+
+import (
+	"errors"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Submission is the weight estimation and training record made from one
+// labeled submission, linking a prediction to its ground truth
+type Submission struct {
+	ID           string            `json:"id"`
+	Estimation   *WeightEstimation `json:"estimation,omitempty"`
+	TrainingData *TrainingData     `json:"training_data,omitempty"`
+}
+
+// GetBySubmissionID retrieves the records sharing the submission ID id. With
+// a userID the estimation must be that user's, since training data has no
+// owner of its own. It returns mongo.ErrNoDocuments when nothing is found.
+func GetBySubmissionID(id, userID string) (*Submission, error) {
+	ctx, cancel := opContext()
+	defer cancel()
+
+	submission := &Submission{ID: id}
+
+	var estimation WeightEstimation
+	err := findOne(ctx, DB.Collection(WeightEstimationCollection), userFilter(bson.M{"submission_id": id}, userID), &estimation)
+	switch {
+	case err == nil:
+		submission.Estimation = &estimation
+	case !errors.Is(err, mongo.ErrNoDocuments):
+		return nil, err
+	case userID != "":
+		return nil, err
+	}
+
+	var trainingData TrainingData
+	err = findOne(ctx, DB.Collection(TrainingCollection), bson.M{"submission_id": id}, &trainingData)
+	switch {
+	case err == nil:
+		submission.TrainingData = &trainingData
+	case !errors.Is(err, mongo.ErrNoDocuments):
+		return nil, err
+	case submission.Estimation == nil:
+		return nil, err
+	}
+
+	return submission, nil
+}
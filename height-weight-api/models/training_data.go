@@ -2,13 +2,24 @@ package models
 
 import (
 	"context"
+	"errors"
+	"math"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
+// maxDistributionBins caps the bins of a height distribution, so a tiny bin
+// size can't build a huge response
+const maxDistributionBins = 1000
+
+// ErrTooManyBins is returned when a bin size splits the height range into
+// more than maxDistributionBins bins
+var ErrTooManyBins = errors.New("bin size too small for the height range")
+
 // TrainingData represents a record for training data
 type TrainingData struct {
 	ID           primitive.ObjectID `bson:"_id,omitempty" json:"id,omitempty"`
@@ -16,11 +27,22 @@ type TrainingData struct {
 	ActualWeight float64            `bson:"actual_weight" json:"actual_weight"`
 	FrontImgPath string             `bson:"front_img_path" json:"front_img_path"`
 	SideImgPath  string             `bson:"side_img_path" json:"side_img_path"`
+	Anonymized   bool               `bson:"anonymized" json:"anonymized"`                           // Faces were blurred before storing the images
+	SubmissionID string             `bson:"submission_id,omitempty" json:"submission_id,omitempty"` // Shared with the estimation of a labeled submission
 	CreatedAt    time.Time          `bson:"created_at" json:"created_at"`
 }
 
 // SaveTrainingData saves the training data to the database
 func SaveTrainingData(data *TrainingData) error {
+	ctx, cancel := opContext()
+	defer cancel()
+
+	return InsertTrainingData(ctx, data)
+}
+
+// InsertTrainingData saves the training data using ctx, which may be a
+// session context to take part in a transaction
+func InsertTrainingData(ctx context.Context, data *TrainingData) error {
 	// Set created_at timestamp if not set
 	if data.CreatedAt.IsZero() {
 		data.CreatedAt = time.Now()
@@ -32,49 +54,251 @@ func SaveTrainingData(data *TrainingData) error {
 	}
 
 	// Get the collection
-	collection := DB.Collection("training_data")
+	collection := DB.Collection(TrainingCollection)
 
 	// Insert the document
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-
 	_, err := collection.InsertOne(ctx, data)
 	return err
 }
 
-// GetTrainingData retrieves training data from the database
-func GetTrainingData(limit int64) ([]*TrainingData, error) {
+// TrainingDataFilter narrows training data to a cohort by height and actual
+// weight, and to a creation time window. Zero bounds are left off.
+type TrainingDataFilter struct {
+	MinHeight    float64
+	MaxHeight    float64
+	MinWeight    float64
+	MaxWeight    float64
+	CreatedAfter time.Time // Exclusive, for incremental pulls
+	CreatedUntil time.Time // Inclusive
+}
+
+// query returns the MongoDB filter matching the set bounds
+func (f TrainingDataFilter) query() bson.M {
+	filter := bson.M{}
+	if r := rangeFilter(f.MinHeight, f.MaxHeight); r != nil {
+		filter["height"] = r
+	}
+	if r := rangeFilter(f.MinWeight, f.MaxWeight); r != nil {
+		filter["actual_weight"] = r
+	}
+	if !f.CreatedAfter.IsZero() || !f.CreatedUntil.IsZero() {
+		created := bson.M{}
+		if !f.CreatedAfter.IsZero() {
+			created["$gt"] = f.CreatedAfter
+		}
+		if !f.CreatedUntil.IsZero() {
+			created["$lte"] = f.CreatedUntil
+		}
+		filter["created_at"] = created
+	}
+	return filter
+}
+
+// rangeFilter returns an inclusive range condition, or nil if neither bound is set
+func rangeFilter(min, max float64) bson.M {
+	if min <= 0 && max <= 0 {
+		return nil
+	}
+	r := bson.M{}
+	if min > 0 {
+		r["$gte"] = min
+	}
+	if max > 0 {
+		r["$lte"] = max
+	}
+	return r
+}
+
+// TrainingDataOptions selects a page of filtered training data
+type TrainingDataOptions struct {
+	TrainingDataFilter
+	Limit  int64 // 0 for all records
+	Offset int64
+}
+
+// GetTrainingData retrieves training data from the database, newest first
+func GetTrainingData(opts TrainingDataOptions) ([]*TrainingData, error) {
 	// Get the collection
-	collection := DB.Collection("training_data")
+	collection := DB.Collection(TrainingCollection)
 
 	// Set up the query
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := opContext()
 	defer cancel()
 
 	findOptions := options.Find()
 	findOptions.SetSort(bson.D{{Key: "created_at", Value: -1}}) // Sort by created_at desc
-	if limit > 0 {
-		findOptions.SetLimit(limit)
+	if opts.Limit > 0 {
+		findOptions.SetLimit(opts.Limit)
+	}
+	if opts.Offset > 0 {
+		findOptions.SetSkip(opts.Offset)
+	}
+
+	// Execute the query and decode the results
+	var results []*TrainingData
+	if err := findAll(ctx, collection, opts.query(), &results, findOptions); err != nil {
+		return nil, err
 	}
 
-	// Execute the query
-	cursor, err := collection.Find(ctx, bson.M{}, findOptions)
+	return results, nil
+}
+
+// CountTrainingData returns the number of training data records matching filter
+func CountTrainingData(filter TrainingDataFilter) (int64, error) {
+	collection := DB.Collection(TrainingCollection)
+
+	ctx, cancel := opContext()
+	defer cancel()
+
+	return countDocuments(ctx, collection, filter.query())
+}
+
+// HeightBin counts the training records with Min <= height < Max
+type HeightBin struct {
+	Min   float64 `json:"min"`
+	Max   float64 `json:"max"`
+	Count int64   `json:"count"`
+}
+
+// GetTrainingDistribution counts training records per height bin of binSize
+// cm, from the bin holding the shortest record to the one holding the
+// tallest. Bins without records are included with a count of 0, so gaps in
+// the data show. Without records it returns no bins.
+func GetTrainingDistribution(binSize float64) ([]HeightBin, error) {
+	collection := DB.Collection(TrainingCollection)
+
+	ctx, cancel := longOpContext()
+	defer cancel()
+
+	// $bucket needs explicit boundaries, so find the height range first
+	hasHeight := bson.M{"height": bson.M{"$type": "number"}}
+	var ranges []struct {
+		Min float64 `bson:"min"`
+		Max float64 `bson:"max"`
+	}
+	err := aggregateAll(ctx, collection, mongo.Pipeline{
+		{{Key: "$match", Value: hasHeight}},
+		{{Key: "$group", Value: bson.M{
+			"_id": nil,
+			"min": bson.M{"$min": "$height"},
+			"max": bson.M{"$max": "$height"},
+		}}},
+	}, &ranges)
 	if err != nil {
 		return nil, err
 	}
-	defer cursor.Close(ctx)
+	if len(ranges) == 0 {
+		return []HeightBin{}, nil
+	}
 
-	// Decode the results
-	var results []*TrainingData
-	if err := cursor.All(ctx, &results); err != nil {
+	// Align bins to multiples of binSize, widened where float rounding cuts off an edge
+	lower := math.Floor(ranges[0].Min/binSize) * binSize
+	if lower > ranges[0].Min {
+		lower -= binSize
+	}
+	count := int(math.Floor((ranges[0].Max-lower)/binSize)) + 1
+	if lower+float64(count)*binSize <= ranges[0].Max {
+		count++
+	}
+	if count > maxDistributionBins {
+		return nil, ErrTooManyBins
+	}
+
+	bins := make([]HeightBin, count)
+	boundaries := make(bson.A, count+1)
+	for i := range boundaries {
+		boundaries[i] = lower + float64(i)*binSize
+	}
+	for i := range bins {
+		bins[i] = HeightBin{Min: boundaries[i].(float64), Max: boundaries[i+1].(float64)}
+	}
+
+	var buckets []struct {
+		Min   float64 `bson:"_id"`
+		Count int64   `bson:"count"`
+	}
+	err = aggregateAll(ctx, collection, mongo.Pipeline{
+		{{Key: "$match", Value: hasHeight}},
+		{{Key: "$bucket", Value: bson.M{
+			"groupBy":    "$height",
+			"boundaries": boundaries,
+			"output":     bson.M{"count": bson.M{"$sum": 1}},
+		}}},
+	}, &buckets)
+	if err != nil {
 		return nil, err
 	}
 
-	return results, nil
+	// Buckets are identified by their lower boundary; empty ones are left out
+	for _, bucket := range buckets {
+		if i := int(math.Round((bucket.Min - lower) / binSize)); i >= 0 && i < count {
+			bins[i].Count = bucket.Count
+		}
+	}
+	return bins, nil
 }
 
-// ExportTrainingData returns all training data formatted for model training
-func ExportTrainingData() ([]*TrainingData, error) {
+// ExportTrainingData returns all training data matching filter formatted for model training
+func ExportTrainingData(filter TrainingDataFilter) ([]*TrainingData, error) {
 	// Get all training data without limit
-	return GetTrainingData(0)
+	return GetTrainingData(TrainingDataOptions{TrainingDataFilter: filter})
+}
+
+// LatestTrainingDataTime returns the newest creation time of the training
+// records matching filter, or the zero time when none match
+func LatestTrainingDataTime(filter TrainingDataFilter) (time.Time, error) {
+	collection := DB.Collection(TrainingCollection)
+
+	ctx, cancel := opContext()
+	defer cancel()
+
+	findOptions := options.FindOne().
+		SetSort(bson.D{{Key: "created_at", Value: -1}}).
+		SetProjection(bson.M{"created_at": 1})
+	var latest TrainingData
+	err := findOne(ctx, collection, filter.query(), &latest, findOptions)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	return latest.CreatedAt, nil
+}
+
+// streamBatchSize is how many training records a stream fetches per round trip
+const streamBatchSize = 500
+
+// StreamTrainingData calls fn with every training record matching filter,
+// oldest first, decoding one at a time so the whole dataset is never held in
+// memory. It stops at the first error from fn, or once ctx is done, e.g.
+// because the client went away; the cursor is closed either way.
+func StreamTrainingData(ctx context.Context, filter TrainingDataFilter, fn func(*TrainingData) error) error {
+	collection := DB.Collection(TrainingCollection)
+
+	// Sorting on created_at alone lets the created_at index serve the sort
+	findOptions := options.Find().
+		SetSort(bson.D{{Key: "created_at", Value: 1}}).
+		SetBatchSize(streamBatchSize)
+	cursor, err := collection.Find(ctx, filter.query(), findOptions)
+	if err != nil {
+		return err
+	}
+	// The request context may already be cancelled, so close with a fresh one
+	defer func() {
+		closeCtx, cancel := opContext()
+		defer cancel()
+		cursor.Close(closeCtx)
+	}()
+
+	for cursor.Next(ctx) {
+		var data TrainingData
+		if err := cursor.Decode(&data); err != nil {
+			return err
+		}
+		if err := fn(&data); err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
 }
@@ -0,0 +1,48 @@
+package models
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestGetTrainingDistribution(t *testing.T) {
+	testDatabase(t)
+
+	bins, err := GetTrainingDistribution(10)
+	if err != nil {
+		t.Fatalf("GetTrainingDistribution without records: %v", err)
+	}
+	if len(bins) != 0 {
+		t.Errorf("bins without records = %v, want none", bins)
+	}
+
+	// Heights on a boundary belong to the bin above it; 170 to 180 cm stays empty
+	for _, height := range []float64{152, 158, 160, 169.9, 185, 199.9, 200} {
+		if err := SaveTrainingData(&TrainingData{Height: height, ActualWeight: 70}); err != nil {
+			t.Fatalf("SaveTrainingData: %v", err)
+		}
+	}
+
+	tests := []struct {
+		binSize float64
+		want    []HeightBin
+	}{
+		{10, []HeightBin{{150, 160, 2}, {160, 170, 2}, {170, 180, 0}, {180, 190, 1}, {190, 200, 1}, {200, 210, 1}}},
+		{25, []HeightBin{{150, 175, 4}, {175, 200, 2}, {200, 225, 1}}},
+		{100, []HeightBin{{100, 200, 6}, {200, 300, 1}}},
+	}
+	for _, tt := range tests {
+		bins, err := GetTrainingDistribution(tt.binSize)
+		if err != nil {
+			t.Fatalf("GetTrainingDistribution(%v): %v", tt.binSize, err)
+		}
+		if !slices.Equal(bins, tt.want) {
+			t.Errorf("GetTrainingDistribution(%v) = %v, want %v", tt.binSize, bins, tt.want)
+		}
+	}
+
+	if _, err := GetTrainingDistribution(0.001); !errors.Is(err, ErrTooManyBins) {
+		t.Errorf("tiny bins error = %v, want %v", err, ErrTooManyBins)
+	}
+}
@@ -2,6 +2,8 @@ package models
 
 import (
 	"context"
+	"errors"
+	"math"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
@@ -12,18 +14,89 @@ import (
 
 var DB *mongo.Database
 
+// Collection names of weight estimations and training data, set from the
+// configuration when connecting
+var (
+	WeightEstimationCollection = "weight_estimations"
+	TrainingCollection         = "training_data"
+)
+
+// ErrInvalidID is returned when an ID is not a valid ObjectID hex string
+var ErrInvalidID = errors.New("invalid ID format")
+
+// ErrTooFewSamples is returned when there isn't enough data for a meaningful percentile
+var ErrTooFewSamples = errors.New("too few samples")
+
+// percentileHeightBandCM is how far from the given height stored estimations
+// still count as similar
+const percentileHeightBandCM = 5
+
+// minPercentileSamples is the number of similar estimations below which a
+// percentile would be misleading
+const minPercentileSamples = 30
+
+// BMI categories of weight estimations, by the WHO adult thresholds
+const (
+	BMIUnderweight = "underweight"
+	BMINormal      = "normal"
+	BMIOverweight  = "overweight"
+	BMIObese       = "obese"
+)
+
+// BMICategories lists the BMI categories from lightest to heaviest
+var BMICategories = []string{BMIUnderweight, BMINormal, BMIOverweight, BMIObese}
+
 // WeightEstimation represents a weight estimation record
 type WeightEstimation struct {
-	ID           primitive.ObjectID `bson:"_id,omitempty" json:"id,omitempty"`
-	Height       float64            `bson:"height" json:"height"`
-	Weight       float64            `bson:"weight" json:"weight"`
-	FrontImgPath string             `bson:"front_img_path" json:"front_img_path"`
-	SideImgPath  string             `bson:"side_img_path" json:"side_img_path"`
-	CreatedAt    time.Time          `bson:"created_at" json:"created_at"`
+	ID              primitive.ObjectID  `bson:"_id,omitempty" json:"id,omitempty"`
+	UserID          string              `bson:"user_id,omitempty" json:"user_id,omitempty"` // Owner, empty when authentication is disabled
+	Height          float64             `bson:"height" json:"height"`
+	Weight          float64             `bson:"weight" json:"weight"`
+	PredictedHeight float64             `bson:"predicted_height,omitempty" json:"predicted_height,omitempty"` // Height inferred by the model
+	FrontImgPath    string              `bson:"front_img_path" json:"front_img_path"`
+	ImageHash       string              `bson:"image_hash,omitempty" json:"-"`                        // Identifies the submitted images
+	SideImgPath     string              `bson:"side_img_path" json:"side_img_path"`                   // First of SideImages
+	SideImages      []SideImage         `bson:"side_images,omitempty" json:"side_images,omitempty"`   // Absent on records made before left and right views
+	Measurements    map[string]float64  `bson:"measurements,omitempty" json:"measurements,omitempty"` // Body circumferences in cm
+	BMI             float64             `bson:"bmi,omitempty" json:"bmi,omitempty"`                   // From the reported height and estimated weight
+	BMICategory     string              `bson:"bmi_category,omitempty" json:"bmi_category,omitempty"` // One of BMICategories
+	ModelVersion    string              `bson:"model_version,omitempty" json:"model_version,omitempty"`
+	InferenceMs     int64               `bson:"inference_ms,omitempty" json:"inference_ms,omitempty"`         // Round trip of the ML prediction
+	PredictionMode  string              `bson:"prediction_mode,omitempty" json:"prediction_mode,omitempty"`   // model, mock or fallback; absent on older records
+	Degraded        bool                `bson:"degraded,omitempty" json:"degraded,omitempty"`                 // Heuristic estimate made while the ML service failed
+	ActualWeight    *float64            `bson:"actual_weight,omitempty" json:"actual_weight,omitempty"`       // Measured weight, when known
+	ReprocessedFrom *primitive.ObjectID `bson:"reprocessed_from,omitempty" json:"reprocessed_from,omitempty"` // Original of a reprocessed estimation
+	ReprocessedAt   *time.Time          `bson:"reprocessed_at,omitempty" json:"reprocessed_at,omitempty"`     // Set when updated by a reprocess
+	SubmissionID    string              `bson:"submission_id,omitempty" json:"submission_id,omitempty"`       // Shared with the training record of a labeled submission
+	CreatedAt       time.Time           `bson:"created_at" json:"created_at"`
+}
+
+// SideImage is a side photo of a weight estimation
+type SideImage struct {
+	View string `bson:"view" json:"view"` // Form field it was uploaded as, e.g. side_image_left
+	Path string `bson:"path" json:"path"`
+}
+
+// Sides returns the side photos of the estimation, reading a record made
+// before SideImages as a single side_image view
+func (e *WeightEstimation) Sides() []SideImage {
+	if len(e.SideImages) > 0 {
+		return e.SideImages
+	}
+	return []SideImage{{View: "side_image", Path: e.SideImgPath}}
 }
 
 // SaveWeightEstimation saves the weight estimation to the database
 func SaveWeightEstimation(estimation *WeightEstimation) error {
+	ctx, cancel := opContext()
+	defer cancel()
+
+	return InsertWeightEstimation(ctx, estimation)
+}
+
+// InsertWeightEstimation saves the weight estimation using ctx, which may be
+// a session context to take part in a transaction
+func InsertWeightEstimation(ctx context.Context, estimation *WeightEstimation) error {
 	// Set created_at timestamp if not set
 	if estimation.CreatedAt.IsZero() {
 		estimation.CreatedAt = time.Now()
@@ -34,24 +107,152 @@ func SaveWeightEstimation(estimation *WeightEstimation) error {
 		estimation.ID = primitive.NewObjectID()
 	}
 
+	estimation.setBMI()
+
 	// Get the collection
-	collection := DB.Collection("weight_estimations")
+	collection := DB.Collection(WeightEstimationCollection)
 
 	// Insert the document
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-
 	_, err := collection.InsertOne(ctx, estimation)
 	return err
 }
 
-// GetWeightEstimations retrieves weight estimations from the database
-func GetWeightEstimations(limit int64) ([]*WeightEstimation, error) {
+// setBMI derives the BMI and its category from the height and weight,
+// clearing them when either is missing
+func (e *WeightEstimation) setBMI() {
+	e.BMI, e.BMICategory = 0, ""
+	if e.Height <= 0 || e.Weight <= 0 {
+		return
+	}
+	e.BMI = CalculateBMI(e.Height, e.Weight)
+	e.BMICategory = BMICategoryFor(e.BMI)
+}
+
+// CalculateBMI returns the BMI of a height in cm and a weight in kg, at full
+// precision like the height and weight, leaving rounding to responses
+func CalculateBMI(heightCm, weightKg float64) float64 {
+	meters := heightCm / 100
+	return weightKg / (meters * meters)
+}
+
+// bmiBackfillBatch is how many estimations RecomputeMissingBMI updates per bulk write
+const bmiBackfillBatch = 500
+
+// RecomputeMissingBMI sets the BMI and its category on weight estimations
+// stored without one, in bulk writes of bmiBackfillBatch, and returns how
+// many it updated, including on failure. Only records still lacking a BMI
+// are touched, so an interrupted run can simply be repeated.
+func RecomputeMissingBMI(ctx context.Context) (int, error) {
+	collection := DB.Collection(WeightEstimationCollection)
+
+	// Records without a height or weight have no BMI to compute
+	filter := bson.M{
+		"bmi":    bson.M{"$exists": false},
+		"height": bson.M{"$gt": 0},
+		"weight": bson.M{"$gt": 0},
+	}
+	cursor, err := collection.Find(ctx, filter, options.Find().SetProjection(bson.M{"height": 1, "weight": 1}))
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+
+	updated := 0
+	writes := make([]mongo.WriteModel, 0, bmiBackfillBatch)
+	flush := func() error {
+		if len(writes) == 0 {
+			return nil
+		}
+		result, err := collection.BulkWrite(ctx, writes, options.BulkWrite().SetOrdered(false))
+		if result != nil {
+			updated += int(result.ModifiedCount)
+		}
+		writes = writes[:0]
+		return err
+	}
+
+	for cursor.Next(ctx) {
+		var estimation WeightEstimation
+		if err := cursor.Decode(&estimation); err != nil {
+			return updated, err
+		}
+		estimation.setBMI()
+		// Matching on the missing BMI again leaves records updated meanwhile alone
+		writes = append(writes, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"_id": estimation.ID, "bmi": bson.M{"$exists": false}}).
+			SetUpdate(bson.M{"$set": bson.M{"bmi": estimation.BMI, "bmi_category": estimation.BMICategory}}))
+		if len(writes) == bmiBackfillBatch {
+			if err := flush(); err != nil {
+				return updated, err
+			}
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return updated, err
+	}
+	return updated, flush()
+}
+
+// BMICategoryFor returns the category of a BMI
+func BMICategoryFor(bmi float64) string {
+	switch {
+	case bmi < 18.5:
+		return BMIUnderweight
+	case bmi < 25:
+		return BMINormal
+	case bmi < 30:
+		return BMIOverweight
+	default:
+		return BMIObese
+	}
+}
+
+// IsBMICategory reports whether category is one of BMICategories
+func IsBMICategory(category string) bool {
+	for _, known := range BMICategories {
+		if category == known {
+			return true
+		}
+	}
+	return false
+}
+
+// WeightEstimationFilter narrows weight estimations to a user and a BMI
+// category. Empty fields are left off.
+type WeightEstimationFilter struct {
+	UserID        string
+	BMICategory   string
+	CreatedBefore time.Time // Zero matches any creation time
+}
+
+// query returns the MongoDB filter matching the set fields
+func (f WeightEstimationFilter) query() bson.M {
+	filter := userFilter(bson.M{}, f.UserID)
+	if f.BMICategory != "" {
+		filter["bmi_category"] = f.BMICategory
+	}
+	if !f.CreatedBefore.IsZero() {
+		filter["created_at"] = bson.M{"$lt": f.CreatedBefore}
+	}
+	return filter
+}
+
+// userFilter restricts a query to the estimations of userID. An empty userID
+// means authentication is disabled and matches every estimation.
+func userFilter(filter bson.M, userID string) bson.M {
+	if userID != "" {
+		filter["user_id"] = userID
+	}
+	return filter
+}
+
+// GetWeightEstimations retrieves the weight estimations matching filter from the database
+func GetWeightEstimations(filter WeightEstimationFilter, limit, offset int64) ([]*WeightEstimation, error) {
 	// Get the collection
-	collection := DB.Collection("weight_estimations")
+	collection := DB.Collection(WeightEstimationCollection)
 
 	// Set up the query
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := opContext()
 	defer cancel()
 
 	findOptions := options.Find()
@@ -59,19 +260,382 @@ func GetWeightEstimations(limit int64) ([]*WeightEstimation, error) {
 	if limit > 0 {
 		findOptions.SetLimit(limit)
 	}
+	if offset > 0 {
+		findOptions.SetSkip(offset)
+	}
+
+	// Execute the query and decode the results
+	var results []*WeightEstimation
+	if err := findAll(ctx, collection, filter.query(), &results, findOptions); err != nil {
+		return nil, err
+	}
+
+	return results, nil
+}
+
+// ListWeightEstimationsAfter retrieves up to limit weight estimations
+// matching filter that follow the estimation with hex ID cursor, newest first
+// or, with ascending, oldest first. An empty cursor starts at the first
+// estimation. Paging by ID keeps pages stable while new estimations are inserted.
+func ListWeightEstimationsAfter(filter WeightEstimationFilter, cursor string, limit int64, ascending bool) ([]*WeightEstimation, error) {
+	query := filter.query()
+	if cursor != "" {
+		objectID, err := primitive.ObjectIDFromHex(cursor)
+		if err != nil {
+			return nil, ErrInvalidID
+		}
+		if ascending {
+			query["_id"] = bson.M{"$gt": objectID}
+		} else {
+			query["_id"] = bson.M{"$lt": objectID}
+		}
+	}
+
+	collection := DB.Collection(WeightEstimationCollection)
+
+	ctx, cancel := opContext()
+	defer cancel()
+
+	// ObjectIDs grow with their creation time, so they order like created_at
+	order := -1
+	if ascending {
+		order = 1
+	}
+	findOptions := options.Find().SetSort(bson.D{{Key: "_id", Value: order}})
+	if limit > 0 {
+		findOptions.SetLimit(limit)
+	}
+
+	results := []*WeightEstimation{}
+	if err := findAll(ctx, collection, query, &results, findOptions); err != nil {
+		return nil, err
+	}
+
+	return results, nil
+}
+
+// CountWeightEstimations returns the total number of weight estimations matching filter
+func CountWeightEstimations(filter WeightEstimationFilter) (int64, error) {
+	collection := DB.Collection(WeightEstimationCollection)
 
-	// Execute the query
-	cursor, err := collection.Find(ctx, bson.M{}, findOptions)
+	ctx, cancel := opContext()
+	defer cancel()
+
+	return countDocuments(ctx, collection, filter.query())
+}
+
+// GetWeightEstimationByID retrieves a weight estimation of userID by its hex
+// ObjectID. Other users' estimations are reported as mongo.ErrNoDocuments.
+func GetWeightEstimationByID(id, userID string) (*WeightEstimation, error) {
+	objectID, err := primitive.ObjectIDFromHex(id)
 	if err != nil {
+		return nil, ErrInvalidID
+	}
+
+	// Get the collection
+	collection := DB.Collection(WeightEstimationCollection)
+
+	ctx, cancel := opContext()
+	defer cancel()
+
+	var estimation WeightEstimation
+	if err := findOne(ctx, collection, userFilter(bson.M{"_id": objectID}, userID), &estimation); err != nil {
 		return nil, err
 	}
-	defer cursor.Close(ctx)
 
-	// Decode the results
-	var results []*WeightEstimation
-	if err := cursor.All(ctx, &results); err != nil {
+	return &estimation, nil
+}
+
+// GetEstimationHistory retrieves the weight estimations of userID created in
+// [from, to), oldest first. A zero from or to leaves that end open.
+func GetEstimationHistory(userID string, from, to time.Time) ([]*WeightEstimation, error) {
+	collection := DB.Collection(WeightEstimationCollection)
+
+	ctx, cancel := opContext()
+	defer cancel()
+
+	createdAt := bson.M{}
+	if !from.IsZero() {
+		createdAt["$gte"] = from
+	}
+	if !to.IsZero() {
+		createdAt["$lt"] = to
+	}
+	filter := userFilter(bson.M{}, userID)
+	if len(createdAt) > 0 {
+		filter["created_at"] = createdAt
+	}
+
+	findOptions := options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}})
+
+	// An empty history is an empty series, not null
+	results := []*WeightEstimation{}
+	if err := findAll(ctx, collection, filter, &results, findOptions); err != nil {
 		return nil, err
 	}
 
 	return results, nil
 }
+
+// FindRecentDuplicate returns the latest estimation of userID created since
+// since for the same images and height, or nil when there is none
+func FindRecentDuplicate(userID, imageHash string, height float64, since time.Time) (*WeightEstimation, error) {
+	collection := DB.Collection(WeightEstimationCollection)
+
+	ctx, cancel := opContext()
+	defer cancel()
+
+	filter := userFilter(bson.M{
+		"image_hash": imageHash,
+		"height":     height,
+		"created_at": bson.M{"$gte": since},
+	}, userID)
+	findOptions := options.FindOne().SetSort(bson.D{{Key: "created_at", Value: -1}})
+
+	var estimation WeightEstimation
+	err := findOne(ctx, collection, filter, &estimation, findOptions)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &estimation, nil
+}
+
+// DeleteEstimationsBefore removes every weight estimation created before t.
+// It returns how many were deleted and the image paths of the deleted records,
+// so their files can be removed. Only the records found by the lookup are
+// deleted, so one created meanwhile doesn't lose its record but keep its files.
+func DeleteEstimationsBefore(t time.Time) ([]string, int64, error) {
+	collection := DB.Collection(WeightEstimationCollection)
+
+	ctx, cancel := longOpContext()
+	defer cancel()
+
+	// Only the lookup is retried; the delete is a write
+	findOptions := options.Find().SetProjection(bson.M{"front_img_path": 1, "side_img_path": 1, "side_images": 1})
+	var estimations []*WeightEstimation
+	if err := findAll(ctx, collection, WeightEstimationFilter{CreatedBefore: t}.query(), &estimations, findOptions); err != nil {
+		return nil, 0, err
+	}
+	if len(estimations) == 0 {
+		return nil, 0, nil
+	}
+
+	ids := make([]primitive.ObjectID, len(estimations))
+	for i, estimation := range estimations {
+		ids[i] = estimation.ID
+	}
+	result, err := collection.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": ids}})
+	if err != nil {
+		return nil, 0, err
+	}
+	return estimationImagePaths(estimations), result.DeletedCount, nil
+}
+
+// estimationImagePaths lists the front and side image paths of estimations
+func estimationImagePaths(estimations []*WeightEstimation) []string {
+	paths := make([]string, 0, 2*len(estimations))
+	for _, estimation := range estimations {
+		paths = append(paths, estimation.FrontImgPath)
+		for _, side := range estimation.Sides() {
+			paths = append(paths, side.Path)
+		}
+	}
+	return paths
+}
+
+// WeightPercentile returns the percentile (0-100) of weightKg among stored
+// estimations within percentileHeightBandCM of heightCm. Ties count as half.
+// It returns ErrTooFewSamples while the band holds too few estimations.
+func WeightPercentile(heightCm, weightKg float64) (float64, error) {
+	collection := DB.Collection(WeightEstimationCollection)
+
+	ctx, cancel := opContext()
+	defer cancel()
+
+	// Degraded estimates are guesses and would skew the distribution
+	band := bson.M{
+		"height":   bson.M{"$gte": heightCm - percentileHeightBandCM, "$lte": heightCm + percentileHeightBandCM},
+		"degraded": bson.M{"$ne": true},
+	}
+
+	total, err := countDocuments(ctx, collection, band)
+	if err != nil {
+		return 0, err
+	}
+	if total < minPercentileSamples {
+		return 0, ErrTooFewSamples
+	}
+
+	below, err := countDocuments(ctx, collection, withWeight(band, bson.M{"$lt": weightKg}))
+	if err != nil {
+		return 0, err
+	}
+	equal, err := countDocuments(ctx, collection, withWeight(band, weightKg))
+	if err != nil {
+		return 0, err
+	}
+
+	return (float64(below) + float64(equal)/2) / float64(total) * 100, nil
+}
+
+// AccuracyReport summarizes how far predicted weights are from the measured ones
+type AccuracyReport struct {
+	Samples int64            `json:"samples"`
+	MAE     float64          `json:"mae"`  // Mean absolute error in kg
+	RMSE    float64          `json:"rmse"` // Root mean squared error in kg
+	Weekly  []WeeklyAccuracy `json:"weekly"`
+}
+
+// WeeklyAccuracy is the prediction error of the estimations of one ISO week
+type WeeklyAccuracy struct {
+	Week    string  `json:"week"` // ISO week, e.g. 2024-W05
+	Samples int64   `json:"samples"`
+	MAE     float64 `json:"mae"`
+	RMSE    float64 `json:"rmse"`
+}
+
+// errorTotals are the summed errors of a group of labeled estimations
+type errorTotals struct {
+	Week            string  `bson:"_id"`
+	Samples         int64   `bson:"samples"`
+	AbsErrorSum     float64 `bson:"abs_error_sum"`
+	SquaredErrorSum float64 `bson:"squared_error_sum"`
+}
+
+// meanErrors returns the MAE and RMSE of the totals
+func (t errorTotals) meanErrors() (float64, float64) {
+	if t.Samples == 0 {
+		return 0, 0
+	}
+	n := float64(t.Samples)
+	return t.AbsErrorSum / n, math.Sqrt(t.SquaredErrorSum / n)
+}
+
+// GetModelAccuracy compares predicted and actual weights of the estimations
+// created in [from, to) that have an actual weight, overall and per ISO week.
+// A zero from or to leaves that end open. Without labeled estimations the
+// report is zeroed.
+func GetModelAccuracy(from, to time.Time) (*AccuracyReport, error) {
+	collection := DB.Collection(WeightEstimationCollection)
+
+	ctx, cancel := longOpContext()
+	defer cancel()
+
+	// Degraded estimates didn't come from the model
+	match := bson.M{
+		"actual_weight": bson.M{"$type": "number"},
+		"degraded":      bson.M{"$ne": true},
+	}
+	createdAt := bson.M{}
+	if !from.IsZero() {
+		createdAt["$gte"] = from
+	}
+	if !to.IsZero() {
+		createdAt["$lt"] = to
+	}
+	if len(createdAt) > 0 {
+		match["created_at"] = createdAt
+	}
+
+	sums := bson.M{
+		"samples":           bson.M{"$sum": 1},
+		"abs_error_sum":     bson.M{"$sum": bson.M{"$abs": "$error"}},
+		"squared_error_sum": bson.M{"$sum": bson.M{"$multiply": bson.A{"$error", "$error"}}},
+	}
+	withID := func(id interface{}) bson.M {
+		group := bson.M{"_id": id}
+		for key, value := range sums {
+			group[key] = value
+		}
+		return group
+	}
+
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: match}},
+		{{Key: "$addFields", Value: bson.M{
+			"error": bson.M{"$subtract": bson.A{"$weight", "$actual_weight"}},
+			"week":  bson.M{"$dateToString": bson.M{"format": "%G-W%V", "date": "$created_at"}},
+		}}},
+		{{Key: "$facet", Value: bson.M{
+			"overall": bson.A{bson.M{"$group": withID(nil)}},
+			"weekly": bson.A{
+				bson.M{"$group": withID("$week")},
+				bson.M{"$sort": bson.M{"_id": 1}},
+			},
+		}}},
+	}
+
+	var facets []struct {
+		Overall []errorTotals `bson:"overall"`
+		Weekly  []errorTotals `bson:"weekly"`
+	}
+	if err := aggregateAll(ctx, collection, pipeline, &facets); err != nil {
+		return nil, err
+	}
+
+	report := &AccuracyReport{Weekly: []WeeklyAccuracy{}}
+	if len(facets) == 0 {
+		return report, nil
+	}
+	if len(facets[0].Overall) > 0 {
+		overall := facets[0].Overall[0]
+		report.Samples = overall.Samples
+		report.MAE, report.RMSE = overall.meanErrors()
+	}
+	for _, totals := range facets[0].Weekly {
+		week := WeeklyAccuracy{Week: totals.Week, Samples: totals.Samples}
+		week.MAE, week.RMSE = totals.meanErrors()
+		report.Weekly = append(report.Weekly, week)
+	}
+
+	return report, nil
+}
+
+// UpdateWeightEstimationPrediction replaces the prediction of an estimation
+// with a newer one, including its model version and whether it is degraded,
+// and marks it as reprocessed
+func UpdateWeightEstimationPrediction(estimation *WeightEstimation) error {
+	collection := DB.Collection(WeightEstimationCollection)
+
+	ctx, cancel := opContext()
+	defer cancel()
+
+	now := time.Now()
+	estimation.ReprocessedAt = &now
+	estimation.setBMI()
+
+	update := bson.M{
+		"$set": bson.M{
+			"weight":           estimation.Weight,
+			"bmi":              estimation.BMI,
+			"bmi_category":     estimation.BMICategory,
+			"predicted_height": estimation.PredictedHeight,
+			"measurements":     estimation.Measurements,
+			"model_version":    estimation.ModelVersion,
+			"inference_ms":     estimation.InferenceMs,
+			"prediction_mode":  estimation.PredictionMode,
+			"degraded":         estimation.Degraded,
+			"reprocessed_at":   now,
+		},
+	}
+	result, err := collection.UpdateByID(ctx, estimation.ID, update)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	return nil
+}
+
+// withWeight returns a copy of filter that also matches weight
+func withWeight(filter bson.M, weight interface{}) bson.M {
+	combined := bson.M{"weight": weight}
+	for key, value := range filter {
+		combined[key] = value
+	}
+	return combined
+}
@@ -0,0 +1,343 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lucasfepe/height-weight-api/internal/testutil"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/event"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestWeightPercentile(t *testing.T) {
+	testDatabase(t)
+
+	// 40 people of 175 cm weighing 60 to 99 kg, a kilogram apart
+	for weight := 60.0; weight < 100; weight++ {
+		seedWeightEstimations(t, &WeightEstimation{Height: 175, Weight: weight})
+	}
+	// Outside the height band, or degraded: none of these count
+	seedWeightEstimations(t,
+		&WeightEstimation{Height: 190, Weight: 50},
+		&WeightEstimation{Height: 160, Weight: 50},
+		&WeightEstimation{Height: 175, Weight: 50, Degraded: true},
+	)
+
+	tests := []struct {
+		name   string
+		height float64
+		weight float64
+		want   float64
+	}{
+		{"lightest of all", 175, 50, 0},
+		{"heaviest of all", 175, 120, 100},
+		{"tie counts as half", 175, 80, 51.25}, // 20 below, 1 equal, of 40
+		{"between samples", 175, 79.5, 50},
+		{"within the band", 179, 80, 51.25},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := WeightPercentile(tt.height, tt.weight)
+			if err != nil {
+				t.Fatalf("WeightPercentile: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("WeightPercentile(%v, %v) = %v, want %v", tt.height, tt.weight, got, tt.want)
+			}
+		})
+	}
+
+	if _, err := WeightPercentile(150, 60); !errors.Is(err, ErrTooFewSamples) {
+		t.Errorf("sparse band error = %v, want ErrTooFewSamples", err)
+	}
+}
+
+func TestBMICategoryFor(t *testing.T) {
+	tests := []struct {
+		bmi  float64
+		want string
+	}{
+		{12, BMIUnderweight},
+		{18.49, BMIUnderweight},
+		{18.5, BMINormal},
+		{24.99, BMINormal},
+		{25, BMIOverweight},
+		{29.99, BMIOverweight},
+		{30, BMIObese},
+		{45, BMIObese},
+	}
+	for _, tt := range tests {
+		if got := BMICategoryFor(tt.bmi); got != tt.want {
+			t.Errorf("BMICategoryFor(%v) = %q, want %q", tt.bmi, got, tt.want)
+		}
+	}
+
+	for _, category := range BMICategories {
+		if !IsBMICategory(category) {
+			t.Errorf("IsBMICategory(%q) = false, want true", category)
+		}
+	}
+	if IsBMICategory("Normal") {
+		t.Error(`IsBMICategory("Normal") = true, want categories matched exactly`)
+	}
+}
+
+// pageWeights pages through the weight estimations limit at a time, calling
+// between after each page, and returns the weights in the order listed
+func pageWeights(t *testing.T, limit int64, ascending bool, between func()) []float64 {
+	t.Helper()
+	var weights []float64
+	cursor := ""
+	for {
+		page, err := ListWeightEstimationsAfter(WeightEstimationFilter{}, cursor, limit, ascending)
+		if err != nil {
+			t.Fatalf("ListWeightEstimationsAfter(%q): %v", cursor, err)
+		}
+		if len(page) == 0 {
+			return weights
+		}
+		for _, estimation := range page {
+			weights = append(weights, estimation.Weight)
+		}
+		cursor = page[len(page)-1].ID.Hex()
+		between()
+	}
+}
+
+func TestListWeightEstimationsAfter(t *testing.T) {
+	testDatabase(t)
+
+	// Weights 1 to 10 mark the insertion order
+	for weight := 1.0; weight <= 10; weight++ {
+		seedWeightEstimations(t, &WeightEstimation{Height: 175, Weight: weight})
+	}
+
+	// Estimations inserted while paging oldest first come after the cursor
+	// and are listed once, at the end
+	next := 11.0
+	insert := func() {
+		if next <= 14 {
+			seedWeightEstimations(t, &WeightEstimation{Height: 175, Weight: next})
+			next++
+		}
+	}
+	ascending := pageWeights(t, 3, true, insert)
+	var want []float64
+	for weight := 1.0; weight < next; weight++ {
+		want = append(want, weight)
+	}
+	if !slices.Equal(ascending, want) {
+		t.Errorf("ascending pages = %v, want %v", ascending, want)
+	}
+
+	// Newest first, later insertions are ahead of the cursor and never show up
+	total := next - 1
+	descending := pageWeights(t, 4, false, func() {
+		seedWeightEstimations(t, &WeightEstimation{Height: 175, Weight: 100 + next})
+		next++
+	})
+	want = want[:0]
+	for weight := total; weight >= 1; weight-- {
+		want = append(want, weight)
+	}
+	if !slices.Equal(descending, want) {
+		t.Errorf("descending pages = %v, want %v", descending, want)
+	}
+
+	if _, err := ListWeightEstimationsAfter(WeightEstimationFilter{}, "not-an-id", 3, false); !errors.Is(err, ErrInvalidID) {
+		t.Errorf("invalid cursor error = %v, want %v", err, ErrInvalidID)
+	}
+}
+
+func TestRecomputeMissingBMI(t *testing.T) {
+	testDatabase(t)
+	collection := DB.Collection(WeightEstimationCollection)
+
+	// Records saved before BMI was stored, inserted as they were
+	legacy := []struct {
+		height, weight float64
+		wantBMI        float64
+		wantCategory   string
+	}{
+		{200, 100, 25, BMIOverweight},
+		{160, 40.96, 16, BMIUnderweight},
+		{175, 0, 0, ""}, // No weight, so nothing to compute
+	}
+	ids := make([]primitive.ObjectID, len(legacy))
+	for i, record := range legacy {
+		ids[i] = primitive.NewObjectID()
+		doc := bson.M{"_id": ids[i], "height": record.height, "weight": record.weight, "created_at": time.Now()}
+		if _, err := collection.InsertOne(context.Background(), doc); err != nil {
+			t.Fatalf("insert legacy record: %v", err)
+		}
+	}
+	seedWeightEstimations(t, &WeightEstimation{Height: 180, Weight: 81})
+
+	updated, err := RecomputeMissingBMI(context.Background())
+	if err != nil {
+		t.Fatalf("RecomputeMissingBMI: %v", err)
+	}
+	if updated != 2 {
+		t.Errorf("updated %d estimations, want 2", updated)
+	}
+
+	for i, record := range legacy {
+		estimation, err := GetWeightEstimationByID(ids[i].Hex(), "")
+		if err != nil {
+			t.Fatalf("GetWeightEstimationByID: %v", err)
+		}
+		if math.Abs(estimation.BMI-record.wantBMI) > 1e-9 || estimation.BMICategory != record.wantCategory {
+			t.Errorf("%v cm, %v kg: BMI %v %q, want %v %q", record.height, record.weight, estimation.BMI, estimation.BMICategory, record.wantBMI, record.wantCategory)
+		}
+	}
+
+	// Only what is still missing is picked up again
+	if updated, err := RecomputeMissingBMI(context.Background()); err != nil || updated != 0 {
+		t.Errorf("second run updated %d (%v), want 0", updated, err)
+	}
+}
+
+func TestEstimationImagePaths(t *testing.T) {
+	estimations := []*WeightEstimation{
+		{FrontImgPath: "a_front.png", SideImgPath: "a_side.png"},
+		{FrontImgPath: "b_front.png", SideImgPath: "b_left.png", SideImages: []SideImage{
+			{View: "side_left", Path: "b_left.png"},
+			{View: "side_right", Path: "b_right.png"},
+		}},
+		{}, // Images not kept
+	}
+	want := []string{"a_front.png", "a_side.png", "b_front.png", "b_left.png", "b_right.png", "", ""}
+	if got := estimationImagePaths(estimations); !slices.Equal(got, want) {
+		t.Errorf("estimationImagePaths = %q, want %q", got, want)
+	}
+}
+
+// mockDB points DB at the mocked deployment of mt for the rest of the test
+func mockDB(mt *mtest.T) {
+	DB = mt.DB
+	mt.Cleanup(func() { DB = nil })
+}
+
+// commandValue returns the value at the dotted path of the command started
+// by event, e.g. "deletes.0.q"
+func commandValue(t *testing.T, event *event.CommandStartedEvent, path string) bson.RawValue {
+	t.Helper()
+	if event == nil {
+		t.Fatalf("no command started to read %s from", path)
+	}
+	value, err := event.Command.LookupErr(strings.Split(path, ".")...)
+	if err != nil {
+		t.Fatalf("%s command lacks %s: %v", event.CommandName, path, err)
+	}
+	return value
+}
+
+func TestDeleteEstimationsBeforeMocked(t *testing.T) {
+	testutil.MockDatabase(t, func(mt *mtest.T) {
+		mockDB(mt)
+		cutoff := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+		first, second := primitive.NewObjectID(), primitive.NewObjectID()
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, "test.weight_estimations", mtest.FirstBatch,
+				bson.D{{Key: "_id", Value: first}, {Key: "front_img_path", Value: "a_front.png"}, {Key: "side_img_path", Value: "a_side.png"}},
+				bson.D{{Key: "_id", Value: second}, {Key: "front_img_path", Value: "b_front.png"}, {Key: "side_img_path", Value: "b_side.png"}}),
+			// One of the two was removed by someone else in between
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}),
+		)
+
+		paths, deleted, err := DeleteEstimationsBefore(cutoff)
+		if err != nil {
+			mt.Fatalf("DeleteEstimationsBefore: %v", err)
+		}
+		if deleted != 1 {
+			mt.Errorf("deleted = %d, want the 1 the delete reported", deleted)
+		}
+		if want := []string{"a_front.png", "a_side.png", "b_front.png", "b_side.png"}; !slices.Equal(paths, want) {
+			mt.Errorf("paths = %q, want %q", paths, want)
+		}
+
+		find := mt.GetStartedEvent()
+		if got := commandValue(mt.T, find, "filter.created_at.$lt").Time(); !got.Equal(cutoff) {
+			mt.Errorf("lookup created_at bound = %v, want %v", got, cutoff)
+		}
+		// The delete is bounded by what the lookup found, not the date
+		del := mt.GetStartedEvent()
+		ids, err := commandValue(mt.T, del, "deletes.0.q._id.$in").Array().Values()
+		if err != nil || len(ids) != 2 || ids[0].ObjectID() != first || ids[1].ObjectID() != second {
+			mt.Errorf("delete filter = %s, want the _ids %s and %s", commandValue(mt.T, del, "deletes.0.q"), first.Hex(), second.Hex())
+		}
+	})
+}
+
+func TestDeleteEstimationsBeforeNothingFound(t *testing.T) {
+	testutil.MockDatabase(t, func(mt *mtest.T) {
+		mockDB(mt)
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "test.weight_estimations", mtest.FirstBatch))
+
+		paths, deleted, err := DeleteEstimationsBefore(time.Now())
+		if err != nil || deleted != 0 || len(paths) != 0 {
+			mt.Errorf("DeleteEstimationsBefore = %q, %d, %v, want nothing deleted", paths, deleted, err)
+		}
+		mt.GetStartedEvent() // The lookup
+		if event := mt.GetStartedEvent(); event != nil {
+			mt.Errorf("ran %s after finding nothing, want no delete", event.CommandName)
+		}
+	})
+}
+
+func TestRecomputeMissingBMIMocked(t *testing.T) {
+	testutil.MockDatabase(t, func(mt *mtest.T) {
+		mockDB(mt)
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, "test.weight_estimations", mtest.FirstBatch,
+				bson.D{{Key: "_id", Value: primitive.NewObjectID()}, {Key: "height", Value: 200.0}, {Key: "weight", Value: 100.0}},
+				bson.D{{Key: "_id", Value: primitive.NewObjectID()}, {Key: "height", Value: 160.0}, {Key: "weight", Value: 40.96}}),
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 2}, bson.E{Key: "nModified", Value: 2}),
+		)
+
+		updated, err := RecomputeMissingBMI(context.Background())
+		if err != nil {
+			mt.Fatalf("RecomputeMissingBMI: %v", err)
+		}
+		if updated != 2 {
+			mt.Errorf("updated = %d, want 2", updated)
+		}
+
+		// Only records with a height and weight but no BMI are looked up
+		find := mt.GetStartedEvent()
+		if exists, ok := commandValue(mt.T, find, "filter.bmi.$exists").BooleanOK(); !ok || exists {
+			mt.Errorf("lookup filter = %s, want bmi missing", commandValue(mt.T, find, "filter"))
+		}
+		for _, field := range []string{"height", "weight"} {
+			if _, err := find.Command.LookupErr("filter", field, "$gt"); err != nil {
+				mt.Errorf("lookup filter = %s, want a positive %s", commandValue(mt.T, find, "filter"), field)
+			}
+		}
+
+		update := mt.GetStartedEvent()
+		want := []struct {
+			bmi      float64
+			category string
+		}{{25, BMIOverweight}, {16, BMIUnderweight}}
+		for i, w := range want {
+			set := fmt.Sprintf("updates.%d.u.$set", i)
+			bmi := commandValue(mt.T, update, set+".bmi").Double()
+			category := commandValue(mt.T, update, set+".bmi_category").StringValue()
+			if math.Abs(bmi-w.bmi) > 1e-9 || category != w.category {
+				mt.Errorf("update %d sets BMI %v %q, want %v %q", i, bmi, category, w.bmi, w.category)
+			}
+			// Records given a BMI meanwhile are left alone
+			if _, err := update.Command.LookupErr("updates", fmt.Sprint(i), "q", "bmi", "$exists"); err != nil {
+				mt.Errorf("update %d filter = %s, want bmi missing", i, commandValue(mt.T, update, fmt.Sprintf("updates.%d.q", i)))
+			}
+		}
+	})
+}
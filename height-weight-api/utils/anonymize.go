@@ -0,0 +1,107 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"math"
+)
+
+// faceMargin widens detected face boxes by this fraction on each side, since
+// detectors tend to crop tightly around the facial features
+const faceMargin = 0.15
+
+// BlurRegions Gaussian-blurs the given regions of an image, e.g. detected
+// faces, and returns it re-encoded in its original format (PNG, otherwise
+// JPEG). Without regions the image is returned unchanged.
+func BlurRegions(data []byte, regions []image.Rectangle) ([]byte, error) {
+	if len(regions) == 0 {
+		return data, nil
+	}
+
+	img, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image: %w", err)
+	}
+
+	bounds := img.Bounds()
+	canvas := image.NewRGBA(bounds)
+	draw.Draw(canvas, bounds, img, bounds.Min, draw.Src)
+
+	for _, region := range regions {
+		dx := int(float64(region.Dx()) * faceMargin)
+		dy := int(float64(region.Dy()) * faceMargin)
+		region = region.Inset(-max(dx, dy)).Intersect(bounds)
+		if region.Empty() {
+			continue
+		}
+		// Scale the blur with the face so small and large faces are equally unrecognizable
+		sigma := math.Max(float64(max(region.Dx(), region.Dy()))/6, 2)
+		gaussianBlur(canvas, region, sigma)
+	}
+
+	var buf bytes.Buffer
+	if format == "png" {
+		err = png.Encode(&buf, canvas)
+	} else {
+		err = jpeg.Encode(&buf, canvas, &jpeg.Options{Quality: jpegQuality})
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode image: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// gaussianBlur blurs rect of img in place with two separable passes. Samples
+// outside rect are clamped to its edge so the blur stays within the region.
+func gaussianBlur(img *image.RGBA, rect image.Rectangle, sigma float64) {
+	radius := int(math.Ceil(3 * sigma))
+	kernel := make([]float64, 2*radius+1)
+	var sum float64
+	for i := range kernel {
+		x := float64(i - radius)
+		kernel[i] = math.Exp(-x * x / (2 * sigma * sigma))
+		sum += kernel[i]
+	}
+	for i := range kernel {
+		kernel[i] /= sum
+	}
+
+	width, height := rect.Dx(), rect.Dy()
+	clamp := func(v, hi int) int { return min(max(v, 0), hi-1) }
+
+	// Horizontal pass into a buffer of the region, four channels per pixel
+	horizontal := make([]float64, width*height*4)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			var acc [4]float64
+			for k, weight := range kernel {
+				offset := img.PixOffset(rect.Min.X+clamp(x+k-radius, width), rect.Min.Y+y)
+				for c := 0; c < 4; c++ {
+					acc[c] += weight * float64(img.Pix[offset+c])
+				}
+			}
+			copy(horizontal[(y*width+x)*4:], acc[:])
+		}
+	}
+
+	// Vertical pass back into the image
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			var acc [4]float64
+			for k, weight := range kernel {
+				i := (clamp(y+k-radius, height)*width + x) * 4
+				for c := 0; c < 4; c++ {
+					acc[c] += weight * horizontal[i+c]
+				}
+			}
+			offset := img.PixOffset(rect.Min.X+x, rect.Min.Y+y)
+			for c := 0; c < 4; c++ {
+				img.Pix[offset+c] = uint8(math.Round(math.Min(acc[c], 255)))
+			}
+		}
+	}
+}
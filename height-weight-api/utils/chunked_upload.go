@@ -0,0 +1,213 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ChunkedKeyPrefix starts the image keys of completed chunked uploads
+const ChunkedKeyPrefix = "chunked/"
+
+// Chunked upload errors
+var (
+	ErrUploadNotFound   = errors.New("upload not found")
+	ErrUploadCompleted  = errors.New("upload already completed")
+	ErrUploadIncomplete = errors.New("upload incomplete")
+	ErrUploadTooLarge   = errors.New("upload exceeds the maximum size")
+)
+
+// RangeMismatchError is returned when a chunk doesn't start where the data
+// received so far ends. Received tells the client where to resume.
+type RangeMismatchError struct {
+	Received int64
+}
+
+// Error implements error
+func (e *RangeMismatchError) Error() string {
+	return fmt.Sprintf("chunk must start at byte %d", e.Received)
+}
+
+// ChunkedUpload is the state of an upload sent in several requests
+type ChunkedUpload struct {
+	ID        string    `json:"upload_id"`
+	Received  int64     `json:"received"`        // Bytes stored so far
+	Total     int64     `json:"total,omitempty"` // Declared size, 0 until a chunk states it
+	Completed bool      `json:"completed"`       // Set once finalized, after which it is read only
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// chunkedUploadEntry is a stored upload. Its lock serializes the writes of
+// concurrent chunks.
+type chunkedUploadEntry struct {
+	ChunkedUpload
+	owner string
+	path  string
+	mu    sync.Mutex
+}
+
+// ChunkedUploadStore assembles chunked uploads in files under dir and keeps
+// their state in memory, removing uploads and their files once they expire
+type ChunkedUploadStore struct {
+	mu      sync.Mutex
+	uploads map[string]*chunkedUploadEntry
+	dir     string
+	maxSize int64
+	ttl     time.Duration
+}
+
+// NewChunkedUploadStore creates a store assembling uploads of at most
+// maxSize bytes in dir, each expiring ttl after it was started
+func NewChunkedUploadStore(dir string, maxSize int64, ttl time.Duration) *ChunkedUploadStore {
+	return &ChunkedUploadStore{
+		uploads: make(map[string]*chunkedUploadEntry),
+		dir:     dir,
+		maxSize: maxSize,
+		ttl:     ttl,
+	}
+}
+
+// MaxSize returns the largest upload the store accepts, in bytes
+func (s *ChunkedUploadStore) MaxSize() int64 {
+	return s.maxSize
+}
+
+// Init starts an empty upload for owner
+func (s *ChunkedUploadStore) Init(owner string) (ChunkedUpload, error) {
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return ChunkedUpload{}, fmt.Errorf("failed to create upload directory: %w", err)
+	}
+
+	id := uuid.New().String()
+	upload := &chunkedUploadEntry{
+		ChunkedUpload: ChunkedUpload{ID: id, ExpiresAt: time.Now().Add(s.ttl)},
+		owner:         owner,
+		path:          filepath.Join(s.dir, id+".part"),
+	}
+	if err := os.WriteFile(upload.path, nil, 0644); err != nil {
+		return ChunkedUpload{}, fmt.Errorf("failed to create upload file: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.evictExpired()
+	s.uploads[id] = upload
+	return upload.ChunkedUpload, nil
+}
+
+// Append writes data at offset start of owner's upload. Chunks must arrive
+// in order: start has to equal the bytes received so far. total is the
+// declared size of the whole upload, or 0 if the chunk doesn't state it.
+func (s *ChunkedUploadStore) Append(id, owner string, start, total int64, data []byte) (ChunkedUpload, error) {
+	upload, err := s.get(id, owner)
+	if err != nil {
+		return ChunkedUpload{}, err
+	}
+
+	upload.mu.Lock()
+	defer upload.mu.Unlock()
+
+	switch {
+	case upload.Completed:
+		return ChunkedUpload{}, ErrUploadCompleted
+	case start != upload.Received:
+		return ChunkedUpload{}, &RangeMismatchError{Received: upload.Received}
+	case total > s.maxSize || start+int64(len(data)) > s.maxSize:
+		return ChunkedUpload{}, ErrUploadTooLarge
+	case total > 0 && upload.Total > 0 && total != upload.Total:
+		return ChunkedUpload{}, fmt.Errorf("total size changed from %d to %d", upload.Total, total)
+	case total > 0 && start+int64(len(data)) > total:
+		return ChunkedUpload{}, fmt.Errorf("chunk ends past the declared total of %d bytes", total)
+	}
+
+	file, err := os.OpenFile(upload.path, os.O_WRONLY, 0644)
+	if err != nil {
+		return ChunkedUpload{}, fmt.Errorf("failed to open upload file: %w", err)
+	}
+	defer file.Close()
+
+	if _, err := file.WriteAt(data, start); err != nil {
+		// Drop a partly written chunk so the client can resend it
+		file.Truncate(start)
+		return ChunkedUpload{}, fmt.Errorf("failed to write chunk: %w", err)
+	}
+
+	upload.Received += int64(len(data))
+	if total > 0 {
+		upload.Total = total
+	}
+	return upload.ChunkedUpload, nil
+}
+
+// Complete finalizes owner's upload and returns the image key to reference
+// it by. It fails with ErrUploadIncomplete while bytes of a declared total
+// are missing.
+func (s *ChunkedUploadStore) Complete(id, owner string) (string, ChunkedUpload, error) {
+	upload, err := s.get(id, owner)
+	if err != nil {
+		return "", ChunkedUpload{}, err
+	}
+
+	upload.mu.Lock()
+	defer upload.mu.Unlock()
+
+	if upload.Received == 0 || (upload.Total > 0 && upload.Received != upload.Total) {
+		return "", ChunkedUpload{}, ErrUploadIncomplete
+	}
+	upload.Completed = true
+	return ChunkedKeyPrefix + upload.ID, upload.ChunkedUpload, nil
+}
+
+// Read returns the data of owner's completed upload with the given key
+func (s *ChunkedUploadStore) Read(key, owner string) ([]byte, error) {
+	id, ok := strings.CutPrefix(key, ChunkedKeyPrefix)
+	if !ok {
+		return nil, ErrUploadNotFound
+	}
+	upload, err := s.get(id, owner)
+	if err != nil {
+		return nil, err
+	}
+
+	upload.mu.Lock()
+	defer upload.mu.Unlock()
+
+	if !upload.Completed {
+		return nil, ErrUploadIncomplete
+	}
+	return os.ReadFile(upload.path)
+}
+
+// get returns the unexpired upload id of owner. Other owners' uploads are
+// reported as not found.
+func (s *ChunkedUploadStore) get(id, owner string) (*chunkedUploadEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	upload, ok := s.uploads[id]
+	if !ok || upload.owner != owner || time.Now().After(upload.ExpiresAt) {
+		return nil, ErrUploadNotFound
+	}
+	return upload, nil
+}
+
+// evictExpired drops expired uploads and their files. The caller must hold the lock.
+func (s *ChunkedUploadStore) evictExpired() {
+	now := time.Now()
+	for id, upload := range s.uploads {
+		if now.After(upload.ExpiresAt) {
+			delete(s.uploads, id)
+			if err := os.Remove(upload.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+				log.Printf("Warning: Failed to remove expired upload %s: %v", upload.path, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package utils
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned when the ML service circuit breaker is rejecting calls
+var ErrCircuitOpen = errors.New("ML service unavailable: circuit breaker open")
+
+// Circuit breaker states
+const (
+	CircuitClosed   = "closed"
+	CircuitOpen     = "open"
+	CircuitHalfOpen = "half-open"
+)
+
+// CircuitBreaker fast-fails calls to a dependency after repeated failures.
+// After maxFailures consecutive failures it opens for the cooldown period,
+// then half-opens to let a single probe call through.
+type CircuitBreaker struct {
+	mu          sync.Mutex
+	state       string
+	failures    int
+	maxFailures int
+	cooldown    time.Duration
+	openedAt    time.Time
+	probing     bool
+}
+
+// NewCircuitBreaker creates a closed circuit breaker
+func NewCircuitBreaker(maxFailures int, cooldown time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{
+		state:       CircuitClosed,
+		maxFailures: maxFailures,
+		cooldown:    cooldown,
+	}
+}
+
+// Allow reports whether a call may proceed, returning ErrCircuitOpen if not.
+// Every allowed call must be followed by RecordSuccess, RecordFailure or
+// Release.
+func (cb *CircuitBreaker) Allow() error {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	switch cb.state {
+	case CircuitOpen:
+		if time.Since(cb.openedAt) < cb.cooldown {
+			return ErrCircuitOpen
+		}
+		cb.state = CircuitHalfOpen
+		cb.probing = true
+		return nil
+	case CircuitHalfOpen:
+		// Only one probe at a time while recovering
+		if cb.probing {
+			return ErrCircuitOpen
+		}
+		cb.probing = true
+		return nil
+	}
+	return nil
+}
+
+// RecordSuccess closes the breaker and resets the failure count
+func (cb *CircuitBreaker) RecordSuccess() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	cb.state = CircuitClosed
+	cb.failures = 0
+	cb.probing = false
+}
+
+// RecordFailure counts a failure, opening the breaker once the threshold is reached
+func (cb *CircuitBreaker) RecordFailure() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	cb.failures++
+	cb.probing = false
+	if cb.state == CircuitHalfOpen || cb.failures >= cb.maxFailures {
+		cb.state = CircuitOpen
+		cb.openedAt = time.Now()
+	}
+}
+
+// Release ends an allowed call without counting it either way, e.g. one the
+// caller cancelled, which says nothing about the dependency. A half-open
+// breaker lets the next call probe instead.
+func (cb *CircuitBreaker) Release() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	cb.probing = false
+}
+
+// State returns the current breaker state
+func (cb *CircuitBreaker) State() string {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if cb.state == CircuitOpen && time.Since(cb.openedAt) >= cb.cooldown {
+		return CircuitHalfOpen
+	}
+	return cb.state
+}
+
+// RecordStatus records an HTTP response from the dependency. Server errors
+// count as failures, anything else means the service is up.
+func (cb *CircuitBreaker) RecordStatus(statusCode int) {
+	if statusCode >= http.StatusInternalServerError {
+		cb.RecordFailure()
+		return
+	}
+	cb.RecordSuccess()
+}
@@ -0,0 +1,184 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lucasfepe/height-weight-api/internal/testutil"
+)
+
+func TestCircuitBreakerTransitions(t *testing.T) {
+	const cooldown = 20 * time.Millisecond
+	cb := NewCircuitBreaker(3, cooldown)
+
+	expect := func(step, want string) {
+		t.Helper()
+		if got := cb.State(); got != want {
+			t.Fatalf("%s: state = %s, want %s", step, got, want)
+		}
+	}
+
+	// Failures below the threshold keep it closed, and a success resets the count
+	cb.RecordFailure()
+	cb.RecordFailure()
+	cb.RecordSuccess()
+	cb.RecordFailure()
+	cb.RecordFailure()
+	expect("below threshold", CircuitClosed)
+
+	cb.RecordFailure()
+	expect("at threshold", CircuitOpen)
+	if err := cb.Allow(); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("Allow while open = %v, want ErrCircuitOpen", err)
+	}
+
+	time.Sleep(cooldown)
+	expect("after cooldown", CircuitHalfOpen)
+	if err := cb.Allow(); err != nil {
+		t.Fatalf("Allow for the probe = %v, want nil", err)
+	}
+	if err := cb.Allow(); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("Allow during the probe = %v, want ErrCircuitOpen", err)
+	}
+
+	// A failed probe reopens it straight away
+	cb.RecordFailure()
+	expect("failed probe", CircuitOpen)
+
+	time.Sleep(cooldown)
+	if err := cb.Allow(); err != nil {
+		t.Fatalf("Allow for the second probe = %v, want nil", err)
+	}
+	cb.RecordSuccess()
+	expect("successful probe", CircuitClosed)
+	if err := cb.Allow(); err != nil {
+		t.Errorf("Allow once closed = %v, want nil", err)
+	}
+}
+
+func TestMLClientCircuitBreaker(t *testing.T) {
+	const cooldown = 30 * time.Millisecond
+	breaker := NewCircuitBreaker(2, cooldown)
+
+	var healthy atomic.Bool
+	var calls atomic.Int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if !healthy.Load() {
+			http.Error(w, "down", http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(`{"weight": 70}`))
+	}))
+	defer server.Close()
+	client := NewMLClient(server.URL, time.Second, 0, 0, MLAuth{}, nil, breaker)
+
+	predict := func() error {
+		_, err := client.PredictWeight(context.Background(), strings.NewReader("front"), testSides(), 175)
+		return err
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := predict(); err == nil || errors.Is(err, ErrCircuitOpen) {
+			t.Fatalf("call %d error = %v, want the server error", i+1, err)
+		}
+	}
+	if state := client.CircuitState(); state != CircuitOpen {
+		t.Fatalf("state after failures = %s, want %s", state, CircuitOpen)
+	}
+
+	// While open, calls fail fast without reaching the service
+	if err := predict(); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("call while open error = %v, want ErrCircuitOpen", err)
+	}
+	if got := calls.Load(); got != 2 {
+		t.Fatalf("service reached %d times, want 2", got)
+	}
+
+	healthy.Store(true)
+	time.Sleep(cooldown)
+	if state := client.CircuitState(); state != CircuitHalfOpen {
+		t.Fatalf("state after cooldown = %s, want %s", state, CircuitHalfOpen)
+	}
+	if err := predict(); err != nil {
+		t.Fatalf("probe call: %v", err)
+	}
+	if state := client.CircuitState(); state != CircuitClosed {
+		t.Errorf("state after recovery = %s, want %s", state, CircuitClosed)
+	}
+}
+
+func TestMLClientsBreakerPerModel(t *testing.T) {
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+	healthy := newPredictServer(t, ModelResponse{Weight: 72})
+	cfg := testutil.Config(t, map[string]string{
+		"ML_MODELS":               "a=" + failing.URL + ",b=" + healthy.URL,
+		"ML_BREAKER_MAX_FAILURES": "1",
+		"ML_RETRIES":              "0",
+	})
+	clients := NewMLClientsFromConfig(cfg)
+
+	predict := func(model string) error {
+		t.Helper()
+		_, service, err := clients.Resolve(model)
+		if err != nil {
+			t.Fatalf("Resolve(%q): %v", model, err)
+		}
+		_, err = service.PredictWeight(context.Background(), strings.NewReader("front"), testSides(), 175)
+		return err
+	}
+
+	if err := predict("a"); err == nil {
+		t.Fatal("prediction by the failing model succeeded")
+	}
+	if err := predict("a"); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("failing model after its breaker opened: error = %v, want ErrCircuitOpen", err)
+	}
+	if err := predict("b"); err != nil {
+		t.Errorf("healthy model blocked by the failing one: %v", err)
+	}
+
+	want := map[string]string{"a": CircuitOpen, "b": CircuitClosed}
+	if states := clients.CircuitStates(); len(states) != len(want) || states["a"] != want["a"] || states["b"] != want["b"] {
+		t.Errorf("CircuitStates() = %v, want %v", states, want)
+	}
+}
+
+func TestMLClientCancelledProbeReleasesBreaker(t *testing.T) {
+	const cooldown = 20 * time.Millisecond
+	breaker := NewCircuitBreaker(1, cooldown)
+	breaker.Allow()
+	breaker.RecordFailure()
+	time.Sleep(cooldown)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The client gives up while the service is still working on the probe
+		io.Copy(io.Discard, r.Body)
+		cancel()
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+	client := NewMLClient(server.URL, time.Second, 0, 0, MLAuth{}, nil, breaker)
+
+	if _, err := client.PredictWeight(ctx, strings.NewReader("front"), testSides(), 175); !errors.Is(err, context.Canceled) {
+		t.Fatalf("cancelled probe error = %v, want context.Canceled", err)
+	}
+	if state := breaker.State(); state != CircuitHalfOpen {
+		t.Fatalf("state after cancelled probe = %s, want %s", state, CircuitHalfOpen)
+	}
+	// The probe slot is free again rather than stuck until a result arrives
+	if err := breaker.Allow(); err != nil {
+		t.Errorf("Allow after cancelled probe = %v, want nil", err)
+	}
+}
@@ -0,0 +1,69 @@
+package utils
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// photoPNG encodes a width by height PNG of a gradient with sensor-like
+// noise, which compresses far better as a JPEG than as a PNG, like a photo
+func photoPNG(t *testing.T, width, height int) []byte {
+	t.Helper()
+	rng := rand.New(rand.NewSource(1))
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			noise := rng.Intn(16)
+			img.Set(x, y, color.RGBA{R: uint8(x*200/width + noise), G: uint8(y*200/height + noise), B: 128, A: 255})
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatalf("encode PNG: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestCompressImage(t *testing.T) {
+	original := photoPNG(t, 400, 600)
+
+	tests := []struct {
+		name       string
+		maxDim     int
+		wantWidth  int
+		wantHeight int
+	}{
+		{"original size", 0, 400, 600},
+		{"within the limit", 800, 400, 600},
+		{"scaled down", 300, 200, 300},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			compressed, err := CompressImage(bytes.NewReader(original), tt.maxDim, 80)
+			if err != nil {
+				t.Fatalf("CompressImage: %v", err)
+			}
+			if len(compressed) >= len(original) {
+				t.Errorf("compressed to %d bytes, want fewer than the original %d", len(compressed), len(original))
+			}
+
+			img, err := jpeg.Decode(bytes.NewReader(compressed))
+			if err != nil {
+				t.Fatalf("compressed image is not a JPEG: %v", err)
+			}
+			if bounds := img.Bounds(); bounds.Dx() != tt.wantWidth || bounds.Dy() != tt.wantHeight {
+				t.Errorf("size = %dx%d, want %dx%d", bounds.Dx(), bounds.Dy(), tt.wantWidth, tt.wantHeight)
+			}
+		})
+	}
+
+	if _, err := CompressImage(strings.NewReader("not an image"), 0, 80); err == nil {
+		t.Error("compressed invalid image data, want an error")
+	}
+}
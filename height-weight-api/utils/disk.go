@@ -0,0 +1,30 @@
+//go:build unix
+
+package utils
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// DiskFree returns the bytes available to unprivileged users on the
+// filesystem holding path. A path that doesn't exist yet is measured at its
+// nearest existing parent, where it would be created.
+func DiskFree(path string) (uint64, error) {
+	path = filepath.Clean(path)
+	for {
+		var stat syscall.Statfs_t
+		err := syscall.Statfs(path, &stat)
+		if err == nil {
+			return uint64(stat.Bavail) * uint64(stat.Bsize), nil
+		}
+
+		parent := filepath.Dir(path)
+		if !errors.Is(err, os.ErrNotExist) || parent == path {
+			return 0, &os.PathError{Op: "statfs", Path: path, Err: err}
+		}
+		path = parent
+	}
+}
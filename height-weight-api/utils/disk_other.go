@@ -0,0 +1,10 @@
+//go:build !unix
+
+package utils
+
+import "errors"
+
+// DiskFree is only implemented on Unix systems
+func DiskFree(path string) (uint64, error) {
+	return 0, errors.New("disk space check not supported on this platform")
+}
@@ -0,0 +1,28 @@
+//go:build unix
+
+package utils
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestDiskFree(t *testing.T) {
+	dir := t.TempDir()
+	free, err := DiskFree(dir)
+	if err != nil {
+		t.Fatalf("DiskFree: %v", err)
+	}
+	if free == 0 {
+		t.Error("DiskFree = 0, want the free space of the temp directory's filesystem")
+	}
+
+	// An upload directory not created yet is measured where it would be created
+	missing, err := DiskFree(filepath.Join(dir, "uploads", "estimations"))
+	if err != nil {
+		t.Fatalf("DiskFree of a missing directory: %v", err)
+	}
+	if missing == 0 {
+		t.Error("DiskFree of a missing directory = 0, want its parent's free space")
+	}
+}
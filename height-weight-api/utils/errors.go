@@ -0,0 +1,43 @@
+package utils
+
+// Error codes returned in the error_code field of error responses. They are
+// part of the API contract: clients match on them, so never change a value.
+const (
+	ErrCodeInvalidRequest     = "INVALID_REQUEST"
+	ErrCodeRequestTooLarge    = "REQUEST_TOO_LARGE"
+	ErrCodeTooManyFiles       = "TOO_MANY_FILES"
+	ErrCodeInvalidHeight      = "INVALID_HEIGHT"
+	ErrCodeInvalidWeight      = "INVALID_WEIGHT"
+	ErrCodeInvalidID          = "INVALID_ID"
+	ErrCodeInvalidModel       = "INVALID_MODEL"
+	ErrCodeInvalidCallbackURL = "INVALID_CALLBACK_URL"
+	ErrCodeMissingImage       = "MISSING_IMAGE"
+	ErrCodeImageTooLarge      = "IMAGE_TOO_LARGE"
+	ErrCodeUnsupportedFormat  = "UNSUPPORTED_FORMAT"
+	ErrCodeUnsupportedMedia   = "UNSUPPORTED_MEDIA_TYPE"
+	ErrCodeInvalidImage       = "INVALID_IMAGE"
+	ErrCodeInvalidImageKey    = "INVALID_IMAGE_KEY"
+	ErrCodeIdenticalImages    = "IDENTICAL_IMAGES"
+	ErrCodeHeightMismatch     = "HEIGHT_MISMATCH"
+	ErrCodeNoPersonDetected   = "NO_PERSON_DETECTED"
+	ErrCodeLowImageQuality    = "LOW_IMAGE_QUALITY"
+	ErrCodeUnauthorized       = "UNAUTHORIZED"
+	ErrCodeForbidden          = "FORBIDDEN"
+	ErrCodeNotFound           = "NOT_FOUND"
+	ErrCodeMethodNotAllowed   = "METHOD_NOT_ALLOWED"
+	ErrCodeImageMissing       = "IMAGE_MISSING"
+	ErrCodeUploadRange        = "UPLOAD_RANGE_MISMATCH"
+	ErrCodeUploadIncomplete   = "UPLOAD_INCOMPLETE"
+	ErrCodeQuotaExceeded      = "QUOTA_EXCEEDED"
+	ErrCodeQueueFull          = "QUEUE_FULL"
+	ErrCodeServerBusy         = "SERVER_BUSY"
+	ErrCodeRequestInProgress  = "REQUEST_IN_PROGRESS"
+	ErrCodeConflict           = "CONFLICT"
+	ErrCodeTimeout            = "REQUEST_TIMEOUT"
+	ErrCodeNotImplemented     = "NOT_IMPLEMENTED"
+	ErrCodeMLUnavailable      = "ML_UNAVAILABLE"
+	ErrCodeMLError            = "ML_ERROR"
+	ErrCodeDatabaseError      = "DATABASE_ERROR"
+	ErrCodeStorageError       = "STORAGE_ERROR"
+	ErrCodeInternal           = "INTERNAL_ERROR"
+)
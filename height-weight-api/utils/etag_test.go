@@ -0,0 +1,44 @@
+package utils
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNotModified(t *testing.T) {
+	etag := ETag("id", "2024-03-01T08:00:00Z", "application/json")
+
+	tests := []struct {
+		name        string
+		ifNoneMatch string
+		want        bool
+	}{
+		{"no header", "", false},
+		{"matching", etag, true},
+		{"weak match", "W/" + etag, true},
+		{"in a list", `"other", ` + etag, true},
+		{"wildcard", "*", true},
+		{"stale", ETag("id", "2024-03-01T08:00:00Z", "application/xml"), false},
+		{"unquoted", etag[1 : len(etag)-1], false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.ifNoneMatch != "" {
+				r.Header.Set("If-None-Match", tt.ifNoneMatch)
+			}
+			w := httptest.NewRecorder()
+			got := NotModified(w, r, etag)
+			if got != tt.want {
+				t.Errorf("NotModified(If-None-Match: %s) = %v, want %v", tt.ifNoneMatch, got, tt.want)
+			}
+			if w.Header().Get("ETag") != etag {
+				t.Errorf("ETag header = %q, want %q", w.Header().Get("ETag"), etag)
+			}
+			if tt.want && w.Code != http.StatusNotModified {
+				t.Errorf("status = %d, want %d", w.Code, http.StatusNotModified)
+			}
+		})
+	}
+}
@@ -0,0 +1,28 @@
+package utils
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// newPredictServer starts a fake ML service answering /predict with response
+func newPredictServer(t *testing.T, response ModelResponse) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/predict" {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(response)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// testSides returns a single side image for a prediction
+func testSides() []SideImage {
+	return []SideImage{{View: SideViewSingle, Image: strings.NewReader("side")}}
+}
@@ -0,0 +1,119 @@
+package utils
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// IdempotencyKeyHeader lets clients retry a request without repeating its effect
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// IdempotentReplayHeader marks a response replayed from an earlier request
+const IdempotentReplayHeader = "Idempotent-Replayed"
+
+// StoredResponse is a response recorded for an idempotency key
+type StoredResponse struct {
+	Status      int
+	ContentType string
+	Body        []byte
+}
+
+// idempotencyEntry is an in-flight or completed request for a key
+type idempotencyEntry struct {
+	response  *StoredResponse // nil while the first request is still running
+	createdAt time.Time
+}
+
+// IdempotencyStore keeps the first successful response per idempotency key in
+// memory, evicting keys once their TTL expires
+type IdempotencyStore struct {
+	mu      sync.Mutex
+	entries map[string]*idempotencyEntry
+	ttl     time.Duration
+}
+
+// NewIdempotencyStore creates an empty store whose keys expire after ttl
+func NewIdempotencyStore(ttl time.Duration) *IdempotencyStore {
+	return &IdempotencyStore{
+		entries: make(map[string]*idempotencyEntry),
+		ttl:     ttl,
+	}
+}
+
+// Reserve claims key for a new request. If the key is taken it returns false
+// along with the stored response, which is nil while the first request runs.
+func (s *IdempotencyStore) Reserve(key string) (*StoredResponse, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.evictExpired()
+
+	if entry, ok := s.entries[key]; ok {
+		return entry.response, false
+	}
+	s.entries[key] = &idempotencyEntry{createdAt: time.Now()}
+	return nil, true
+}
+
+// Complete stores the response for a reserved key
+func (s *IdempotencyStore) Complete(key string, response *StoredResponse) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if entry, ok := s.entries[key]; ok {
+		entry.response = response
+	}
+}
+
+// Release frees a reserved key so the request can be retried
+func (s *IdempotencyStore) Release(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.entries, key)
+}
+
+// evictExpired drops expired keys. The caller must hold the lock.
+func (s *IdempotencyStore) evictExpired() {
+	for key, entry := range s.entries {
+		if time.Since(entry.createdAt) > s.ttl {
+			delete(s.entries, key)
+		}
+	}
+}
+
+// ResponseRecorder passes a response through to the client while keeping a
+// copy, so it can be stored for idempotent replay
+type ResponseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   []byte
+}
+
+// NewResponseRecorder wraps w to record what is written to it
+func NewResponseRecorder(w http.ResponseWriter) *ResponseRecorder {
+	return &ResponseRecorder{ResponseWriter: w, status: http.StatusOK}
+}
+
+// WriteHeader records and forwards the status code
+func (rr *ResponseRecorder) WriteHeader(code int) {
+	rr.status = code
+	rr.ResponseWriter.WriteHeader(code)
+}
+
+// Write records and forwards the body
+func (rr *ResponseRecorder) Write(p []byte) (int, error) {
+	rr.body = append(rr.body, p...)
+	return rr.ResponseWriter.Write(p)
+}
+
+// Response returns the recorded response. Only the content type is kept of
+// the headers, since others like Content-Encoding belong to the transport.
+func (rr *ResponseRecorder) Response() *StoredResponse {
+	return &StoredResponse{
+		Status:      rr.status,
+		ContentType: rr.Header().Get("Content-Type"),
+		Body:        rr.body,
+	}
+}
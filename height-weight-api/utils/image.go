@@ -0,0 +1,288 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"io"
+	"net/http"
+	"slices"
+)
+
+// jpegQuality is used when re-encoding rotated JPEGs
+const jpegQuality = 95
+
+// exifOrientationTag is the EXIF tag holding the image orientation
+const exifOrientationTag = 0x0112
+
+// imageExts maps the image types http.DetectContentType recognizes to the
+// extension images of that type are saved with
+var imageExts = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+	"image/bmp":  ".bmp",
+}
+
+// SniffImageType detects the MIME type of an image from its first bytes,
+// whatever its file name claims, and returns it with the extension to save
+// the image with. The extension is empty if the data isn't a known image.
+func SniffImageType(header []byte) (string, string) {
+	mimeType := http.DetectContentType(header)
+	return mimeType, imageExts[mimeType]
+}
+
+// Reasons CheckStillImage rejects an image
+var (
+	ErrMultiFrameImage       = errors.New("image has more than one frame")
+	ErrUnsupportedColorModel = errors.New("image has an unsupported color model")
+)
+
+// stillColorModels are the color models, besides palettes, that the
+// estimation pipeline handles. CMYK JPEGs, for one, are not among them.
+var stillColorModels = []color.Model{
+	color.GrayModel, color.Gray16Model,
+	color.RGBAModel, color.RGBA64Model,
+	color.NRGBAModel, color.NRGBA64Model,
+	color.YCbCrModel,
+}
+
+// CheckStillImage returns ErrMultiFrameImage for animated GIFs, PNGs and
+// WebPs, and ErrUnsupportedColorModel for images of a color model the
+// pipeline doesn't handle. Formats without a registered decoder only have
+// their frames checked.
+func CheckStillImage(data []byte) error {
+	switch {
+	case bytes.HasPrefix(data, []byte("GIF8")):
+		animation, err := gif.DecodeAll(bytes.NewReader(data))
+		if err != nil {
+			return fmt.Errorf("failed to decode image: %w", err)
+		}
+		if len(animation.Image) > 1 {
+			return ErrMultiFrameImage
+		}
+	case bytes.HasPrefix(data, pngSignature):
+		if pngAnimated(data) {
+			return ErrMultiFrameImage
+		}
+	case len(data) >= 12 && string(data[:4]) == "RIFF" && string(data[8:12]) == "WEBP":
+		if webpAnimated(data) {
+			return ErrMultiFrameImage
+		}
+	}
+
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if errors.Is(err, image.ErrFormat) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to decode image: %w", err)
+	}
+	if _, ok := config.ColorModel.(color.Palette); !ok && !slices.Contains(stillColorModels, config.ColorModel) {
+		return ErrUnsupportedColorModel
+	}
+	return nil
+}
+
+// pngSignature starts every PNG file
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// pngAnimated reports whether a PNG is an APNG, which declares its animation
+// in an acTL chunk ahead of the image data
+func pngAnimated(data []byte) bool {
+	i := len(pngSignature)
+	for i+8 <= len(data) {
+		length := int(binary.BigEndian.Uint32(data[i : i+4]))
+		switch string(data[i+4 : i+8]) {
+		case "acTL":
+			return true
+		case "IDAT":
+			return false
+		}
+		// Length, type and CRC surround the chunk data
+		i += 12 + length
+	}
+	return false
+}
+
+// webpAnimated reports whether an extended WebP has its animation flag set
+func webpAnimated(data []byte) bool {
+	// The VP8X chunk, when present, comes first, with the flags byte after its header
+	return len(data) >= 21 && string(data[12:16]) == "VP8X" && data[20]&0x02 != 0
+}
+
+// ImagesIdentical reports whether two images have byte-identical content
+func ImagesIdentical(a, b io.Reader) (bool, error) {
+	hashA := sha256.New()
+	if _, err := io.Copy(hashA, a); err != nil {
+		return false, fmt.Errorf("failed to read first image: %w", err)
+	}
+
+	hashB := sha256.New()
+	if _, err := io.Copy(hashB, b); err != nil {
+		return false, fmt.Errorf("failed to read second image: %w", err)
+	}
+
+	return bytes.Equal(hashA.Sum(nil), hashB.Sum(nil)), nil
+}
+
+// ImageSetHash returns a hex digest identifying the front and side images of
+// an estimation. A single side hashes as the front and side pair always has.
+func ImageSetHash(front []byte, sides ...[]byte) string {
+	frontSum := sha256.Sum256(front)
+	sums := frontSum[:]
+	for _, side := range sides {
+		sideSum := sha256.Sum256(side)
+		sums = append(sums, sideSum[:]...)
+	}
+	setSum := sha256.Sum256(sums)
+	return hex.EncodeToString(setSum[:])
+}
+
+// AutoOrient rotates and flips a JPEG so it is upright according to its EXIF
+// orientation, and strips the EXIF metadata for privacy. Upright JPEGs are
+// only stripped, not re-encoded. Other formats are returned unchanged.
+func AutoOrient(r io.Reader) ([]byte, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read image: %w", err)
+	}
+	if len(data) < 2 || data[0] != 0xFF || data[1] != 0xD8 {
+		return data, nil
+	}
+
+	orientation, stripped := scanJPEG(data)
+	if orientation < 2 || orientation > 8 {
+		return stripped, nil
+	}
+
+	img, err := jpeg.Decode(bytes.NewReader(stripped))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image: %w", err)
+	}
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, orient(img, orientation), &jpeg.Options{Quality: jpegQuality}); err != nil {
+		return nil, fmt.Errorf("failed to encode image: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// scanJPEG walks the JPEG header segments, returning the EXIF orientation
+// (0 if absent) and a copy of the image with its EXIF segments removed
+func scanJPEG(data []byte) (int, []byte) {
+	orientation := 0
+	out := make([]byte, 0, len(data))
+	out = append(out, data[:2]...)
+
+	i := 2
+	for i+4 <= len(data) && data[i] == 0xFF {
+		marker := data[i+1]
+		// Start of scan: the compressed image data follows
+		if marker == 0xDA {
+			break
+		}
+		// Standalone markers carry no length
+		if marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7) {
+			out = append(out, data[i:i+2]...)
+			i += 2
+			continue
+		}
+
+		end := i + 2 + int(binary.BigEndian.Uint16(data[i+2:i+4]))
+		if end > len(data) {
+			break
+		}
+
+		payload := data[i+4 : end]
+		if marker == 0xE1 && bytes.HasPrefix(payload, []byte("Exif\x00\x00")) {
+			if o := exifOrientation(payload[6:]); o > 0 {
+				orientation = o
+			}
+		} else {
+			out = append(out, data[i:end]...)
+		}
+		i = end
+	}
+
+	return orientation, append(out, data[i:]...)
+}
+
+// exifOrientation reads the orientation tag from the first IFD of a TIFF
+// structured EXIF payload, returning 0 if it can't be found
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 0
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0
+	}
+
+	ifd := int(order.Uint32(tiff[4:8]))
+	if ifd+2 > len(tiff) {
+		return 0
+	}
+	entries := int(order.Uint16(tiff[ifd : ifd+2]))
+	for n := 0; n < entries; n++ {
+		entry := ifd + 2 + n*12
+		if entry+12 > len(tiff) {
+			return 0
+		}
+		if order.Uint16(tiff[entry:entry+2]) == exifOrientationTag {
+			return int(order.Uint16(tiff[entry+8 : entry+10]))
+		}
+	}
+	return 0
+}
+
+// orient applies the transform for an EXIF orientation value (2-8) to img
+func orient(img image.Image, orientation int) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+
+	// Orientations 5-8 swap width and height
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2: // Mirrored horizontally
+				dx, dy = w-1-x, y
+			case 3: // Rotated 180
+				dx, dy = w-1-x, h-1-y
+			case 4: // Mirrored vertically
+				dx, dy = x, h-1-y
+			case 5: // Transposed
+				dx, dy = y, x
+			case 6: // Needs 90 clockwise
+				dx, dy = h-1-y, x
+			case 7: // Transversed
+				dx, dy = h-1-y, w-1-x
+			case 8: // Needs 90 counter-clockwise
+				dx, dy = y, w-1-x
+			}
+			dst.Set(dx, dy, img.At(b.Min.X+x, b.Min.Y+y))
+		}
+	}
+	return dst
+}
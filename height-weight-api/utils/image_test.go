@@ -0,0 +1,216 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestImagesIdentical(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b string
+		want bool
+	}{
+		{"same bytes", "front photo", "front photo", true},
+		{"different bytes", "front photo", "side photo", false},
+		{"one byte apart", "photo-1", "photo-2", false},
+		{"prefix", "photo", "photo and more", false},
+		{"both empty", "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ImagesIdentical(strings.NewReader(tt.a), strings.NewReader(tt.b))
+			if err != nil {
+				t.Fatalf("ImagesIdentical: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("ImagesIdentical(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+			}
+		})
+	}
+
+	// Large images are compared in full, not just their first block
+	large := bytes.Repeat([]byte{7}, 1<<20)
+	changed := bytes.Clone(large)
+	changed[len(changed)-1] = 8
+	if same, _ := ImagesIdentical(bytes.NewReader(large), bytes.NewReader(changed)); same {
+		t.Error("images differing in their last byte reported identical")
+	}
+}
+
+// taggedJPEG encodes a 32x16 JPEG whose top-left quadrant is white and the
+// rest black, with an EXIF segment carrying orientation
+func taggedJPEG(t *testing.T, orientation uint16) []byte {
+	t.Helper()
+	img := image.NewGray(image.Rect(0, 0, 32, 16))
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 16; x++ {
+			img.SetGray(x, y, color.Gray{Y: 255})
+		}
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 100}); err != nil {
+		t.Fatalf("encode JPEG: %v", err)
+	}
+	data := buf.Bytes()
+
+	// Big-endian TIFF header, then a single IFD holding the orientation tag
+	exif := []byte("Exif\x00\x00MM\x00\x2a\x00\x00\x00\x08\x00\x01")
+	exif = binary.BigEndian.AppendUint16(exif, exifOrientationTag)
+	exif = append(exif, 0x00, 0x03, 0x00, 0x00, 0x00, 0x01)
+	exif = binary.BigEndian.AppendUint16(exif, orientation)
+	exif = append(exif, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00)
+
+	segment := []byte{0xFF, 0xE1}
+	segment = binary.BigEndian.AppendUint16(segment, uint16(len(exif)+2))
+	segment = append(segment, exif...)
+
+	tagged := append([]byte{}, data[:2]...)
+	tagged = append(tagged, segment...)
+	return append(tagged, data[2:]...)
+}
+
+func TestAutoOrient(t *testing.T) {
+	tests := []struct {
+		orientation   uint16
+		width, height int
+		bright        image.Point // Corner that should hold the white quadrant
+	}{
+		{1, 32, 16, image.Pt(0, 0)},
+		{2, 32, 16, image.Pt(1, 0)},
+		{3, 32, 16, image.Pt(1, 1)},
+		{4, 32, 16, image.Pt(0, 1)},
+		{5, 16, 32, image.Pt(0, 0)},
+		{6, 16, 32, image.Pt(1, 0)},
+		{7, 16, 32, image.Pt(1, 1)},
+		{8, 16, 32, image.Pt(0, 1)},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("orientation %d", tt.orientation), func(t *testing.T) {
+			tagged := taggedJPEG(t, tt.orientation)
+			if orientation, _ := scanJPEG(tagged); orientation != int(tt.orientation) {
+				t.Fatalf("test image orientation = %d, want %d", orientation, tt.orientation)
+			}
+
+			out, err := AutoOrient(bytes.NewReader(tagged))
+			if err != nil {
+				t.Fatalf("AutoOrient: %v", err)
+			}
+			if bytes.Contains(out, []byte("Exif\x00\x00")) {
+				t.Error("output still has an EXIF segment")
+			}
+			img, err := jpeg.Decode(bytes.NewReader(out))
+			if err != nil {
+				t.Fatalf("decode output: %v", err)
+			}
+			if b := img.Bounds(); b.Dx() != tt.width || b.Dy() != tt.height {
+				t.Fatalf("output is %dx%d, want %dx%d", b.Dx(), b.Dy(), tt.width, tt.height)
+			}
+
+			// Sample the middle of each quadrant; only the expected one is white
+			for qy := 0; qy < 2; qy++ {
+				for qx := 0; qx < 2; qx++ {
+					x, y := tt.width/4+qx*tt.width/2, tt.height/4+qy*tt.height/2
+					gray := color.GrayModel.Convert(img.At(x, y)).(color.Gray).Y
+					want := image.Pt(qx, qy) == tt.bright
+					if got := gray > 128; got != want {
+						t.Errorf("quadrant (%d, %d) gray %d, want white %v", qx, qy, gray, want)
+					}
+				}
+			}
+		})
+	}
+
+	// Upright images are only stripped, keeping their encoded data as is
+	tagged := taggedJPEG(t, 1)
+	out, err := AutoOrient(bytes.NewReader(tagged))
+	if err != nil {
+		t.Fatalf("AutoOrient: %v", err)
+	}
+	if !bytes.HasSuffix(tagged, out[2:]) {
+		t.Error("upright image was re-encoded")
+	}
+
+	// Other formats pass through untouched
+	png := []byte("\x89PNG\r\n\x1a\nnot really")
+	if out, err := AutoOrient(bytes.NewReader(png)); err != nil || !bytes.Equal(out, png) {
+		t.Errorf("AutoOrient(PNG) = %q, %v, want it unchanged", out, err)
+	}
+}
+
+// gifFrames encodes a GIF of the given number of blank frames
+func gifFrames(t *testing.T, frames int) []byte {
+	t.Helper()
+	animation := &gif.GIF{}
+	for i := 0; i < frames; i++ {
+		frame := image.NewPaletted(image.Rect(0, 0, 8, 8), color.Palette{color.Black, color.White})
+		animation.Image = append(animation.Image, frame)
+		animation.Delay = append(animation.Delay, 10)
+	}
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, animation); err != nil {
+		t.Fatalf("encode GIF: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// stillPNG encodes an 8x8 gray PNG
+func stillPNG(t *testing.T) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, 8, 8))); err != nil {
+		t.Fatalf("encode PNG: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// animatedPNG turns a still PNG into an APNG by declaring two frames in an
+// acTL chunk right after IHDR, which is all CheckStillImage looks at
+func animatedPNG(t *testing.T) []byte {
+	t.Helper()
+	still := stillPNG(t)
+	ihdrEnd := len(pngSignature) + 12 + 13
+	chunk := binary.BigEndian.AppendUint32(nil, 8)
+	chunk = append(chunk, "acTL"...)
+	chunk = binary.BigEndian.AppendUint32(chunk, 2) // Frames
+	chunk = binary.BigEndian.AppendUint32(chunk, 0) // Plays, 0 looping forever
+	chunk = binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+	return slices.Concat(still[:ihdrEnd], chunk, still[ihdrEnd:])
+}
+
+func TestCheckStillImage(t *testing.T) {
+	// An extended WebP header with the animation flag set
+	animatedWebP := []byte("RIFF\x00\x00\x00\x00WEBPVP8X\x0a\x00\x00\x00\x02\x00\x00\x00")
+
+	tests := []struct {
+		name string
+		data []byte
+		want error
+	}{
+		{"still PNG", stillPNG(t), nil},
+		{"animated PNG", animatedPNG(t), ErrMultiFrameImage},
+		{"single-frame GIF", gifFrames(t, 1), nil},
+		{"multi-frame GIF", gifFrames(t, 3), ErrMultiFrameImage},
+		{"animated WebP", animatedWebP, ErrMultiFrameImage},
+		{"JPEG", taggedJPEG(t, 1), nil},
+		{"unknown format", []byte("not an image at all"), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := CheckStillImage(tt.data); !errors.Is(err, tt.want) {
+				t.Errorf("CheckStillImage = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,26 @@
+package utils
+
+import "sync/atomic"
+
+// InFlight counts operations in progress
+type InFlight struct {
+	n atomic.Int64
+}
+
+// MLInFlight counts estimations waiting on or running an ML prediction
+var MLInFlight = &InFlight{}
+
+// Begin records the start of an operation, which must be matched by Done
+func (c *InFlight) Begin() {
+	c.n.Add(1)
+}
+
+// Done records the end of an operation started with Begin
+func (c *InFlight) Done() {
+	c.n.Add(-1)
+}
+
+// Count returns the number of operations in progress
+func (c *InFlight) Count() int64 {
+	return c.n.Load()
+}
@@ -0,0 +1,504 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lucasfepe/height-weight-api/config"
+	"github.com/lucasfepe/height-weight-api/models"
+)
+
+// ErrMLBusy is returned when no ML service request slot frees up in time
+var ErrMLBusy = errors.New("ML service busy: too many concurrent requests")
+
+// ErrNoPersonDetected is returned when the model answers with an implausible
+// weight, which it does when it can't find a person in the photos
+var ErrNoPersonDetected = errors.New("no person detected in the images")
+
+// mlRetryBackoff is the wait before the first retry, growing with each attempt
+const mlRetryBackoff = 500 * time.Millisecond
+
+// ModelResponse represents the response from the TensorFlow model service
+type ModelResponse struct {
+	Height          float64 `json:"height"`
+	Weight          float64 `json:"weight"`
+	PredictedHeight float64 `json:"predicted_height"`
+	Confidence      float64 `json:"confidence"`
+	// Body circumferences in centimeters, e.g. chest, waist and hip. Older models omit it.
+	Measurements map[string]float64 `json:"measurements,omitempty"`
+	Error        string             `json:"error,omitempty"`
+	// Round trip of the prediction in milliseconds, measured by the client
+	InferenceMs int64 `json:"-"`
+	// PredictionModeModel or PredictionModeMock, whichever made the prediction
+	Mode string `json:"-"`
+}
+
+// Prediction modes, telling real model predictions from DEV_MODE heuristics
+const (
+	PredictionModeModel = "model"
+	PredictionModeMock  = "mock"
+)
+
+// Side views a prediction takes, named by the form field carrying each: a
+// single side, or left and right profiles for models trained on both
+const (
+	SideViewSingle = "side_image"
+	SideViewLeft   = "side_image_left"
+	SideViewRight  = "side_image_right"
+)
+
+// SideViews lists every side view in the order they are sent
+var SideViews = []string{SideViewSingle, SideViewLeft, SideViewRight}
+
+// SideImage is a side photo sent for a prediction
+type SideImage struct {
+	View  string // One of SideViews
+	Image io.Reader
+}
+
+// MLService is the ML service API the handlers depend on
+type MLService interface {
+	// PredictWeight estimates weight from a front photo, one or more side
+	// photos and the reported height
+	PredictWeight(ctx context.Context, front io.Reader, sides []SideImage, height float64) (*ModelResponse, error)
+	// Predict estimates height and weight from a single photo
+	Predict(ctx context.Context, image io.Reader) (*models.MLServiceResponse, error)
+	// DetectFaces returns the bounding boxes of the faces in a photo
+	DetectFaces(ctx context.Context, image io.Reader) ([]image.Rectangle, error)
+}
+
+// FaceBox is a face bounding box reported by the ML service, in pixels
+type FaceBox struct {
+	X      int `json:"x"`
+	Y      int `json:"y"`
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+// faceDetectionResponse is the response of the ML service's /detect-faces endpoint
+type faceDetectionResponse struct {
+	Faces []FaceBox `json:"faces"`
+	Error string    `json:"error,omitempty"`
+}
+
+// MLAuth is the credential attached to ML service requests. The zero value
+// sends none.
+type MLAuth struct {
+	Header string
+	Value  string
+}
+
+// NewMLAuth builds the credential configured by MLServiceToken and
+// MLAuthHeader. In the Authorization header the token is sent as a bearer
+// token, other headers carry it as is.
+func NewMLAuth(cfg *config.Config) MLAuth {
+	if cfg.MLServiceToken == "" {
+		return MLAuth{}
+	}
+	if http.CanonicalHeaderKey(cfg.MLAuthHeader) == "Authorization" {
+		return MLAuth{Header: "Authorization", Value: "Bearer " + cfg.MLServiceToken}
+	}
+	return MLAuth{Header: cfg.MLAuthHeader, Value: cfg.MLServiceToken}
+}
+
+// apply sets the credential on req, if there is one
+func (a MLAuth) apply(req *http.Request) {
+	if a.Value != "" {
+		req.Header.Set(a.Header, a.Value)
+	}
+}
+
+// MLClient calls one ML service instance over HTTP. Network errors and 5xx
+// responses are retried, and every attempt goes through the client's circuit
+// breaker and holds a slot of the concurrency limiter while in flight.
+type MLClient struct {
+	baseURL    string
+	httpClient *http.Client
+	timeout    time.Duration // Limit of a single attempt, 0 for none
+	retries    int
+	minWeight  float64 // Lowest predicted weight taken as a real result
+	auth       MLAuth
+	breaker    *CircuitBreaker
+	limiter    *Semaphore
+}
+
+// NewMLClient creates a client for the ML service at baseURL guarded by
+// breaker, which must not be shared with clients of other services, or one
+// failing service would cut off the rest. Predicted weights below minWeight
+// are reported as ErrNoPersonDetected. Every request carries auth. Requests
+// wait for a slot of limiter, which may be nil for no limit.
+func NewMLClient(baseURL string, timeout time.Duration, retries int, minWeight float64, auth MLAuth, limiter *Semaphore, breaker *CircuitBreaker) *MLClient {
+	return &MLClient{
+		baseURL:    baseURL,
+		httpClient: &http.Client{},
+		timeout:    timeout,
+		retries:    retries,
+		minWeight:  minWeight,
+		auth:       auth,
+		breaker:    breaker,
+		limiter:    limiter,
+	}
+}
+
+// CircuitState returns the state of the client's circuit breaker
+func (c *MLClient) CircuitState() string {
+	return c.breaker.State()
+}
+
+// PredictWeight sends the front and side images along with height to the
+// model service, each side image as the form field of its view
+func (c *MLClient) PredictWeight(ctx context.Context, front io.Reader, sides []SideImage, height float64) (*ModelResponse, error) {
+	body, contentType, err := multipartBody(func(mw *multipart.Writer) error {
+		if err := writeFormFile(mw, "front_image", front, "front.jpg"); err != nil {
+			return err
+		}
+		for _, side := range sides {
+			// side_image_left is sent as side_left.jpg
+			if err := writeFormFile(mw, side.View, side.Image, strings.Replace(side.View, "_image", "", 1)+".jpg"); err != nil {
+				return err
+			}
+		}
+		return mw.WriteField("height", strconv.FormatFloat(height, 'f', -1, 64))
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Retries are included, since they are part of what the caller waits for
+	var result ModelResponse
+	start := time.Now()
+	if err := c.post(ctx, "/predict", body, contentType, &result); err != nil {
+		return nil, err
+	}
+	result.InferenceMs = time.Since(start).Milliseconds()
+	result.Mode = PredictionModeModel
+	if result.Error != "" {
+		return nil, fmt.Errorf("model service error: %s", result.Error)
+	}
+	// Zeros with low confidence mean the model found nobody, not a weightless person.
+	// A zero predicted height is left alone, since older models don't predict height.
+	if result.Weight <= 0 || result.Weight < c.minWeight || result.PredictedHeight < 0 {
+		return nil, fmt.Errorf("%w: predicted weight %g kg, height %g cm", ErrNoPersonDetected, result.Weight, result.PredictedHeight)
+	}
+	return &result, nil
+}
+
+// Predict sends a single image to the model service
+func (c *MLClient) Predict(ctx context.Context, image io.Reader) (*models.MLServiceResponse, error) {
+	body, contentType, err := multipartBody(func(mw *multipart.Writer) error {
+		return writeFormFile(mw, "image", image, "image.jpg")
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var result models.MLServiceResponse
+	if err := c.post(ctx, "/predict", body, contentType, &result); err != nil {
+		return nil, err
+	}
+	if result.Error != "" {
+		return nil, fmt.Errorf("model service error: %s", result.Error)
+	}
+	return &result, nil
+}
+
+// DetectFaces sends an image to the model service's face detector
+func (c *MLClient) DetectFaces(ctx context.Context, img io.Reader) ([]image.Rectangle, error) {
+	body, contentType, err := multipartBody(func(mw *multipart.Writer) error {
+		return writeFormFile(mw, "image", img, "image.jpg")
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var result faceDetectionResponse
+	if err := c.post(ctx, "/detect-faces", body, contentType, &result); err != nil {
+		return nil, err
+	}
+	if result.Error != "" {
+		return nil, fmt.Errorf("model service error: %s", result.Error)
+	}
+
+	faces := make([]image.Rectangle, len(result.Faces))
+	for i, face := range result.Faces {
+		faces[i] = image.Rect(face.X, face.Y, face.X+face.Width, face.Y+face.Height)
+	}
+	return faces, nil
+}
+
+// post sends a multipart body to the endpoint at path and decodes the JSON
+// response into out. The body is buffered so it can be resent on retry.
+func (c *MLClient) post(ctx context.Context, path string, body []byte, contentType string, out interface{}) error {
+	var lastErr error
+	for attempt := 0; attempt <= c.retries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(time.Duration(attempt) * mlRetryBackoff):
+			}
+		}
+
+		respBody, status, err := c.send(ctx, path, body, contentType)
+		if errors.Is(err, ErrMLBusy) || errors.Is(err, ErrCircuitOpen) {
+			return err
+		}
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		if status >= http.StatusInternalServerError {
+			lastErr = fmt.Errorf("ML service returned error status %d: %s", status, string(respBody))
+			continue
+		}
+		if status != http.StatusOK {
+			return fmt.Errorf("ML service returned error status %d: %s", status, string(respBody))
+		}
+
+		if err := json.Unmarshal(respBody, out); err != nil {
+			return fmt.Errorf("failed to parse ML service response: %w, response: %s", err, string(respBody))
+		}
+		return nil
+	}
+	return lastErr
+}
+
+// send makes a single request to path and returns the response body and
+// status. Backpressure and the circuit breaker apply per attempt, so retry
+// backoffs don't hold a request slot. An attempt is limited to the client
+// timeout or whatever is left of ctx's deadline, whichever is shorter.
+func (c *MLClient) send(ctx context.Context, path string, body []byte, contentType string) ([]byte, int, error) {
+	// Don't start a call the request no longer has time for
+	if err := ctx.Err(); err != nil {
+		return nil, 0, err
+	}
+	// Wait briefly for a free slot rather than pile onto a saturated service
+	if !c.limiter.Acquire(ctx) {
+		if err := ctx.Err(); err != nil {
+			return nil, 0, err
+		}
+		return nil, 0, ErrMLBusy
+	}
+	defer c.limiter.Release()
+
+	// Fast-fail while the ML service is known to be down
+	if err := c.breaker.Allow(); err != nil {
+		return nil, 0, err
+	}
+
+	// A ctx deadline sooner than the timeout is kept, so it alone ends the attempt
+	attemptCtx := ctx
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		attemptCtx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+
+	req, err := http.NewRequestWithContext(attemptCtx, http.MethodPost, c.baseURL+path, bytes.NewReader(body))
+	if err != nil {
+		c.breaker.RecordFailure()
+		return nil, 0, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", contentType)
+	c.auth.apply(req)
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		// A cancelled request says nothing about the health of the ML service
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			c.breaker.Release()
+			return nil, 0, ctxErr
+		}
+		c.breaker.RecordFailure()
+		return nil, 0, fmt.Errorf("failed to send request to ML service: %w", err)
+	}
+	respBody, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	c.breaker.RecordStatus(resp.StatusCode)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to read response from ML service: %w", err)
+	}
+	return respBody, resp.StatusCode, nil
+}
+
+// multipartBody builds a multipart form with write and returns it with its content type
+func multipartBody(write func(mw *multipart.Writer) error) ([]byte, string, error) {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	if err := write(mw); err != nil {
+		return nil, "", err
+	}
+	if err := mw.Close(); err != nil {
+		return nil, "", fmt.Errorf("failed to close multipart writer: %w", err)
+	}
+	return body.Bytes(), mw.FormDataContentType(), nil
+}
+
+// writeFormFile copies r into a file field of the form. Files keep their own
+// name, other readers are sent as fallbackName.
+func writeFormFile(mw *multipart.Writer, field string, r io.Reader, fallbackName string) error {
+	name := fallbackName
+	if f, ok := r.(*os.File); ok {
+		name = filepath.Base(f.Name())
+	}
+
+	part, err := mw.CreateFormFile(field, name)
+	if err != nil {
+		return fmt.Errorf("failed to create form file for %s: %w", field, err)
+	}
+	if _, err := io.Copy(part, r); err != nil {
+		return fmt.Errorf("failed to copy %s to form: %w", field, err)
+	}
+	return nil
+}
+
+// mockMLService predicts without an ML service, for local development. A
+// non-zero weight replaces the heuristic, and a non-nil err fails every call.
+type mockMLService struct {
+	weight float64
+	err    error
+}
+
+// newMockMLService creates the mock configured by MockWeight and MockError
+func newMockMLService(cfg *config.Config) mockMLService {
+	mock := mockMLService{weight: cfg.MockWeight}
+	switch cfg.MockError {
+	case "":
+	case "busy":
+		mock.err = ErrMLBusy
+	case "unavailable":
+		mock.err = ErrCircuitOpen
+	case "no_person":
+		mock.err = ErrNoPersonDetected
+	default:
+		mock.err = fmt.Errorf("mock ML service error: %s", cfg.MockError)
+	}
+	return mock
+}
+
+// PredictWeight derives a weight from the height, nudged by the image sizes
+func (m mockMLService) PredictWeight(_ context.Context, front io.Reader, sides []SideImage, height float64) (*ModelResponse, error) {
+	frontSize, _ := io.Copy(io.Discard, front)
+	var sideSize int64
+	for _, side := range sides {
+		size, _ := io.Copy(io.Discard, side.Image)
+		sideSize += size
+	}
+	if m.err != nil {
+		return nil, m.err
+	}
+	if m.weight > 0 {
+		return &ModelResponse{Weight: m.weight, Mode: PredictionModeMock}, nil
+	}
+	return &ModelResponse{Weight: HeuristicWeight(height, frontSize, sideSize), Mode: PredictionModeMock}, nil
+}
+
+// HeuristicWeight is a rough weight guess from the height, nudged by the image
+// sizes, for when no ML model is available
+func HeuristicWeight(height float64, frontSize, sideSize int64) float64 {
+	return (height-100)*0.9 + float64(frontSize%10)*0.1 + float64(sideSize%10)*0.1
+}
+
+// Predict returns a fixed estimation
+func (m mockMLService) Predict(_ context.Context, image io.Reader) (*models.MLServiceResponse, error) {
+	if _, err := io.Copy(io.Discard, image); err != nil {
+		return nil, fmt.Errorf("failed to read image: %w", err)
+	}
+	if m.err != nil {
+		return nil, m.err
+	}
+	weight := 65.0
+	if m.weight > 0 {
+		weight = m.weight
+	}
+	return &models.MLServiceResponse{Height: 170, Weight: weight, Confidence: 0.5}, nil
+}
+
+// DetectFaces finds no faces, leaving images unchanged
+func (m mockMLService) DetectFaces(_ context.Context, img io.Reader) ([]image.Rectangle, error) {
+	if _, err := io.Copy(io.Discard, img); err != nil {
+		return nil, fmt.Errorf("failed to read image: %w", err)
+	}
+	return nil, m.err
+}
+
+// MLClients holds the ML service of every model version, keyed by model key
+type MLClients struct {
+	services     map[string]MLService
+	defaultModel string
+}
+
+// NewMLClients creates a set of ML services using defaultModel when a request
+// doesn't select one
+func NewMLClients(services map[string]MLService, defaultModel string) *MLClients {
+	return &MLClients{services: services, defaultModel: defaultModel}
+}
+
+// NewMLClientsFromConfig creates a client per configured model version. In
+// DEV_MODE every model is served by a mock instead.
+func NewMLClientsFromConfig(cfg *config.Config) *MLClients {
+	devMode := os.Getenv("DEV_MODE") == "true"
+	mock := newMockMLService(cfg)
+	if devMode {
+		log.Println("WARNING: Using mock weight prediction instead of ML model")
+		if mock.err != nil {
+			log.Printf("WARNING: Mock ML service fails every call: %v", mock.err)
+		}
+	}
+
+	// One limit across all models, which usually share the ML service's resources
+	limiter := NewSemaphore(cfg.MaxConcurrentMLCalls, cfg.MLQueueWait)
+	auth := NewMLAuth(cfg)
+
+	services := make(map[string]MLService, len(cfg.MLServiceURLs))
+	for model, url := range cfg.MLServiceURLs {
+		if devMode {
+			services[model] = mock
+			continue
+		}
+		// Each model gets its own breaker, so a failing one doesn't block the others
+		breaker := NewCircuitBreaker(cfg.MLBreakerMaxFailures, cfg.MLBreakerCooldown)
+		services[model] = NewMLClient(url, cfg.MLTimeout, cfg.MLRetries, cfg.MinPlausibleWeight, auth, limiter, breaker)
+	}
+	return NewMLClients(services, cfg.DefaultMLModel)
+}
+
+// Resolve returns the model key and ML service to use for a request. An empty
+// key selects the default model.
+func (c *MLClients) Resolve(model string) (string, MLService, error) {
+	if model == "" {
+		model = c.defaultModel
+	}
+	service, ok := c.services[model]
+	if !ok {
+		return "", nil, fmt.Errorf("%w: %s", config.ErrUnknownMLModel, model)
+	}
+	return model, service, nil
+}
+
+// CircuitStates returns the circuit breaker state of every model's ML
+// service, keyed by model. Services without a breaker, such as the DEV_MODE
+// mock, are left out.
+func (c *MLClients) CircuitStates() map[string]string {
+	states := make(map[string]string, len(c.services))
+	for model, service := range c.services {
+		if client, ok := service.(*MLClient); ok {
+			states[model] = client.CircuitState()
+		}
+	}
+	return states
+}
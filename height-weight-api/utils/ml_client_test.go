@@ -0,0 +1,510 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lucasfepe/height-weight-api/config"
+	"github.com/lucasfepe/height-weight-api/internal/testutil"
+)
+
+func TestMLClientsRouteByModel(t *testing.T) {
+	v1 := newPredictServer(t, ModelResponse{Weight: 61})
+	v2 := newPredictServer(t, ModelResponse{Weight: 72})
+	cfg := testutil.Config(t, map[string]string{"ML_MODELS": "v1=" + v1.URL + ",v2=" + v2.URL})
+	clients := NewMLClientsFromConfig(cfg)
+
+	tests := []struct {
+		model      string
+		wantModel  string
+		wantWeight float64
+	}{
+		{"v1", "v1", 61},
+		{"v2", "v2", 72},
+		{"", "v1", 61}, // The first listed model is the default
+	}
+	for _, tt := range tests {
+		model, service, err := clients.Resolve(tt.model)
+		if err != nil {
+			t.Fatalf("Resolve(%q): %v", tt.model, err)
+		}
+		if model != tt.wantModel {
+			t.Errorf("Resolve(%q) model = %q, want %q", tt.model, model, tt.wantModel)
+		}
+		prediction, err := service.PredictWeight(context.Background(), strings.NewReader("front"), testSides(), 175)
+		if err != nil {
+			t.Fatalf("PredictWeight via %q: %v", tt.model, err)
+		}
+		if prediction.Weight != tt.wantWeight {
+			t.Errorf("model %q predicted %v, want %v from its own server", tt.model, prediction.Weight, tt.wantWeight)
+		}
+	}
+
+	if _, _, err := clients.Resolve("v3"); !errors.Is(err, config.ErrUnknownMLModel) {
+		t.Errorf("Resolve(v3) error = %v, want ErrUnknownMLModel", err)
+	}
+}
+
+func TestMLClientsConcurrentRouting(t *testing.T) {
+	v1 := newPredictServer(t, ModelResponse{Weight: 61})
+	v2 := newPredictServer(t, ModelResponse{Weight: 72})
+	cfg := testutil.Config(t, map[string]string{"ML_MODELS": "v1=" + v1.URL + ",v2=" + v2.URL, "MAX_CONCURRENT_ML_CALLS": "0"})
+	clients := NewMLClientsFromConfig(cfg)
+	want := map[string]float64{"v1": 61, "v2": 72}
+
+	// Run with -race: each request resolves and calls its model's URL while others do the same
+	var wg sync.WaitGroup
+	errs := make(chan error, 40)
+	for i := 0; i < cap(errs); i++ {
+		model := []string{"v1", "v2"}[i%2]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, service, err := clients.Resolve(model)
+			if err != nil {
+				errs <- err
+				return
+			}
+			prediction, err := service.PredictWeight(context.Background(), strings.NewReader("front"), testSides(), 175)
+			if err != nil {
+				errs <- err
+				return
+			}
+			if prediction.Weight != want[model] {
+				errs <- fmt.Errorf("model %s predicted %v, want %v", model, prediction.Weight, want[model])
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestPredictWeightSideFields(t *testing.T) {
+	var fields []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseMultipartForm(1 << 20); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		fields = fields[:0]
+		for _, view := range SideViews {
+			if _, ok := r.MultipartForm.File[view]; ok {
+				fields = append(fields, view)
+			}
+		}
+		w.Write([]byte(`{"weight": 70}`))
+	}))
+	defer server.Close()
+	client := NewMLClient(server.URL, time.Second, 0, 0, MLAuth{}, nil, NewCircuitBreaker(5, time.Minute))
+
+	tests := []struct {
+		name  string
+		views []string
+	}{
+		{"single side", []string{SideViewSingle}},
+		{"left and right", []string{SideViewLeft, SideViewRight}},
+		{"all three", []string{SideViewSingle, SideViewLeft, SideViewRight}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var sides []SideImage
+			for _, view := range tt.views {
+				sides = append(sides, SideImage{View: view, Image: strings.NewReader(view)})
+			}
+			if _, err := client.PredictWeight(context.Background(), strings.NewReader("front"), sides, 175); err != nil {
+				t.Fatalf("PredictWeight: %v", err)
+			}
+			if !slices.Equal(fields, tt.views) {
+				t.Errorf("ML service got side fields %v, want %v", fields, tt.views)
+			}
+		})
+	}
+}
+
+func TestPredictWeightMeasurements(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want map[string]float64
+	}{
+		{"with measurements", `{"weight": 70, "measurements": {"chest": 98.5, "waist": 82}}`, map[string]float64{"chest": 98.5, "waist": 82}},
+		{"without measurements", `{"weight": 70}`, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(tt.body))
+			}))
+			defer server.Close()
+
+			client := NewMLClient(server.URL, time.Second, 0, 0, MLAuth{}, nil, NewCircuitBreaker(5, time.Minute))
+			prediction, err := client.PredictWeight(context.Background(), strings.NewReader("front"), testSides(), 175)
+			if err != nil {
+				t.Fatalf("PredictWeight: %v", err)
+			}
+			if !maps.Equal(prediction.Measurements, tt.want) {
+				t.Errorf("measurements = %v, want %v", prediction.Measurements, tt.want)
+			}
+		})
+	}
+}
+
+func TestMLClientPredictWeight(t *testing.T) {
+	tests := []struct {
+		name       string
+		statuses   []int  // Status of each attempt, the last one repeating
+		body       string // Body of a 200 response
+		retries    int
+		wantErr    error // Sentinel the error must wrap, nil for any error
+		wantOK     bool
+		wantWeight float64
+		wantCalls  int
+	}{
+		{"success", []int{200}, `{"weight": 70.5, "predicted_height": 176}`, 0, nil, true, 70.5, 1},
+		{"server error retried", []int{502, 200}, `{"weight": 70.5}`, 1, nil, true, 70.5, 2},
+		{"server error exhausts retries", []int{500}, ``, 1, nil, false, 0, 2},
+		{"client error not retried", []int{400}, ``, 2, nil, false, 0, 1},
+		{"model error", []int{200}, `{"error": "no input"}`, 0, nil, false, 0, 1},
+		{"zero weight", []int{200}, `{"weight": 0, "confidence": 0.1}`, 0, ErrNoPersonDetected, false, 0, 1},
+		{"below minimum weight", []int{200}, `{"weight": 1.5}`, 0, ErrNoPersonDetected, false, 0, 1},
+		{"malformed response", []int{200}, `{"weight":`, 0, nil, false, 0, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls atomic.Int64
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				n := int(calls.Add(1))
+				if r.URL.Path != "/predict" {
+					http.NotFound(w, r)
+					return
+				}
+				status := tt.statuses[min(n, len(tt.statuses))-1]
+				if status != http.StatusOK {
+					http.Error(w, "failed", status)
+					return
+				}
+				w.Write([]byte(tt.body))
+			}))
+			defer server.Close()
+
+			client := NewMLClient(server.URL, time.Second, tt.retries, 2, MLAuth{}, nil, NewCircuitBreaker(10, time.Minute))
+			prediction, err := client.PredictWeight(context.Background(), strings.NewReader("front"), testSides(), 175)
+			if ok := err == nil; ok != tt.wantOK {
+				t.Fatalf("PredictWeight error = %v, want ok %v", err, tt.wantOK)
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Errorf("PredictWeight error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantOK {
+				if prediction.Weight != tt.wantWeight || prediction.Mode != PredictionModeModel {
+					t.Errorf("prediction = %v kg by %q, want %v kg by %q", prediction.Weight, prediction.Mode, tt.wantWeight, PredictionModeModel)
+				}
+			}
+			if got := int(calls.Load()); got != tt.wantCalls {
+				t.Errorf("ML service called %d times, want %d", got, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestMLClientPredictAndDetectFaces(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, _, err := r.FormFile("image"); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		switch r.URL.Path {
+		case "/predict":
+			w.Write([]byte(`{"height": 172, "weight": 68}`))
+		case "/detect-faces":
+			w.Write([]byte(`{"faces": [{"x": 10, "y": 20, "width": 30, "height": 40}]}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	client := NewMLClient(server.URL, time.Second, 0, 0, MLAuth{}, nil, NewCircuitBreaker(10, time.Minute))
+
+	result, err := client.Predict(context.Background(), strings.NewReader("image"))
+	if err != nil {
+		t.Fatalf("Predict: %v", err)
+	}
+	if result.Height != 172 || result.Weight != 68 {
+		t.Errorf("Predict = %v cm %v kg, want 172 cm 68 kg", result.Height, result.Weight)
+	}
+
+	faces, err := client.DetectFaces(context.Background(), strings.NewReader("image"))
+	if err != nil {
+		t.Fatalf("DetectFaces: %v", err)
+	}
+	if want := []image.Rectangle{image.Rect(10, 20, 40, 60)}; !slices.Equal(faces, want) {
+		t.Errorf("DetectFaces = %v, want %v", faces, want)
+	}
+}
+
+func TestDevModeMock(t *testing.T) {
+	tests := []struct {
+		name       string
+		env        map[string]string
+		wantWeight float64
+		wantErr    error
+		wantMsg    string
+	}{
+		{name: "heuristic by default", wantWeight: HeuristicWeight(175, int64(len("front")), int64(len("side")))},
+		{name: "fixed weight", env: map[string]string{"MOCK_WEIGHT": "82.5"}, wantWeight: 82.5},
+		{name: "busy", env: map[string]string{"MOCK_ERROR": "busy"}, wantErr: ErrMLBusy},
+		{name: "unavailable", env: map[string]string{"MOCK_ERROR": "unavailable"}, wantErr: ErrCircuitOpen},
+		{name: "no person", env: map[string]string{"MOCK_ERROR": "no_person"}, wantErr: ErrNoPersonDetected},
+		{name: "other failure", env: map[string]string{"MOCK_ERROR": "model crashed"}, wantMsg: "model crashed"},
+		{name: "error wins over weight", env: map[string]string{"MOCK_WEIGHT": "82.5", "MOCK_ERROR": "busy"}, wantErr: ErrMLBusy},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("DEV_MODE", "true")
+			_, service, err := NewMLClientsFromConfig(testutil.Config(t, tt.env)).Resolve("")
+			if err != nil {
+				t.Fatalf("Resolve: %v", err)
+			}
+
+			resp, err := service.PredictWeight(context.Background(), strings.NewReader("front"), testSides(), 175)
+			switch {
+			case tt.wantErr != nil:
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("error = %v, want %v", err, tt.wantErr)
+				}
+			case tt.wantMsg != "":
+				if err == nil || !strings.Contains(err.Error(), tt.wantMsg) {
+					t.Fatalf("error = %v, want one mentioning %q", err, tt.wantMsg)
+				}
+			case err != nil:
+				t.Fatalf("PredictWeight: %v", err)
+			default:
+				if resp.Weight != tt.wantWeight || resp.Mode != PredictionModeMock {
+					t.Errorf("got %v kg (%s), want %v kg (%s)", resp.Weight, resp.Mode, tt.wantWeight, PredictionModeMock)
+				}
+			}
+		})
+	}
+}
+
+func TestPredictWeightNoPersonDetected(t *testing.T) {
+	tests := []struct {
+		name      string
+		minWeight string // MIN_PLAUSIBLE_WEIGHT, empty for the default
+		response  ModelResponse
+		wantOK    bool
+	}{
+		{"normal prediction", "", ModelResponse{Weight: 72.5, PredictedHeight: 176}, true},
+		{"no predicted height", "", ModelResponse{Weight: 72.5}, true},
+		{"zeros", "", ModelResponse{Weight: 0, PredictedHeight: 0, Confidence: 0.05}, false},
+		{"negative weight", "", ModelResponse{Weight: -3, PredictedHeight: 170}, false},
+		{"negative height", "", ModelResponse{Weight: 72.5, PredictedHeight: -1}, false},
+		{"below the configured minimum", "30", ModelResponse{Weight: 25, PredictedHeight: 120}, false},
+		{"at the configured minimum", "30", ModelResponse{Weight: 30, PredictedHeight: 120}, true},
+		{"no minimum still rejects zero", "0", ModelResponse{Weight: 0}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("DEV_MODE", "false")
+			server := newPredictServer(t, tt.response)
+			env := map[string]string{"ML_SERVICE_URL": server.URL}
+			if tt.minWeight != "" {
+				env["MIN_PLAUSIBLE_WEIGHT"] = tt.minWeight
+			}
+			_, service, err := NewMLClientsFromConfig(testutil.Config(t, env)).Resolve("")
+			if err != nil {
+				t.Fatalf("Resolve: %v", err)
+			}
+
+			prediction, err := service.PredictWeight(context.Background(), strings.NewReader("front"), testSides(), 175)
+			if !tt.wantOK {
+				if !errors.Is(err, ErrNoPersonDetected) {
+					t.Errorf("PredictWeight error = %v, want %v", err, ErrNoPersonDetected)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("PredictWeight: %v", err)
+			}
+			if prediction.Weight != tt.response.Weight {
+				t.Errorf("weight = %v, want %v", prediction.Weight, tt.response.Weight)
+			}
+		})
+	}
+}
+
+func TestMLAuthHeader(t *testing.T) {
+	tests := []struct {
+		name       string
+		env        map[string]string
+		wantHeader string // Empty when no credential is sent
+		wantValue  string
+	}{
+		{"no token", nil, "", ""},
+		{"bearer token", map[string]string{"ML_SERVICE_TOKEN": "secret"}, "Authorization", "Bearer secret"},
+		{"lowercase authorization", map[string]string{"ML_SERVICE_TOKEN": "secret", "ML_AUTH_HEADER": "authorization"}, "Authorization", "Bearer secret"},
+		{"custom header", map[string]string{"ML_SERVICE_TOKEN": "secret", "ML_AUTH_HEADER": "X-Api-Key"}, "X-Api-Key", "secret"},
+		{"header without a token", map[string]string{"ML_AUTH_HEADER": "X-Api-Key"}, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("DEV_MODE", "false")
+			var mu sync.Mutex
+			seen := map[string]http.Header{}
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				seen[r.URL.Path] = r.Header.Clone()
+				mu.Unlock()
+				switch r.URL.Path {
+				case "/predict":
+					w.Write([]byte(`{"weight": 70}`))
+				case "/version":
+					w.Write([]byte(`{"version": "1.2.0"}`))
+				default:
+					w.Write([]byte(`{"status": "ok"}`))
+				}
+			}))
+			defer server.Close()
+
+			env := map[string]string{"ML_SERVICE_URL": server.URL}
+			for key, value := range tt.env {
+				env[key] = value
+			}
+			cfg := testutil.Config(t, env)
+			_, service, err := NewMLClientsFromConfig(cfg).Resolve("")
+			if err != nil {
+				t.Fatalf("Resolve: %v", err)
+			}
+			if _, err := service.PredictWeight(context.Background(), strings.NewReader("front"), testSides(), 175); err != nil {
+				t.Fatalf("PredictWeight: %v", err)
+			}
+			auth := NewMLAuth(cfg)
+			if err := PingMLService(context.Background(), cfg.MLServiceURL, auth); err != nil {
+				t.Fatalf("PingMLService: %v", err)
+			}
+			MLServiceVersion(context.Background(), cfg.MLServiceURL, auth)
+
+			mu.Lock()
+			defer mu.Unlock()
+			for _, path := range []string{"/predict", "/health", "/version"} {
+				header, ok := seen[path]
+				if !ok {
+					t.Errorf("%s not requested", path)
+					continue
+				}
+				for _, name := range []string{"Authorization", "X-Api-Key"} {
+					want := ""
+					if name == tt.wantHeader {
+						want = tt.wantValue
+					}
+					if got := header.Get(name); got != want {
+						t.Errorf("%s: %s = %q, want %q", path, name, got, want)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestPredictWeightInferenceTime(t *testing.T) {
+	const delay = 200 * time.Millisecond
+	tests := []struct {
+		name    string
+		delay   time.Duration
+		failing int32 // Attempts answered 503 before the prediction
+		wantMin time.Duration
+		wantMax time.Duration
+	}{
+		{"fast", 0, 0, 0, 100 * time.Millisecond},
+		{"slow", delay, 0, delay, delay + 500*time.Millisecond},
+		// Retries are part of the wait, so they count
+		{"retried", delay, 1, delay, delay + 2*time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var attempts atomic.Int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if attempts.Add(1) <= tt.failing {
+					http.Error(w, "warming up", http.StatusServiceUnavailable)
+					return
+				}
+				time.Sleep(tt.delay)
+				w.Write([]byte(`{"weight": 70}`))
+			}))
+			defer server.Close()
+			client := NewMLClient(server.URL, 5*time.Second, int(tt.failing), 0, MLAuth{}, nil, NewCircuitBreaker(5, time.Minute))
+
+			result, err := client.PredictWeight(context.Background(), strings.NewReader("front"), testSides(), 175)
+			if err != nil {
+				t.Fatalf("PredictWeight: %v", err)
+			}
+			if got := time.Duration(result.InferenceMs) * time.Millisecond; got < tt.wantMin || got > tt.wantMax {
+				t.Errorf("inference time = %v, want %v to %v", got, tt.wantMin, tt.wantMax)
+			}
+			if result.Mode != PredictionModeModel {
+				t.Errorf("mode = %q, want %q", result.Mode, PredictionModeModel)
+			}
+		})
+	}
+}
+
+func TestMLClientDeadline(t *testing.T) {
+	tests := []struct {
+		name      string
+		timeout   time.Duration // Client timeout
+		deadline  time.Duration // Left on the request context, negative when already past
+		wantCalls int64
+	}{
+		{"request deadline sooner", 5 * time.Second, 100 * time.Millisecond, 1},
+		{"client timeout sooner", 100 * time.Millisecond, 5 * time.Second, 1},
+		{"request already expired", 5 * time.Second, -time.Second, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls atomic.Int64
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				calls.Add(1)
+				// Reading the body lets the server notice the client hanging up
+				io.Copy(io.Discard, r.Body)
+				select {
+				case <-time.After(3 * time.Second):
+					w.Write([]byte(`{"weight": 70}`))
+				case <-r.Context().Done():
+				}
+			}))
+			defer server.Close()
+			client := NewMLClient(server.URL, tt.timeout, 0, 0, MLAuth{}, nil, NewCircuitBreaker(5, time.Minute))
+
+			ctx, cancel := context.WithTimeout(context.Background(), tt.deadline)
+			defer cancel()
+			start := time.Now()
+			_, err := client.PredictWeight(ctx, strings.NewReader("front"), testSides(), 175)
+			elapsed := time.Since(start)
+			if err == nil {
+				t.Fatal("PredictWeight succeeded past the deadline")
+			}
+			// Whichever limit is sooner ends the call, well before the slow reply
+			if elapsed > time.Second {
+				t.Errorf("PredictWeight took %v, want it cut off after about 100ms", elapsed)
+			}
+			if got := calls.Load(); got != tt.wantCalls {
+				t.Errorf("ML service called %d times, want %d", got, tt.wantCalls)
+			}
+		})
+	}
+}
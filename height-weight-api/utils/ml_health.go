@@ -0,0 +1,79 @@
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// UnknownMLVersion is reported when the ML service doesn't tell its version
+const UnknownMLVersion = "unknown"
+
+// maxVersionBodySize bounds the ML service responses read for its version
+const maxVersionBodySize = 64 << 10
+
+// PingMLService checks that the ML service at url answers its health endpoint,
+// sending auth like prediction requests. The request is bounded by ctx, so
+// callers should set a short deadline.
+func PingMLService(ctx context.Context, url string, auth MLAuth) error {
+	resp, err := getMLService(ctx, url+"/health", auth)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("ML service health check returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// MLServiceVersion returns the version the ML service at url reports on its
+// /version endpoint, or else in the version field of its /health response.
+// A service that reports neither, or can't be reached, is UnknownMLVersion.
+func MLServiceVersion(ctx context.Context, url string, auth MLAuth) string {
+	for _, path := range []string{"/version", "/health"} {
+		if version := fetchMLVersion(ctx, url+path, auth); version != "" {
+			return version
+		}
+	}
+	return UnknownMLVersion
+}
+
+// fetchMLVersion returns the version field of the JSON object at url, empty
+// when there is none
+func fetchMLVersion(ctx context.Context, url string, auth MLAuth) string {
+	resp, err := getMLService(ctx, url, auth)
+	if err != nil {
+		return ""
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return ""
+	}
+	var body struct {
+		Version string `json:"version"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxVersionBodySize)).Decode(&body); err != nil {
+		return ""
+	}
+	return body.Version
+}
+
+// getMLService sends a GET request to the ML service with auth
+func getMLService(ctx context.Context, url string, auth MLAuth) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create health request: %w", err)
+	}
+	auth.apply(req)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("ML service unreachable: %w", err)
+	}
+	return resp, nil
+}
@@ -0,0 +1,99 @@
+package utils
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestPingMLService(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/health" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(`{"status":"ok"}`))
+	}))
+	defer up.Close()
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "model not loaded", http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer slow.Close()
+
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	tests := []struct {
+		name    string
+		url     string
+		healthy bool
+	}{
+		{"up", up.URL, true},
+		{"unhealthy", failing.URL, false},
+		{"slow", slow.URL, false},
+		{"down", down.URL, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+
+			start := time.Now()
+			err := PingMLService(ctx, tt.url, MLAuth{})
+			if healthy := err == nil; healthy != tt.healthy {
+				t.Errorf("PingMLService = %v, want healthy %v", err, tt.healthy)
+			}
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Errorf("PingMLService took %v, want it bounded by the context", elapsed)
+			}
+		})
+	}
+}
+
+func TestMLServiceVersion(t *testing.T) {
+	// versionServer answers each path with its body, and 404 for the others
+	versionServer := func(bodies map[string]string) string {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, ok := bodies[r.URL.Path]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			w.Write([]byte(body))
+		}))
+		t.Cleanup(server.Close)
+		return server.URL
+	}
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	tests := []struct {
+		name string
+		url  string
+		want string
+	}{
+		{"version endpoint", versionServer(map[string]string{"/version": `{"version":"2.1.0"}`, "/health": `{"version":"1.0"}`}), "2.1.0"},
+		{"health fallback", versionServer(map[string]string{"/health": `{"status":"ok","version":"1.4"}`}), "1.4"},
+		{"unparseable version", versionServer(map[string]string{"/version": "2.1.0", "/health": `{"version":"1.4"}`}), "1.4"},
+		{"not reported", versionServer(map[string]string{"/health": `{"status":"ok"}`}), UnknownMLVersion},
+		{"unreachable", down.URL, UnknownMLVersion},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := MLServiceVersion(context.Background(), tt.url, MLAuth{}); got != tt.want {
+				t.Errorf("MLServiceVersion = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
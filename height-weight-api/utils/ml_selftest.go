@@ -0,0 +1,66 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+)
+
+// selfTestHeight is the height in cm reported with the self-test images
+const selfTestHeight = 175.0
+
+// maxSelfTestWeight is the heaviest self-test prediction in kg still taken
+// as sane
+const maxSelfTestWeight = 500.0
+
+// SelfTestML sends a bundled front and side image pair to service and checks
+// that it answers with a sane prediction, proving the whole round trip works
+// rather than only that the service is listening. The images are drawn
+// silhouettes, so a model that finds nobody in them still passes: it answered
+// a well-formed prediction.
+func SelfTestML(ctx context.Context, service MLService) error {
+	front, err := selfTestImage(60)
+	if err != nil {
+		return fmt.Errorf("failed to create self-test image: %w", err)
+	}
+	side, err := selfTestImage(30)
+	if err != nil {
+		return fmt.Errorf("failed to create self-test image: %w", err)
+	}
+
+	result, err := service.PredictWeight(ctx, bytes.NewReader(front), []SideImage{{View: SideViewSingle, Image: bytes.NewReader(side)}}, selfTestHeight)
+	if errors.Is(err, ErrNoPersonDetected) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("ML self-test prediction failed: %w", err)
+	}
+	if result.Weight > maxSelfTestWeight {
+		return fmt.Errorf("ML self-test predicted an implausible weight of %g kg", result.Weight)
+	}
+	return nil
+}
+
+// selfTestImage draws a standing figure of the given body width as a JPEG
+func selfTestImage(bodyWidth int) ([]byte, error) {
+	img := image.NewRGBA(image.Rect(0, 0, 240, 480))
+	draw.Draw(img, img.Bounds(), image.White, image.Point{}, draw.Src)
+
+	figure := image.NewUniform(color.Gray{Y: 40})
+	center := img.Bounds().Dx() / 2
+	// Head, body and legs
+	draw.Draw(img, image.Rect(center-20, 40, center+20, 90), figure, image.Point{}, draw.Src)
+	draw.Draw(img, image.Rect(center-bodyWidth/2, 95, center+bodyWidth/2, 270), figure, image.Point{}, draw.Src)
+	draw.Draw(img, image.Rect(center-bodyWidth/2, 270, center+bodyWidth/2, 440), figure, image.Point{}, draw.Src)
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 80}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
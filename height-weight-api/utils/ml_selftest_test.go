@@ -0,0 +1,59 @@
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"image/jpeg"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/lucasfepe/height-weight-api/internal/testutil"
+)
+
+func TestSelfTestML(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   int
+		response ModelResponse
+		wantErr  bool
+	}{
+		{"sane", http.StatusOK, ModelResponse{Weight: 72}, false},
+		{"no person", http.StatusOK, ModelResponse{Weight: 0}, false},
+		{"implausible", http.StatusOK, ModelResponse{Weight: 900}, true},
+		{"failing", http.StatusInternalServerError, ModelResponse{Error: "model not loaded"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				// The self-test sends the bundled images like any estimation
+				if height := r.FormValue("height"); height != "175" {
+					t.Errorf("height = %q, want 175", height)
+				}
+				for _, field := range []string{"front_image", SideViewSingle} {
+					file, _, err := r.FormFile(field)
+					if err != nil {
+						t.Errorf("%s: %v", field, err)
+						continue
+					}
+					if _, err := jpeg.Decode(file); err != nil {
+						t.Errorf("%s is not a JPEG: %v", field, err)
+					}
+					file.Close()
+				}
+				w.WriteHeader(tt.status)
+				json.NewEncoder(w).Encode(tt.response)
+			}))
+			defer server.Close()
+
+			cfg := testutil.Config(t, map[string]string{"ML_MODELS": "v1=" + server.URL, "ML_RETRIES": "0"})
+			_, service, err := NewMLClientsFromConfig(cfg).Resolve("v1")
+			if err != nil {
+				t.Fatalf("Resolve: %v", err)
+			}
+			if err := SelfTestML(context.Background(), service); (err != nil) != tt.wantErr {
+				t.Errorf("SelfTestML = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,111 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+
+	"github.com/lucasfepe/height-weight-api/models"
+)
+
+// glyphWidth and glyphHeight are the size of an overlay font glyph in font pixels
+const (
+	glyphWidth  = 5
+	glyphHeight = 7
+)
+
+// overlayGlyphs is a small bitmap font covering the overlay text. Runes
+// without a glyph are drawn as blanks.
+var overlayGlyphs = map[rune][glyphHeight]string{
+	'0': {".###.", "#...#", "#..##", "#.#.#", "##..#", "#...#", ".###."},
+	'1': {"..#..", ".##..", "..#..", "..#..", "..#..", "..#..", ".###."},
+	'2': {".###.", "#...#", "....#", "...#.", "..#..", ".#...", "#####"},
+	'3': {"#####", "...#.", "..#..", "...#.", "....#", "#...#", ".###."},
+	'4': {"...#.", "..##.", ".#.#.", "#..#.", "#####", "...#.", "...#."},
+	'5': {"#####", "#....", "####.", "....#", "....#", "#...#", ".###."},
+	'6': {"..##.", ".#...", "#....", "####.", "#...#", "#...#", ".###."},
+	'7': {"#####", "....#", "...#.", "..#..", ".#...", ".#...", ".#..."},
+	'8': {".###.", "#...#", "#...#", ".###.", "#...#", "#...#", ".###."},
+	'9': {".###.", "#...#", "#...#", ".####", "....#", "...#.", ".##.."},
+	'.': {".....", ".....", ".....", ".....", ".....", ".##..", ".##.."},
+	'c': {".....", ".....", ".###.", "#....", "#....", "#...#", ".###."},
+	'm': {".....", ".....", "##.#.", "#.#.#", "#.#.#", "#...#", "#...#"},
+	'k': {"#....", "#....", "#..#.", "#.#..", "##...", "#.#..", "#..#."},
+	'g': {".....", ".####", "#...#", "#...#", ".####", "....#", ".###."},
+}
+
+// Overlay colors: light text on a dark label, framed in the accent color
+var (
+	overlayText   = color.RGBA{R: 255, G: 255, B: 255, A: 255}
+	overlayLabel  = color.RGBA{R: 0, G: 0, B: 0, A: 180}
+	overlayAccent = color.RGBA{R: 0, G: 200, B: 83, A: 255}
+)
+
+// AnnotateImage returns a copy of img with the estimation's height and weight
+// drawn in a label at its top left, and the photo framed by a bounding box.
+// The text scales with the image so it stays readable.
+func AnnotateImage(img image.Image, est *models.Estimation) (image.Image, error) {
+	if est == nil {
+		return nil, errors.New("no estimation to annotate")
+	}
+	bounds := img.Bounds()
+	if bounds.Empty() {
+		return nil, errors.New("image is empty")
+	}
+
+	canvas := image.NewRGBA(bounds)
+	draw.Draw(canvas, bounds, img, bounds.Min, draw.Src)
+
+	lines := []string{fmt.Sprintf("%.1f cm", est.Height), fmt.Sprintf("%.1f kg", est.Weight)}
+	columns := max(len(lines[0]), len(lines[1]))
+
+	// One font pixel per 80 image pixels of the shorter side, so a phone photo
+	// gets large text, but never wider than the image
+	border := max(2, min(bounds.Dx(), bounds.Dy())/80)
+	fit := (bounds.Dx() - 2*border) / (columns*(glyphWidth+1) + 3)
+	scale := max(1, min(min(bounds.Dx(), bounds.Dy())/80, fit))
+
+	// Bounding box around the photo
+	for _, edge := range []image.Rectangle{
+		image.Rect(bounds.Min.X, bounds.Min.Y, bounds.Max.X, bounds.Min.Y+border),
+		image.Rect(bounds.Min.X, bounds.Max.Y-border, bounds.Max.X, bounds.Max.Y),
+		image.Rect(bounds.Min.X, bounds.Min.Y, bounds.Min.X+border, bounds.Max.Y),
+		image.Rect(bounds.Max.X-border, bounds.Min.Y, bounds.Max.X, bounds.Max.Y),
+	} {
+		draw.Draw(canvas, edge, image.NewUniform(overlayAccent), image.Point{}, draw.Src)
+	}
+
+	// Label behind the text, blended so the photo shows through
+	padding := 2 * scale
+	advance := (glyphWidth + 1) * scale
+	lineHeight := (glyphHeight + 2) * scale
+	label := image.Rect(0, 0, columns*advance-scale+2*padding, len(lines)*lineHeight-2*scale+2*padding).
+		Add(bounds.Min.Add(image.Pt(border, border))).
+		Intersect(bounds)
+	draw.Draw(canvas, label, image.NewUniform(overlayLabel), image.Point{}, draw.Over)
+
+	for row, line := range lines {
+		origin := label.Min.Add(image.Pt(padding, padding+row*lineHeight))
+		for i, r := range line {
+			drawGlyph(canvas, overlayGlyphs[r], origin.Add(image.Pt(i*advance, 0)), scale)
+		}
+	}
+	return canvas, nil
+}
+
+// drawGlyph draws a glyph with its top left corner at origin, each font pixel
+// as a scale × scale square. Pixels outside the canvas are clipped.
+func drawGlyph(canvas *image.RGBA, glyph [glyphHeight]string, origin image.Point, scale int) {
+	text := image.NewUniform(overlayText)
+	for y, row := range glyph {
+		for x, pixel := range row {
+			if pixel != '#' {
+				continue
+			}
+			square := image.Rect(x*scale, y*scale, (x+1)*scale, (y+1)*scale).Add(origin)
+			draw.Draw(canvas, square.Intersect(canvas.Bounds()), text, image.Point{}, draw.Src)
+		}
+	}
+}
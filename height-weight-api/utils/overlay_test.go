@@ -0,0 +1,54 @@
+package utils
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"testing"
+
+	"github.com/lucasfepe/height-weight-api/models"
+)
+
+func TestAnnotateImage(t *testing.T) {
+	gray := color.RGBA{R: 128, G: 128, B: 128, A: 255}
+	// Offset bounds, as a cropped image has
+	img := image.NewRGBA(image.Rect(10, 20, 410, 620))
+	draw.Draw(img, img.Bounds(), image.NewUniform(gray), image.Point{}, draw.Src)
+
+	annotated, err := AnnotateImage(img, &models.Estimation{Height: 175.5, Weight: 70.2})
+	if err != nil {
+		t.Fatalf("AnnotateImage: %v", err)
+	}
+	if annotated.Bounds() != img.Bounds() {
+		t.Errorf("bounds = %v, want %v", annotated.Bounds(), img.Bounds())
+	}
+
+	// Framed in the accent color, with the text label inside the top left
+	if got := color.RGBAModel.Convert(annotated.At(10, 20)); got != overlayAccent {
+		t.Errorf("corner = %v, want the accent %v", got, overlayAccent)
+	}
+	labelled := 0
+	for y := 25; y < 60; y++ {
+		for x := 15; x < 100; x++ {
+			if color.RGBAModel.Convert(annotated.At(x, y)) != gray {
+				labelled++
+			}
+		}
+	}
+	if labelled == 0 {
+		t.Error("no label drawn at the top left")
+	}
+	if got := color.RGBAModel.Convert(annotated.At(210, 320)); got != gray {
+		t.Errorf("center = %v, want the photo's %v", got, gray)
+	}
+	if img.At(10, 20) != gray {
+		t.Error("AnnotateImage drew on the original image")
+	}
+
+	if _, err := AnnotateImage(img, nil); err == nil {
+		t.Error("AnnotateImage without an estimation succeeded, want an error")
+	}
+	if _, err := AnnotateImage(image.NewRGBA(image.Rectangle{}), &models.Estimation{}); err == nil {
+		t.Error("AnnotateImage of an empty image succeeded, want an error")
+	}
+}
@@ -0,0 +1,30 @@
+package utils
+
+// Page wraps one page of list results with pagination metadata
+type Page struct {
+	Items   interface{} `json:"items"`
+	Total   int64       `json:"total"`
+	Limit   int64       `json:"limit"`
+	Offset  int64       `json:"offset"`
+	HasMore bool        `json:"has_more"`
+}
+
+// CursorPage wraps one page of list results fetched after a cursor. Pass
+// NextCursor as the cursor of the following page; it is empty on the last page.
+type CursorPage struct {
+	Items      interface{} `json:"items"`
+	Limit      int64       `json:"limit"`
+	NextCursor string      `json:"next_cursor,omitempty"`
+	HasMore    bool        `json:"has_more"`
+}
+
+// NewPage builds a Page for count items fetched at offset out of total
+func NewPage(items interface{}, count int, total, limit, offset int64) Page {
+	return Page{
+		Items:   items,
+		Total:   total,
+		Limit:   limit,
+		Offset:  offset,
+		HasMore: offset+int64(count) < total,
+	}
+}
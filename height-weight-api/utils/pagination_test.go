@@ -0,0 +1,30 @@
+package utils
+
+import "testing"
+
+func TestNewPage(t *testing.T) {
+	tests := []struct {
+		name                 string
+		count                int
+		total, limit, offset int64
+		wantMore             bool
+	}{
+		{"first of several pages", 10, 25, 10, 0, true},
+		{"middle page", 10, 25, 10, 10, true},
+		{"last partial page", 5, 25, 10, 20, false},
+		{"exactly filled", 10, 20, 10, 10, false},
+		{"empty collection", 0, 0, 10, 0, false},
+		{"offset past the end", 0, 25, 10, 30, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			page := NewPage([]int{}, tt.count, tt.total, tt.limit, tt.offset)
+			if page.HasMore != tt.wantMore {
+				t.Errorf("HasMore = %v, want %v", page.HasMore, tt.wantMore)
+			}
+			if page.Total != tt.total || page.Limit != tt.limit || page.Offset != tt.offset {
+				t.Errorf("page = total %d limit %d offset %d, want %d %d %d", page.Total, page.Limit, page.Offset, tt.total, tt.limit, tt.offset)
+			}
+		})
+	}
+}
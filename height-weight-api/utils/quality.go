@@ -0,0 +1,69 @@
+package utils
+
+import (
+	"image"
+)
+
+// qualitySampleSize is the longest side, in pixels, images are scaled down
+// to before measuring their quality, so the metrics don't depend on the
+// camera resolution and big photos are measured quickly
+const qualitySampleSize = 512
+
+// ImageQuality measures how sharp and how bright a photo is. blur is the
+// variance of the Laplacian of its luminance: blurry photos have few edges
+// and score low. brightness is the mean luminance from 0 (black) to 255
+// (white). Both are measured on the image scaled to at most
+// qualitySampleSize pixels on its longer side.
+func ImageQuality(img image.Image) (blur, brightness float64) {
+	gray, width, height := sampleLuminance(img)
+	if width == 0 || height == 0 {
+		return 0, 0
+	}
+
+	var sum float64
+	for _, v := range gray {
+		sum += v
+	}
+	brightness = sum / float64(len(gray))
+
+	// The Laplacian needs a neighbour on every side, so the border is skipped
+	if width < 3 || height < 3 {
+		return 0, brightness
+	}
+	var lapSum, lapSumSq float64
+	for y := 1; y < height-1; y++ {
+		for x := 1; x < width-1; x++ {
+			i := y*width + x
+			lap := gray[i-width] + gray[i+width] + gray[i-1] + gray[i+1] - 4*gray[i]
+			lapSum += lap
+			lapSumSq += lap * lap
+		}
+	}
+	n := float64((width - 2) * (height - 2))
+	mean := lapSum / n
+	return lapSumSq/n - mean*mean, brightness
+}
+
+// sampleLuminance returns the luminance of img, 0 to 255, scaled down by
+// averaging blocks of pixels until it fits qualitySampleSize
+func sampleLuminance(img image.Image) ([]float64, int, int) {
+	bounds := img.Bounds()
+	step := max(1, (max(bounds.Dx(), bounds.Dy())+qualitySampleSize-1)/qualitySampleSize)
+	width, height := bounds.Dx()/step, bounds.Dy()/step
+
+	gray := make([]float64, width*height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			var sum float64
+			for dy := 0; dy < step; dy++ {
+				for dx := 0; dx < step; dx++ {
+					r, g, b, _ := img.At(bounds.Min.X+x*step+dx, bounds.Min.Y+y*step+dy).RGBA()
+					// Rec. 601 luma, from 16-bit channels to 0-255
+					sum += (0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)) / 257
+				}
+			}
+			gray[y*width+x] = sum / float64(step*step)
+		}
+	}
+	return gray, width, height
+}
@@ -0,0 +1,53 @@
+package utils
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// grayImage returns a width by height image with each pixel's shade from shade
+func grayImage(width, height int, shade func(x, y int) uint8) *image.Gray {
+	img := image.NewGray(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.SetGray(x, y, color.Gray{Y: shade(x, y)})
+		}
+	}
+	return img
+}
+
+func TestImageQuality(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	noise := func(x, y int) uint8 { return uint8(rng.Intn(256)) }
+	edges := func(x, y int) uint8 {
+		if (x/8+y/8)%2 == 0 {
+			return 30
+		}
+		return 220
+	}
+	gradient := func(x, y int) uint8 { return uint8(60 + x*120/400) }
+
+	sharp, _ := ImageQuality(grayImage(400, 400, noise))
+	checkerboard, _ := ImageQuality(grayImage(400, 400, edges))
+	blurred, brightness := ImageQuality(grayImage(400, 400, gradient))
+	if blurred > 1 {
+		t.Errorf("smooth gradient sharpness = %v, want about 0", blurred)
+	}
+	if checkerboard < 100*max(blurred, 1) || sharp < checkerboard {
+		t.Errorf("sharpness of noise %v, checkerboard %v, gradient %v, want them in decreasing order and far apart", sharp, checkerboard, blurred)
+	}
+	if brightness < 115 || brightness > 125 {
+		t.Errorf("gradient brightness = %v, want about 120", brightness)
+	}
+
+	// Large photos are scaled down first, which keeps a flat image flat
+	if sharpness, brightness := ImageQuality(grayImage(2000, 1500, func(x, y int) uint8 { return 200 })); sharpness != 0 || math.Abs(brightness-200) > 1e-9 {
+		t.Errorf("flat 2000x1500 image = sharpness %v, brightness %v, want 0 and 200", sharpness, brightness)
+	}
+	if sharpness, brightness := ImageQuality(image.NewGray(image.Rect(0, 0, 2, 2))); sharpness != 0 || brightness != 0 {
+		t.Errorf("2x2 black image = sharpness %v, brightness %v, want 0 and 0", sharpness, brightness)
+	}
+}
@@ -1,53 +1,245 @@
 package utils
 
 import (
+	"bytes"
 	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
 	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 )
 
-// Response represents a standard API response
+// APIVersion is the version of the response schema, sent in every Response
+// so clients can adapt as the API evolves
+const APIVersion = "1"
+
+// Response represents a standard API response. In XML it is a <response>
+// element whose children are named like the JSON fields. Respond fills in
+// APIVersion and Meta.
 type Response struct {
-	Success bool        `json:"success"`
-	Data    interface{} `json:"data,omitempty"`
-	Message string      `json:"message,omitempty"`
+	Success    bool                   `json:"success"`
+	APIVersion string                 `json:"api_version"`
+	Data       interface{}            `json:"data,omitempty"`
+	Message    string                 `json:"message,omitempty"`
+	ErrorCode  string                 `json:"error_code,omitempty"`
+	Details    map[string]interface{} `json:"details,omitempty"`
+	Meta       *ResponseMeta          `json:"meta,omitempty"`
+}
+
+// ResponseMeta describes the request a Response answers
+type ResponseMeta struct {
+	Timestamp time.Time `json:"timestamp"`
+	RequestID string    `json:"request_id,omitempty"`
 }
 
+// PrettyJSON makes Respond indent every JSON response. Single requests can
+// ask for it with ?pretty=true.
+var PrettyJSON bool
+
+// jsonIndent is the indentation of pretty JSON responses
+const jsonIndent = "  "
+
 // ErrorResponse represents an error response
 type ErrorResponse struct {
 	Error string `json:"error"`
 }
 
-// RespondWithError sends a JSON error response
-func RespondWithError(w http.ResponseWriter, code int, message string) {
-	response := Response{
-		Success: false,
-		Message: message,
+// Respond writes payload as JSON, or as XML when the request's Accept header
+// prefers it, with the matching Content-Type
+func Respond(w http.ResponseWriter, r *http.Request, code int, payload interface{}) {
+	if response, ok := payload.(Response); ok {
+		response.APIVersion = APIVersion
+		response.Meta = &ResponseMeta{Timestamp: time.Now().UTC()}
+		if r != nil {
+			response.Meta.RequestID = RequestID(r.Context())
+		}
+		payload = response
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(code)
-	json.NewEncoder(w).Encode(response)
-}
+	var body bytes.Buffer
+	contentType := ResponseContentType(r)
 
-// RespondWithJSON sends a JSON response
-func RespondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
-	response := Response{
-		Success: code >= 200 && code < 300,
-		Data:    payload,
+	var err error
+	if contentType == "application/xml" {
+		err = writeXML(&body, payload)
+	} else {
+		encoder := json.NewEncoder(&body)
+		if wantsPrettyJSON(r) {
+			encoder.SetIndent("", jsonIndent)
+		}
+		err = encoder.Encode(payload)
 	}
 
-	responseJSON, err := json.Marshal(response)
 	if err != nil {
+		// Fall back to a plain JSON error, which can always be encoded
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(Response{
-			Success: false,
-			Message: "Internal server error",
+			Success:    false,
+			APIVersion: APIVersion,
+			Message:    "Internal server error",
+			ErrorCode:  ErrCodeInternal,
 		})
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Add("Vary", "Accept")
 	w.WriteHeader(code)
-	w.Write(responseJSON)
+	w.Write(body.Bytes())
+}
+
+// RespondWithError sends an error response with one of the ErrCode values
+func RespondWithError(w http.ResponseWriter, r *http.Request, code int, errCode, message string) {
+	RespondWithErrorDetails(w, r, code, errCode, message, nil)
+}
+
+// RespondWithErrorDetails sends an error response with extra context for clients
+func RespondWithErrorDetails(w http.ResponseWriter, r *http.Request, code int, errCode, message string, details map[string]interface{}) {
+	Respond(w, r, code, Response{
+		Success:   false,
+		Message:   message,
+		ErrorCode: errCode,
+		Details:   details,
+	})
+}
+
+// RespondWithData sends payload wrapped in the standard Response
+func RespondWithData(w http.ResponseWriter, r *http.Request, code int, payload interface{}) {
+	Respond(w, r, code, Response{
+		Success: code >= 200 && code < 300,
+		Data:    payload,
+	})
+}
+
+// wantsPrettyJSON reports whether JSON for r should be indented, for all
+// responses through PrettyJSON or for r through its pretty query parameter
+func wantsPrettyJSON(r *http.Request) bool {
+	if PrettyJSON {
+		return true
+	}
+	if r == nil {
+		return false
+	}
+	pretty, _ := strconv.ParseBool(r.URL.Query().Get("pretty"))
+	return pretty
+}
+
+// ResponseContentType returns the media type Respond uses for r:
+// application/xml when the Accept header prefers XML, application/json otherwise
+func ResponseContentType(r *http.Request) string {
+	if r != nil && prefersXML(r.Header.Get("Accept")) {
+		return "application/xml"
+	}
+	return "application/json"
+}
+
+// prefersXML reports whether an Accept header ranks XML above JSON. JSON wins
+// ties, so wildcards and a missing header keep the JSON default.
+func prefersXML(accept string) bool {
+	var jsonQ, xmlQ float64
+	for _, mediaRange := range strings.Split(accept, ",") {
+		mediaType, params, _ := strings.Cut(strings.TrimSpace(mediaRange), ";")
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			if value, ok := strings.CutPrefix(strings.TrimSpace(param), "q="); ok {
+				if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+
+		switch strings.ToLower(strings.TrimSpace(mediaType)) {
+		case "application/xml", "text/xml":
+			xmlQ = max(xmlQ, q)
+		case "application/json", "application/*", "*/*":
+			jsonQ = max(jsonQ, q)
+		}
+	}
+	return xmlQ > jsonQ
+}
+
+// writeXML encodes payload as XML under a <response> root. The payload goes
+// through its JSON form first, so element names and omitted fields match the
+// JSON output and maps encode too, which encoding/xml can't do on its own.
+func writeXML(w io.Writer, payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return err
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	encoder := xml.NewEncoder(w)
+	if err := encodeXMLValue(encoder, "response", value); err != nil {
+		return err
+	}
+	return encoder.Flush()
+}
+
+// encodeXMLValue writes a decoded JSON value as an element called name.
+// Objects become child elements in key order, arrays repeated <item> elements.
+func encodeXMLValue(encoder *xml.Encoder, name string, value interface{}) error {
+	start := xml.StartElement{Name: xml.Name{Local: xmlElementName(name)}}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		if err := encoder.EncodeToken(start); err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if err := encodeXMLValue(encoder, key, v[key]); err != nil {
+				return err
+			}
+		}
+		return encoder.EncodeToken(start.End())
+	case []interface{}:
+		if err := encoder.EncodeToken(start); err != nil {
+			return err
+		}
+		for _, item := range v {
+			if err := encodeXMLValue(encoder, "item", item); err != nil {
+				return err
+			}
+		}
+		return encoder.EncodeToken(start.End())
+	case nil:
+		return encoder.EncodeElement("", start)
+	default:
+		return encoder.EncodeElement(fmt.Sprint(v), start)
+	}
+}
+
+// xmlElementName turns a JSON key into a valid XML element name
+func xmlElementName(key string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_', r == '-', r == '.':
+			return r
+		}
+		return '_'
+	}, key)
+
+	if name == "" || !(name[0] == '_' || (name[0] >= 'a' && name[0] <= 'z') || (name[0] >= 'A' && name[0] <= 'Z')) {
+		name = "_" + name
+	}
+	return name
 }
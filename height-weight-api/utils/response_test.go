@@ -0,0 +1,188 @@
+package utils
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestResponseContentType(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   string
+	}{
+		{"", "application/json"},
+		{"*/*", "application/json"},
+		{"application/json", "application/json"},
+		{"application/xml", "application/xml"},
+		{"text/xml", "application/xml"},
+		{"application/json, application/xml", "application/json"},
+		{"application/json;q=0.5, application/xml", "application/xml"},
+		{"application/xml;q=0.9, */*", "application/json"},
+		{"text/html", "application/json"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.accept, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.Header.Set("Accept", tt.accept)
+			if got := ResponseContentType(r); got != tt.want {
+				t.Errorf("ResponseContentType(Accept: %q) = %q, want %q", tt.accept, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRespondFormats(t *testing.T) {
+	payload := map[string]interface{}{
+		"weight":   70.5,
+		"views":    []string{"side_image_left", "side_image_right"},
+		"bad key":  true,
+		"1st":      "first",
+		"optional": nil,
+	}
+
+	t.Run("json", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		RespondWithData(w, httptest.NewRequest(http.MethodGet, "/", nil), http.StatusOK, payload)
+		if got := w.Header().Get("Content-Type"); got != "application/json" {
+			t.Errorf("Content-Type = %q, want application/json", got)
+		}
+		var response struct {
+			Success bool `json:"success"`
+			Data    struct {
+				Weight float64  `json:"weight"`
+				Views  []string `json:"views"`
+			} `json:"data"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Fatalf("decode JSON %q: %v", w.Body.String(), err)
+		}
+		if !response.Success || response.Data.Weight != 70.5 || len(response.Data.Views) != 2 {
+			t.Errorf("response = %+v, want the payload", response)
+		}
+	})
+
+	t.Run("xml", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Accept", "application/xml")
+		w := httptest.NewRecorder()
+		RespondWithData(w, r, http.StatusCreated, payload)
+		if w.Code != http.StatusCreated {
+			t.Errorf("status = %d, want %d", w.Code, http.StatusCreated)
+		}
+		if got := w.Header().Get("Content-Type"); got != "application/xml" {
+			t.Errorf("Content-Type = %q, want application/xml", got)
+		}
+		if got := w.Header().Get("Vary"); got != "Accept" {
+			t.Errorf("Vary = %q, want Accept", got)
+		}
+
+		var response struct {
+			XMLName    xml.Name `xml:"response"`
+			Success    bool     `xml:"success"`
+			APIVersion string   `xml:"api_version"`
+			Data       struct {
+				Weight   float64  `xml:"weight"`
+				Views    []string `xml:"views>item"`
+				BadKey   bool     `xml:"bad_key"`
+				First    string   `xml:"_1st"`
+				Optional *string  `xml:"optional"`
+			} `xml:"data"`
+		}
+		if err := xml.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Fatalf("decode XML %q: %v", w.Body.String(), err)
+		}
+		if !response.Success || response.APIVersion != APIVersion {
+			t.Errorf("envelope = success %v, api_version %q; want true, %q", response.Success, response.APIVersion, APIVersion)
+		}
+		data := response.Data
+		if data.Weight != 70.5 || len(data.Views) != 2 || data.Views[1] != "side_image_right" || !data.BadKey || data.First != "first" {
+			t.Errorf("data = %+v, want the payload with sanitized element names", data)
+		}
+		if data.Optional == nil || *data.Optional != "" {
+			t.Errorf("optional = %v, want an empty element for null", data.Optional)
+		}
+	})
+}
+
+func TestRespondPrettyJSON(t *testing.T) {
+	tests := []struct {
+		name   string
+		global bool
+		target string
+		want   bool
+	}{
+		{"compact", false, "/", false},
+		{"global", true, "/", true},
+		{"query", false, "/?pretty=true", true},
+		{"query off", false, "/?pretty=0", false},
+		{"query invalid", false, "/?pretty=yes", false},
+		{"global ignores query", true, "/?pretty=false", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			PrettyJSON = tt.global
+			t.Cleanup(func() { PrettyJSON = false })
+
+			w := httptest.NewRecorder()
+			RespondWithData(w, httptest.NewRequest(http.MethodGet, tt.target, nil), http.StatusOK, map[string]float64{"weight": 70.5})
+			body := w.Body.String()
+			if got := strings.Contains(body, "\n"+jsonIndent+`"success": true`); got != tt.want {
+				t.Errorf("indented = %v, want %v in %q", got, tt.want, body)
+			}
+
+			var response struct {
+				Success bool `json:"success"`
+				Data    struct {
+					Weight float64 `json:"weight"`
+				} `json:"data"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+				t.Fatalf("decode JSON %q: %v", body, err)
+			}
+			if !response.Success || response.Data.Weight != 70.5 {
+				t.Errorf("response = %+v, want the payload", response)
+			}
+		})
+	}
+}
+
+func TestRespondAPIVersion(t *testing.T) {
+	tests := []struct {
+		name    string
+		respond func(w http.ResponseWriter, r *http.Request)
+		success bool
+	}{
+		{"success", func(w http.ResponseWriter, r *http.Request) {
+			RespondWithData(w, r, http.StatusOK, map[string]float64{"weight": 70.5})
+		}, true},
+		{"error", func(w http.ResponseWriter, r *http.Request) {
+			RespondWithError(w, r, http.StatusBadRequest, ErrCodeInvalidRequest, "Invalid request")
+		}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r = r.WithContext(WithRequestID(r.Context(), "req-1"))
+			w := httptest.NewRecorder()
+			tt.respond(w, r)
+
+			var response Response
+			if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+				t.Fatalf("decode JSON %q: %v", w.Body.String(), err)
+			}
+			if response.Success != tt.success {
+				t.Errorf("success = %v, want %v", response.Success, tt.success)
+			}
+			if response.APIVersion != APIVersion {
+				t.Errorf("api_version = %q, want %q", response.APIVersion, APIVersion)
+			}
+			if response.Meta == nil || response.Meta.RequestID != "req-1" || response.Meta.Timestamp.IsZero() {
+				t.Errorf("meta = %+v, want a timestamp and request ID req-1", response.Meta)
+			}
+		})
+	}
+}
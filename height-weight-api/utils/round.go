@@ -0,0 +1,9 @@
+package utils
+
+import "math"
+
+// Round rounds v to places decimal places, half away from zero
+func Round(v float64, places int) float64 {
+	scale := math.Pow(10, float64(places))
+	return math.Round(v*scale) / scale
+}
@@ -0,0 +1,24 @@
+package utils
+
+import "testing"
+
+func TestRound(t *testing.T) {
+	tests := []struct {
+		v      float64
+		places int
+		want   float64
+	}{
+		{72.456, 0, 72},
+		{72.5, 0, 73},
+		{72.456, 1, 72.5},
+		{72.456, 2, 72.46},
+		{72.456, 3, 72.456},
+		{-1.25, 1, -1.3},
+		{0, 2, 0},
+	}
+	for _, tt := range tests {
+		if got := Round(tt.v, tt.places); got != tt.want {
+			t.Errorf("Round(%v, %d) = %v, want %v", tt.v, tt.places, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package utils
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lucasfepe/height-weight-api/config"
+)
+
+// ErrObjectNotFound is returned when an object key doesn't exist in the bucket
+var ErrObjectNotFound = errors.New("object not found")
+
+// ErrObjectTooLarge is returned when an object exceeds the size allowed for it
+var ErrObjectTooLarge = errors.New("object too large")
+
+// maxPresignExpiry is the longest validity S3 accepts for a presigned URL
+const maxPresignExpiry = 7 * 24 * time.Hour
+
+// S3Client talks to an S3-compatible object store using presigned requests
+// (AWS Signature Version 4), so no SDK is needed
+type S3Client struct {
+	endpoint  *url.URL
+	region    string
+	bucket    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+	now       func() time.Time
+}
+
+// NewS3ClientFromConfig returns a client for the configured bucket, or nil
+// when S3 storage isn't configured
+func NewS3ClientFromConfig(cfg *config.Config) (*S3Client, error) {
+	if cfg.S3Bucket == "" {
+		return nil, nil
+	}
+
+	endpoint, err := url.Parse(cfg.S3Endpoint)
+	if err != nil || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid S3 endpoint %q", cfg.S3Endpoint)
+	}
+
+	return &S3Client{
+		endpoint:  endpoint,
+		region:    cfg.S3Region,
+		bucket:    cfg.S3Bucket,
+		accessKey: cfg.S3AccessKey,
+		secretKey: cfg.S3SecretKey,
+		client:    &http.Client{Timeout: 30 * time.Second},
+		now:       time.Now,
+	}, nil
+}
+
+// PresignPut returns a URL the client can PUT the object for key to directly,
+// valid for expiry
+func (c *S3Client) PresignPut(ctx context.Context, key string, expiry time.Duration) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	return c.presign(http.MethodPut, key, expiry)
+}
+
+// GetObject downloads the object for key, failing with ErrObjectTooLarge
+// once it exceeds maxSize bytes
+func (c *S3Client) GetObject(ctx context.Context, key string, maxSize int64) ([]byte, error) {
+	objectURL, err := c.presign(http.MethodGet, key, time.Minute)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, objectURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create S3 request: %w", err)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach S3: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, ErrObjectNotFound
+	case resp.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("S3 returned status %d", resp.StatusCode)
+	case resp.ContentLength > maxSize:
+		return nil, ErrObjectTooLarge
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read S3 object: %w", err)
+	}
+	if int64(len(data)) > maxSize {
+		return nil, ErrObjectTooLarge
+	}
+	return data, nil
+}
+
+// presign builds a path-style object URL for method carrying a SigV4 query
+// signature. The payload is left unsigned so clients can send any body.
+func (c *S3Client) presign(method, key string, expiry time.Duration) (string, error) {
+	if key == "" {
+		return "", errors.New("empty object key")
+	}
+	return c.signURL(method, strings.TrimSuffix(c.endpoint.Path, "/")+"/"+c.bucket+"/"+key, expiry)
+}
+
+// signURL returns the URL of path on the endpoint with a SigV4 query
+// signature for method, valid for expiry
+func (c *S3Client) signURL(method, path string, expiry time.Duration) (string, error) {
+	if expiry <= 0 || expiry > maxPresignExpiry {
+		return "", fmt.Errorf("presign expiry must be between 1s and %s", maxPresignExpiry)
+	}
+
+	now := c.now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	scope := now.Format("20060102") + "/" + c.region + "/s3/aws4_request"
+
+	query := map[string]string{
+		"X-Amz-Algorithm":     "AWS4-HMAC-SHA256",
+		"X-Amz-Credential":    c.accessKey + "/" + scope,
+		"X-Amz-Date":          amzDate,
+		"X-Amz-Expires":       strconv.Itoa(int(expiry.Seconds())),
+		"X-Amz-SignedHeaders": "host",
+	}
+	canonicalQuery := canonicalQueryString(query)
+
+	canonicalRequest := strings.Join([]string{
+		method,
+		sigV4Escape(path, false),
+		canonicalQuery,
+		"host:" + c.endpoint.Host + "\n",
+		"host",
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+	hashedRequest := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hex.EncodeToString(hashedRequest[:]),
+	}, "\n")
+
+	signingKey := hmacSHA256([]byte("AWS4"+c.secretKey), now.Format("20060102"))
+	for _, part := range []string{c.region, "s3", "aws4_request"} {
+		signingKey = hmacSHA256(signingKey, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	return c.endpoint.Scheme + "://" + c.endpoint.Host + sigV4Escape(path, false) +
+		"?" + canonicalQuery + "&X-Amz-Signature=" + signature, nil
+}
+
+// canonicalQueryString encodes params sorted by name, as SigV4 requires
+func canonicalQueryString(params map[string]string) string {
+	names := make([]string, 0, len(params))
+	for name := range params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	pairs := make([]string, 0, len(names))
+	for _, name := range names {
+		pairs = append(pairs, sigV4Escape(name, true)+"="+sigV4Escape(params[name], true))
+	}
+	return strings.Join(pairs, "&")
+}
+
+// sigV4Escape percent-encodes everything but unreserved characters, and
+// slashes too unless encodeSlash is false, matching AWS's URI encoding
+func sigV4Escape(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c >= 'A' && c <= 'Z', c >= 'a' && c <= 'z', c >= '0' && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// hmacSHA256 returns the HMAC-SHA256 of data keyed with key
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
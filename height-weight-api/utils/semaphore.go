@@ -0,0 +1,57 @@
+package utils
+
+import (
+	"context"
+	"time"
+)
+
+// Semaphore caps how many callers may hold it at once. A nil Semaphore is
+// unlimited.
+type Semaphore struct {
+	slots chan struct{}
+	wait  time.Duration
+}
+
+// NewSemaphore creates a semaphore with size slots whose Acquire gives up
+// after wait. A size of 0 or less means no limit and returns nil.
+func NewSemaphore(size int, wait time.Duration) *Semaphore {
+	if size <= 0 {
+		return nil
+	}
+	return &Semaphore{slots: make(chan struct{}, size), wait: wait}
+}
+
+// Acquire takes a slot, waiting at most the configured time for one to free
+// up. It reports false when none did or ctx ended first.
+func (s *Semaphore) Acquire(ctx context.Context) bool {
+	if s == nil {
+		return true
+	}
+
+	// Skip the timer when a slot is free
+	select {
+	case s.slots <- struct{}{}:
+		return true
+	default:
+	}
+
+	timer := time.NewTimer(s.wait)
+	defer timer.Stop()
+
+	select {
+	case s.slots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// Release frees a slot taken by a successful Acquire
+func (s *Semaphore) Release() {
+	if s == nil {
+		return
+	}
+	<-s.slots
+}
@@ -0,0 +1,109 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingServer is a fake ML service recording the most predictions it
+// served at once. Each prediction holds until release is closed.
+type countingServer struct {
+	*httptest.Server
+	inFlight, peak atomic.Int64
+	release        chan struct{}
+}
+
+func newCountingServer(t *testing.T) *countingServer {
+	t.Helper()
+	s := &countingServer{release: make(chan struct{})}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := s.inFlight.Add(1)
+		defer s.inFlight.Add(-1)
+		for {
+			peak := s.peak.Load()
+			if n <= peak || s.peak.CompareAndSwap(peak, n) {
+				break
+			}
+		}
+		<-s.release
+		w.Write([]byte(`{"weight": 70}`))
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestMLClientConcurrencyLimit(t *testing.T) {
+	const limit, callers = 3, 12
+	server := newCountingServer(t)
+	client := NewMLClient(server.URL, 5*time.Second, 0, 0, MLAuth{}, NewSemaphore(limit, 5*time.Second), NewCircuitBreaker(callers, time.Minute))
+
+	var wg sync.WaitGroup
+	errs := make(chan error, callers)
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := client.PredictWeight(context.Background(), strings.NewReader("front"), testSides(), 175)
+			errs <- err
+		}()
+	}
+
+	// Let the callers pile up against the limit before releasing them
+	deadline := time.Now().Add(2 * time.Second)
+	for server.inFlight.Load() < limit && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(server.release)
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Errorf("PredictWeight: %v", err)
+		}
+	}
+	if peak := server.peak.Load(); peak != limit {
+		t.Errorf("peak concurrent predictions = %d, want %d", peak, limit)
+	}
+}
+
+func TestMLClientBusy(t *testing.T) {
+	server := newCountingServer(t)
+	defer close(server.release)
+	client := NewMLClient(server.URL, 5*time.Second, 0, 0, MLAuth{}, NewSemaphore(1, 20*time.Millisecond), NewCircuitBreaker(5, time.Minute))
+
+	go client.PredictWeight(context.Background(), strings.NewReader("front"), testSides(), 175)
+	for server.inFlight.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	start := time.Now()
+	_, err := client.PredictWeight(context.Background(), strings.NewReader("front"), testSides(), 175)
+	if !errors.Is(err, ErrMLBusy) {
+		t.Errorf("PredictWeight with the only slot taken = %v, want ErrMLBusy", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("busy call took %v, want it to give up after the queue wait", elapsed)
+	}
+	if got := client.CircuitState(); got != CircuitClosed {
+		t.Errorf("circuit = %s after a busy call, want %s", got, CircuitClosed)
+	}
+}
+
+func TestNilSemaphoreUnlimited(t *testing.T) {
+	s := NewSemaphore(0, time.Second)
+	for i := 0; i < 100; i++ {
+		if !s.Acquire(context.Background()) {
+			t.Fatal("nil semaphore refused a slot")
+		}
+	}
+	s.Release()
+}
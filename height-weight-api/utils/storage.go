@@ -0,0 +1,141 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ErrImageMissing is returned when a stored image is no longer on disk
+var ErrImageMissing = errors.New("stored image no longer exists")
+
+// maxFilenameLength caps sanitized client filenames, well below filesystem limits
+const maxFilenameLength = 100
+
+// DatedUploadPath returns the YYYY/MM/DD subdirectory of root for time t
+func DatedUploadPath(root string, t time.Time) string {
+	return filepath.Join(root, t.Format("2006"), t.Format("01"), t.Format("02"))
+}
+
+// DirSize returns the total size in bytes of the regular files under path.
+// A missing directory has size 0.
+func DirSize(path string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(path, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		size += info.Size()
+		return nil
+	})
+	return size, err
+}
+
+// SafeFilename reduces a client-supplied filename to a single path element of
+// letters, digits, dots, dashes and underscores, so it can't escape the
+// directory it is saved in. Empty or dot-only names become "image".
+func SafeFilename(name string) string {
+	// Clients on Windows may send backslash-separated paths
+	name = filepath.Base(strings.ReplaceAll(name, "\\", "/"))
+
+	safe := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '-', r == '_':
+			return r
+		}
+		return '_'
+	}, name)
+
+	// Keep the extension when trimming long names
+	if len(safe) > maxFilenameLength {
+		ext := filepath.Ext(safe)
+		if len(ext) > maxFilenameLength/2 {
+			ext = ""
+		}
+		safe = safe[:maxFilenameLength-len(ext)] + ext
+	}
+
+	if strings.Trim(safe, ".") == "" {
+		return "image"
+	}
+	return safe
+}
+
+// OpenStoredImage opens a previously saved upload, returning ErrImageMissing
+// if the file has been removed
+func OpenStoredImage(path string) (*os.File, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %s", ErrImageMissing, path)
+	}
+	return f, err
+}
+
+// TempFileSet tracks the files written while handling one request, so that a
+// failure partway through doesn't leave some of them orphaned on disk. Defer
+// Cleanup right away and call Keep once the files are referenced elsewhere.
+type TempFileSet struct {
+	paths []string
+	kept  bool
+}
+
+// WriteFile writes data to path like os.WriteFile and tracks the file
+func (s *TempFileSet) WriteFile(path string, data []byte, perm os.FileMode) error {
+	// Whatever is at path is only ours to remove once it has been opened
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		// Don't leave a partial file behind
+		os.Remove(path)
+		return err
+	}
+	s.paths = append(s.paths, path)
+	return nil
+}
+
+// Handoff moves the tracked files to a new set, e.g. for a job that outlives
+// the request, leaving s with nothing to clean up
+func (s *TempFileSet) Handoff() *TempFileSet {
+	handed := &TempFileSet{paths: s.paths}
+	s.paths = nil
+	return handed
+}
+
+// Keep disarms Cleanup, leaving the tracked files in place
+func (s *TempFileSet) Keep() {
+	s.kept = true
+}
+
+// Cleanup removes the tracked files unless Keep was called
+func (s *TempFileSet) Cleanup() {
+	if s.kept {
+		return
+	}
+	for _, path := range s.paths {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Printf("Warning: Failed to remove file %s: %v", path, err)
+		}
+	}
+	s.paths = nil
+}
@@ -0,0 +1,151 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDatedUploadPath(t *testing.T) {
+	tests := []struct {
+		name string
+		root string
+		at   time.Time
+		want string
+	}{
+		{"zero padded", "uploads", time.Date(2024, time.March, 5, 23, 59, 0, 0, time.UTC), filepath.Join("uploads", "2024", "03", "05")},
+		{"end of year", "uploads/training", time.Date(2023, time.December, 31, 0, 0, 0, 0, time.UTC), filepath.Join("uploads", "training", "2023", "12", "31")},
+		{"absolute root", "/srv/uploads", time.Date(2025, time.October, 17, 12, 0, 0, 0, time.UTC), filepath.Join("/srv/uploads", "2025", "10", "17")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := DatedUploadPath(tt.root, tt.at); got != tt.want {
+				t.Errorf("DatedUploadPath(%q, %v) = %q, want %q", tt.root, tt.at, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDirSize(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]int{"a.png": 100, "nested/b.png": 250, "nested/deeper/c.png": 50}
+	for name, size := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("create dir: %v", err)
+		}
+		if err := os.WriteFile(path, make([]byte, size), 0644); err != nil {
+			t.Fatalf("write %s: %v", name, err)
+		}
+	}
+
+	if size, err := DirSize(dir); err != nil || size != 400 {
+		t.Errorf("DirSize = %d, %v, want 400", size, err)
+	}
+	// Nothing has been stored yet before the first upload
+	if size, err := DirSize(filepath.Join(dir, "missing")); err != nil || size != 0 {
+		t.Errorf("DirSize of a missing dir = %d, %v, want 0", size, err)
+	}
+}
+
+func TestSafeFilename(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"plain", "photo.jpg", "photo.jpg"},
+		{"parent traversal", "../../etc/passwd", "passwd"},
+		{"absolute path", "/etc/shadow.png", "shadow.png"},
+		{"windows traversal", `..\..\windows\system32\evil.jpg`, "evil.jpg"},
+		{"dot dot", "..", "image"},
+		{"dots only", "...", "image"},
+		{"empty", "", "image"},
+		{"null byte", "photo.jpg\x00.sh", "photo.jpg_.sh"},
+		{"shell characters", "a;rm -rf $(x)|b.png", "a_rm_-rf___x__b.png"},
+		{"spaces and unicode", "my phöto.jpg", "my_ph_to.jpg"},
+		{"hidden file", ".htaccess", ".htaccess"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := SafeFilename(tt.in); got != tt.want {
+				t.Errorf("SafeFilename(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+
+	long := SafeFilename(strings.Repeat("a", 300) + ".jpeg")
+	if len(long) != maxFilenameLength || !strings.HasSuffix(long, ".jpeg") {
+		t.Errorf("long name became %q (%d bytes), want %d bytes keeping .jpeg", long, len(long), maxFilenameLength)
+	}
+
+	// Whatever the name, the result stays inside the directory it is joined to
+	dir := t.TempDir()
+	for _, tt := range tests {
+		path := filepath.Join(dir, SafeFilename(tt.in))
+		if filepath.Dir(path) != dir {
+			t.Errorf("SafeFilename(%q) escapes to %s", tt.in, path)
+		}
+	}
+}
+
+func TestTempFileSet(t *testing.T) {
+	t.Run("cleanup after a failed write", func(t *testing.T) {
+		dir := t.TempDir()
+		var files TempFileSet
+		first := filepath.Join(dir, "front.jpg")
+		if err := files.WriteFile(first, []byte("front"), 0644); err != nil {
+			t.Fatalf("first WriteFile: %v", err)
+		}
+		// A directory in the way makes the second save fail
+		second := filepath.Join(dir, "side.jpg")
+		if err := os.Mkdir(second, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := files.WriteFile(second, []byte("side"), 0644); err == nil {
+			t.Fatal("second WriteFile succeeded, want an error")
+		}
+
+		files.Cleanup()
+		if _, err := os.Stat(first); !os.IsNotExist(err) {
+			t.Errorf("first file still there after Cleanup: %v", err)
+		}
+		if info, err := os.Stat(second); err != nil || !info.IsDir() {
+			t.Errorf("Cleanup touched the directory it didn't write: %v", err)
+		}
+	})
+
+	t.Run("keep", func(t *testing.T) {
+		dir := t.TempDir()
+		var files TempFileSet
+		path := filepath.Join(dir, "front.jpg")
+		if err := files.WriteFile(path, []byte("front"), 0644); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+		files.Keep()
+		files.Cleanup()
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("kept file removed: %v", err)
+		}
+	})
+
+	t.Run("handoff", func(t *testing.T) {
+		dir := t.TempDir()
+		var files TempFileSet
+		path := filepath.Join(dir, "front.jpg")
+		if err := files.WriteFile(path, []byte("front"), 0644); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+		handed := files.Handoff()
+		files.Cleanup()
+		if _, err := os.Stat(path); err != nil {
+			t.Fatalf("file removed by the set it was handed off from: %v", err)
+		}
+		handed.Cleanup()
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("file still there after the new owner's Cleanup: %v", err)
+		}
+	})
+}
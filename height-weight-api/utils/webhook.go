@@ -0,0 +1,128 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"syscall"
+	"time"
+)
+
+// WebhookSignatureHeader carries the hex HMAC-SHA256 of the webhook body
+const WebhookSignatureHeader = "X-Webhook-Signature"
+
+// webhookAttempts is how many times a webhook delivery is tried
+const webhookAttempts = 3
+
+// ErrInternalAddress is returned for callback URLs pointing at internal networks
+var ErrInternalAddress = errors.New("callback URL points to an internal address")
+
+// webhookClient refuses to connect to internal addresses, even if DNS changes
+// between validation and delivery
+var webhookClient = &http.Client{
+	Timeout: 10 * time.Second,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: 5 * time.Second,
+			Control: func(network, address string, _ syscall.RawConn) error {
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+				if ip := net.ParseIP(host); ip == nil || isInternalIP(ip) {
+					return ErrInternalAddress
+				}
+				return nil
+			},
+		}).DialContext,
+	},
+}
+
+// ValidateCallbackURL checks that a callback URL is http(s) and doesn't
+// resolve to a loopback, private or otherwise internal address
+func ValidateCallbackURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("invalid callback URL: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("callback URL must use http or https")
+	}
+	if u.Hostname() == "" {
+		return fmt.Errorf("callback URL must include a host")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, u.Hostname())
+	if err != nil {
+		return fmt.Errorf("failed to resolve callback host: %w", err)
+	}
+	for _, ip := range ips {
+		if isInternalIP(ip.IP) {
+			return ErrInternalAddress
+		}
+	}
+	return nil
+}
+
+// isInternalIP reports whether ip belongs to a non-public network
+func isInternalIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsMulticast()
+}
+
+// SignWebhook returns the hex HMAC-SHA256 signature of body using secret
+func SignWebhook(body []byte, secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// DeliverWebhook POSTs payload as JSON to url, signing the body with secret
+// when one is configured. Failed deliveries are retried with backoff.
+func DeliverWebhook(url string, payload any, secret string) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to marshal webhook payload: %w", err)
+	}
+
+	var lastErr error
+	for attempt := 0; attempt < webhookAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(attempt) * time.Second)
+		}
+
+		req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+		if err != nil {
+			return fmt.Errorf("failed to create webhook request: %w", err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if secret != "" {
+			req.Header.Set(WebhookSignatureHeader, "sha256="+SignWebhook(body, secret))
+		}
+
+		resp, err := webhookClient.Do(req)
+		if err != nil {
+			lastErr = fmt.Errorf("failed to deliver webhook: %w", err)
+			continue
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			return nil
+		}
+		lastErr = fmt.Errorf("webhook receiver returned status %d", resp.StatusCode)
+	}
+
+	return lastErr
+}
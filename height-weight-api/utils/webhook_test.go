@@ -0,0 +1,119 @@
+package utils
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+// useWebhookClient makes deliveries go through client for the test, since
+// the default client refuses the loopback address of httptest receivers
+func useWebhookClient(t *testing.T, client *http.Client) {
+	t.Helper()
+	previous := webhookClient
+	webhookClient = client
+	t.Cleanup(func() { webhookClient = previous })
+}
+
+func TestDeliverWebhookSignature(t *testing.T) {
+	const secret = "webhook-secret"
+	var body []byte
+	var signature string
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ = io.ReadAll(r.Body)
+		signature = r.Header.Get(WebhookSignatureHeader)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer receiver.Close()
+	useWebhookClient(t, receiver.Client())
+
+	if err := DeliverWebhook(receiver.URL, map[string]interface{}{"job_id": "job-1", "weight": 70.5}, secret); err != nil {
+		t.Fatalf("DeliverWebhook: %v", err)
+	}
+	if string(body) != `{"job_id":"job-1","weight":70.5}` {
+		t.Errorf("body = %s, want the JSON payload", body)
+	}
+	if want := "sha256=" + SignWebhook(body, secret); signature != want {
+		t.Errorf("signature = %q, want %q", signature, want)
+	}
+	if signature == "sha256="+SignWebhook(body, "other-secret") {
+		t.Error("signature verifies with the wrong secret")
+	}
+
+	// Without a secret the body goes unsigned
+	if err := DeliverWebhook(receiver.URL, map[string]string{"job_id": "job-2"}, ""); err != nil {
+		t.Fatalf("DeliverWebhook without secret: %v", err)
+	}
+	if signature != "" {
+		t.Errorf("signature without secret = %q, want none", signature)
+	}
+}
+
+func TestDeliverWebhookRetries(t *testing.T) {
+	var attempts atomic.Int64
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if attempts.Add(1) == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer receiver.Close()
+	useWebhookClient(t, receiver.Client())
+
+	if err := DeliverWebhook(receiver.URL, map[string]string{"job_id": "job-1"}, "secret"); err != nil {
+		t.Fatalf("DeliverWebhook: %v", err)
+	}
+	if got := attempts.Load(); got != 2 {
+		t.Errorf("receiver called %d times, want 2", got)
+	}
+}
+
+func TestDeliverWebhookRefusesInternalAddresses(t *testing.T) {
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("delivery reached a loopback receiver")
+	}))
+	defer receiver.Close()
+
+	// The receiver is on loopback, which the default client won't dial
+	req, err := http.NewRequest(http.MethodPost, receiver.URL, nil)
+	if err != nil {
+		t.Fatalf("new request: %v", err)
+	}
+	resp, err := webhookClient.Do(req)
+	if err == nil {
+		resp.Body.Close()
+	}
+	if !errors.Is(err, ErrInternalAddress) {
+		t.Errorf("delivery error = %v, want ErrInternalAddress", err)
+	}
+}
+
+func TestValidateCallbackURL(t *testing.T) {
+	tests := []struct {
+		name    string
+		url     string
+		wantErr bool
+	}{
+		{"public https", "https://93.184.216.34/hooks/estimate", false},
+		{"public http", "http://93.184.216.34:8080/hook", false},
+		{"ftp scheme", "ftp://93.184.216.34/hook", true},
+		{"missing host", "https:///hook", true},
+		{"loopback", "http://127.0.0.1:9000/hook", true},
+		{"private network", "http://10.0.0.5/hook", true},
+		{"link-local metadata", "http://169.254.169.254/latest/meta-data", true},
+		{"IPv6 loopback", "http://[::1]/hook", true},
+		{"unspecified", "http://0.0.0.0/hook", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateCallbackURL(tt.url)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ValidateCallbackURL(%q) = %v, want error %v", tt.url, err, tt.wantErr)
+			}
+		})
+	}
+}